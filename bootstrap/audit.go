@@ -0,0 +1,66 @@
+package bootstrap
+
+import (
+	"time"
+)
+
+const (
+	// AuditCapabilitiesRestricted is recorded when a command is started with a restricted set of capabilities.
+	AuditCapabilitiesRestricted = "capabilities.restricted"
+	// AuditCommandExecuted is recorded before a RUN command is executed, with the user of the command.
+	AuditCommandExecuted = "command.executed"
+	// AuditHostDirectoryMounted is recorded when a host directory is bind mounted for a command.
+	AuditHostDirectoryMounted = "host-directory.mounted"
+	// AuditSecretsMounted is recorded when the secrets are exposed to a command, with the secret IDs.
+	AuditSecretsMounted = "secrets.mounted"
+)
+
+// AuditRecord is a security relevant action of the bootstrap. The details never contain secret values.
+type AuditRecord struct {
+	Action  string
+	Command string
+	Details map[string]string
+	Index   *int
+	Time    time.Time
+	User    string
+}
+
+// AuditSink receives the audit records, separate from the operational logging.
+// An audit failure does not fail the bootstrap, the failure is logged as a warning.
+type AuditSink interface {
+	Audit(AuditRecord) error
+}
+
+// auditSinkReceiver is a command runner recording the audit records of the actions it executes,
+// the bootstrapper hands its audit sink to the command runner implementing it.
+type auditSinkReceiver interface {
+	setAuditSink(AuditSink)
+}
+
+// audit writes the record to the audit sink of the bootstrapper, if any.
+func (b *defaultBootstrapper) audit(record AuditRecord) {
+	if b.auditSink == nil {
+		return
+	}
+	record.Command = b.redact(record.Command)
+	record.Time = b.clock.Now().UTC()
+	if err := b.auditSink.Audit(record); err != nil {
+		b.logger.Warn("failed writing audit record", "action", record.Action, "reason", err)
+	}
+}
+
+func (n *shellCommandRunner) setAuditSink(sink AuditSink) {
+	n.auditSink = sink
+}
+
+// audit writes the record of the command at the index to the audit sink of the runner, if any.
+func (n *shellCommandRunner) audit(index int, record AuditRecord) {
+	if n.auditSink == nil {
+		return
+	}
+	record.Index = &index
+	record.Time = n.clock.Now().UTC()
+	if err := n.auditSink.Audit(record); err != nil {
+		n.logger.Warn("failed writing audit record", "action", record.Action, "reason", err)
+	}
+}
@@ -1,134 +1,1053 @@
 package bootstrap
 
 import (
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/pem"
 	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
 	"time"
+	"unicode"
 
+	"github.com/combust-labs/firebuild-mmds/clock"
 	"github.com/combust-labs/firebuild-mmds/mmds"
 	"github.com/combust-labs/firebuild-shared/build/commands"
 	"github.com/combust-labs/firebuild-shared/build/rootfs"
 	"github.com/hashicorp/go-hclog"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
+// ArchConstraintArg is the name of the build argument used to constrain
+// a RUN command to a comma separated list of guest architectures, using GOARCH names.
+// A command with the argument set is executed only on a matching guest.
+const ArchConstraintArg = "FIREBUILD_GOARCH"
+
+// DefaultMMDSBaseURI is the default guest URI of the MMDS metadata root.
+const DefaultMMDSBaseURI = "http://169.254.169.254/latest/meta-data"
+
+// DefaultWorkContextFetchAttempts is the default number of times the work context
+// is fetched from an endpoint when the server stream is incomplete.
+const DefaultWorkContextFetchAttempts = 3
+
+// workContextFetchRetryDelay is the delay before fetching an incomplete work context again.
+const workContextFetchRetryDelay = time.Second
+
+// MMDSEnvPrefix is the prefix of environment variables created from MMDS metadata keys.
+const MMDSEnvPrefix = "MMDS_"
+
 type Bootstrapper interface {
+	BuildMetadata() map[string]string
+	DeployMerkleRoot() string
 	Execute() error
+	ExecuteWithRetry(context.Context, int, time.Duration) error
+	RestoreFromSnapshot([]byte) error
+	Snapshot() ([]byte, error)
+	WithAllowEmptyWorkContext(bool) Bootstrapper
+	WithAuditSink(AuditSink) Bootstrapper
+	WithClientCertProvider(func() (*tls.Certificate, error)) Bootstrapper
+	WithClock(clock.Clock) Bootstrapper
+	WithCommandFilter([]string, []string) Bootstrapper
 	WithCommandRunner(CommandRunner) Bootstrapper
+	WithDeduplicateCommands(bool) Bootstrapper
+	WithDiagnosticsDir(string) Bootstrapper
+	WithContinueOnResourceError(bool) Bootstrapper
+	WithEnvPrefix(string, bool) Bootstrapper
+	WithErrorClassifier(ErrorClassifier) Bootstrapper
+	WithEventLog(io.Writer) Bootstrapper
+	WithFailFastThreshold(int) Bootstrapper
+	WithFinalizeCommand(commands.Run) Bootstrapper
+	WithMMDSBaseURI(string) Bootstrapper
+	WithPostResourceCommand(string, commands.Run) Bootstrapper
+	WithMMDSEnv([]string) Bootstrapper
+	WithProgressFile(string) Bootstrapper
+	WithReadinessProbe(commands.Run, time.Duration, time.Duration) Bootstrapper
 	WithResourceDeployer(ResourceDeployer) Bootstrapper
+	WithResourceResolver(ResourceResolver) Bootstrapper
+	WithRunLdconfig(bool) Bootstrapper
+	WithSensitiveEnvKeys([]string) Bootstrapper
+	WithServerCertFingerprints([]string) Bootstrapper
+	WithServerNameMatcher(func(*x509.Certificate) bool) Bootstrapper
+	WithStrictCAValidity(bool) Bootstrapper
+	WithTemplateTargets(bool) Bootstrapper
+	WithTracerProvider(trace.TracerProvider) Bootstrapper
+	WithWorkContextFetchAttempts(int) Bootstrapper
 }
 
 type defaultBootstrapper struct {
-	commandRunner    CommandRunner
-	bootstrapData    *mmds.MMDSBootstrap
-	logger           hclog.Logger
-	resourceDeployer ResourceDeployer
+	allowEmptyWorkContext   bool
+	auditSink               AuditSink
+	clientCertProvider      func() (*tls.Certificate, error)
+	commandFilter           *commandFilter
+	commandRunner           CommandRunner
+	continueOnResourceError bool
+	bootstrapData           *mmds.MMDSBootstrap
+	failFastThreshold       int
+	finalizeCommand         *commands.Run
+	linkerCacheStale        bool
+	logger                  hclog.Logger
+	lookupLdconfig          func() (string, error)
+	resourceDeployer        ResourceDeployer
+	resourceResolver        ResourceResolver
+	commandEnv              map[string]string
+	deduplicateCommands     bool
+	buildMetadata           map[string]string
+	deployMerkleRoot        string
+	diagnostics             *diagnostics
+	diagnosticsDir          string
+	envPrefix               *envPrefix
+	errorClassifier         ErrorClassifier
+	eventLog                *eventLog
+	mmdsBaseURI             string
+	mmdsEnvKeys             []string
+	mmdsValues              map[string]string
+	postResourceCommands    []postResourceCommand
+	progress                *bootstrapProgress
+	progressFile            string
+	readinessProbe          *readinessProbe
+	restored                *bootstrapSnapshot
+	runLdconfig             bool
+	sensitiveEnvKeys        []string
+	sensitiveValues         map[string]struct{}
+	tracer                  trace.Tracer
+	clock                   clock.Clock
+	strictCAValidity        bool
+	templateTargets         bool
+	serverCertFingerprints  []string
+	serverNameMatcher       func(*x509.Certificate) bool
+	newClient               func(hclog.Logger, *rootfs.GRPCClientConfig) (rootfs.ClientProvider, error)
+	fetchAttempts           int
 }
 
 func NewDefaultBoostrapper(logger hclog.Logger, bootstrapData *mmds.MMDSBootstrap) Bootstrapper {
 	return &defaultBootstrapper{
-		commandRunner:    &noopCommandRunner{logger: logger.Named("noop-runner")},
-		bootstrapData:    bootstrapData,
-		logger:           logger,
-		resourceDeployer: &noopResourceDeployer{logger: logger.Named("noo-deployer")},
+		allowEmptyWorkContext: true,
+		commandRunner:         &noopCommandRunner{logger: logger.Named("noop-runner")},
+		bootstrapData:         bootstrapData,
+		failFastThreshold:     1,
+		commandEnv:            map[string]string{},
+		logger:                logger,
+		lookupLdconfig:        lookupLdconfig,
+		mmdsBaseURI:           DefaultMMDSBaseURI,
+		resourceDeployer:      &noopResourceDeployer{logger: logger.Named("noo-deployer")},
+		sensitiveValues:       map[string]struct{}{},
+		tracer:                noop.NewTracerProvider().Tracer(TracerName),
+		clock:                 clock.Real(),
+		newClient:             rootfs.NewClient,
+		fetchAttempts:         DefaultWorkContextFetchAttempts,
 	}
 }
 
+// DeployMerkleRoot returns the root hash of a Merkle tree over the path, the mode and the contents hash
+// of every file and directory deployed by the last execution, a verifiable fingerprint
+// of what the bootstrap added. Empty when the resource deployer does not list the deployed files
+// or nothing was deployed.
+func (b *defaultBootstrapper) DeployMerkleRoot() string {
+	return b.deployMerkleRoot
+}
+
 // Execute executes the bootstrap sequence on the machine.
+// With a progress file or restored from a snapshot, the commands executed successfully by an earlier bootstrap
+// are not executed again. A failed bootstrap returns a *BootstrapError, IsResumable reports if it can be resumed.
 func (b *defaultBootstrapper) Execute() error {
-	clientTLSConfig, err := getTLSConfig(b.bootstrapData)
+	progress, err := b.startProgress()
+	if err != nil {
+		return err
+	}
+	return b.execute(context.Background(), progress, func(error) bool { return true })
+}
+
+// ExecuteWithRetry executes the bootstrap sequence on the machine, executing the bootstrap again
+// on failure up to attempts times. Every attempt connects to the server and fetches the work context
+// again in case the server has updated it. The commands executed successfully by an earlier attempt
+// are not executed again. Except of the last attempt, a failed attempt does not abort the build
+// on the server and does not execute the finalize command. Every next attempt waits twice
+// as long as the previous one, measured with the clock. An attempt failing with an error
+// classified as permanent by the error classifier is the last attempt.
+func (b *defaultBootstrapper) ExecuteWithRetry(ctx context.Context, attempts int, backoff time.Duration) error {
+	if attempts < 1 {
+		attempts = 1
+	}
+	progress, err := b.startProgress()
+	if err != nil {
+		return err
+	}
+	for attempt := 1; ; attempt++ {
+		// an attempt failing with a permanent error is the final attempt:
+		permanent := false
+		err := b.execute(ctx, progress, func(err error) bool {
+			permanent = !shouldRetry(b.errorClassifier, err, true)
+			return attempt == attempts || permanent
+		})
+		if err == nil || attempt == attempts {
+			return err
+		}
+		if permanent || !shouldRetry(b.errorClassifier, err, true) {
+			b.logger.Error("bootstrap attempt failed permanently, not retrying", "attempt", attempt, "reason", err)
+			return err
+		}
+		b.logger.Warn("bootstrap attempt failed, retrying",
+			"attempt", attempt,
+			"attempts", attempts,
+			"backoff", backoff,
+			"reason", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-b.clock.After(backoff):
+		}
+		backoff = backoff * 2
+	}
+}
+
+// execute executes a single bootstrap attempt, the final function reports if the attempt failed
+// with the error is final. A failed attempt which is not final does not execute the finalize command
+// and does not abort the build on the server.
+func (b *defaultBootstrapper) execute(parentCtx context.Context, progress *bootstrapProgress, final func(error) bool) (executeErr error) {
+	ctx, endSpan := b.startSpan(parentCtx, "bootstrap.Execute")
+	defer func() { endSpan(executeErr) }()
+
+	b.diagnostics = newDiagnostics(b.diagnosticsDir)
+	for _, component := range []interface{}{b.commandRunner, b.resourceDeployer} {
+		if receiver, ok := component.(clockReceiver); ok {
+			receiver.setClock(b.clock)
+		}
+	}
+	if receiver, ok := b.commandRunner.(auditSinkReceiver); ok && b.auditSink != nil {
+		receiver.setAuditSink(b.auditSink)
+	}
+	if receiver, ok := b.commandRunner.(sensitiveEnvReceiver); ok && len(b.sensitiveEnvKeys) > 0 {
+		receiver.addSensitiveEnv(b.sensitiveEnvKeys)
+	}
+	if b.errorClassifier != nil {
+		for _, component := range []interface{}{b.commandRunner, b.resourceDeployer} {
+			if receiver, ok := component.(errorClassifierReceiver); ok {
+				receiver.setErrorClassifier(b.errorClassifier)
+			}
+		}
+	}
+
+	started := b.clock.Now()
+	b.emitEvent(Event{Type: EventBootstrapStarted})
+	defer func() {
+		event := Event{DurationMs: b.clock.Now().Sub(started).Milliseconds(), Type: EventBootstrapFinished}
+		if executeErr != nil {
+			event.Error = executeErr.Error()
+		}
+		b.emitEvent(event)
+	}()
+
+	defer func() {
+		if executeErr != nil {
+			b.dumpDiagnostics(executeErr)
+		}
+	}()
+
+	phase := BootstrapPhaseValidation
+	defer func() {
+		if executeErr != nil {
+			executeErr = &BootstrapError{Err: executeErr, Phase: phase}
+		}
+	}()
+
+	if err := validateCAChainValidity(b.logger, b.bootstrapData.CaChain, b.clock.Now(), b.strictCAValidity); err != nil {
+		return err
+	}
+
+	if err := b.bootstrapData.Validate(); err != nil {
+		b.logger.Error("invalid bootstrap data", "reason", err)
+		return err
+	}
+
+	clientTLSConfig, err := getTLSConfig(b.bootstrapData, b.serverNameMatcher, b.serverCertFingerprints, b.clientCertProvider)
 	if err != nil {
 		b.logger.Error("failed creating client TLS config", "reason", err)
 		return err
 	}
 
-	clientConfig := &rootfs.GRPCClientConfig{
-		HostPort:       b.bootstrapData.HostPort,
-		TLSConfig:      clientTLSConfig,
-		MaxRecvMsgSize: rootfs.DefaultMaxMsgSize, // TODO: this setting should be in the future configurable via MMDS settings
+	for k, v := range b.envPrefix.environment(os.Environ()) {
+		b.commandEnv[k] = v
 	}
 
-	client, err := rootfs.NewClient(b.logger.Named("grpc-client"), clientConfig)
+	if len(b.mmdsEnvKeys) > 0 {
+		phase = BootstrapPhaseMMDS
+		mmdsValues, err := mmds.GuestFetchMMDSValues(ctx, http.DefaultClient, b.mmdsBaseURI, b.mmdsEnvKeys)
+		if err != nil {
+			b.logger.Error("failed fetching MMDS environment", "reason", err)
+			return err
+		}
+		b.mmdsValues = mmdsValues
+		for k, v := range mmdsValues {
+			b.commandEnv[mmdsKeyToEnvName(k)] = v
+		}
+	}
+
+	if b.finalizeCommand != nil {
+		b.collectSensitiveValues(*b.finalizeCommand)
+	}
+	if b.readinessProbe != nil {
+		b.collectSensitiveValues(b.readinessProbe.command)
+	}
+	for _, verification := range b.postResourceCommands {
+		b.collectSensitiveValues(verification.command)
+	}
+
+	phase = BootstrapPhaseConnect
+	client, err := b.connect(clientTLSConfig)
 	if err != nil {
-		b.logger.Error("failed constructing gRPC client", "reason", err)
 		return err
 	}
+	// the connection is reused by all calls of the attempt and closed after the outcome is reported:
+	defer closeClient(b.logger, client)
 
 	chanFinished := make(chan struct{}, 1)
 	go func() {
-		timer := time.NewTimer(b.bootstrapData.SafePingInterval())
+		pingAfter := b.clock.After(b.bootstrapData.SafePingInterval())
 		for {
 			select {
-			case <-timer.C:
+			case <-pingAfter:
 				b.logger.Debug("pinging server")
 				if err := client.Ping(); err != nil {
 					b.logger.Error("ping returned an error", "reason", err)
 					return
 				}
-				timer.Reset(time.Second * 5)
+				pingAfter = b.clock.After(time.Second * 5)
 			case <-chanFinished:
-				timer.Stop()
 				b.logger.Debug("ping stopped, program finished")
 				return
 			}
 		}
 	}()
 
-	if err := client.Commands(); err != nil {
-		b.logger.Error("failed fetching bootstrap commands over gRPC", "reason", err)
-		return err
+	phase = BootstrapPhaseCommands
+	executeErr = b.executeCommands(ctx, client, progress)
+
+	if provider, ok := b.resourceDeployer.(manifestProvider); ok {
+		b.deployMerkleRoot = merkleRoot(provider.Manifest())
+		b.logger.Info("deployed files fingerprinted", "merkle-root", b.deployMerkleRoot)
 	}
 
-	for {
+	if verifier, ok := b.resourceDeployer.(expectedTreeVerifier); ok && executeErr == nil {
+		phase = BootstrapPhaseVerification
+		executeErr = verifier.VerifyExpectedTree()
+	}
+
+	if executeErr == nil && b.readinessProbe != nil {
+		phase = BootstrapPhaseReadiness
+		executeErr = b.waitForReadiness(client)
+	}
+
+	if executeErr != nil && !final(executeErr) {
+		close(chanFinished)
+		return executeErr
+	}
+
+	if b.finalizeCommand != nil {
+		finalizeIndex := FinalizeCommandIndex
+		endFinalize := b.startCommand(ctx, "bootstrap.Finalize", Event{
+			Command: b.finalizeCommand.OriginalCommand,
+			Index:   &finalizeIndex,
+			Kind:    "RUN",
+		})
+		err := b.redactError(executeIndexed(b.commandRunner, FinalizeCommandIndex, b.withCommandEnv(*b.finalizeCommand), client))
+		endFinalize(err)
+		if err != nil {
+			b.logger.Error("executing finalize command failed", "reason", err)
+			if executeErr == nil {
+				// the finalize command error is reported only when there was no earlier error:
+				phase = BootstrapPhaseFinalize
+				executeErr = errors.Wrap(err, "finalize command failed")
+			}
+		}
+	}
+
+	close(chanFinished)
+
+	if cleaner, ok := b.resourceDeployer.(resourceDeployerCleaner); ok {
+		if err := cleaner.Cleanup(); err != nil && executeErr == nil {
+			phase = BootstrapPhaseFinalize
+			executeErr = errors.Wrap(err, "resource deployer cleanup failed")
+		}
+	}
+
+	if executeErr != nil {
+		client.Abort(executeErr)
+		return executeErr
+	}
+
+	phase = BootstrapPhaseComplete
+	return client.Success()
+}
+
+// connect returns a client of the first server endpoint serving the work context.
+// The endpoints are tried in order, if none of them serves the work context,
+// the failures of all endpoints are returned as EndpointFailures.
+func (b *defaultBootstrapper) connect(clientTLSConfig *tls.Config) (rootfs.ClientProvider, error) {
+	failures := EndpointFailures{}
+	for _, endpoint := range b.bootstrapData.Endpoints() {
+		clientConfig := &rootfs.GRPCClientConfig{
+			HostPort:       endpoint,
+			TLSConfig:      clientTLSConfig,
+			MaxRecvMsgSize: rootfs.DefaultMaxMsgSize, // TODO: this setting should be in the future configurable via MMDS settings
+		}
+		client, err := b.fetchWorkContext(clientConfig)
+		if err != nil {
+			failures = append(failures, errors.Wrapf(err, "endpoint '%s'", endpoint))
+			continue
+		}
+		b.logger.Info("connected to server", "host-port", endpoint, "failed-endpoints", len(failures))
+		return client, nil
+	}
+	if len(failures) == 0 {
+		b.logger.Error("no server endpoints in the bootstrap data")
+		return nil, errors.New("no server endpoints in the bootstrap data")
+	}
+	b.logger.Error("failed connecting to any server endpoint", "failed-endpoints", len(failures))
+	return nil, failures
+}
+
+// fetchWorkContext connects to the endpoint and fetches the work context.
+// A fetch of an incomplete work context, or failing with an error classified as transient,
+// is retried over the same connection, a reset stream does not break the connection.
+func (b *defaultBootstrapper) fetchWorkContext(clientConfig *rootfs.GRPCClientConfig) (rootfs.ClientProvider, error) {
+	client, err := b.newClient(b.logger.Named("grpc-client"), clientConfig)
+	if err != nil {
+		b.logger.Warn("failed constructing gRPC client", "host-port", clientConfig.HostPort, "reason", err)
+		return nil, err
+	}
+	for attempt := 1; ; attempt++ {
+		err = asIncompleteWorkContext(client.Commands())
+		if err == nil {
+			b.captureBuildMetadata(client)
+			return client, nil
+		}
+		if !shouldRetry(b.errorClassifier, err, errors.Is(err, ErrIncompleteWorkContext)) || attempt >= b.fetchAttempts {
+			b.logger.Warn("failed fetching bootstrap commands over gRPC", "host-port", clientConfig.HostPort, "attempts", attempt, "reason", err)
+			closeClient(b.logger, client)
+			return nil, err
+		}
+		b.logger.Warn("incomplete work context received, retrying", "host-port", clientConfig.HostPort, "attempt", attempt, "reason", err)
+		b.clock.Sleep(workContextFetchRetryDelay)
+	}
+}
+
+// closeClient closes the connection of the client if the client supports it.
+func closeClient(logger hclog.Logger, client rootfs.ClientProvider) {
+	closer, ok := client.(io.Closer)
+	if !ok {
+		return
+	}
+	if err := closer.Close(); err != nil {
+		logger.Warn("failed closing gRPC client", "reason", err)
+	}
+}
+
+// executeRun executes the RUN command, the command is stopped when the context is done
+// if the command runner supports it.
+func (b *defaultBootstrapper) executeRun(ctx context.Context, index int, cmd commands.Run, client rootfs.ClientProvider) error {
+	if runner, ok := b.commandRunner.(ContextCommandRunner); ok {
+		return b.redactError(runner.ExecuteContext(ctx, index, cmd, client))
+	}
+	return b.redactError(executeIndexed(b.commandRunner, index, cmd, client))
+}
+
+func (b *defaultBootstrapper) executeCommands(ctx context.Context, client rootfs.ClientProvider, progress *bootstrapProgress) error {
+
+	failures := CommandFailures{}
+	consecutiveFailures := 0
+	var lastRun *commands.Run
+	var previousCommand commands.VMInitSerializableCommand
+	received := 0
+
+	for commandIndex := 0; ; commandIndex++ {
 
 		serializableCommand := client.NextCommand()
 		if serializableCommand == nil {
 			break // finished
 		}
+		received = received + 1
+
+		index := commandIndex
+		if run, ok := serializableCommand.(commands.Run); ok {
+			b.collectSensitiveValues(run)
+		}
+		b.diagnostics.recordCommand(commandIndex, b.redactCommand(serializableCommand))
+
+		duplicate := b.deduplicateCommands && isDuplicateRun(previousCommand, serializableCommand)
+		previousCommand = serializableCommand
+		if duplicate {
+			command := originalCommand(serializableCommand)
+			b.logger.Info("skipping RUN command, identical to the preceding command", "index", commandIndex, "command", b.redact(command))
+			b.emitEvent(Event{Command: command, Index: &index, Kind: "RUN", Reason: "identical to the preceding command", Type: EventCommandSkipped})
+			continue
+		}
+
+		if run, ok := serializableCommand.(commands.Run); ok {
+			// the target templates of the following resource commands are evaluated with the environment of the last RUN command:
+			withEnv := b.withCommandEnv(run)
+			lastRun = &withEnv
+		}
+
+		if tags := commandTags(serializableCommand); !b.commandFilter.matches(tags) {
+			b.logger.Info("skipping command, tags do not match the command filter",
+				"index", commandIndex,
+				"tags", tags)
+			b.emitEvent(Event{Index: &index, Reason: "tags do not match the command filter", Type: EventCommandSkipped})
+			continue
+		}
+
+		if command := originalCommand(serializableCommand); progress.isCompleted(commandIndex, command) {
+			b.logger.Info("skipping command, already executed", "index", commandIndex, "command", b.redact(command))
+			b.emitEvent(Event{Command: command, Index: &index, Reason: "already executed", Type: EventCommandSkipped})
+			continue
+		}
+
+		var commandErr error
+		isResourceCommand := false
 
 		switch vCommand := serializableCommand.(type) {
 		case commands.Run:
-			if err := b.commandRunner.Execute(vCommand, client); err != nil {
-				b.logger.Error("bootstrap failed, executing RUN command failed", "reason", err)
-				close(chanFinished)
-				client.Abort(err)
-				return err
+			if !commandMatchesArch(vCommand, runtime.GOARCH) {
+				b.logger.Info("skipping RUN command, architecture does not match",
+					"command", b.redact(vCommand.OriginalCommand),
+					"required-arch", vCommand.Args[ArchConstraintArg],
+					"guest-arch", runtime.GOARCH)
+				b.emitEvent(Event{Command: vCommand.OriginalCommand, Index: &index, Kind: "RUN", Reason: "architecture does not match", Type: EventCommandSkipped})
+				continue
+			}
+			if commandErr = b.refreshLinkerCache(ctx, client); commandErr != nil {
+				break // the command is not executed with a stale linker cache
+			}
+			endCommand := b.startCommand(ctx, "bootstrap.Run", Event{
+				Command: vCommand.OriginalCommand,
+				Index:   &index,
+				Kind:    "RUN",
+			})
+			b.audit(AuditRecord{Action: AuditCommandExecuted, Command: vCommand.OriginalCommand, Index: &index, User: vCommand.User.Value})
+			commandErr = b.executeRun(ctx, commandIndex, b.withCommandEnv(vCommand), client)
+			endCommand(commandErr)
+			if commandErr != nil {
+				b.logger.Error("executing RUN command failed", "reason", commandErr)
+				commandErr = &runCommandError{err: commandErr}
 			}
 		case commands.Add:
-			if err := b.resourceDeployer.Add(vCommand, client); err != nil {
-				b.logger.Error("bootstrap failed, executing ADD command failed", "reason", err)
-				close(chanFinished)
-				client.Abort(err)
-				return err
+			isResourceCommand = true
+			endCommand := b.startCommand(ctx, "bootstrap.Add", Event{
+				Index:  &index,
+				Kind:   "ADD",
+				Source: vCommand.Source,
+				Target: vCommand.Target,
+			})
+			target, targetClient, err := b.renderTarget(client, vCommand.Target, lastRun)
+			if err != nil {
+				commandErr = err
+			} else {
+				vCommand.Target = target
+				commandErr = addIndexed(b.resourceDeployer, commandIndex, vCommand, b.resourceClient(targetClient, ResourceRequest{
+					CommandIndex: commandIndex,
+					Source:       vCommand.Source,
+					Target:       vCommand.Target,
+					User:         vCommand.User,
+					Workdir:      vCommand.Workdir,
+				}))
+				if commandErr == nil {
+					commandErr = b.verifyResource(ctx, commandIndex, vCommand.Source, targetClient)
+				}
+			}
+			endCommand(commandErr)
+			if commandErr != nil {
+				b.logger.Error("executing ADD command failed", "reason", commandErr)
 			}
 		case commands.Copy:
-			if err := b.resourceDeployer.Copy(vCommand, client); err != nil {
-				b.logger.Error("bootstrap failed, executing COPY command failed", "reason", err)
-				close(chanFinished)
-				client.Abort(err)
-				return err
+			isResourceCommand = true
+			endCommand := b.startCommand(ctx, "bootstrap.Copy", Event{
+				Index:  &index,
+				Kind:   "COPY",
+				Source: vCommand.Source,
+				Target: vCommand.Target,
+			})
+			target, targetClient, err := b.renderTarget(client, vCommand.Target, lastRun)
+			if err != nil {
+				commandErr = err
+			} else {
+				vCommand.Target = target
+				commandErr = copyIndexed(b.resourceDeployer, commandIndex, vCommand, b.resourceClient(targetClient, ResourceRequest{
+					CommandIndex: commandIndex,
+					Source:       vCommand.Source,
+					Target:       vCommand.Target,
+					User:         vCommand.User,
+					Workdir:      vCommand.Workdir,
+				}))
+				if commandErr == nil {
+					commandErr = b.verifyResource(ctx, commandIndex, vCommand.Source, targetClient)
+				}
+			}
+			endCommand(commandErr)
+			if commandErr != nil {
+				b.logger.Error("executing COPY command failed", "reason", commandErr)
+			}
+		}
+
+		if commandErr == nil {
+			consecutiveFailures = 0
+			if isResourceCommand && b.runLdconfig {
+				b.linkerCacheStale = true
+			}
+			if err := progress.complete(commandIndex, originalCommand(serializableCommand)); err != nil {
+				b.logger.Warn("failed recording progress", "index", commandIndex, "reason", err)
+			}
+			continue
+		}
+
+		failures = append(failures, commandErr)
+
+		if isResourceCommand && b.continueOnResourceError {
+			b.logger.Warn("continuing after resource deployment failure", "index", commandIndex)
+			continue
+		}
+
+		consecutiveFailures = consecutiveFailures + 1
+
+		if consecutiveFailures >= b.failFastThreshold {
+			b.logger.Error("bootstrap failed, consecutive failures threshold reached",
+				"consecutive-failures", consecutiveFailures,
+				"threshold", b.failFastThreshold)
+			if b.failFastThreshold == 1 {
+				return commandErr
 			}
+			return failures
 		}
 
 	}
 
-	close(chanFinished)
+	if received == 0 {
+		if !b.allowEmptyWorkContext {
+			b.logger.Error("bootstrap failed, the work context has no commands")
+			return ErrEmptyWorkContext
+		}
+		b.logger.Warn("the work context has no commands, nothing to execute")
+	}
 
-	return client.Success()
+	// the libraries deployed by the trailing resource commands must be usable in the bootstrapped guest:
+	if err := b.refreshLinkerCache(ctx, client); err != nil {
+		if len(failures) == 0 {
+			return err
+		}
+		failures = append(failures, err)
+	}
+
+	if len(failures) > 0 {
+		b.logger.Error("bootstrap failed, commands failed", "failures", len(failures))
+		return failures
+	}
+
+	return nil
+}
+
+// WithAllowEmptyWorkContext configures if a work context without commands is a successful bootstrap.
+// By default, an empty work context is allowed, the bootstrap succeeds without executing anything
+// and a warning is logged. When not allowed, the bootstrap fails with ErrEmptyWorkContext,
+// for example for deployments where an empty work context indicates a misconfigured build.
+// The finalize command and the readiness probe are executed in both cases, like after any other work context.
+func (b *defaultBootstrapper) WithAllowEmptyWorkContext(input bool) Bootstrapper {
+	b.allowEmptyWorkContext = input
+	return b
+}
+
+// WithAuditSink configures the sink of the audit records of the security relevant actions:
+// the execution of RUN commands with their user and, with a command runner supporting it, the secrets
+// and host directories exposed to the commands and the capability restrictions of the commands.
+func (b *defaultBootstrapper) WithAuditSink(input AuditSink) Bootstrapper {
+	b.auditSink = input
+	return b
+}
+
+// WithClientCertProvider configures the provider of the client certificate presented to the server
+// on every TLS handshake, including reconnects, so a fresh certificate can be supplied on long builds.
+// The Certificate and Key of the bootstrap data are still required and loaded, they are presented
+// when the provider returns a nil certificate. A provider error fails the handshake.
+func (b *defaultBootstrapper) WithClientCertProvider(input func() (*tls.Certificate, error)) Bootstrapper {
+	b.clientCertProvider = input
+	return b
+}
+
+// WithClock configures the clock of the bootstrapper. The clock measures the ping interval,
+// the backoff of ExecuteWithRetry, the delay before fetching an incomplete work context again,
+// the readiness probe interval and timeout and the durations of the commands, validates the CA chain
+// and timestamps the events, the audit records and the diagnostics. The clock is handed to a command runner
+// timestamping the output and the audit records, measuring the output idle timeout and the output flush interval
+// and waiting for the retry backoff, to a scripted command runner waiting for the delay of the results,
+// to a resource tracking command runner measuring the wall time and handing the clock over to the inner runner,
+// and to a resource deployer measuring the resource deploy timeout and waiting
+// for the resource open retry backoff.
+func (b *defaultBootstrapper) WithClock(input clock.Clock) Bootstrapper {
+	b.clock = input
+	return b
+}
+
+// WithCommandFilter configures the bootstrapper to execute only the commands
+// with tags matching the filter, for example to execute a subset of the plan during development.
+// RUN commands are tagged with the TagsArg build argument. Excluded tags take precedence,
+// CommandFilterCatchAll excludes the untagged commands and the tagged commands not included.
+func (b *defaultBootstrapper) WithCommandFilter(include, exclude []string) Bootstrapper {
+	b.commandFilter = newCommandFilter(include, exclude)
+	return b
 }
 
 func (b *defaultBootstrapper) WithCommandRunner(input CommandRunner) Bootstrapper {
 	b.commandRunner = input
 	return b
 }
+
+// WithContinueOnResourceError configures the bootstrapper to continue when an ADD or COPY
+// command fails. The failures are returned as CommandFailures when the bootstrap finishes.
+// RUN command failures are not affected, see WithFailFastThreshold.
+func (b *defaultBootstrapper) WithContinueOnResourceError(input bool) Bootstrapper {
+	b.continueOnResourceError = input
+	return b
+}
+
+// WithDeduplicateCommands configures the bootstrapper to skip a RUN command identical to the immediately
+// preceding command: the same command, arguments, environment, shell, user and workdir. Generated build plans
+// sometimes repeat a command. A repeated command is not always redundant, the default is to execute every command.
+func (b *defaultBootstrapper) WithDeduplicateCommands(input bool) Bootstrapper {
+	b.deduplicateCommands = input
+	return b
+}
+
+// WithDiagnosticsDir configures the directory a diagnostics bundle is written to when the bootstrap fails.
+// The bundle is a single JSON file with the work context received so far, the events of the bootstrap
+// including the outcome of every command, the deployed paths, the command environment and the error.
+// The bundle may contain sensitive values of the work context and is readable by the owner only.
+func (b *defaultBootstrapper) WithDiagnosticsDir(input string) Bootstrapper {
+	b.diagnosticsDir = input
+	return b
+}
+
+// WithEnvPrefix configures the prefix of the bootstrapper environment variables injected into every command,
+// for example BUILD_, a channel to pass runtime values into the build without changing the build plan.
+// With strip, the prefix is removed from the variable names: BUILD_VERSION is injected as VERSION.
+// The MMDS environment and the environment of the command take precedence. An empty prefix injects nothing.
+func (b *defaultBootstrapper) WithEnvPrefix(prefix string, strip bool) Bootstrapper {
+	b.envPrefix = &envPrefix{prefix: prefix, strip: strip}
+	return b
+}
+
+// WithErrorClassifier configures the classifier deciding if a failed operation is retried, used by
+// ExecuteWithRetry, the work context fetch and, handed to a shell command runner and an executing resource deployer,
+// the command and the resource open retries. A transient error is retried, a permanent error is not and an unknown
+// error is retried according to the default of the retry loop. DefaultErrorClassifier is used by default.
+func (b *defaultBootstrapper) WithErrorClassifier(input ErrorClassifier) Bootstrapper {
+	b.errorClassifier = input
+	return b
+}
+
+// WithEventLog configures the writer of the bootstrap event log, an append-only stream
+// of newline delimited JSON events: the bootstrap started and finished, every command started,
+// finished and skipped, and every deployed resource. Failures are recorded in the events.
+// Unlike the log output, the event log is meant to be replayed or compared across builds.
+func (b *defaultBootstrapper) WithEventLog(input io.Writer) Bootstrapper {
+	b.eventLog = &eventLog{writer: input}
+	return b
+}
+
+// WithFailFastThreshold configures the number of consecutive command failures
+// after which the bootstrap is aborted. The default is 1, the bootstrap is aborted
+// on the first failure. With a higher threshold, the bootstrap continues past
+// failing commands and returns all failures as CommandFailures.
+func (b *defaultBootstrapper) WithFailFastThreshold(input int) Bootstrapper {
+	if input < 1 {
+		input = 1
+	}
+	b.failFastThreshold = input
+	return b
+}
+
+// WithFinalizeCommand configures a command executed after the bootstrap sequence,
+// regardless of the bootstrap outcome. A failing finalize command fails the bootstrap
+// only when the bootstrap sequence itself has succeeded.
+func (b *defaultBootstrapper) WithFinalizeCommand(input commands.Run) Bootstrapper {
+	b.finalizeCommand = &input
+	return b
+}
+
+// WithMMDSBaseURI configures the MMDS metadata root used to resolve the MMDS environment.
+// The default is DefaultMMDSBaseURI.
+func (b *defaultBootstrapper) WithMMDSBaseURI(input string) Bootstrapper {
+	b.mmdsBaseURI = input
+	return b
+}
+
+// WithMMDSEnv configures MMDS metadata keys exposed to every RUN command as environment
+// variables. The variable name is the upper-cased key prefixed with MMDSEnvPrefix,
+// for example the Network/CniNetworkName key becomes MMDS_NETWORK_CNINETWORKNAME.
+// The environment of the command takes precedence.
+func (b *defaultBootstrapper) WithMMDSEnv(input []string) Bootstrapper {
+	b.mmdsEnvKeys = input
+	return b
+}
+
+// WithPostResourceCommand configures a command verifying the resources of the ADD and COPY commands
+// with the source matching the glob, for example nginx -t after copying nginx.conf. The glob is matched
+// against the source and the source file name. The command is executed after the resources are deployed,
+// a failing command fails the resource command. The commands matching a source are executed
+// in the order they were configured.
+func (b *defaultBootstrapper) WithPostResourceCommand(sourceGlob string, cmd commands.Run) Bootstrapper {
+	b.postResourceCommands = append(b.postResourceCommands, postResourceCommand{command: cmd, sourceGlob: sourceGlob})
+	return b
+}
+
+// WithProgressFile configures a file recording the successfully executed commands.
+// A bootstrap executed again with the same progress file, for example after a guest restart,
+// does not execute these commands again. A command is considered executed only when
+// the command at the same index of the work context is the same.
+func (b *defaultBootstrapper) WithProgressFile(input string) Bootstrapper {
+	b.progressFile = input
+	return b
+}
+
+// WithReadinessProbe configures a command executed after the bootstrap sequence
+// has succeeded to validate that the provisioned services are ready. The probe is
+// executed every interval until it succeeds. If the probe does not succeed
+// within the timeout, the bootstrap fails.
+func (b *defaultBootstrapper) WithReadinessProbe(cmd commands.Run, interval, timeout time.Duration) Bootstrapper {
+	b.readinessProbe = &readinessProbe{
+		command:  cmd,
+		interval: interval,
+		timeout:  timeout,
+	}
+	return b
+}
+
 func (b *defaultBootstrapper) WithResourceDeployer(input ResourceDeployer) Bootstrapper {
 	b.resourceDeployer = input
 	return b
 }
 
-func getTLSConfig(bootstrapData *mmds.MMDSBootstrap) (*tls.Config, error) {
+func (b *defaultBootstrapper) waitForReadiness(client rootfs.ClientProvider) error {
+	deadline := b.clock.Now().Add(b.readinessProbe.timeout)
+	for attempt := 1; ; attempt++ {
+		err := b.redactError(executeIndexed(b.commandRunner, ReadinessProbeCommandIndex, b.withCommandEnv(b.readinessProbe.command), client))
+		if err == nil {
+			b.logger.Info("readiness probe succeeded", "attempts", attempt)
+			return nil
+		}
+		if b.clock.Now().Add(b.readinessProbe.interval).After(deadline) {
+			b.logger.Error("readiness probe did not succeed within timeout",
+				"attempts", attempt,
+				"timeout", b.readinessProbe.timeout,
+				"reason", err)
+			return errors.Wrapf(err, "readiness probe did not succeed within %s", b.readinessProbe.timeout)
+		}
+		b.logger.Debug("readiness probe failed, retrying", "attempt", attempt, "reason", err)
+		b.clock.Sleep(b.readinessProbe.interval)
+	}
+}
+
+// WithResourceResolver configures the resolver of the ADD and COPY resources
+// the server has not resolved. The resources resolved by the server take precedence.
+func (b *defaultBootstrapper) WithResourceResolver(input ResourceResolver) Bootstrapper {
+	b.resourceResolver = input
+	return b
+}
+
+// WithRunLdconfig configures the bootstrapper to refresh the linker cache with ldconfig,
+// executed with the command runner, after the resources have been deployed, so the deployed
+// shared libraries are usable by the following RUN commands. The cache is refreshed once
+// before the first RUN command following the resource commands and after the last command.
+// The refresh is skipped with a warning when ldconfig is not installed.
+func (b *defaultBootstrapper) WithRunLdconfig(input bool) Bootstrapper {
+	b.runLdconfig = input
+	return b
+}
+
+// WithSensitiveEnvKeys configures the names of the environment variables and build arguments of the RUN commands
+// with values redacted as *** from the bootstrapper logs, the errors of the commands, the event log, the audit records
+// and the diagnostics, for example the names of the variables holding tokens. The keys are also handed to a command
+// runner redacting the sensitive environment itself, the values it redacts keep the marker of the runner.
+// The environment added by the bootstrapper, for example the MMDS environment, is redacted too.
+func (b *defaultBootstrapper) WithSensitiveEnvKeys(input []string) Bootstrapper {
+	b.sensitiveEnvKeys = input
+	return b
+}
+
+// WithServerCertFingerprints configures the hex encoded SHA256 fingerprints of the DER encoded
+// server certificates the bootstrapper connects to. A server with the leaf certificate not in the list
+// is rejected, in addition to the certificate chain and server name verification.
+// Unlike public key pinning, the fingerprints must be updated when the certificate is renewed.
+func (b *defaultBootstrapper) WithServerCertFingerprints(input []string) Bootstrapper {
+	b.serverCertFingerprints = input
+	return b
+}
+
+// WithServerNameMatcher configures the bootstrapper to identify the server with the matcher
+// instead of matching the DNS names of the server certificate against the ServerName.
+// The certificate chain is still verified against the CA chain, the matcher is called
+// with the verified server certificate and the connection is rejected when it returns false.
+// For example, to match the SPIFFE URI SANs.
+func (b *defaultBootstrapper) WithServerNameMatcher(input func(*x509.Certificate) bool) Bootstrapper {
+	b.serverNameMatcher = input
+	return b
+}
+
+// WithStrictCAValidity configures the bootstrapper to fail when a CA chain certificate
+// is expired or not yet valid. By default, such certificates are logged as warnings.
+func (b *defaultBootstrapper) WithStrictCAValidity(input bool) Bootstrapper {
+	b.strictCAValidity = input
+	return b
+}
+
+// WithTemplateTargets configures the bootstrapper to evaluate the ADD and COPY targets as Go text/template
+// templates, for example /etc/app/{{.MMDS.instance_id}}.conf, to write per instance files.
+// The templates are evaluated against .Args and .Env of the last RUN command, including the MMDS environment,
+// and .MMDS with the values of the keys configured with WithMMDSEnv. A missing key fails the command.
+// Only the lower, upper and trim functions and the comparison and logical builtins are available,
+// a target rendered with a '..' element fails the command.
+func (b *defaultBootstrapper) WithTemplateTargets(input bool) Bootstrapper {
+	b.templateTargets = input
+	return b
+}
+
+// WithTracerProvider configures the OpenTelemetry tracer provider used to instrument the bootstrap.
+// The bootstrap is traced with a span, every command with a child span.
+// When not set, a no-op tracer is used.
+func (b *defaultBootstrapper) WithTracerProvider(input trace.TracerProvider) Bootstrapper {
+	b.tracer = input.Tracer(TracerName)
+	return b
+}
+
+// WithWorkContextFetchAttempts configures how many times the work context is fetched from
+// an endpoint when the server resets or closes the stream before the complete work context is received.
+// The retries reuse the established connection, only the commands are fetched again. When all attempts fail,
+// the connection is closed, the next endpoint is tried and the failure matches ErrIncompleteWorkContext.
+func (b *defaultBootstrapper) WithWorkContextFetchAttempts(input int) Bootstrapper {
+	if input < 1 {
+		input = 1
+	}
+	b.fetchAttempts = input
+	return b
+}
+
+// withCommandEnv returns the command with the bootstrapper provided environment added.
+// The environment of the command takes precedence.
+func (b *defaultBootstrapper) withCommandEnv(cmd commands.Run) commands.Run {
+	if len(b.commandEnv) == 0 {
+		return cmd
+	}
+	env := map[string]string{}
+	for k, v := range b.commandEnv {
+		env[k] = v
+	}
+	for k, v := range cmd.Env {
+		env[k] = v
+	}
+	cmd.Env = env
+	return cmd
+}
+
+type readinessProbe struct {
+	command  commands.Run
+	interval time.Duration
+	timeout  time.Duration
+}
+
+func mmdsKeyToEnvName(key string) string {
+	return MMDSEnvPrefix + strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return unicode.ToUpper(r)
+		}
+		return '_'
+	}, strings.Trim(key, "/"))
+}
+
+// isDuplicateRun returns true if both commands are RUN commands executing the same command
+// with the same arguments, environment, shell, user and workdir.
+func isDuplicateRun(previous, current commands.VMInitSerializableCommand) bool {
+	previousRun, ok := previous.(commands.Run)
+	if !ok {
+		return false
+	}
+	currentRun, ok := current.(commands.Run)
+	if !ok {
+		return false
+	}
+	return previousRun.Command == currentRun.Command &&
+		reflect.DeepEqual(previousRun.Args, currentRun.Args) &&
+		reflect.DeepEqual(previousRun.Env, currentRun.Env) &&
+		reflect.DeepEqual(previousRun.Shell, currentRun.Shell) &&
+		reflect.DeepEqual(previousRun.User, currentRun.User) &&
+		reflect.DeepEqual(previousRun.Workdir, currentRun.Workdir)
+}
+
+func commandMatchesArch(cmd commands.Run, arch string) bool {
+	constraint, ok := cmd.Args[ArchConstraintArg]
+	if !ok || strings.TrimSpace(constraint) == "" {
+		return true
+	}
+	for _, item := range strings.Split(constraint, ",") {
+		if strings.TrimSpace(item) == arch {
+			return true
+		}
+	}
+	return false
+}
+
+// validateCAChainValidity checks the validity window of every CA chain certificate,
+// an expired or not yet valid CA usually means a clock skew or a stale CA.
+func validateCAChainValidity(logger hclog.Logger, caChain string, now time.Time, strict bool) error {
+	input := []byte(caChain)
+	for {
+		block, remaining := pem.Decode(input)
+		if block == nil {
+			return nil
+		}
+		input = remaining
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return errors.Wrap(err, "failed parsing CA chain certificate")
+		}
+		var validityErr error
+		if now.Before(cert.NotBefore) {
+			validityErr = fmt.Errorf("CA certificate '%s' is not valid before %s, current time %s",
+				cert.Subject.String(), cert.NotBefore.Format(time.RFC3339), now.Format(time.RFC3339))
+		} else if now.After(cert.NotAfter) {
+			validityErr = fmt.Errorf("CA certificate '%s' expired at %s, current time %s",
+				cert.Subject.String(), cert.NotAfter.Format(time.RFC3339), now.Format(time.RFC3339))
+		}
+		if validityErr == nil {
+			continue
+		}
+		if strict {
+			logger.Error("invalid CA chain certificate", "reason", validityErr)
+			return validityErr
+		}
+		logger.Warn("invalid CA chain certificate, the TLS handshake will likely fail", "reason", validityErr)
+	}
+}
+
+// BuildTLSConfig returns the client TLS configuration the bootstrapper connects to the server with:
+// the server is verified against the certificate and the CA chain of the bootstrap configuration
+// and the client authenticates with the bootstrap certificate and key. Callers can reuse the configuration
+// for auxiliary connections to the same server, for example fetching resources over HTTPS.
+// The options configured on a bootstrapper, like the server name matcher or the certificate fingerprints,
+// do not apply.
+func BuildTLSConfig(cfg *mmds.MMDSBootstrap) (*tls.Config, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("no bootstrap configuration")
+	}
+	return getTLSConfig(cfg, nil, nil, nil)
+}
+
+func getTLSConfig(bootstrapData *mmds.MMDSBootstrap, serverNameMatcher func(*x509.Certificate) bool, serverCertFingerprints []string, clientCertProvider func() (*tls.Certificate, error)) (*tls.Config, error) {
 	roots := x509.NewCertPool()
 	input := []byte(bootstrapData.Certificate)
 	for {
@@ -159,9 +1078,104 @@ func getTLSConfig(bootstrapData *mmds.MMDSBootstrap) (*tls.Config, error) {
 		return nil, errors.Wrap(err, "failed loading TLS certificate")
 	}
 
-	return &tls.Config{
+	tlsConfig := &tls.Config{
 		ServerName:   bootstrapData.ServerName,
 		RootCAs:      roots,
 		Certificates: []tls.Certificate{tlsCert},
+	}
+
+	if clientCertProvider != nil {
+		// called on every handshake, including reconnects:
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := clientCertProvider()
+			if err != nil {
+				return nil, errors.Wrap(err, "failed providing client certificate")
+			}
+			if cert == nil {
+				return &tlsCert, nil
+			}
+			return cert, nil
+		}
+	}
+
+	verifiers := []func(tls.ConnectionState) error{}
+
+	if serverNameMatcher != nil {
+		// the default verification matches the ServerName,
+		// the chain is verified in VerifyConnection instead:
+		tlsConfig.ServerName = ""
+		tlsConfig.InsecureSkipVerify = true
+		verifiers = append(verifiers, verifyServerIdentity(roots, serverNameMatcher))
+	}
+
+	if len(serverCertFingerprints) > 0 {
+		verifier, err := verifyServerFingerprint(serverCertFingerprints)
+		if err != nil {
+			return nil, err
+		}
+		verifiers = append(verifiers, verifier)
+	}
+
+	if len(verifiers) > 0 {
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			for _, verifier := range verifiers {
+				if err := verifier(state); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// verifyServerFingerprint returns a function rejecting a server certificate with the hex encoded
+// SHA256 of the DER certificate not in the fingerprints. The fingerprints may be colon separated.
+func verifyServerFingerprint(fingerprints []string) (func(tls.ConnectionState) error, error) {
+	allowed := map[string]struct{}{}
+	for _, fingerprint := range fingerprints {
+		normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(fingerprint), ":", ""))
+		if decoded, err := hex.DecodeString(normalized); err != nil || len(decoded) != sha256.Size {
+			return nil, fmt.Errorf("invalid server certificate fingerprint '%s', expected a hex encoded SHA256", fingerprint)
+		}
+		allowed[normalized] = struct{}{}
+	}
+	return func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return fmt.Errorf("server did not present a certificate")
+		}
+		serverCert := state.PeerCertificates[0]
+		fingerprint := sha256.Sum256(serverCert.Raw)
+		if _, ok := allowed[hex.EncodeToString(fingerprint[:])]; !ok {
+			return fmt.Errorf("server certificate '%s' fingerprint '%s' not allowed", serverCert.Subject, hex.EncodeToString(fingerprint[:]))
+		}
+		return nil
 	}, nil
 }
+
+// verifyServerIdentity returns a function verifying the server certificate chain
+// against the roots and the identity of the server certificate with the matcher.
+func verifyServerIdentity(roots *x509.CertPool, serverNameMatcher func(*x509.Certificate) bool) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return fmt.Errorf("server did not present a certificate")
+		}
+		intermediates := x509.NewCertPool()
+		for _, cert := range state.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+		serverCert := state.PeerCertificates[0]
+		if _, err := serverCert.Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}); err != nil {
+			return errors.Wrap(err, "failed verifying server certificate")
+		}
+		if !serverNameMatcher(serverCert) {
+			return fmt.Errorf("server certificate '%s' rejected by the server name matcher", serverCert.Subject)
+		}
+		return nil
+	}
+}
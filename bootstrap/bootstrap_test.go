@@ -2,9 +2,21 @@ package bootstrap
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/fs"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
@@ -12,6 +24,7 @@ import (
 	"time"
 
 	"github.com/combust-labs/firebuild-embedded-ca/ca"
+	"github.com/combust-labs/firebuild-mmds/clock"
 	"github.com/combust-labs/firebuild-mmds/mmds"
 	"github.com/combust-labs/firebuild-shared/build/commands"
 	"github.com/combust-labs/firebuild-shared/build/resources"
@@ -22,8 +35,6 @@ import (
 
 func TestFailingRunCommandBootstrap(t *testing.T) {
 
-	testServerAppName := "test-server-app"
-
 	logger := hclog.Default()
 	logger.SetLevel(hclog.Trace)
 
@@ -55,50 +66,7 @@ func TestFailingRunCommandBootstrap(t *testing.T) {
 		},
 	}
 
-	// construct an embedded CA to manually handle TLS configs:
-	embeddedCAConfig := &ca.EmbeddedCAConfig{
-		Addresses:     []string{testServerAppName},
-		CertsValidFor: time.Hour,
-		KeySize:       1024,
-	}
-
-	embeddedCA, err := ca.NewDefaultEmbeddedCAWithLogger(embeddedCAConfig, logger.Named("embedded-ca"))
-	if err != nil {
-		t.Fatal("failed constructing embedded CA", err)
-	}
-
-	serverTLSConfig, err := embeddedCA.NewServerCertTLSConfig()
-	if err != nil {
-		t.Fatal("failed creating test server TLS config", err)
-	}
-
-	grpcConfig := &rootfs.GRPCServiceConfig{
-		ServerName:      testServerAppName,
-		BindHostPort:    "127.0.0.1:0",
-		TLSConfigServer: serverTLSConfig,
-	}
-
-	testServer := rootfs.NewTestServer(t, logger.Named("grpc-server"), grpcConfig, buildCtx)
-	testServer.Start()
-	select {
-	case startErr := <-testServer.FailedNotify():
-		t.Fatal("expected the GRPC server to start but it failed", startErr)
-	case <-testServer.ReadyNotify():
-		t.Log("GRPC server started and serving on", grpcConfig.BindHostPort)
-	}
-
-	clientCertData, err := embeddedCA.NewClientCert()
-	if err != nil {
-		t.Fatal("failed creating test client certitifcate", err)
-	}
-
-	bootstrapConfig := &mmds.MMDSBootstrap{
-		HostPort:    grpcConfig.BindHostPort,
-		CaChain:     strings.Join(embeddedCA.CAPEMChain(), "\n"),
-		Certificate: string(clientCertData.CertificatePEM()),
-		Key:         string(clientCertData.KeyPEM()),
-		ServerName:  testServerAppName,
-	}
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
 
 	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
 		WithCommandRunner(NewShellCommandRunner(logger.Named("shell-runner"))).
@@ -115,8 +83,6 @@ func TestFailingRunCommandBootstrap(t *testing.T) {
 
 func TestFailingAddBootstrap(t *testing.T) {
 
-	testServerAppName := "test-server-app"
-
 	logger := hclog.Default()
 	logger.SetLevel(hclog.Debug)
 
@@ -167,50 +133,7 @@ func TestFailingAddBootstrap(t *testing.T) {
 		},
 	}
 
-	// construct an embedded CA to manually handle TLS configs:
-	embeddedCAConfig := &ca.EmbeddedCAConfig{
-		Addresses:     []string{testServerAppName},
-		CertsValidFor: time.Hour,
-		KeySize:       1024,
-	}
-
-	embeddedCA, err := ca.NewDefaultEmbeddedCAWithLogger(embeddedCAConfig, logger.Named("embedded-ca"))
-	if err != nil {
-		t.Fatal("failed constructing embedded CA", err)
-	}
-
-	serverTLSConfig, err := embeddedCA.NewServerCertTLSConfig()
-	if err != nil {
-		t.Fatal("failed creating test server TLS config", err)
-	}
-
-	grpcConfig := &rootfs.GRPCServiceConfig{
-		ServerName:      testServerAppName,
-		BindHostPort:    "127.0.0.1:0",
-		TLSConfigServer: serverTLSConfig,
-	}
-
-	testServer := rootfs.NewTestServer(t, logger.Named("grpc-server"), grpcConfig, buildCtx)
-	testServer.Start()
-	select {
-	case startErr := <-testServer.FailedNotify():
-		t.Fatal("expected the GRPC server to start but it failed", startErr)
-	case <-testServer.ReadyNotify():
-		t.Log("GRPC server started and serving on", grpcConfig.BindHostPort)
-	}
-
-	clientCertData, err := embeddedCA.NewClientCert()
-	if err != nil {
-		t.Fatal("failed creating test client certitifcate", err)
-	}
-
-	bootstrapConfig := &mmds.MMDSBootstrap{
-		HostPort:    grpcConfig.BindHostPort,
-		CaChain:     strings.Join(embeddedCA.CAPEMChain(), "\n"),
-		Certificate: string(clientCertData.CertificatePEM()),
-		Key:         string(clientCertData.KeyPEM()),
-		ServerName:  testServerAppName,
-	}
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
 
 	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
 		WithCommandRunner(NewShellCommandRunner(logger.Named("shell-runner"))).
@@ -227,8 +150,6 @@ func TestFailingAddBootstrap(t *testing.T) {
 
 func TestFailingCopyBootstrap(t *testing.T) {
 
-	testServerAppName := "test-server-app"
-
 	logger := hclog.Default()
 	logger.SetLevel(hclog.Debug)
 
@@ -279,50 +200,7 @@ func TestFailingCopyBootstrap(t *testing.T) {
 		},
 	}
 
-	// construct an embedded CA to manually handle TLS configs:
-	embeddedCAConfig := &ca.EmbeddedCAConfig{
-		Addresses:     []string{testServerAppName},
-		CertsValidFor: time.Hour,
-		KeySize:       1024,
-	}
-
-	embeddedCA, err := ca.NewDefaultEmbeddedCAWithLogger(embeddedCAConfig, logger.Named("embedded-ca"))
-	if err != nil {
-		t.Fatal("failed constructing embedded CA", err)
-	}
-
-	serverTLSConfig, err := embeddedCA.NewServerCertTLSConfig()
-	if err != nil {
-		t.Fatal("failed creating test server TLS config", err)
-	}
-
-	grpcConfig := &rootfs.GRPCServiceConfig{
-		ServerName:      testServerAppName,
-		BindHostPort:    "127.0.0.1:0",
-		TLSConfigServer: serverTLSConfig,
-	}
-
-	testServer := rootfs.NewTestServer(t, logger.Named("grpc-server"), grpcConfig, buildCtx)
-	testServer.Start()
-	select {
-	case startErr := <-testServer.FailedNotify():
-		t.Fatal("expected the GRPC server to start but it failed", startErr)
-	case <-testServer.ReadyNotify():
-		t.Log("GRPC server started and serving on", grpcConfig.BindHostPort)
-	}
-
-	clientCertData, err := embeddedCA.NewClientCert()
-	if err != nil {
-		t.Fatal("failed creating test client certitifcate", err)
-	}
-
-	bootstrapConfig := &mmds.MMDSBootstrap{
-		HostPort:    grpcConfig.BindHostPort,
-		CaChain:     strings.Join(embeddedCA.CAPEMChain(), "\n"),
-		Certificate: string(clientCertData.CertificatePEM()),
-		Key:         string(clientCertData.KeyPEM()),
-		ServerName:  testServerAppName,
-	}
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
 
 	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
 		WithCommandRunner(NewShellCommandRunner(logger.Named("shell-runner"))).
@@ -337,9 +215,61 @@ func TestFailingCopyBootstrap(t *testing.T) {
 	assert.Equal(t, len(serverOutput), 2)
 }
 
-func TestSuccessfulBootstrapWithResources(t *testing.T) {
+func TestUnindexedResourceDeployer(t *testing.T) {
 
-	testServerAppName := "test-server-app"
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{
+			commands.Add{
+				OriginalCommand: "ADD etc/app.conf /etc/app.conf",
+				OriginalSource:  "etc/app.conf",
+				Source:          "etc/app.conf",
+				Target:          "/etc/app.conf",
+				User:            commands.DefaultUser(),
+				Workdir:         commands.DefaultWorkdir(),
+			},
+			commands.Copy{
+				OriginalCommand: "COPY etc/db.conf /etc/db.conf",
+				OriginalSource:  "etc/db.conf",
+				Source:          "etc/db.conf",
+				Target:          "/etc/db.conf",
+				User:            commands.DefaultUser(),
+				Workdir:         commands.DefaultWorkdir(),
+			},
+		},
+	}
+
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+	deployer := &recordingResourceDeployer{}
+	assert.Nil(t, NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithResourceDeployer(deployer).
+		Execute())
+
+	<-testServer.FinishedNotify()
+
+	// a deployer without the command index executes the commands with Add and Copy:
+	assert.Equal(t, []string{"ADD etc/app.conf", "COPY etc/db.conf"}, deployer.deployed)
+}
+
+// recordingResourceDeployer is a resource deployer without the command index.
+type recordingResourceDeployer struct {
+	deployed []string
+}
+
+func (r *recordingResourceDeployer) Add(cmd commands.Add, grpcClient rootfs.ClientProvider) error {
+	r.deployed = append(r.deployed, "ADD "+cmd.Source)
+	return nil
+}
+
+func (r *recordingResourceDeployer) Copy(cmd commands.Copy, grpcClient rootfs.ClientProvider) error {
+	r.deployed = append(r.deployed, "COPY "+cmd.Source)
+	return nil
+}
+
+func TestSuccessfulBootstrapWithResources(t *testing.T) {
 
 	logger := hclog.Default()
 	logger.SetLevel(hclog.Debug)
@@ -448,9 +378,32 @@ func TestSuccessfulBootstrapWithResources(t *testing.T) {
 		},
 	}
 
-	// construct an embedded CA to manually handle TLS configs:
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+	resourceDeployer := NewExecutingResourceDeployer(logger.Named("executing-deployer"))
+	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithCommandRunner(NewShellCommandRunner(logger.Named("shell-runner"))).
+		WithResourceDeployer(resourceDeployer)
+
+	bootstrapErr := bootstrapper.Execute()
+	assert.Nil(t, bootstrapErr)
+
+	<-testServer.FinishedNotify()
+
+	serverOutput := testServer.ReceivedStdout()
+	assert.Equal(t, len(serverOutput), 2)
+
+	assert.NotEmpty(t, bootstrapper.DeployMerkleRoot())
+	assert.Equal(t, merkleRoot(resourceDeployer.Manifest()), bootstrapper.DeployMerkleRoot())
+}
+
+func TestBuildTLSConfig(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
 	embeddedCAConfig := &ca.EmbeddedCAConfig{
-		Addresses:     []string{testServerAppName},
+		Addresses:     []string{"test-app"},
 		CertsValidFor: time.Hour,
 		KeySize:       1024,
 	}
@@ -460,96 +413,2094 @@ func TestSuccessfulBootstrapWithResources(t *testing.T) {
 		t.Fatal("failed constructing embedded CA", err)
 	}
 
-	serverTLSConfig, err := embeddedCA.NewServerCertTLSConfig()
+	bootstrapConfig, err := mmds.NewBootstrapFromCA(embeddedCA, "127.0.0.1:0", "irrelevant")
 	if err != nil {
-		t.Fatal("failed creating test server TLS config", err)
+		t.Fatal("failed creating test bootstrap config", err)
 	}
 
-	grpcConfig := &rootfs.GRPCServiceConfig{
-		ServerName:      testServerAppName,
-		BindHostPort:    "127.0.0.1:0",
-		TLSConfigServer: serverTLSConfig,
+	tlsConfig, tlsConfigErr := BuildTLSConfig(bootstrapConfig)
+	if tlsConfigErr != nil {
+		t.Fatal("expected TLS config, got error", tlsConfigErr)
 	}
+	assert.Equal(t, bootstrapConfig.ServerName, tlsConfig.ServerName)
+	assert.Equal(t, 1, len(tlsConfig.Certificates))
 
-	testServer := rootfs.NewTestServer(t, logger.Named("grpc-server"), grpcConfig, buildCtx)
-	testServer.Start()
-	select {
-	case startErr := <-testServer.FailedNotify():
-		t.Fatal("expected the GRPC server to start but it failed", startErr)
-	case <-testServer.ReadyNotify():
-		t.Log("GRPC server started and serving on", grpcConfig.BindHostPort)
+	_, tlsConfigErr = BuildTLSConfig(nil)
+	assert.NotNil(t, tlsConfigErr)
+}
+
+func TestGetTLSConfigClientCertProvider(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	embeddedCA, err := ca.NewDefaultEmbeddedCAWithLogger(&ca.EmbeddedCAConfig{
+		Addresses:     []string{"test-app"},
+		CertsValidFor: time.Hour,
+		KeySize:       1024,
+	}, logger.Named("embedded-ca"))
+	if err != nil {
+		t.Fatal("failed constructing embedded CA", err)
 	}
 
-	clientCertData, err := embeddedCA.NewClientCert()
+	bootstrapConfig, err := mmds.NewBootstrapFromCA(embeddedCA, "127.0.0.1:0", "irrelevant")
 	if err != nil {
-		t.Fatal("failed creating test client certitifcate", err)
+		t.Fatal("failed creating test bootstrap config", err)
 	}
 
-	bootstrapConfig := &mmds.MMDSBootstrap{
-		HostPort:    grpcConfig.BindHostPort,
-		CaChain:     strings.Join(embeddedCA.CAPEMChain(), "\n"),
-		Certificate: string(clientCertData.CertificatePEM()),
-		Key:         string(clientCertData.KeyPEM()),
-		ServerName:  testServerAppName,
+	renewedCertData, err := embeddedCA.NewClientCert()
+	if err != nil {
+		t.Fatal("failed creating renewed client certificate", err)
+	}
+	renewedCert, err := tls.X509KeyPair(renewedCertData.CertificatePEM(), renewedCertData.KeyPEM())
+	if err != nil {
+		t.Fatal("failed loading renewed client certificate", err)
 	}
 
-	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
-		WithCommandRunner(NewShellCommandRunner(logger.Named("shell-runner"))).
-		WithResourceDeployer(NewExecutingResourceDeployer(logger.Named("executing-deployer")))
+	var providedCert *tls.Certificate
+	var providerErr error
+	tlsConfig, err := getTLSConfig(bootstrapConfig, nil, nil, func() (*tls.Certificate, error) {
+		return providedCert, providerErr
+	})
+	if err != nil {
+		t.Fatal("expected TLS config, got error", err)
+	}
 
-	bootstrapErr := bootstrapper.Execute()
-	assert.Nil(t, bootstrapErr)
+	// the static certificate is presented when the provider has no certificate:
+	cert, err := tlsConfig.GetClientCertificate(&tls.CertificateRequestInfo{})
+	assert.Nil(t, err)
+	assert.Equal(t, tlsConfig.Certificates[0].Certificate, cert.Certificate)
 
-	<-testServer.FinishedNotify()
+	providedCert = &renewedCert
+	cert, err = tlsConfig.GetClientCertificate(&tls.CertificateRequestInfo{})
+	assert.Nil(t, err)
+	assert.Equal(t, renewedCert.Certificate, cert.Certificate)
 
-	serverOutput := testServer.ReceivedStdout()
-	assert.Equal(t, len(serverOutput), 2)
+	providerErr = fmt.Errorf("renewal failed")
+	_, err = tlsConfig.GetClientCertificate(&tls.CertificateRequestInfo{})
+	assert.NotNil(t, err)
 }
 
-func TestGetTLSConfig(t *testing.T) {
+func TestValidateCAChainValidity(t *testing.T) {
 
 	logger := hclog.Default()
 	logger.SetLevel(hclog.Debug)
 
-	embeddedCAConfig := &ca.EmbeddedCAConfig{
+	embeddedCA, err := ca.NewDefaultEmbeddedCAWithLogger(&ca.EmbeddedCAConfig{
 		Addresses:     []string{"test-app"},
 		CertsValidFor: time.Hour,
 		KeySize:       1024,
-	}
-
-	embeddedCA, err := ca.NewDefaultEmbeddedCAWithLogger(embeddedCAConfig, logger.Named("embedded-ca"))
+	}, logger.Named("embedded-ca"))
 	if err != nil {
 		t.Fatal("failed constructing embedded CA", err)
 	}
 
-	clientCertData, err := embeddedCA.NewClientCert()
-	if err != nil {
-		t.Fatal("failed creating test client certitifcate", err)
-	}
+	caChain := strings.Join(embeddedCA.CAPEMChain(), "\n")
 
-	bootstrapConfig := &mmds.MMDSBootstrap{
-		HostPort:    "127.0.0.1:0",
-		CaChain:     strings.Join(embeddedCA.CAPEMChain(), "\n"),
-		Certificate: string(clientCertData.CertificatePEM()),
-		Key:         string(clientCertData.KeyPEM()),
-		ServerName:  "irrelevant",
-	}
+	assert.Nil(t, validateCAChainValidity(logger, caChain, time.Now(), true))
 
-	_, tlsConfigErr := getTLSConfig(bootstrapConfig)
-	if tlsConfigErr != nil {
-		t.Fatal("expected TLS config, got error", tlsConfigErr)
+	// expired and not yet valid CAs are only logged unless strict:
+	assert.Nil(t, validateCAChainValidity(logger, caChain, time.Now().Add(48*time.Hour), false))
+	assert.Nil(t, validateCAChainValidity(logger, caChain, time.Now().Add(-48*time.Hour), false))
+
+	expiredErr := validateCAChainValidity(logger, caChain, time.Now().Add(48*time.Hour), true)
+	assert.NotNil(t, expiredErr)
+	assert.Contains(t, expiredErr.Error(), "expired")
+
+	notYetValidErr := validateCAChainValidity(logger, caChain, time.Now().Add(-48*time.Hour), true)
+	assert.NotNil(t, notYetValidErr)
+	assert.Contains(t, notYetValidErr.Error(), "is not valid before")
+}
+
+func TestFinalizeCommandAfterSuccessfulBootstrap(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{
+			commands.Run{
+				OriginalCommand: "RUN echo primary",
+				Args:            map[string]string{},
+				Command:         "echo primary",
+				Env:             map[string]string{},
+				Shell: commands.Shell{
+					Commands: []string{"/bin/echo", "-e"},
+				},
+				User:    commands.DefaultUser(),
+				Workdir: commands.DefaultWorkdir(),
+			},
+		},
 	}
 
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithCommandRunner(NewShellCommandRunner(logger.Named("shell-runner"))).
+		WithFinalizeCommand(commands.Run{
+			OriginalCommand: "RUN exit 1",
+			Args:            map[string]string{},
+			Command:         "exit 1",
+			Env:             map[string]string{},
+			Shell:           commands.DefaultShell(),
+			User:            commands.DefaultUser(),
+			Workdir:         commands.DefaultWorkdir(),
+		})
+
+	bootstrapErr := bootstrapper.Execute()
+	assert.NotNil(t, bootstrapErr)
+	assert.Contains(t, bootstrapErr.Error(), "finalize command failed")
+
+	<-testServer.FinishedNotify()
+
+	serverOutput := testServer.ReceivedStdout()
+	assert.Equal(t, 1, len(serverOutput))
 }
 
-const testDockerfileMultiStage = `FROM alpine:3.13 as builder
+func TestFinalizeCommandAfterFailingBootstrap(t *testing.T) {
 
-FROM alpine:3.13
-ARG PARAM1=value
-ENV ENVPARAM1=envparam1
-RUN mkdir -p /dir
-ADD resource1 /target/resource1
-COPY resource2 /target/resource2
-COPY --from=builder /etc/test /etc/test
-RUN cp /dir/${ENVPARAM1} \
-	&& call --arg=${PARAM1}`
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{
+			commands.Run{
+				OriginalCommand: "RUN exit 1",
+				Args:            map[string]string{},
+				Command:         "exit 1",
+				Env:             map[string]string{},
+				Shell:           commands.DefaultShell(),
+				User:            commands.DefaultUser(),
+				Workdir:         commands.DefaultWorkdir(),
+			},
+		},
+	}
+
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithCommandRunner(NewShellCommandRunner(logger.Named("shell-runner"))).
+		WithFinalizeCommand(commands.Run{
+			OriginalCommand: "RUN echo finalize",
+			Args:            map[string]string{},
+			Command:         "echo finalize",
+			Env:             map[string]string{},
+			Shell: commands.Shell{
+				Commands: []string{"/bin/echo", "-e"},
+			},
+			User:    commands.DefaultUser(),
+			Workdir: commands.DefaultWorkdir(),
+		})
+
+	bootstrapErr := bootstrapper.Execute()
+	assert.NotNil(t, bootstrapErr)
+	assert.NotContains(t, bootstrapErr.Error(), "finalize command failed")
+
+	<-testServer.FinishedNotify()
+
+	// the finalize command runs even though the RUN command failed:
+	serverOutput := testServer.ReceivedStdout()
+	assert.Equal(t, 1, len(serverOutput))
+}
+
+func TestFailFastThreshold(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	failingCommand := commands.Run{
+		OriginalCommand: "RUN exit 1",
+		Args:            map[string]string{},
+		Command:         "exit 1",
+		Env:             map[string]string{},
+		Shell:           commands.DefaultShell(),
+		User:            commands.DefaultUser(),
+		Workdir:         commands.DefaultWorkdir(),
+	}
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{
+			failingCommand,
+			failingCommand,
+			commands.Run{
+				OriginalCommand: "RUN echo after failures",
+				Args:            map[string]string{},
+				Command:         "echo after failures",
+				Env:             map[string]string{},
+				Shell: commands.Shell{
+					Commands: []string{"/bin/echo", "-e"},
+				},
+				User:    commands.DefaultUser(),
+				Workdir: commands.DefaultWorkdir(),
+			},
+		},
+	}
+
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithCommandRunner(NewShellCommandRunner(logger.Named("shell-runner"))).
+		WithFailFastThreshold(3)
+
+	bootstrapErr := bootstrapper.Execute()
+	assert.NotNil(t, bootstrapErr)
+	var failures CommandFailures
+	assert.True(t, errors.As(bootstrapErr, &failures))
+	assert.Equal(t, 2, len(failures))
+
+	<-testServer.FinishedNotify()
+
+	serverOutput := testServer.ReceivedStdout()
+	assert.Equal(t, 1, len(serverOutput))
+}
+
+func TestContinueOnResourceError(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{
+			commands.Add{
+				OriginalCommand: "ADD etc/test-file1 /etc/test-file1",
+				OriginalSource:  "etc/test-file1",
+				Source:          "etc/test-file1",
+				Target:          "/etc/test-file1",
+				User:            commands.DefaultUser(),
+				Workdir:         commands.Workdir{Value: tempDir},
+			},
+			commands.Run{
+				OriginalCommand: "RUN echo after resource failure",
+				Args:            map[string]string{},
+				Command:         "echo after resource failure",
+				Env:             map[string]string{},
+				Shell: commands.Shell{
+					Commands: []string{"/bin/echo", "-e"},
+				},
+				User:    commands.DefaultUser(),
+				Workdir: commands.DefaultWorkdir(),
+			},
+		},
+	}
+
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithCommandRunner(NewShellCommandRunner(logger.Named("shell-runner"))).
+		WithResourceDeployer(NewExecutingResourceDeployer(logger.Named("executing-deployer"))).
+		WithContinueOnResourceError(true)
+
+	bootstrapErr := bootstrapper.Execute()
+	assert.NotNil(t, bootstrapErr)
+	var failures CommandFailures
+	assert.True(t, errors.As(bootstrapErr, &failures))
+	assert.Equal(t, 1, len(failures))
+
+	<-testServer.FinishedNotify()
+
+	// the RUN command after the failed ADD was executed:
+	serverOutput := testServer.ReceivedStdout()
+	assert.Equal(t, 1, len(serverOutput))
+}
+
+func TestReadinessProbe(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{},
+	}
+
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+	runner := &probeFailingCommandRunner{failures: 2}
+	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithCommandRunner(runner).
+		WithReadinessProbe(commands.Run{Command: "probe"}, time.Millisecond, time.Second)
+
+	assert.Nil(t, bootstrapper.Execute())
+	assert.Equal(t, 3, runner.attempts)
+
+	<-testServer.FinishedNotify()
+}
+
+func TestReadinessProbeTimeout(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{},
+	}
+
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+	// the fake clock does not sleep, the probe is attempted at 0s, 10s, ..., 60s:
+	runner := &probeFailingCommandRunner{failures: 1000}
+	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithClock(clock.NewFake(time.Now())).
+		WithCommandRunner(runner).
+		WithReadinessProbe(commands.Run{Command: "probe"}, 10*time.Second, time.Minute)
+
+	bootstrapErr := bootstrapper.Execute()
+	assert.NotNil(t, bootstrapErr)
+	assert.Contains(t, bootstrapErr.Error(), "readiness probe did not succeed")
+	assert.Equal(t, 7, runner.attempts)
+
+	<-testServer.FinishedNotify()
+}
+
+func TestEndpointFailover(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{
+			commands.Run{
+				OriginalCommand: "RUN echo failover",
+				Args:            map[string]string{},
+				Command:         "echo failover",
+				Env:             map[string]string{},
+				Shell: commands.Shell{
+					Commands: []string{"/bin/echo", "-e"},
+				},
+				User:    commands.DefaultUser(),
+				Workdir: commands.DefaultWorkdir(),
+			},
+		},
+	}
+
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+	serverHostPort := bootstrapConfig.HostPort
+	bootstrapConfig.HostPort = mustUnusedHostPort(t)
+	bootstrapConfig.HostPorts = []string{serverHostPort}
+
+	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithCommandRunner(NewShellCommandRunner(logger.Named("shell-runner")))
+
+	assert.Nil(t, bootstrapper.Execute())
+
+	<-testServer.FinishedNotify()
+
+	assert.Equal(t, 1, len(testServer.ReceivedStdout()))
+}
+
+func TestEndpointFailoverAllFailed(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	embeddedCA, err := ca.NewDefaultEmbeddedCAWithLogger(&ca.EmbeddedCAConfig{
+		Addresses:     []string{"test-server-app"},
+		CertsValidFor: time.Hour,
+		KeySize:       1024,
+	}, logger.Named("embedded-ca"))
+	if err != nil {
+		t.Fatal("failed constructing embedded CA", err)
+	}
+
+	unusedHostPort1 := mustUnusedHostPort(t)
+	unusedHostPort2 := mustUnusedHostPort(t)
+
+	bootstrapConfig, err := mmds.NewBootstrapFromCA(embeddedCA, unusedHostPort1, "test-server-app")
+	if err != nil {
+		t.Fatal("failed creating test bootstrap config", err)
+	}
+	// the duplicate endpoint is tried once:
+	bootstrapConfig.HostPorts = []string{unusedHostPort2, unusedHostPort1}
+
+	bootstrapErr := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).Execute()
+	assert.NotNil(t, bootstrapErr)
+	var failures EndpointFailures
+	assert.True(t, errors.As(bootstrapErr, &failures))
+	assert.Equal(t, 2, len(failures))
+	assert.Contains(t, bootstrapErr.Error(), unusedHostPort1)
+	assert.Contains(t, bootstrapErr.Error(), unusedHostPort2)
+}
+
+func TestServerNameMatcher(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{
+			commands.Run{
+				OriginalCommand: "RUN echo matched",
+				Args:            map[string]string{},
+				Command:         "echo matched",
+				Env:             map[string]string{},
+				Shell: commands.Shell{
+					Commands: []string{"/bin/echo", "-e"},
+				},
+				User:    commands.DefaultUser(),
+				Workdir: commands.DefaultWorkdir(),
+			},
+		},
+	}
+
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+	serverName := bootstrapConfig.ServerName
+	// the default matching would reject the server:
+	bootstrapConfig.ServerName = "not-" + serverName
+
+	matchedCerts := []*x509.Certificate{}
+	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithCommandRunner(NewShellCommandRunner(logger.Named("shell-runner"))).
+		WithServerNameMatcher(func(cert *x509.Certificate) bool {
+			matchedCerts = append(matchedCerts, cert)
+			for _, name := range cert.DNSNames {
+				if name == serverName {
+					return true
+				}
+			}
+			return false
+		})
+
+	assert.Nil(t, bootstrapper.Execute())
+
+	<-testServer.FinishedNotify()
+
+	assert.NotEmpty(t, matchedCerts)
+	assert.Equal(t, 1, len(testServer.ReceivedStdout()))
+}
+
+func TestServerNameMatcherRejected(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	_, bootstrapConfig := mustStartTestServer(t, logger, &rootfs.WorkContext{})
+
+	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithServerNameMatcher(func(cert *x509.Certificate) bool {
+			return false
+		})
+
+	bootstrapErr := bootstrapper.Execute()
+	assert.NotNil(t, bootstrapErr)
+	assert.Contains(t, bootstrapErr.Error(), "rejected by the server name matcher")
+}
+
+func TestServerCertFingerprints(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, &rootfs.WorkContext{})
+
+	defer testServer.Stop()
+
+	// capture the server certificate with a matcher accepting every server:
+	serverCerts := []*x509.Certificate{}
+	rejectedErr := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithServerCertFingerprints([]string{strings.Repeat("ab", sha256.Size)}).
+		WithServerNameMatcher(func(cert *x509.Certificate) bool {
+			serverCerts = append(serverCerts, cert)
+			return true
+		}).
+		Execute()
+	assert.NotNil(t, rejectedErr)
+	assert.Contains(t, rejectedErr.Error(), "not allowed")
+	if len(serverCerts) == 0 {
+		t.Fatal("expected the server certificate")
+	}
+
+	fingerprint := sha256.Sum256(serverCerts[0].Raw)
+	assert.Nil(t, NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithServerCertFingerprints([]string{strings.ToUpper(hex.EncodeToString(fingerprint[:]))}).
+		Execute())
+
+	<-testServer.FinishedNotify()
+
+	invalidErr := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithServerCertFingerprints([]string{"not-a-fingerprint"}).
+		Execute()
+	assert.NotNil(t, invalidErr)
+	assert.Contains(t, invalidErr.Error(), "invalid server certificate fingerprint")
+}
+
+func TestIncompleteWorkContextRetried(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{
+			commands.Run{
+				OriginalCommand: "RUN echo retried",
+				Args:            map[string]string{},
+				Command:         "echo retried",
+				Env:             map[string]string{},
+				Shell: commands.Shell{
+					Commands: []string{"/bin/echo", "-e"},
+				},
+				User:    commands.DefaultUser(),
+				Workdir: commands.DefaultWorkdir(),
+			},
+		},
+	}
+
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithClock(clock.NewFake(time.Now())).
+		WithCommandRunner(NewShellCommandRunner(logger.Named("shell-runner")))
+	counters := withResettingStream(bootstrapper, 2)
+
+	assert.Nil(t, bootstrapper.Execute())
+
+	<-testServer.FinishedNotify()
+
+	// the fetch is retried over a single connection, closed once at the end:
+	assert.Equal(t, 1, counters.dials)
+	assert.Equal(t, 3, counters.fetches)
+	assert.Equal(t, 1, counters.closed)
+	assert.Equal(t, 1, len(testServer.ReceivedStdout()))
+}
+
+func TestIncompleteWorkContextAttemptsExhausted(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	_, bootstrapConfig := mustStartTestServer(t, logger, &rootfs.WorkContext{})
+
+	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithClock(clock.NewFake(time.Now())).
+		WithWorkContextFetchAttempts(2)
+	counters := withResettingStream(bootstrapper, 10)
+
+	bootstrapErr := bootstrapper.Execute()
+	assert.NotNil(t, bootstrapErr)
+	assert.True(t, errors.Is(bootstrapErr, ErrIncompleteWorkContext))
+	assert.Equal(t, 1, counters.dials)
+	assert.Equal(t, 2, counters.fetches)
+	assert.Equal(t, 1, counters.closed)
+}
+
+func TestBuildMetadata(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{testRunCommand("true")},
+	}
+
+	metadata := map[string]string{
+		"build-id":     "42",
+		"source-image": "alpine:3.13",
+		"timestamp":    "2021-04-01T00:00:00Z",
+	}
+
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+	defer testServer.Stop()
+
+	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig)
+	assert.Equal(t, map[string]string{}, bootstrapper.BuildMetadata())
+	bootstrapper.(*defaultBootstrapper).newClient = func(logger hclog.Logger, cfg *rootfs.GRPCClientConfig) (rootfs.ClientProvider, error) {
+		client, err := rootfs.NewClient(logger, cfg)
+		if err != nil {
+			return nil, err
+		}
+		return &buildMetadataClient{ClientProvider: client, metadata: metadata}, nil
+	}
+
+	assert.Nil(t, bootstrapper.Execute())
+	<-testServer.FinishedNotify()
+	assert.Equal(t, metadata, bootstrapper.BuildMetadata())
+
+	// the returned build metadata is a copy:
+	bootstrapper.BuildMetadata()["build-id"] = "changed"
+	assert.Equal(t, "42", bootstrapper.BuildMetadata()["build-id"])
+
+	// a client without the build metadata:
+	otherServer, otherConfig := mustStartTestServer(t, logger, buildCtx)
+	defer otherServer.Stop()
+	other := NewDefaultBoostrapper(logger.Named("bootstrapper"), otherConfig)
+	assert.Nil(t, other.Execute())
+	<-otherServer.FinishedNotify()
+	assert.Equal(t, map[string]string{}, other.BuildMetadata())
+}
+
+func TestEmptyWorkContext(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	t.Run("allowed by default", func(t *testing.T) {
+		testServer, bootstrapConfig := mustStartTestServer(t, logger, &rootfs.WorkContext{})
+		defer testServer.Stop()
+
+		assert.Nil(t, NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).Execute())
+		<-testServer.FinishedNotify()
+		assert.Nil(t, testServer.Aborted())
+	})
+
+	t.Run("not allowed", func(t *testing.T) {
+		testServer, bootstrapConfig := mustStartTestServer(t, logger, &rootfs.WorkContext{})
+		defer testServer.Stop()
+
+		bootstrapErr := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+			WithAllowEmptyWorkContext(false).
+			Execute()
+		assert.True(t, errors.Is(bootstrapErr, ErrEmptyWorkContext))
+		<-testServer.FinishedNotify()
+		// the error is sent to the server as a message:
+		if assert.NotNil(t, testServer.Aborted()) {
+			assert.True(t, strings.Contains(testServer.Aborted().Error(), ErrEmptyWorkContext.Error()))
+		}
+	})
+}
+
+func TestAsIncompleteWorkContext(t *testing.T) {
+	assert.Nil(t, asIncompleteWorkContext(nil))
+	for _, err := range []error{
+		io.ErrUnexpectedEOF,
+		fmt.Errorf("failed reading commands: %w", io.EOF),
+		fmt.Errorf("rpc error: code = Internal desc = stream terminated by RST_STREAM with error code: PROTOCOL_ERROR"),
+		fmt.Errorf("unexpected end of JSON input"),
+	} {
+		incompleteErr := asIncompleteWorkContext(err)
+		assert.True(t, errors.Is(incompleteErr, ErrIncompleteWorkContext), err.Error())
+		assert.True(t, errors.Is(incompleteErr, err))
+	}
+	otherErr := fmt.Errorf("permission denied")
+	assert.Equal(t, otherErr, asIncompleteWorkContext(otherErr))
+}
+
+func TestEventLog(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{
+			commands.Run{
+				OriginalCommand: "RUN echo event",
+				Args:            map[string]string{},
+				Command:         "echo event",
+				Env:             map[string]string{},
+				User:            commands.DefaultUser(),
+				Workdir:         commands.DefaultWorkdir(),
+			},
+			commands.Add{
+				OriginalCommand: "ADD etc /etc",
+				Source:          "etc",
+				Target:          "/etc",
+				User:            commands.DefaultUser(),
+				Workdir:         commands.DefaultWorkdir(),
+			},
+			commands.Run{
+				OriginalCommand: "RUN echo debug",
+				Args:            map[string]string{TagsArg: "debug"},
+				Command:         "echo debug",
+				Env:             map[string]string{},
+				User:            commands.DefaultUser(),
+				Workdir:         commands.DefaultWorkdir(),
+			},
+		},
+	}
+
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+	eventLog := &bytes.Buffer{}
+	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithCommandFilter(nil, []string{"debug"}).
+		WithCommandRunner(&recordingCommandRunner{}).
+		WithEventLog(eventLog)
+
+	assert.Nil(t, bootstrapper.Execute())
+
+	<-testServer.FinishedNotify()
+
+	events := []Event{}
+	for _, line := range strings.Split(strings.TrimSpace(eventLog.String()), "\n") {
+		event := Event{}
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatal("expected JSON event, got error", err)
+		}
+		events = append(events, event)
+	}
+
+	types := []string{}
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+	assert.Equal(t, []string{
+		EventBootstrapStarted,
+		EventCommandStarted,
+		EventCommandFinished,
+		EventCommandStarted,
+		EventCommandFinished,
+		EventResourceDeployed,
+		EventCommandSkipped,
+		EventBootstrapFinished,
+	}, types)
+	assert.Equal(t, "RUN echo event", events[1].Command)
+	assert.Equal(t, 0, *events[1].Index)
+	assert.Equal(t, "ADD", events[5].Kind)
+	assert.Equal(t, "/etc", events[5].Target)
+	assert.Equal(t, 2, *events[6].Index)
+	assert.Nil(t, events[7].Index)
+	assert.Empty(t, events[7].Error)
+}
+
+func TestMerkleRoot(t *testing.T) {
+	assert.Equal(t, "", merkleRoot(nil))
+
+	leaf := func(entry ManifestEntry) []byte {
+		hash := sha256.Sum256([]byte(entry.Path + "\x00" + entry.Mode + "\x00" + entry.SHA256))
+		return hash[:]
+	}
+	node := func(left, right []byte) []byte {
+		hash := sha256.Sum256(append(append([]byte{}, left...), right...))
+		return hash[:]
+	}
+
+	a := ManifestEntry{Path: "/a", Mode: "0644", SHA256: "aa"}
+	b := ManifestEntry{Path: "/b", Mode: "0755", IsDir: true}
+	c := ManifestEntry{Path: "/c", Mode: "0600", SHA256: "cc"}
+
+	assert.Equal(t, hex.EncodeToString(leaf(a)), merkleRoot([]ManifestEntry{a}))
+	// the order of deployment does not matter, the odd node is promoted:
+	expected := hex.EncodeToString(node(node(leaf(a), leaf(b)), leaf(c)))
+	assert.Equal(t, expected, merkleRoot([]ManifestEntry{a, b, c}))
+	assert.Equal(t, expected, merkleRoot([]ManifestEntry{c, a, b}))
+
+	// the last deployment of a path wins:
+	modified := ManifestEntry{Path: "/a", Mode: "0644", SHA256: "modified"}
+	assert.Equal(t, hex.EncodeToString(leaf(modified)), merkleRoot([]ManifestEntry{a, modified}))
+	assert.NotEqual(t, merkleRoot([]ManifestEntry{a}), merkleRoot([]ManifestEntry{{Path: "/a", Mode: "0600", SHA256: "aa"}}))
+}
+
+func TestResourceResolver(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{
+			commands.Add{
+				OriginalCommand: "ADD s3://bucket/app.conf /etc/app.conf",
+				Source:          "s3://bucket/app.conf",
+				Target:          "/etc/app.conf",
+				User:            commands.DefaultUser(),
+				Workdir:         commands.Workdir{Value: tempDir},
+			},
+		},
+	}
+
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+	resolver := &testResourceResolver{contents: []byte("resolved contents")}
+	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithResourceDeployer(NewExecutingResourceDeployer(logger.Named("executing-deployer"))).
+		WithResourceResolver(resolver)
+
+	assert.Nil(t, bootstrapper.Execute())
+
+	<-testServer.FinishedNotify()
+
+	assert.Equal(t, []ResourceRequest{{
+		CommandIndex: 0,
+		Source:       "s3://bucket/app.conf",
+		Target:       "/etc/app.conf",
+		User:         commands.DefaultUser(),
+		Workdir:      commands.Workdir{Value: tempDir},
+	}}, resolver.requests)
+
+	deployed, err := ioutil.ReadFile(filepath.Join(tempDir, "etc/app.conf"))
+	assert.Nil(t, err)
+	assert.Equal(t, "resolved contents", string(deployed))
+}
+
+func TestMMDSResourceResolver(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{
+			commands.Add{
+				OriginalCommand: "ADD mmds://app.conf /etc/app.conf",
+				Source:          "mmds://app.conf",
+				Target:          "/etc/app.conf",
+				User:            commands.DefaultUser(),
+				Workdir:         commands.Workdir{Value: tempDir},
+			},
+			commands.Copy{
+				OriginalCommand: "COPY mmds://app.conf /etc/conf.d/",
+				Source:          "mmds://app.conf",
+				Target:          "/etc/conf.d/",
+				User:            commands.DefaultUser(),
+				Workdir:         commands.Workdir{Value: tempDir},
+			},
+		},
+	}
+
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+	// the parts are reassembled in order:
+	mmdsServer := mustStartTestMMDSServer(t, map[string]string{
+		"Parts":    "2",
+		"part-001": base64.StdEncoding.EncodeToString([]byte("second part")),
+		"part-000": base64.StdEncoding.EncodeToString([]byte("first part, ")),
+	})
+	defer mmdsServer.Close()
+
+	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithResourceDeployer(NewExecutingResourceDeployer(logger.Named("executing-deployer"))).
+		WithResourceResolver(NewMMDSResourceResolver(mmdsServer.Client(), mmdsServer.URL+"/latest/meta-data", logger.Named("mmds-resolver")))
+
+	assert.Nil(t, bootstrapper.Execute())
+
+	<-testServer.FinishedNotify()
+
+	for _, path := range []string{"etc/app.conf", "etc/conf.d/app.conf"} {
+		deployed, err := ioutil.ReadFile(filepath.Join(tempDir, path))
+		assert.Nil(t, err)
+		assert.Equal(t, "first part, second part", string(deployed))
+	}
+}
+
+func TestMMDSResourceResolverMissingPart(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{
+			commands.Add{
+				OriginalCommand: "ADD mmds://app.conf /etc/app.conf",
+				Source:          "mmds://app.conf",
+				Target:          "/etc/app.conf",
+				User:            commands.DefaultUser(),
+				Workdir:         commands.Workdir{Value: tempDir},
+			},
+		},
+	}
+
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+	mmdsServer := mustStartTestMMDSServer(t, map[string]string{
+		"Parts":    "2",
+		"part-000": base64.StdEncoding.EncodeToString([]byte("first part, ")),
+	})
+	defer mmdsServer.Close()
+
+	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithResourceDeployer(NewExecutingResourceDeployer(logger.Named("executing-deployer"))).
+		WithResourceResolver(NewMMDSResourceResolver(mmdsServer.Client(), mmdsServer.URL+"/latest/meta-data", logger.Named("mmds-resolver")))
+
+	// the resource is validated before it is deployed:
+	executeErr := bootstrapper.Execute()
+	assert.NotNil(t, executeErr)
+	assert.Contains(t, executeErr.Error(), "part 'part-001' missing")
+
+	<-testServer.FinishedNotify()
+
+	_, statErr := os.Stat(filepath.Join(tempDir, "etc/app.conf"))
+	assert.True(t, os.IsNotExist(statErr))
+}
+
+// mustStartTestMMDSServer starts an MMDS server serving the chunked resource under the resource/app.conf key.
+func mustStartTestMMDSServer(t *testing.T, resource map[string]string) *httptest.Server {
+	data, err := json.Marshal(resource)
+	if err != nil {
+		t.Fatal("expected chunked resource, got error", err)
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/latest/meta-data/resource/app.conf" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	}))
+}
+
+func TestTemplateTargets(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	target := "/etc/{{.Env.APP}}/{{.Args.ROLE | upper}}/app.conf"
+	run := testRunCommand("echo configure")
+	run.Args = map[string]string{"ROLE": "primary"}
+	run.Env = map[string]string{"APP": "web"}
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{
+			run,
+			commands.Copy{
+				OriginalCommand: "COPY app.conf " + target,
+				Source:          "app.conf",
+				Target:          target,
+				User:            commands.DefaultUser(),
+				Workdir:         commands.Workdir{Value: tempDir},
+			},
+		},
+		ResourcesResolved: rootfs.Resources{
+			"app.conf": []resources.ResolvedResource{
+				resources.NewResolvedFileResourceWithPath(func() (io.ReadCloser, error) {
+					return io.NopCloser(bytes.NewReader([]byte("templated"))), nil
+				},
+					fs.FileMode(0644),
+					"app.conf",
+					target,
+					commands.Workdir{Value: tempDir},
+					commands.DefaultUser(),
+					"app.conf"),
+			},
+		},
+	}
+
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+	defer testServer.Stop()
+
+	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithCommandRunner(&recordingCommandRunner{}).
+		WithResourceDeployer(NewExecutingResourceDeployer(logger.Named("executing-deployer"))).
+		WithTemplateTargets(true)
+
+	assert.Nil(t, bootstrapper.Execute())
+
+	<-testServer.FinishedNotify()
+
+	deployed, err := ioutil.ReadFile(filepath.Join(tempDir, "etc/web/PRIMARY/app.conf"))
+	assert.Nil(t, err)
+	assert.Equal(t, "templated", string(deployed))
+}
+
+func TestRenderTargetTemplate(t *testing.T) {
+	data := targetTemplateData{
+		Args: map[string]string{},
+		Env:  map[string]string{"DIR": "../.."},
+		MMDS: map[string]string{"instance_id": "i-123"},
+	}
+
+	rendered, err := renderTargetTemplate("/etc/{{.MMDS.instance_id}}.conf", data)
+	assert.Nil(t, err)
+	assert.Equal(t, "/etc/i-123.conf", rendered)
+
+	rendered, err = renderTargetTemplate("/etc/plain.conf", data)
+	assert.Nil(t, err)
+	assert.Equal(t, "/etc/plain.conf", rendered)
+
+	for _, target := range []string{
+		"/etc/{{.Env.MISSING}}",
+		"/etc/{{.Env.DIR}}/passwd",
+		`/etc/{{printf "%s" .Env.DIR}}`,
+		"/etc/{{call .Env.DIR}}",
+	} {
+		_, err := renderTargetTemplate(target, data)
+		assert.NotNil(t, err, target)
+	}
+}
+
+func TestDiagnosticsDir(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+	diagnosticsDir := filepath.Join(tempDir, "diagnostics")
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{
+			testRunCommand("echo first"),
+			testRunCommand("echo flaky"),
+		},
+	}
+
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+	defer testServer.Stop()
+
+	assert.NotNil(t, NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithCommandRunner(&flakyCommandRunner{command: "echo flaky", failures: 1}).
+		WithDiagnosticsDir(diagnosticsDir).
+		Execute())
+
+	<-testServer.FinishedNotify()
+
+	files, err := ioutil.ReadDir(diagnosticsDir)
+	if err != nil {
+		t.Fatal("expected diagnostics dir, got error", err)
+	}
+	if len(files) != 1 {
+		t.Fatal("expected one diagnostics bundle, got", len(files))
+	}
+	assert.Equal(t, fs.FileMode(0600), files[0].Mode().Perm())
+
+	data, err := ioutil.ReadFile(filepath.Join(diagnosticsDir, files[0].Name()))
+	assert.Nil(t, err)
+	bundle := map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal(data, &bundle))
+	assert.Equal(t, "flaky command failed", bundle["Error"])
+	assert.Equal(t, string(BootstrapPhaseCommands), bundle["Phase"])
+	assert.Equal(t, 2, len(bundle["Commands"].([]interface{})))
+	// started, two commands started and finished:
+	assert.Equal(t, 5, len(bundle["Events"].([]interface{})))
+
+	// a successful bootstrap writes no diagnostics:
+	successServer, successConfig := mustStartTestServer(t, logger, buildCtx)
+	defer successServer.Stop()
+
+	assert.Nil(t, NewDefaultBoostrapper(logger.Named("bootstrapper"), successConfig).
+		WithCommandRunner(&recordingCommandRunner{}).
+		WithDiagnosticsDir(filepath.Join(tempDir, "success")).
+		Execute())
+	<-successServer.FinishedNotify()
+	assert.Nil(t, successServer.Aborted())
+	_, statErr := os.Stat(filepath.Join(tempDir, "success"))
+	assert.True(t, os.IsNotExist(statErr))
+}
+
+func TestMMDSKeyToEnvName(t *testing.T) {
+	assert.Equal(t, "MMDS_LOCALHOSTNAME", mmdsKeyToEnvName("LocalHostname"))
+	assert.Equal(t, "MMDS_NETWORK_CNINETWORKNAME", mmdsKeyToEnvName("/Network/CniNetworkName"))
+	assert.Equal(t, "MMDS_MACHINE_CPU_TEMPLATE", mmdsKeyToEnvName("Machine/CPU-Template"))
+}
+
+func TestCommandMatchesArch(t *testing.T) {
+	assert.True(t, commandMatchesArch(commands.Run{}, "amd64"))
+	assert.True(t, commandMatchesArch(commands.Run{Args: map[string]string{ArchConstraintArg: "amd64"}}, "amd64"))
+	assert.True(t, commandMatchesArch(commands.Run{Args: map[string]string{ArchConstraintArg: "arm64, amd64"}}, "amd64"))
+	assert.False(t, commandMatchesArch(commands.Run{Args: map[string]string{ArchConstraintArg: "arm64"}}, "amd64"))
+}
+
+func TestCommandFilter(t *testing.T) {
+	var noFilter *commandFilter
+	assert.True(t, noFilter.matches([]string{"debug"}))
+
+	includeFilter := newCommandFilter([]string{"provision"}, nil)
+	assert.True(t, includeFilter.matches([]string{}))
+	assert.True(t, includeFilter.matches([]string{"provision"}))
+	assert.True(t, includeFilter.matches([]string{"debug", "provision"}))
+	assert.False(t, includeFilter.matches([]string{"debug"}))
+
+	excludeFilter := newCommandFilter(nil, []string{"debug"})
+	assert.True(t, excludeFilter.matches([]string{}))
+	assert.True(t, excludeFilter.matches([]string{"provision"}))
+	assert.False(t, excludeFilter.matches([]string{"debug", "provision"}))
+
+	catchAllFilter := newCommandFilter([]string{"provision"}, []string{CommandFilterCatchAll})
+	assert.False(t, catchAllFilter.matches([]string{}))
+	assert.True(t, catchAllFilter.matches([]string{"provision"}))
+	assert.False(t, catchAllFilter.matches([]string{"debug"}))
+
+	assert.Equal(t, []string{"debug", "provision"}, commandTags(commands.Run{Args: map[string]string{TagsArg: "debug, provision,"}}))
+	assert.Equal(t, []string{}, commandTags(commands.Run{}))
+	assert.Equal(t, []string{}, commandTags(commands.Copy{}))
+}
+
+func TestCommandFilterBootstrap(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	newRun := func(text, tags string) commands.Run {
+		return commands.Run{
+			OriginalCommand: "RUN echo " + text,
+			Args:            map[string]string{TagsArg: tags},
+			Command:         "echo " + text,
+			Env:             map[string]string{},
+			Shell: commands.Shell{
+				Commands: []string{"/bin/echo", "-e"},
+			},
+			User:    commands.DefaultUser(),
+			Workdir: commands.DefaultWorkdir(),
+		}
+	}
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{
+			newRun("untagged", ""),
+			newRun("provision", "provision"),
+			newRun("debug", "debug"),
+			newRun("provision-debug", "provision,debug"),
+		},
+	}
+
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+	commandRunner := &recordingCommandRunner{}
+	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithCommandFilter([]string{"provision"}, []string{"debug"}).
+		WithCommandRunner(commandRunner)
+
+	assert.Nil(t, bootstrapper.Execute())
+
+	<-testServer.FinishedNotify()
+
+	assert.Equal(t, []string{"echo untagged", "echo provision"}, commandRunner.executed)
+}
+
+func TestExecuteWithRetry(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{
+			testRunCommand("echo first"),
+			testRunCommand("echo flaky"),
+			testRunCommand("echo last"),
+		},
+	}
+
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+	defer testServer.Stop()
+
+	commandRunner := &flakyCommandRunner{command: "echo flaky", failures: 2}
+	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithCommandRunner(commandRunner)
+
+	assert.Nil(t, bootstrapper.ExecuteWithRetry(context.Background(), 3, time.Millisecond))
+
+	<-testServer.FinishedNotify()
+
+	assert.Nil(t, testServer.Aborted())
+	// the commands executed successfully are not executed again:
+	assert.Equal(t, []string{"echo first", "echo flaky", "echo flaky", "echo flaky", "echo last"}, commandRunner.executed)
+}
+
+func TestExecuteWithRetryPermanentError(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{
+			testRunCommand("echo first"),
+			testRunCommand("echo flaky"),
+		},
+	}
+
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+	defer testServer.Stop()
+
+	commandRunner := &flakyCommandRunner{command: "echo flaky", failures: 2}
+	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithCommandRunner(commandRunner).
+		WithErrorClassifier(func(err error) ErrorClass {
+			return ErrorClassPermanent
+		})
+
+	assert.NotNil(t, bootstrapper.ExecuteWithRetry(context.Background(), 3, time.Millisecond))
+
+	<-testServer.FinishedNotify()
+
+	// the attempt failing permanently is the last attempt and aborts the build:
+	assert.NotNil(t, testServer.Aborted())
+	assert.Equal(t, []string{"echo first", "echo flaky"}, commandRunner.executed)
+}
+
+func TestDefaultErrorClassifier(t *testing.T) {
+	assert.Equal(t, ErrorClassTransient, DefaultErrorClassifier(errors.Join(errors.New("fetch failed"), ErrIncompleteWorkContext)))
+	assert.Equal(t, ErrorClassTransient, DefaultErrorClassifier(&net.OpError{Op: "dial", Err: errors.New("refused")}))
+	assert.Equal(t, ErrorClassTransient, DefaultErrorClassifier(fmt.Errorf("read: %w", io.ErrUnexpectedEOF)))
+	assert.Equal(t, ErrorClassPermanent, DefaultErrorClassifier(&BootstrapError{Err: errors.New("invalid"), Phase: BootstrapPhaseValidation}))
+	assert.Equal(t, ErrorClassPermanent, DefaultErrorClassifier(fmt.Errorf("open: %w", os.ErrNotExist)))
+	assert.Equal(t, ErrorClassPermanent, DefaultErrorClassifier(context.Canceled))
+	assert.Equal(t, ErrorClassPermanent, DefaultErrorClassifier(&MaxTotalDeployBytesError{}))
+	assert.Equal(t, ErrorClassPermanent, DefaultErrorClassifier(fmt.Errorf("command 1: %w", ErrBinaryNotAllowed)))
+	assert.Equal(t, ErrorClassPermanent, DefaultErrorClassifier(fmt.Errorf("command 1: %w", ErrSourceNotAllowed)))
+	assert.Equal(t, ErrorClassUnknown, DefaultErrorClassifier(errors.New("command exited with code: 1")))
+}
+
+func TestExecuteWithRetryAttemptsExhausted(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{
+			testRunCommand("echo first"),
+			testRunCommand("echo flaky"),
+		},
+	}
+
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+	defer testServer.Stop()
+
+	commandRunner := &flakyCommandRunner{command: "echo flaky", failures: 2}
+	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithCommandRunner(commandRunner)
+
+	assert.NotNil(t, bootstrapper.ExecuteWithRetry(context.Background(), 2, time.Millisecond))
+
+	<-testServer.FinishedNotify()
+
+	// only the last attempt aborts the build:
+	assert.NotNil(t, testServer.Aborted())
+	assert.Equal(t, []string{"echo first", "echo flaky", "echo flaky"}, commandRunner.executed)
+}
+
+func TestProgressFile(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+	progressFile := filepath.Join(tempDir, "state", "progress.json")
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{
+			testRunCommand("echo first"),
+			testRunCommand("echo flaky"),
+		},
+	}
+
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+	defer testServer.Stop()
+
+	commandRunner := &flakyCommandRunner{command: "echo flaky", failures: 1}
+	assert.NotNil(t, NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithCommandRunner(commandRunner).
+		WithProgressFile(progressFile).
+		Execute())
+	<-testServer.FinishedNotify()
+	assert.NotNil(t, testServer.Aborted())
+
+	// a restarted bootstrap resumes after the last successful command:
+	resumedServer, resumedConfig := mustStartTestServer(t, logger, buildCtx)
+	defer resumedServer.Stop()
+
+	assert.Nil(t, NewDefaultBoostrapper(logger.Named("bootstrapper"), resumedConfig).
+		WithCommandRunner(commandRunner).
+		WithProgressFile(progressFile).
+		Execute())
+	<-resumedServer.FinishedNotify()
+	assert.Nil(t, resumedServer.Aborted())
+	// the completed command is skipped, only the failed command is executed again:
+	assert.Equal(t, []string{"echo first", "echo flaky", "echo flaky"}, commandRunner.executed)
+
+	progress, err := loadProgress(progressFile)
+	if err != nil {
+		t.Fatal("expected progress, got error", err)
+	}
+	assert.True(t, progress.isCompleted(0, "RUN echo first"))
+	assert.True(t, progress.isCompleted(1, "RUN echo flaky"))
+	// a changed command is executed again:
+	assert.False(t, progress.isCompleted(1, "RUN echo changed"))
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	configContents := []byte("config contents")
+	rootfs.MustPutTestResource(t, filepath.Join(tempDir, "context/app.conf"), configContents)
+
+	runs := filepath.Join(tempDir, "runs")
+	marker := filepath.Join(tempDir, "marker")
+	output := filepath.Join(tempDir, "output")
+	newRun := func(command string) commands.Run {
+		return commands.Run{
+			OriginalCommand: "RUN " + command,
+			Args:            map[string]string{},
+			Command:         command,
+			Env:             map[string]string{},
+			Shell: commands.Shell{
+				Commands: []string{"/bin/sh", "-c"},
+			},
+			User:    commands.DefaultUser(),
+			Workdir: commands.DefaultWorkdir(),
+		}
+	}
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{
+			newRun("echo run >> " + runs + " && echo VERSION=1.2.3"),
+			commands.Copy{
+				OriginalCommand: "COPY app.conf /etc/app.conf",
+				OriginalSource:  "app.conf",
+				Source:          "app.conf",
+				Target:          "/etc/app.conf",
+				User:            commands.DefaultUser(),
+				Workdir:         commands.Workdir{Value: tempDir},
+			},
+			// fails until the guest restarts:
+			newRun("[ -f " + marker + " ] || { touch " + marker + "; exit 1; }; echo $VERSION > " + output),
+		},
+		ResourcesResolved: rootfs.Resources{
+			"app.conf": []resources.ResolvedResource{
+				resources.NewResolvedFileResourceWithPath(func() (io.ReadCloser, error) {
+					return io.NopCloser(bytes.NewReader(configContents)), nil
+				},
+					fs.FileMode(0644),
+					"app.conf",
+					"/etc/app.conf",
+					commands.Workdir{Value: tempDir},
+					commands.DefaultUser(),
+					filepath.Join(tempDir, "context/app.conf")),
+			},
+		},
+	}
+
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+	defer testServer.Stop()
+
+	parseFacts := func(stdout string) (map[string]string, error) {
+		parts := strings.SplitN(strings.TrimSpace(stdout), "=", 2)
+		return map[string]string{parts[0]: parts[1]}, nil
+	}
+
+	suspended := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithCommandRunner(NewShellCommandRunner(logger.Named("shell-runner")).
+			WithCleanEnvironment(true).
+			WithFactCapture(0, parseFacts)).
+		WithResourceDeployer(NewExecutingResourceDeployer(logger.Named("executing-deployer")))
+	assert.NotNil(t, suspended.Execute())
+	<-testServer.FinishedNotify()
+
+	snapshot, err := suspended.Snapshot()
+	if err != nil {
+		t.Fatal("expected snapshot, got error", err)
+	}
+
+	// the bootstrapper of the restarted process does not capture the facts itself:
+	resumedServer, resumedConfig := mustStartTestServer(t, logger, buildCtx)
+	defer resumedServer.Stop()
+
+	resumed := NewDefaultBoostrapper(logger.Named("bootstrapper"), resumedConfig).
+		WithCommandRunner(NewShellCommandRunner(logger.Named("shell-runner")).
+			WithCleanEnvironment(true)).
+		WithResourceDeployer(NewExecutingResourceDeployer(logger.Named("executing-deployer")))
+	assert.Nil(t, resumed.RestoreFromSnapshot(snapshot))
+	assert.Nil(t, resumed.Execute())
+	<-resumedServer.FinishedNotify()
+	assert.Nil(t, resumedServer.Aborted())
+
+	// the completed commands are not executed again, the facts are restored:
+	runsContents, err := ioutil.ReadFile(runs)
+	assert.Nil(t, err)
+	assert.Equal(t, "run\n", string(runsContents))
+	outputContents, err := ioutil.ReadFile(output)
+	assert.Nil(t, err)
+	assert.Equal(t, "1.2.3\n", string(outputContents))
+	// the deployed files are part of the resumed manifest:
+	assert.NotEqual(t, "", resumed.DeployMerkleRoot())
+	assert.Equal(t, suspended.DeployMerkleRoot(), resumed.DeployMerkleRoot())
+
+	assert.NotNil(t, resumed.RestoreFromSnapshot([]byte(`{"Version":0}`)))
+	assert.NotNil(t, resumed.RestoreFromSnapshot([]byte("not json")))
+}
+
+func TestIsResumable(t *testing.T) {
+	runErr := &runCommandError{err: fmt.Errorf("command exited with code: 1")}
+	for _, tc := range []struct {
+		err       error
+		resumable bool
+	}{
+		{err: &BootstrapError{Err: EndpointFailures{fmt.Errorf("connection refused")}, Phase: BootstrapPhaseConnect}, resumable: true},
+		{err: &BootstrapError{Err: fmt.Errorf("not ready"), Phase: BootstrapPhaseReadiness}, resumable: true},
+		{err: &BootstrapError{Err: ErrResourceDeployTimeout, Phase: BootstrapPhaseCommands}, resumable: true},
+		{err: &BootstrapError{Err: runErr, Phase: BootstrapPhaseCommands}, resumable: false},
+		{err: &BootstrapError{Err: CommandFailures{ErrResourceDeployTimeout, runErr}, Phase: BootstrapPhaseCommands}, resumable: false},
+		{err: &BootstrapError{Err: os.ErrNotExist, Phase: BootstrapPhaseCommands}, resumable: false},
+		{err: &BootstrapError{Err: &MaxTotalDeployBytesError{Limit: 1}, Phase: BootstrapPhaseCommands}, resumable: false},
+		{err: &BootstrapError{Err: fmt.Errorf("expired"), Phase: BootstrapPhaseValidation}, resumable: false},
+		{err: &BootstrapError{Err: fmt.Errorf("failed"), Phase: BootstrapPhaseFinalize}, resumable: false},
+		{err: fmt.Errorf("not a bootstrap error"), resumable: false},
+	} {
+		assert.Equal(t, tc.resumable, IsResumable(tc.err), tc.err.Error())
+	}
+}
+
+func TestIsResumableBootstrap(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{
+			testRunCommand("echo flaky"),
+		},
+	}
+
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+	defer testServer.Stop()
+
+	bootstrapErr := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithCommandRunner(&flakyCommandRunner{command: "echo flaky", failures: 1}).
+		Execute()
+
+	<-testServer.FinishedNotify()
+
+	var typedErr *BootstrapError
+	if assert.True(t, errors.As(bootstrapErr, &typedErr)) {
+		assert.Equal(t, BootstrapPhaseCommands, typedErr.Phase)
+	}
+	assert.Equal(t, "flaky command failed", bootstrapErr.Error())
+	assert.False(t, IsResumable(bootstrapErr))
+
+	bootstrapConfig.HostPort = mustUnusedHostPort(t)
+	connectErr := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).Execute()
+	assert.True(t, IsResumable(connectErr))
+}
+
+// mustUnusedHostPort returns a local address nothing listens on.
+func mustUnusedHostPort(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("expected listener, got error", err)
+	}
+	hostPort := listener.Addr().String()
+	listener.Close()
+	return hostPort
+}
+
+// testResourceResolver resolves every request to a file with the contents.
+type testResourceResolver struct {
+	contents []byte
+	requests []ResourceRequest
+}
+
+func (r *testResourceResolver) Resolve(request ResourceRequest) ([]resources.ResolvedResource, error) {
+	r.requests = append(r.requests, request)
+	return []resources.ResolvedResource{
+		resources.NewResolvedFileResourceWithPath(func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(r.contents)), nil
+		},
+			fs.FileMode(0644),
+			filepath.Base(request.Target),
+			request.Target,
+			request.Workdir,
+			request.User,
+			request.Source),
+	}, nil
+}
+
+// recordingCommandRunner records the executed commands.
+type recordingCommandRunner struct {
+	executed []string
+}
+
+func (r *recordingCommandRunner) Execute(cmd commands.Run, grpcClient rootfs.ClientProvider) error {
+	r.executed = append(r.executed, cmd.Command)
+	return nil
+}
+
+// testRunCommand returns a RUN command executed with /bin/sh.
+func TestDeduplicateCommands(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	withEnv := testRunCommand("echo first")
+	withEnv.Env["KEY"] = "value"
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{
+			testRunCommand("echo first"),
+			testRunCommand("echo first"),
+			withEnv,
+			testRunCommand("echo second"),
+			testRunCommand("echo first"),
+		},
+	}
+
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+	defer testServer.Stop()
+
+	commandRunner := &flakyCommandRunner{}
+	assert.Nil(t, NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithCommandRunner(commandRunner).
+		WithDeduplicateCommands(true).
+		Execute())
+
+	// only the command identical to the immediately preceding command is skipped:
+	assert.Equal(t, []string{"echo first", "echo first", "echo second", "echo first"}, commandRunner.executed)
+}
+
+func TestRunLdconfig(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	newCopy := func(target string) commands.Copy {
+		return commands.Copy{
+			OriginalCommand: "COPY lib.so " + target,
+			OriginalSource:  "lib.so",
+			Source:          "lib.so",
+			Target:          target,
+			User:            commands.DefaultUser(),
+			Workdir:         commands.DefaultWorkdir(),
+		}
+	}
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{
+			testRunCommand("echo first"),
+			newCopy("/usr/lib/lib1.so"),
+			newCopy("/usr/lib/lib2.so"),
+			testRunCommand("echo second"),
+			testRunCommand("echo third"),
+			newCopy("/usr/lib/lib3.so"),
+		},
+	}
+
+	t.Run("installed", func(t *testing.T) {
+		testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+		defer testServer.Stop()
+
+		commandRunner := &flakyCommandRunner{}
+		bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+			WithCommandRunner(commandRunner).
+			WithRunLdconfig(true)
+		bootstrapper.(*defaultBootstrapper).lookupLdconfig = func() (string, error) {
+			return "/sbin/ldconfig", nil
+		}
+		assert.Nil(t, bootstrapper.Execute())
+
+		// the cache is refreshed once for consecutive resource commands and after the last command:
+		assert.Equal(t, []string{"echo first", "/sbin/ldconfig", "echo second", "echo third", "/sbin/ldconfig"}, commandRunner.executed)
+	})
+
+	t.Run("failing", func(t *testing.T) {
+		testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+		defer testServer.Stop()
+
+		commandRunner := &flakyCommandRunner{command: "/sbin/ldconfig", failures: 1}
+		bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+			WithCommandRunner(commandRunner).
+			WithRunLdconfig(true)
+		bootstrapper.(*defaultBootstrapper).lookupLdconfig = func() (string, error) {
+			return "/sbin/ldconfig", nil
+		}
+		assert.NotNil(t, bootstrapper.Execute())
+
+		// the command following the failed refresh is not executed:
+		assert.Equal(t, []string{"echo first", "/sbin/ldconfig"}, commandRunner.executed)
+	})
+
+	t.Run("not installed", func(t *testing.T) {
+		testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+		defer testServer.Stop()
+
+		commandRunner := &flakyCommandRunner{}
+		bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+			WithCommandRunner(commandRunner).
+			WithRunLdconfig(true)
+		bootstrapper.(*defaultBootstrapper).lookupLdconfig = func() (string, error) {
+			return "", fmt.Errorf("ldconfig not found")
+		}
+		assert.Nil(t, bootstrapper.Execute())
+
+		assert.Equal(t, []string{"echo first", "echo second", "echo third"}, commandRunner.executed)
+	})
+}
+
+func TestPostResourceCommand(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	newCopy := func(source string) commands.Copy {
+		return commands.Copy{
+			OriginalCommand: "COPY " + source + " /etc/nginx/",
+			OriginalSource:  source,
+			Source:          source,
+			Target:          "/etc/nginx/",
+			User:            commands.DefaultUser(),
+			Workdir:         commands.DefaultWorkdir(),
+		}
+	}
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{
+			newCopy("nginx.conf"),
+			newCopy("lib.so"),
+			newCopy("conf/site.conf"),
+			testRunCommand("echo done"),
+		},
+	}
+
+	t.Run("verified", func(t *testing.T) {
+		testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+		defer testServer.Stop()
+
+		commandRunner := &flakyCommandRunner{}
+		assert.Nil(t, NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+			WithCommandRunner(commandRunner).
+			WithPostResourceCommand("*.conf", testRunCommand("nginx -t")).
+			WithPostResourceCommand("conf/*", testRunCommand("check site")).
+			Execute())
+
+		assert.Equal(t, []string{"nginx -t", "nginx -t", "check site", "echo done"}, commandRunner.executed)
+	})
+
+	t.Run("failing", func(t *testing.T) {
+		testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+		defer testServer.Stop()
+
+		commandRunner := &flakyCommandRunner{command: "nginx -t", failures: 1}
+		assert.NotNil(t, NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+			WithCommandRunner(commandRunner).
+			WithPostResourceCommand("*.conf", testRunCommand("nginx -t")).
+			Execute())
+
+		// the command following the failed verification is not executed:
+		assert.Equal(t, []string{"nginx -t"}, commandRunner.executed)
+	})
+
+	t.Run("invalid glob", func(t *testing.T) {
+		testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+		defer testServer.Stop()
+
+		commandRunner := &flakyCommandRunner{}
+		assert.NotNil(t, NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+			WithCommandRunner(commandRunner).
+			WithPostResourceCommand("[", testRunCommand("nginx -t")).
+			Execute())
+		assert.Equal(t, 0, len(commandRunner.executed))
+	})
+}
+
+func TestScriptedCommandRunner(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{
+			testRunCommand("echo first"),
+			testRunCommand("echo flaky"),
+			testRunCommand("echo failing"),
+			testRunCommand("echo last"),
+		},
+	}
+
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+	defer testServer.Stop()
+
+	commandRunner := NewScriptedCommandRunner(map[int]ScriptedResult{
+		0: {Stdout: []string{"first"}},
+		1: {Delay: time.Hour, ExitCode: 1, SucceedAfter: 1},
+		2: {ExitCode: 2, Stderr: []string{"failing"}},
+	})
+
+	// the delay is measured by the clock of the bootstrapper:
+	start := time.Now()
+	fake := clock.NewFake(start)
+	bootstrapErr := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithClock(fake).
+		WithCommandRunner(commandRunner).
+		WithFailFastThreshold(3).
+		Execute()
+	assert.NotNil(t, bootstrapErr)
+
+	<-testServer.FinishedNotify()
+
+	// the flaky command fails once, the failing command fails every time:
+	var failures CommandFailures
+	if assert.True(t, errors.As(bootstrapErr, &failures)) {
+		assert.Equal(t, 2, len(failures))
+	}
+	assert.Equal(t, []int{0, 1, 2, 3}, commandRunner.Executed())
+	assert.False(t, fake.Now().Before(start.Add(time.Hour)))
+	assert.True(t, time.Since(start) < time.Second*5)
+	assert.Equal(t, []string{"first"}, testServer.ReceivedStdout())
+	assert.Equal(t, []string{"failing"}, testServer.ReceivedStderr())
+
+	assert.Nil(t, commandRunner.ExecuteIndexed(1, testRunCommand("echo flaky"), &outputRecordingClient{}))
+	assert.NotNil(t, commandRunner.ExecuteIndexed(2, testRunCommand("echo failing"), &outputRecordingClient{}))
+}
+
+func TestEnvPrefix(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	t.Setenv("FIREBUILD_TEST_VERSION", "1.2.3")
+	t.Setenv("FIREBUILD_TEST_OVERRIDDEN", "from-environment")
+
+	command := testRunCommand("echo version")
+	command.Env["OVERRIDDEN"] = "from-command"
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{command},
+	}
+
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+	defer testServer.Stop()
+
+	commandRunner := &envRecordingCommandRunner{}
+	assert.Nil(t, NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithCommandRunner(commandRunner).
+		WithEnvPrefix("FIREBUILD_TEST_", true).
+		Execute())
+
+	if assert.Equal(t, 1, len(commandRunner.env)) {
+		assert.Equal(t, "1.2.3", commandRunner.env[0]["VERSION"])
+		// the environment of the command takes precedence:
+		assert.Equal(t, "from-command", commandRunner.env[0]["OVERRIDDEN"])
+	}
+
+	kept := (&envPrefix{prefix: "BUILD_"}).environment([]string{"BUILD_VERSION=1", "BUILD_=skipped", "OTHER=2", "BUILD_EMPTY="})
+	assert.Equal(t, map[string]string{"BUILD_VERSION": "1", "BUILD_": "skipped", "BUILD_EMPTY": ""}, kept)
+	stripped := (&envPrefix{prefix: "BUILD_", strip: true}).environment([]string{"BUILD_VERSION=1", "BUILD_=skipped"})
+	assert.Equal(t, map[string]string{"VERSION": "1"}, stripped)
+	assert.Equal(t, map[string]string{}, (&envPrefix{}).environment([]string{"OTHER=2"}))
+}
+
+// envRecordingCommandRunner records the environment of the executed commands.
+type envRecordingCommandRunner struct {
+	env []map[string]string
+}
+
+func (r *envRecordingCommandRunner) Execute(cmd commands.Run, grpcClient rootfs.ClientProvider) error {
+	r.env = append(r.env, cmd.Env)
+	return nil
+}
+
+func testRunCommand(command string) commands.Run {
+	return commands.Run{
+		OriginalCommand: "RUN " + command,
+		Args:            map[string]string{},
+		Command:         command,
+		Env:             map[string]string{},
+		Shell: commands.Shell{
+			Commands: []string{"/bin/sh", "-c"},
+		},
+		User:    commands.DefaultUser(),
+		Workdir: commands.DefaultWorkdir(),
+	}
+}
+
+// flakyCommandRunner fails the command the configured number of times.
+type flakyCommandRunner struct {
+	command  string
+	executed []string
+	failures int
+}
+
+func (r *flakyCommandRunner) Execute(cmd commands.Run, grpcClient rootfs.ClientProvider) error {
+	r.executed = append(r.executed, cmd.Command)
+	if cmd.Command == r.command && r.failures > 0 {
+		r.failures = r.failures - 1
+		return fmt.Errorf("flaky command failed")
+	}
+	return nil
+}
+
+// probeFailingCommandRunner fails the readiness probe the configured number of times.
+type probeFailingCommandRunner struct {
+	attempts int
+	failures int
+}
+
+func (r *probeFailingCommandRunner) Execute(cmd commands.Run, grpcClient rootfs.ClientProvider) error {
+	return r.ExecuteIndexed(0, cmd, grpcClient)
+}
+
+func (r *probeFailingCommandRunner) ExecuteIndexed(index int, cmd commands.Run, grpcClient rootfs.ClientProvider) error {
+	if index != ReadinessProbeCommandIndex {
+		return nil
+	}
+	r.attempts = r.attempts + 1
+	if r.attempts <= r.failures {
+		return fmt.Errorf("not ready")
+	}
+	return nil
+}
+
+// buildMetadataClient provides the build metadata of the work context.
+type buildMetadataClient struct {
+	rootfs.ClientProvider
+	metadata map[string]string
+}
+
+func (c *buildMetadataClient) BuildMetadata() map[string]string {
+	return c.metadata
+}
+
+// resettingStreamClient fails the work context fetch as if the server reset the stream.
+type resettingStreamClient struct {
+	rootfs.ClientProvider
+	counters *streamCounters
+	failures int
+}
+
+func (c *resettingStreamClient) Close() error {
+	c.counters.closed = c.counters.closed + 1
+	return nil
+}
+
+func (c *resettingStreamClient) Commands() error {
+	c.counters.fetches = c.counters.fetches + 1
+	if c.counters.fetches <= c.failures {
+		return fmt.Errorf("rpc error: code = Internal desc = stream terminated by RST_STREAM with error code: INTERNAL_ERROR")
+	}
+	return c.ClientProvider.Commands()
+}
+
+// streamCounters counts the connections and the work context fetches of the bootstrapper clients.
+type streamCounters struct {
+	closed  int
+	dials   int
+	fetches int
+}
+
+// withResettingStream configures the bootstrapper clients to fail the first failures fetches
+// and returns the counters of the clients.
+func withResettingStream(bootstrapper Bootstrapper, failures int) *streamCounters {
+	counters := &streamCounters{}
+	bootstrapper.(*defaultBootstrapper).newClient = func(logger hclog.Logger, cfg *rootfs.GRPCClientConfig) (rootfs.ClientProvider, error) {
+		client, err := rootfs.NewClient(logger, cfg)
+		if err != nil {
+			return nil, err
+		}
+		counters.dials = counters.dials + 1
+		return &resettingStreamClient{ClientProvider: client, counters: counters, failures: failures}, nil
+	}
+	return counters
+}
+
+// mustStartTestServer starts a test GRPC server serving the work context
+// and returns the server together with the bootstrap data required to connect to it.
+func mustStartTestServer(t *testing.T, logger hclog.Logger, buildCtx *rootfs.WorkContext) (rootfs.TestServer, *mmds.MMDSBootstrap) {
+
+	testServerAppName := "test-server-app"
+
+	// construct an embedded CA to manually handle TLS configs:
+	embeddedCAConfig := &ca.EmbeddedCAConfig{
+		Addresses:     []string{testServerAppName},
+		CertsValidFor: time.Hour,
+		KeySize:       1024,
+	}
+
+	embeddedCA, err := ca.NewDefaultEmbeddedCAWithLogger(embeddedCAConfig, logger.Named("embedded-ca"))
+	if err != nil {
+		t.Fatal("failed constructing embedded CA", err)
+	}
+
+	serverTLSConfig, err := embeddedCA.NewServerCertTLSConfig()
+	if err != nil {
+		t.Fatal("failed creating test server TLS config", err)
+	}
+
+	grpcConfig := &rootfs.GRPCServiceConfig{
+		ServerName:      testServerAppName,
+		BindHostPort:    "127.0.0.1:0",
+		TLSConfigServer: serverTLSConfig,
+	}
+
+	testServer := rootfs.NewTestServer(t, logger.Named("grpc-server"), grpcConfig, buildCtx)
+	testServer.Start()
+	select {
+	case startErr := <-testServer.FailedNotify():
+		t.Fatal("expected the GRPC server to start but it failed", startErr)
+	case <-testServer.ReadyNotify():
+		t.Log("GRPC server started and serving on", grpcConfig.BindHostPort)
+	}
+
+	bootstrapConfig, err := mmds.NewBootstrapFromCA(embeddedCA, grpcConfig.BindHostPort, testServerAppName)
+	if err != nil {
+		t.Fatal("failed creating test bootstrap config", err)
+	}
+
+	return testServer, bootstrapConfig
+}
+
+const testDockerfileMultiStage = `FROM alpine:3.13 as builder
+
+FROM alpine:3.13
+ARG PARAM1=value
+ENV ENVPARAM1=envparam1
+RUN mkdir -p /dir
+ADD resource1 /target/resource1
+COPY resource2 /target/resource2
+COPY --from=builder /etc/test /etc/test
+RUN cp /dir/${ENVPARAM1} \
+	&& call --arg=${PARAM1}`
+
+func TestAuditSink(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{
+			commands.Run{
+				OriginalCommand: "RUN --mount=type=secret,id=token true",
+				Args:            map[string]string{},
+				Command:         "true",
+				Env:             map[string]string{},
+				Shell: commands.Shell{
+					Commands: []string{"/bin/sh", "-c", "true"},
+				},
+				User:    commands.User{Value: "nobody"},
+				Workdir: commands.DefaultWorkdir(),
+			},
+		},
+	}
+
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+	sink := &recordingAuditSink{}
+	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithAuditSink(sink).
+		WithCommandRunner(NewShellCommandRunner(logger.Named("shell-runner")).
+			WithSecretsDir(filepath.Join(tempDir, "secrets")).
+			WithSecret("token", []byte("secret-value")))
+
+	assert.Nil(t, bootstrapper.Execute())
+
+	<-testServer.FinishedNotify()
+
+	if assert.Equal(t, 2, len(sink.records)) {
+		assert.Equal(t, AuditCommandExecuted, sink.records[0].Action)
+		assert.Equal(t, "nobody", sink.records[0].User)
+		assert.Equal(t, 0, *sink.records[0].Index)
+		assert.Equal(t, AuditSecretsMounted, sink.records[1].Action)
+		assert.Equal(t, "token", sink.records[1].Details["secret-ids"])
+		assert.Equal(t, 0, *sink.records[1].Index)
+	}
+	for _, record := range sink.records {
+		assert.False(t, record.Time.IsZero())
+		for _, v := range record.Details {
+			assert.NotContains(t, v, "secret-value")
+		}
+	}
+}
+
+func TestSensitiveEnvKeys(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	run := testRunCommand("login --token s3cr3t-token")
+	run.Env["TOKEN"] = "s3cr3t-token"
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{run},
+	}
+
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+	defer testServer.Stop()
+
+	eventLog := &bytes.Buffer{}
+	sink := &recordingAuditSink{}
+	bootstrapErr := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithAuditSink(sink).
+		WithCommandRunner(&leakingCommandRunner{}).
+		WithDiagnosticsDir(tempDir).
+		WithEventLog(eventLog).
+		WithSensitiveEnvKeys([]string{"TOKEN"}).
+		Execute()
+
+	assert.NotNil(t, bootstrapErr)
+	assert.True(t, errors.Is(bootstrapErr, errLeakingCommand))
+	assert.NotContains(t, bootstrapErr.Error(), "s3cr3t-token")
+	assert.Contains(t, bootstrapErr.Error(), "login --token ***")
+
+	assert.NotContains(t, eventLog.String(), "s3cr3t-token")
+	assert.Contains(t, eventLog.String(), "login --token ***")
+	if assert.Equal(t, 1, len(sink.records)) {
+		assert.Equal(t, "RUN login --token ***", sink.records[0].Command)
+	}
+
+	diagnosticsFiles, err := filepath.Glob(filepath.Join(tempDir, "*.diagnostics.json"))
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(diagnosticsFiles)) {
+		diagnostics, err := ioutil.ReadFile(diagnosticsFiles[0])
+		assert.Nil(t, err)
+		assert.NotContains(t, string(diagnostics), "s3cr3t-token")
+	}
+}
+
+// errLeakingCommand is the error of the leaking command runner.
+var errLeakingCommand = errors.New("login failed")
+
+// leakingCommandRunner fails every command with an error containing the command and its environment.
+type leakingCommandRunner struct{}
+
+func (r *leakingCommandRunner) Execute(cmd commands.Run, grpcClient rootfs.ClientProvider) error {
+	return fmt.Errorf("command %q with token %q: %w", cmd.Command, cmd.Env["TOKEN"], errLeakingCommand)
+}
+
+// recordingAuditSink records the audit records.
+type recordingAuditSink struct {
+	records []AuditRecord
+}
+
+func (s *recordingAuditSink) Audit(record AuditRecord) error {
+	s.records = append(s.records, record)
+	return nil
+}
@@ -0,0 +1,49 @@
+package bootstrap
+
+import (
+	"sort"
+
+	"github.com/combust-labs/firebuild-shared/build/rootfs"
+)
+
+// BuildMetadataProvider is a client of a server attaching the build metadata to the work context,
+// for example the build id, the source image and the build timestamp.
+type BuildMetadataProvider interface {
+	BuildMetadata() map[string]string
+}
+
+// BuildMetadata returns the build metadata attached by the server to the work context
+// fetched by the last execution. Empty when the client does not provide the build metadata.
+func (b *defaultBootstrapper) BuildMetadata() map[string]string {
+	output := map[string]string{}
+	for k, v := range b.buildMetadata {
+		output[k] = v
+	}
+	return output
+}
+
+// captureBuildMetadata records the build metadata of the fetched work context
+// so the bootstrap can be correlated with the build record of the server.
+func (b *defaultBootstrapper) captureBuildMetadata(client rootfs.ClientProvider) {
+	b.buildMetadata = map[string]string{}
+	provider, ok := client.(BuildMetadataProvider)
+	if !ok {
+		return
+	}
+	for k, v := range provider.BuildMetadata() {
+		b.buildMetadata[k] = v
+	}
+	if len(b.buildMetadata) == 0 {
+		return
+	}
+	keys := []string{}
+	for k := range b.buildMetadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	logValues := []interface{}{}
+	for _, k := range keys {
+		logValues = append(logValues, k, b.buildMetadata[k])
+	}
+	b.logger.Info("build metadata received", logValues...)
+}
@@ -0,0 +1,89 @@
+package bootstrap
+
+import (
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// capabilityNumbers maps the Linux capability names, without the CAP_ prefix, to their numbers.
+var capabilityNumbers = map[string]uint{
+	"audit_control":      30,
+	"audit_read":         37,
+	"audit_write":        29,
+	"block_suspend":      36,
+	"bpf":                39,
+	"checkpoint_restore": 40,
+	"chown":              0,
+	"dac_override":       1,
+	"dac_read_search":    2,
+	"fowner":             3,
+	"fsetid":             4,
+	"ipc_lock":           14,
+	"ipc_owner":          15,
+	"kill":               5,
+	"lease":              28,
+	"linux_immutable":    9,
+	"mac_admin":          33,
+	"mac_override":       32,
+	"mknod":              27,
+	"net_admin":          12,
+	"net_bind_service":   10,
+	"net_broadcast":      11,
+	"net_raw":            13,
+	"perfmon":            38,
+	"setfcap":            31,
+	"setgid":             6,
+	"setpcap":            8,
+	"setuid":             7,
+	"sys_admin":          21,
+	"sys_boot":           22,
+	"sys_chroot":         18,
+	"sys_module":         16,
+	"sys_nice":           23,
+	"sys_pacct":          20,
+	"sys_ptrace":         19,
+	"sys_rawio":          17,
+	"sys_resource":       24,
+	"sys_time":           25,
+	"sys_tty_config":     26,
+	"syslog":             34,
+	"wake_alarm":         35,
+}
+
+// parseCapabilities returns the capability numbers for the names, for example CAP_NET_BIND_SERVICE
+// or net_bind_service. The names are case insensitive.
+func parseCapabilities(names []string) ([]uint, error) {
+	caps := []uint{}
+	for _, name := range names {
+		normalized := strings.TrimPrefix(strings.ToLower(strings.TrimSpace(name)), "cap_")
+		number, ok := capabilityNumbers[normalized]
+		if !ok {
+			return nil, errors.Errorf("unknown capability '%s'", name)
+		}
+		caps = append(caps, number)
+	}
+	sort.Slice(caps, func(i, j int) bool { return caps[i] < caps[j] })
+	return caps, nil
+}
+
+// startWithCapabilities starts the command with only the capabilities configured for the command index.
+// A command without configured capabilities is started with the capabilities of the runner.
+func (n *shellCommandRunner) startWithCapabilities(index int, cmd *exec.Cmd) error {
+	names, ok := n.commandCapabilities[index]
+	if !ok {
+		return n.netns.start(cmd)
+	}
+	caps, err := parseCapabilities(names)
+	if err != nil {
+		return errors.Wrapf(err, "failed restricting capabilities of command %d", index)
+	}
+	if err := startRestricted(cmd, caps, n.netns.enter); err != nil {
+		return errors.Wrapf(err, "failed starting command %d with capabilities %v", index, names)
+	}
+	n.logger.Debug("command started with restricted capabilities", "index", index, "capabilities", names)
+	n.audit(index, AuditRecord{Action: AuditCapabilitiesRestricted, Details: map[string]string{"capabilities": strings.Join(names, ",")}})
+	return nil
+}
@@ -0,0 +1,105 @@
+package bootstrap
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	linuxCapabilityVersion3 = 0x20080522
+	prCapbsetDrop           = 24
+	// lastCapabilityFallback is used when the kernel does not report the last supported capability:
+	lastCapabilityFallback = 40
+)
+
+type capHeader struct {
+	version uint32
+	pid     int32
+}
+
+type capData struct {
+	effective   uint32
+	permitted   uint32
+	inheritable uint32
+}
+
+// startRestricted starts the command from a dedicated OS thread with all capabilities except the given ones
+// dropped from the bounding, effective, permitted and inheritable sets. The capabilities are per thread on Linux
+// and the command inherits the capabilities of the thread it is forked from. The thread enters the network
+// namespace of the command before the capabilities are dropped, entering a namespace requires CAP_SYS_ADMIN.
+// The thread is never unlocked, the Go runtime terminates it when the goroutine exits so no other goroutine
+// runs with the dropped capabilities or in the network namespace of the command.
+func startRestricted(cmd *exec.Cmd, caps []uint, enter func() error) error {
+	result := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		if err := enter(); err != nil {
+			result <- err
+			return
+		}
+		if err := dropCapabilities(caps); err != nil {
+			result <- err
+			return
+		}
+		result <- cmd.Start()
+	}()
+	return <-result
+}
+
+func dropCapabilities(caps []uint) error {
+	keep := map[uint]bool{}
+	for _, capability := range caps {
+		keep[capability] = true
+	}
+
+	lastCapability := readLastCapability()
+	// dropping from the bounding set requires CAP_SETPCAP, the bounding set is dropped first:
+	for capability := uint(0); capability <= lastCapability; capability++ {
+		if keep[capability] {
+			continue
+		}
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prCapbsetDrop, uintptr(capability), 0); errno != 0 {
+			return errors.Wrapf(errno, "failed dropping capability %d from the bounding set", capability)
+		}
+	}
+
+	header := capHeader{version: linuxCapabilityVersion3}
+	data := [2]capData{}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPGET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return errors.Wrap(errno, "failed reading capabilities")
+	}
+	restricted := [2]capData{}
+	for _, capability := range caps {
+		word, bit := capability/32, uint32(1)<<(capability%32)
+		// a capability the runner does not have cannot be granted:
+		if data[word].permitted&bit == 0 {
+			return errors.Errorf("capability %d is not permitted to the runner", capability)
+		}
+		restricted[word].effective |= data[word].effective & bit
+		restricted[word].permitted |= bit
+		restricted[word].inheritable |= bit
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&restricted[0])), 0); errno != 0 {
+		return errors.Wrap(errno, "failed setting capabilities")
+	}
+	return nil
+}
+
+func readLastCapability() uint {
+	contents, err := ioutil.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if err != nil {
+		return lastCapabilityFallback
+	}
+	lastCapability, err := strconv.ParseUint(strings.TrimSpace(string(contents)), 10, 32)
+	if err != nil {
+		return lastCapabilityFallback
+	}
+	return uint(lastCapability)
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package bootstrap
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+func startRestricted(cmd *exec.Cmd, caps []uint, enter func() error) error {
+	return fmt.Errorf("restricting capabilities is supported on Linux only")
+}
@@ -0,0 +1,31 @@
+package bootstrap
+
+import (
+	"github.com/hashicorp/go-hclog"
+)
+
+// DefaultCgroupRoot is the default cgroup v2 hierarchy mount point.
+const DefaultCgroupRoot = "/sys/fs/cgroup"
+
+// CgroupLimits defines the resource limits applied to every RUN command.
+type CgroupLimits struct {
+	// MemoryMaxBytes is the maximum memory available to a command, 0 means no limit.
+	MemoryMaxBytes int64
+	// CPUQuota is the number of CPUs available to a command, for example 0.5, 0 means no limit.
+	CPUQuota float64
+	// Root is the cgroup v2 hierarchy mount point, DefaultCgroupRoot when empty.
+	Root string
+}
+
+// NewCgroupLimitedCommandRunner returns a shell command runner placing every command
+// in a dedicated cgroup v2 with the configured limits. Managing cgroups requires
+// privileges, when the cgroup cannot be created, the command is executed
+// without limits and a warning is logged.
+func NewCgroupLimitedCommandRunner(limits CgroupLimits, logger hclog.Logger) ShellCommandRunner {
+	if limits.Root == "" {
+		limits.Root = DefaultCgroupRoot
+	}
+	runner := NewShellCommandRunner(logger).(*shellCommandRunner)
+	runner.cgroupLimits = &limits
+	return runner
+}
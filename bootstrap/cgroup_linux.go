@@ -0,0 +1,110 @@
+package bootstrap
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	cgroupParentName = "firebuild-vminit"
+	cgroupCPUPeriod  = 100000
+)
+
+type commandCgroup struct {
+	dir    *os.File
+	limits CgroupLimits
+	path   string
+}
+
+func newCommandCgroup(limits CgroupLimits, index int) (*commandCgroup, error) {
+	parent := filepath.Join(limits.Root, cgroupParentName)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return nil, errors.Wrap(err, "failed creating parent cgroup")
+	}
+	// controllers must be enabled for the children of every level:
+	for _, level := range []string{limits.Root, parent} {
+		if err := ioutil.WriteFile(filepath.Join(level, "cgroup.subtree_control"), []byte("+memory +cpu"), 0644); err != nil {
+			return nil, errors.Wrapf(err, "failed enabling cgroup controllers in '%s'", level)
+		}
+	}
+	path := filepath.Join(parent, fmt.Sprintf("cmd-%d-%d", index, os.Getpid()))
+	if err := os.Mkdir(path, 0755); err != nil && !os.IsExist(err) {
+		return nil, errors.Wrap(err, "failed creating command cgroup")
+	}
+	cgroup := &commandCgroup{limits: limits, path: path}
+	if limits.MemoryMaxBytes > 0 {
+		if err := cgroup.write("memory.max", strconv.FormatInt(limits.MemoryMaxBytes, 10)); err != nil {
+			cgroup.Close()
+			return nil, err
+		}
+	}
+	if limits.CPUQuota > 0 {
+		quota := int64(limits.CPUQuota * cgroupCPUPeriod)
+		if err := cgroup.write("cpu.max", fmt.Sprintf("%d %d", quota, cgroupCPUPeriod)); err != nil {
+			cgroup.Close()
+			return nil, err
+		}
+	}
+	dir, err := os.Open(path)
+	if err != nil {
+		cgroup.Close()
+		return nil, errors.Wrap(err, "failed opening command cgroup")
+	}
+	cgroup.dir = dir
+	return cgroup, nil
+}
+
+// apply configures the command to start directly in the cgroup.
+func (c *commandCgroup) apply(cmd *exec.Cmd) {
+	if c == nil {
+		return
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(c.dir.Fd())
+}
+
+// oomKilled reports if any process in the cgroup was killed by the OOM killer.
+func (c *commandCgroup) oomKilled() bool {
+	if c == nil {
+		return false
+	}
+	data, err := ioutil.ReadFile(filepath.Join(c.path, "memory.events"))
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "oom_kill" && fields[1] != "0" {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *commandCgroup) Close() error {
+	if c == nil {
+		return nil
+	}
+	if c.dir != nil {
+		c.dir.Close()
+	}
+	return os.Remove(c.path)
+}
+
+func (c *commandCgroup) write(file, value string) error {
+	if err := ioutil.WriteFile(filepath.Join(c.path, file), []byte(value), 0644); err != nil {
+		return errors.Wrapf(err, "failed writing cgroup '%s'", file)
+	}
+	return nil
+}
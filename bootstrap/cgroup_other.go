@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package bootstrap
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+type commandCgroup struct{}
+
+func newCommandCgroup(limits CgroupLimits, index int) (*commandCgroup, error) {
+	return nil, fmt.Errorf("cgroups are supported on Linux only")
+}
+
+func (c *commandCgroup) apply(cmd *exec.Cmd) {}
+
+func (c *commandCgroup) oomKilled() bool { return false }
+
+func (c *commandCgroup) Close() error { return nil }
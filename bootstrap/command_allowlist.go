@@ -0,0 +1,119 @@
+package bootstrap
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/combust-labs/firebuild-shared/env"
+	"github.com/pkg/errors"
+)
+
+// ErrBinaryNotAllowed is returned when the executable of a RUN command is not in the binary allowlist.
+var ErrBinaryNotAllowed = errors.New("command executable not in the binary allowlist")
+
+// commandExecutable returns the first token of the command executed by the shell,
+// skipping the leading variable assignments, for example FOO=bar in FOO=bar make.
+func commandExecutable(command string) string {
+	for _, field := range strings.Fields(command) {
+		if name := strings.SplitN(field, "=", 2)[0]; strings.Contains(field, "=") && isEnvName(name) {
+			continue
+		}
+		return field
+	}
+	return ""
+}
+
+// isEnvName returns true if the input is a valid shell variable name.
+func isEnvName(input string) bool {
+	if input == "" {
+		return false
+	}
+	for i, r := range input {
+		if r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (i > 0 && r >= '0' && r <= '9') {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// commandPathEnv returns the PATH the command is executed with,
+// a PATH in the environment of the command takes precedence.
+func commandPathEnv(baseEnv []string, cmdEnv env.BuildEnv) string {
+	if value, ok := cmdEnv.Snapshot()["PATH"]; ok {
+		return value
+	}
+	path := ""
+	for _, item := range baseEnv {
+		if strings.HasPrefix(item, "PATH=") {
+			path = strings.TrimPrefix(item, "PATH=")
+		}
+	}
+	return path
+}
+
+// resolveExecutable resolves the executable like the shell, a name with a slash
+// is relative to the workdir, other names are looked up in the path.
+func resolveExecutable(name, path, workdir string) (string, error) {
+	isExecutable := func(candidate string) bool {
+		info, err := os.Stat(candidate)
+		return err == nil && info.Mode().IsRegular() && info.Mode().Perm()&0111 != 0
+	}
+	if strings.Contains(name, "/") {
+		candidate := name
+		if !filepath.IsAbs(candidate) {
+			candidate = filepath.Join(workdir, candidate)
+		}
+		if isExecutable(candidate) {
+			return filepath.Clean(candidate), nil
+		}
+		return "", errors.Errorf("executable '%s' not found", name)
+	}
+	for _, dir := range filepath.SplitList(path) {
+		if dir == "" {
+			dir = "."
+		}
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(workdir, dir)
+		}
+		if candidate := filepath.Join(dir, name); isExecutable(candidate) {
+			return candidate, nil
+		}
+	}
+	return "", errors.Errorf("executable '%s' not found in PATH '%s'", name, path)
+}
+
+// checkBinaryAllowlist fails with ErrBinaryNotAllowed when the resolved executable
+// of the expanded command is not in the binary allowlist. The allowlisted paths and the executable
+// are compared with the symlinks evaluated.
+func (n *shellCommandRunner) checkBinaryAllowlist(index int, command, workdir string, cmdEnv env.BuildEnv) error {
+	if n.binaryAllowlist == nil {
+		return nil
+	}
+	name := commandExecutable(command)
+	if name == "" {
+		return nil // an empty command does not execute anything
+	}
+	resolved, err := resolveExecutable(name, commandPathEnv(n.baseEnvironment(), cmdEnv), workdir)
+	if err != nil {
+		return errors.Wrapf(ErrBinaryNotAllowed, "command %d: %s", index, err)
+	}
+	allowed := map[string]struct{}{}
+	for _, path := range n.binaryAllowlist {
+		allowed[filepath.Clean(path)] = struct{}{}
+		if evaluated, err := filepath.EvalSymlinks(path); err == nil {
+			allowed[evaluated] = struct{}{}
+		}
+	}
+	candidates := []string{resolved}
+	if evaluated, err := filepath.EvalSymlinks(resolved); err == nil {
+		candidates = append(candidates, evaluated)
+	}
+	for _, candidate := range candidates {
+		if _, ok := allowed[candidate]; ok {
+			return nil
+		}
+	}
+	return errors.Wrapf(ErrBinaryNotAllowed, "command %d: executable '%s' resolved to '%s'", index, name, resolved)
+}
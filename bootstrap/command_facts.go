@@ -0,0 +1,46 @@
+package bootstrap
+
+import (
+	"bytes"
+	"io"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// FactParser parses the stdout of a command into facts.
+type FactParser func(stdout string) (map[string]string, error)
+
+// captureFacts returns the stdout writer also capturing the stdout of the command
+// and the captured stdout, nil when the facts of the command are not captured.
+func (n *shellCommandRunner) captureFacts(index int, stdout io.Writer) (io.Writer, *bytes.Buffer) {
+	if _, ok := n.factParsers[index]; !ok {
+		return stdout, nil
+	}
+	captured := &bytes.Buffer{}
+	return io.MultiWriter(stdout, captured), captured
+}
+
+// recordFacts parses the captured stdout of the successful command into the facts
+// injected into the environment of the subsequent commands.
+func (n *shellCommandRunner) recordFacts(index int, captured *bytes.Buffer) error {
+	if captured == nil {
+		return nil
+	}
+	facts, err := n.factParsers[index](captured.String())
+	if err != nil {
+		n.logger.Error("failed parsing command facts", "index", index, "reason", err)
+		return errors.Wrapf(err, "failed parsing the facts of command %d", index)
+	}
+	if n.facts == nil {
+		n.facts = map[string]string{}
+	}
+	names := []string{}
+	for k, v := range facts {
+		n.facts[k] = v
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	n.logger.Info("command facts captured", "index", index, "facts", names)
+	return nil
+}
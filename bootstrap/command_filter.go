@@ -0,0 +1,76 @@
+package bootstrap
+
+import (
+	"strings"
+
+	"github.com/combust-labs/firebuild-shared/build/commands"
+)
+
+// TagsArg is the name of the build argument used to tag a RUN command
+// with a comma separated list of tags, for example provision,debug.
+// ADD and COPY commands are untagged.
+const TagsArg = "FIREBUILD_TAGS"
+
+// CommandFilterCatchAll is the exclude filter tag matching the untagged commands
+// and the tagged commands not explicitly included.
+const CommandFilterCatchAll = "*"
+
+// commandFilter selects the commands to execute by their tags.
+// A nil filter selects all commands.
+type commandFilter struct {
+	exclude map[string]struct{}
+	include map[string]struct{}
+}
+
+func newCommandFilter(include, exclude []string) *commandFilter {
+	filter := &commandFilter{
+		exclude: map[string]struct{}{},
+		include: map[string]struct{}{},
+	}
+	for _, tag := range include {
+		filter.include[strings.TrimSpace(tag)] = struct{}{}
+	}
+	for _, tag := range exclude {
+		filter.exclude[strings.TrimSpace(tag)] = struct{}{}
+	}
+	return filter
+}
+
+// matches returns true if a command with the tags is executed.
+// An excluded tag takes precedence over an included tag. A tagged command is executed
+// when one of its tags is included, or nothing is included and there is no catch-all exclude.
+// An untagged command is executed unless there is a catch-all exclude.
+func (f *commandFilter) matches(tags []string) bool {
+	if f == nil {
+		return true
+	}
+	for _, tag := range tags {
+		if _, ok := f.exclude[tag]; ok {
+			return false
+		}
+	}
+	for _, tag := range tags {
+		if _, ok := f.include[tag]; ok {
+			return true
+		}
+	}
+	if _, ok := f.exclude[CommandFilterCatchAll]; ok {
+		return false
+	}
+	return len(tags) == 0 || len(f.include) == 0
+}
+
+// commandTags returns the tags of the command.
+func commandTags(cmd commands.VMInitSerializableCommand) []string {
+	vRun, ok := cmd.(commands.Run)
+	if !ok {
+		return []string{}
+	}
+	tags := []string{}
+	for _, item := range strings.Split(vRun.Args[TagsArg], ",") {
+		if tag := strings.TrimSpace(item); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
@@ -0,0 +1,74 @@
+package bootstrap
+
+import (
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// commandLog writes the output of a single command to a gzip compressed file.
+// A nil command log discards the output.
+type commandLog struct {
+	sync.Mutex
+	file     *os.File
+	gzWriter *gzip.Writer
+	newLines bool
+}
+
+func newCommandLog(dir string, index int, mode OutputMode) (*commandLog, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, commandFileName(index, ".log.gz")), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &commandLog{
+		file:     file,
+		gzWriter: gzip.NewWriter(file),
+		// in lines mode the new lines are stripped from the output:
+		newLines: mode == OutputModeLines,
+	}, nil
+}
+
+// commandFileName returns the name of a per command file with the given extension.
+func commandFileName(index int, extension string) string {
+	switch index {
+	case FinalizeCommandIndex:
+		return "cmd-finalize" + extension
+	case LdconfigCommandIndex:
+		return "cmd-ldconfig" + extension
+	case PostResourceCommandIndex:
+		return "cmd-post-resource" + extension
+	case ReadinessProbeCommandIndex:
+		return "cmd-readiness" + extension
+	}
+	return fmt.Sprintf("cmd-%d%s", index, extension)
+}
+
+func (l *commandLog) Write(p []byte) {
+	if l == nil {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.gzWriter.Write(p)
+	if l.newLines {
+		l.gzWriter.Write([]byte("\n"))
+	}
+}
+
+func (l *commandLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.Lock()
+	defer l.Unlock()
+	if err := l.gzWriter.Close(); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
@@ -0,0 +1,84 @@
+package bootstrap
+
+import (
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/combust-labs/firebuild-shared/build/commands"
+)
+
+// loginShells are the shells invoked with -l to start a login shell.
+var loginShells = map[string]struct{}{
+	"ash":  {},
+	"bash": {},
+	"dash": {},
+	"ksh":  {},
+	"sh":   {},
+	"zsh":  {},
+}
+
+// loginShellArgs returns the shell arguments starting a login shell and true,
+// or the arguments unchanged and false when the shell is not known to support -l.
+func loginShellArgs(shell []string) ([]string, bool) {
+	if len(shell) == 0 {
+		return shell, false
+	}
+	if _, ok := loginShells[filepath.Base(shell[0])]; !ok {
+		return shell, false
+	}
+	for _, arg := range shell[1:] {
+		if arg == "-l" || arg == "--login" {
+			return shell, true
+		}
+	}
+	return append([]string{shell[0], "-l"}, shell[1:]...), true
+}
+
+// userHomeDir returns the home directory of the user of the command,
+// the user is a name or a uid, optionally followed by the group.
+func userHomeDir(cmdUser commands.User) (string, error) {
+	name := strings.SplitN(cmdUser.Value, ":", 2)[0]
+	lookup := user.Lookup
+	if _, err := strconv.Atoi(name); err == nil {
+		lookup = user.LookupId
+	}
+	hostUser, err := lookup(name)
+	if err != nil {
+		return "", err
+	}
+	return hostUser.HomeDir, nil
+}
+
+// shellArgs returns a copy of the shell arguments of the command and true if the command
+// is executed in a login shell.
+func (n *shellCommandRunner) shellArgs(index int, shell []string) ([]string, bool) {
+	args := append([]string{}, shell...)
+	if !n.loginShell {
+		return args, false
+	}
+	args, login := loginShellArgs(args)
+	if !login {
+		n.logger.Debug("shell does not support a login shell, executing with the default invocation", "index", index, "shell", shell)
+	}
+	return args, login
+}
+
+// loginEnvironment returns the base environment with the HOME of the user of the command,
+// the login shell sources the profile of the HOME. With an unknown user, the HOME is inherited.
+func (n *shellCommandRunner) loginEnvironment(index int, cmdUser commands.User) []string {
+	environment := n.baseEnvironment()
+	home, err := n.lookupHome(cmdUser)
+	if err != nil || home == "" {
+		n.logger.Debug("home directory of the command user not resolved, HOME inherited", "index", index, "user", cmdUser.Value, "reason", err)
+		return environment
+	}
+	output := []string{}
+	for _, item := range environment {
+		if !strings.HasPrefix(item, "HOME=") {
+			output = append(output, item)
+		}
+	}
+	return append(output, "HOME="+home)
+}
@@ -0,0 +1,84 @@
+package bootstrap
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// commandMount is a host directory bind mounted at the target for the duration of every command.
+type commandMount struct {
+	readonly bool
+	source   string
+	target   string
+}
+
+// mountAll bind mounts the configured host directories and returns a function unmounting them.
+// The mounts are undone when any of them fails.
+func (n *shellCommandRunner) mountAll(index int) (func(), error) {
+	cleanups := []func(){}
+	cleanup := func() {
+		for i := len(cleanups) - 1; i >= 0; i-- {
+			cleanups[i]()
+		}
+	}
+	for _, mount := range n.mounts {
+		mountCleanup, err := n.mount(mount)
+		if err != nil {
+			cleanup()
+			n.logger.Error("failed mounting host directory", "index", index, "source", mount.source, "target", mount.target, "reason", err)
+			return func() {}, errors.Wrapf(err, "failed bind mounting '%s' at '%s'", mount.source, mount.target)
+		}
+		cleanups = append(cleanups, mountCleanup)
+		n.audit(index, AuditRecord{Action: AuditHostDirectoryMounted, Details: map[string]string{
+			"readonly": strconv.FormatBool(mount.readonly),
+			"source":   mount.source,
+			"target":   mount.target,
+		}})
+	}
+	return cleanup, nil
+}
+
+func (n *shellCommandRunner) mount(mount commandMount) (func(), error) {
+	stat, err := os.Stat(mount.source)
+	if err != nil {
+		return nil, err
+	}
+	if !stat.IsDir() {
+		return nil, fmt.Errorf("source is not a directory")
+	}
+	createdDir := false
+	if _, err := os.Stat(mount.target); os.IsNotExist(err) {
+		if err := os.MkdirAll(mount.target, 0755); err != nil {
+			return nil, err
+		}
+		createdDir = true
+	}
+	removeDir := func() {
+		if createdDir {
+			os.Remove(mount.target)
+		}
+	}
+	if err := bindMount(mount.source, mount.target, mount.readonly); err != nil {
+		removeDir()
+		return nil, err
+	}
+	return func() {
+		if err := unmount(mount.target); err != nil {
+			n.logger.Error("failed unmounting host directory", "source", mount.source, "target", mount.target, "reason", err)
+			return
+		}
+		removeDir()
+	}, nil
+}
+
+func newCommandMount(source, target string, readonly bool) commandMount {
+	return commandMount{
+		readonly: readonly,
+		source:   filepath.Clean(source),
+		target:   filepath.Clean(target),
+	}
+}
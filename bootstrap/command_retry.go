@@ -0,0 +1,95 @@
+package bootstrap
+
+import (
+	"context"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/combust-labs/firebuild-shared/build/commands"
+	"github.com/combust-labs/firebuild-shared/build/rootfs"
+	"github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
+)
+
+// RetryAttemptsArg is the name of the build argument used to execute a RUN command
+// up to the given number of times while it exits with a non-zero code, for example 3.
+// A command without the argument is executed once.
+const RetryAttemptsArg = "FIREBUILD_RETRY_ATTEMPTS"
+
+// RetryBackoffArg is the name of the build argument with the delay before retrying a failed RUN command,
+// as a Go duration, for example 5s. The delay doubles after every failed attempt. The default is no delay.
+const RetryBackoffArg = "FIREBUILD_RETRY_BACKOFF"
+
+// commandRetryHint is the retry policy a RUN command carries in its arguments.
+type commandRetryHint struct {
+	attempts int
+	backoff  time.Duration
+}
+
+// parseCommandRetryHint returns the retry policy of the command. An invalid hint is logged
+// and the command is executed once.
+func parseCommandRetryHint(logger hclog.Logger, cmd commands.Run) commandRetryHint {
+	hint := commandRetryHint{attempts: 1}
+	if value := strings.TrimSpace(cmd.Args[RetryAttemptsArg]); value != "" {
+		attempts, err := strconv.Atoi(value)
+		if err != nil || attempts < 1 {
+			logger.Warn("invalid retry attempts, executing the command once", "value", value)
+			return hint
+		}
+		hint.attempts = attempts
+	}
+	if value := strings.TrimSpace(cmd.Args[RetryBackoffArg]); value != "" {
+		backoff, err := time.ParseDuration(value)
+		if err != nil || backoff < 0 {
+			logger.Warn("invalid retry backoff, retrying without delay", "value", value)
+			return hint
+		}
+		hint.backoff = backoff
+	}
+	return hint
+}
+
+// Execute executes the command like ExecuteIndexed, as the command with the index 0.
+func (n *shellCommandRunner) Execute(cmd commands.Run, grpcClient rootfs.ClientProvider) error {
+	return n.ExecuteIndexed(0, cmd, grpcClient)
+}
+
+// ExecuteIndexed executes the command, retrying it according to the retry hint of the command
+// while the command exits with a non-zero code. Commands failing to start or killed
+// after the output idle timeout are not retried. The error classifier handed by the bootstrapper
+// takes precedence: a transient error is retried, a permanent error is not.
+func (n *shellCommandRunner) ExecuteIndexed(index int, cmd commands.Run, grpcClient rootfs.ClientProvider) error {
+	return n.ExecuteContext(context.Background(), index, cmd, grpcClient)
+}
+
+// ExecuteContext executes the command like ExecuteIndexed and kills it when the context is done.
+// The output buffered when the command is killed is delivered to the server before returning,
+// a cancelled command is not retried.
+func (n *shellCommandRunner) ExecuteContext(ctx context.Context, index int, cmd commands.Run, grpcClient rootfs.ClientProvider) error {
+	hint := parseCommandRetryHint(n.logger, cmd)
+	backoff := hint.backoff
+	for attempt := 1; ; attempt++ {
+		err := n.executeAttempt(ctx, index, cmd, grpcClient)
+		if err == nil || attempt >= hint.attempts {
+			return err
+		}
+		var exitErr *exec.ExitError
+		if !shouldRetry(n.errorClassifier, err, errors.As(err, &exitErr)) {
+			return err
+		}
+		n.logger.Warn("command failed, retrying",
+			"index", index,
+			"attempt", attempt,
+			"attempts", hint.attempts,
+			"backoff", backoff,
+			"reason", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-n.clock.After(backoff):
+		}
+		backoff = backoff * 2
+	}
+}
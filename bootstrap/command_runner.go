@@ -1,12 +1,18 @@
 package bootstrap
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io/fs"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/combust-labs/firebuild-mmds/clock"
 	"github.com/combust-labs/firebuild-shared/build/commands"
 	"github.com/combust-labs/firebuild-shared/build/rootfs"
 	"github.com/combust-labs/firebuild-shared/env"
@@ -14,15 +20,59 @@ import (
 	"github.com/pkg/errors"
 )
 
+// FinalizeCommandIndex is the command index passed to the command runner
+// when executing the finalize command.
+const FinalizeCommandIndex = -1
+
+// LdconfigCommandIndex is the command index passed to the command runner
+// when refreshing the linker cache after the resources have been deployed.
+const LdconfigCommandIndex = -3
+
+// PostResourceCommandIndex is the command index passed to the command runner
+// when verifying the deployed resources with a post resource command.
+const PostResourceCommandIndex = -4
+
+// ReadinessProbeCommandIndex is the command index passed to the command runner
+// when executing the readiness probe.
+const ReadinessProbeCommandIndex = -2
+
+// CommandRunner executes RUN commands.
 type CommandRunner interface {
 	Execute(commands.Run, rootfs.ClientProvider) error
 }
 
+// IndexedCommandRunner is a command runner receiving the index of the command, the position
+// of the command in the work context or one of the special command indexes, for example FinalizeCommandIndex.
+// The bootstrapper executes the commands with ExecuteIndexed when the runner implements it.
+type IndexedCommandRunner interface {
+	CommandRunner
+	ExecuteIndexed(int, commands.Run, rootfs.ClientProvider) error
+}
+
+// ContextCommandRunner is a command runner stopping the command when the context is done.
+// The bootstrapper executes the commands with ExecuteContext when the runner implements it.
+type ContextCommandRunner interface {
+	IndexedCommandRunner
+	ExecuteContext(context.Context, int, commands.Run, rootfs.ClientProvider) error
+}
+
+// executeIndexed executes the command with the index when the command runner supports it.
+func executeIndexed(runner CommandRunner, index int, cmd commands.Run, grpcClient rootfs.ClientProvider) error {
+	if indexed, ok := runner.(IndexedCommandRunner); ok {
+		return indexed.ExecuteIndexed(index, cmd, grpcClient)
+	}
+	return runner.Execute(cmd, grpcClient)
+}
+
 type noopCommandRunner struct {
 	logger hclog.Logger
 }
 
 func (n *noopCommandRunner) Execute(cmd commands.Run, grpcClient rootfs.ClientProvider) error {
+	return n.ExecuteIndexed(0, cmd, grpcClient)
+}
+
+func (n *noopCommandRunner) ExecuteIndexed(index int, cmd commands.Run, grpcClient rootfs.ClientProvider) error {
 
 	cmdEnv := env.NewBuildEnv()
 	for k, v := range cmd.Args {
@@ -46,37 +96,340 @@ func (n *noopCommandRunner) Execute(cmd commands.Run, grpcClient rootfs.ClientPr
 		strings.Join(cmd.Shell.Commands, " "),
 		strings.ReplaceAll(envString+cmdEnv.Expand(cmd.Command), "'", "'\\''"))
 
-	n.logger.Debug("executing RUN command", "command", executableCommand)
+	n.logger.Debug("executing RUN command", "index", index, "command", executableCommand)
 
 	return nil
 }
 
+// OutputMode defines how the captured command output is delivered.
+type OutputMode int
+
+const (
+	// OutputModeRaw delivers the output in chunks, as read from the process.
+	OutputModeRaw OutputMode = iota
+	// OutputModeLines delivers the output in complete lines.
+	OutputModeLines
+)
+
+// ShellCommandRunner is a command runner executing RUN commands in a shell.
+type ShellCommandRunner interface {
+	ContextCommandRunner
+	WithBinaryAllowlist([]string) ShellCommandRunner
+	WithCleanEnvironment(bool) ShellCommandRunner
+	WithCommandCapabilities(int, []string) ShellCommandRunner
+	WithCompressedLogDir(string) ShellCommandRunner
+	WithEnvAllowlist([]string) ShellCommandRunner
+	WithFactCapture(int, FactParser) ShellCommandRunner
+	WithFailureOutputDir(string) ShellCommandRunner
+	WithFilesystemDiff([]string) ShellCommandRunner
+	WithFilesystemDiffMaxEntries(int) ShellCommandRunner
+	WithIOPriority(IOPriorityClass, int) ShellCommandRunner
+	WithLoginShell(bool) ShellCommandRunner
+	WithMount(string, string, bool) ShellCommandRunner
+	WithNiceness(int) ShellCommandRunner
+	WithOutputFlushInterval(time.Duration) ShellCommandRunner
+	WithOutputIdleTimeout(time.Duration) ShellCommandRunner
+	WithOutputMode(OutputMode) ShellCommandRunner
+	WithPath(string) ShellCommandRunner
+	WithSecret(string, []byte) ShellCommandRunner
+	WithSecretsDir(string) ShellCommandRunner
+	WithSensitiveEnv([]string) ShellCommandRunner
+	WithStdoutRedirect(int, string, fs.FileMode) ShellCommandRunner
+	WithSyslog(string) ShellCommandRunner
+	WithTimestampedOutput(bool) ShellCommandRunner
+	WithTrailingNewline(bool) ShellCommandRunner
+}
+
 type shellCommandRunner struct {
-	defaultUser commands.User
-	logger      hclog.Logger
+	auditSink           AuditSink
+	binaryAllowlist     []string
+	cgroupLimits        *CgroupLimits
+	cleanEnvironment    bool
+	clock               clock.Clock
+	commandCapabilities map[int][]string
+	compressedLogDir    string
+	defaultUser         commands.User
+	envAllowlist        []string
+	errorClassifier     ErrorClassifier
+	factParsers         map[int]FactParser
+	facts               map[string]string
+	failureOutputDir    string
+	fsDiffMaxEntries    int
+	fsDiffPaths         []string
+	ioPriority          *ioPriority
+	lastUsage           *CommandUsage
+	logger              hclog.Logger
+	loginShell          bool
+	lookupHome          func(commands.User) (string, error)
+	mounts              []commandMount
+	netns               *commandNetns
+	niceness            *int
+	outputFlushInterval time.Duration
+	outputIdleTimeout   time.Duration
+	outputMode          OutputMode
+	path                string
+	secrets             map[string][]byte
+	secretsDir          string
+	sensitiveEnv        []string
+	stdoutRedirects     map[int]stdoutRedirect
+	syslog              syslogWriter
+	syslogOnce          sync.Once
+	syslogTag           string
+	timestampedOutput   bool
+	trailingNewline     bool
 }
 
-func NewShellCommandRunner(logger hclog.Logger) CommandRunner {
+func NewShellCommandRunner(logger hclog.Logger) ShellCommandRunner {
 	return &shellCommandRunner{
-		defaultUser: commands.DefaultUser(),
-		logger:      logger,
+		clock:            clock.Real(),
+		defaultUser:      commands.DefaultUser(),
+		fsDiffMaxEntries: DefaultFilesystemDiffMaxEntries,
+		logger:           logger,
+		lookupHome:       userHomeDir,
+		outputMode:       OutputModeRaw,
+		secrets:          map[string][]byte{},
+		secretsDir:       DefaultSecretsDir,
 	}
 }
 
-func (n *shellCommandRunner) Execute(cmd commands.Run, grpcClient rootfs.ClientProvider) error {
+// WithBinaryAllowlist configures the absolute paths of the executables the commands are allowed to execute,
+// for example /usr/bin/apt-get. The first token of the expanded command, after the leading variable assignments,
+// is resolved like the shell does, with the PATH of the command, and a command with an executable
+// not in the allowlist fails with ErrBinaryNotAllowed before it is executed. Shell builtins are not executables
+// and are rejected. The check applies to the command only, the shell and the processes started by the command
+// are not restricted. An empty allowlist rejects every command, a nil allowlist disables the check.
+func (n *shellCommandRunner) WithBinaryAllowlist(input []string) ShellCommandRunner {
+	n.binaryAllowlist = input
+	return n
+}
+
+// WithCleanEnvironment configures the runner to start every command from an empty environment
+// populated only with the Args and Env of the command and the variables of the runner environment
+// allowed with WithEnvAllowlist, so the environment of the host does not leak into the build.
+// PATH is not inherited unless allowed, the path configured with WithPath is always set.
+func (n *shellCommandRunner) WithCleanEnvironment(input bool) ShellCommandRunner {
+	n.cleanEnvironment = input
+	return n
+}
+
+// WithCommandCapabilities configures the runner to drop all Linux capabilities except the listed ones,
+// for example CAP_NET_BIND_SERVICE, for the process of the command at the index. An empty list drops
+// all capabilities. Dropping the capabilities requires CAP_SETPCAP, the command fails when the capabilities
+// cannot be set or a listed capability is not held by the runner. Supported on Linux only.
+func (n *shellCommandRunner) WithCommandCapabilities(index int, caps []string) ShellCommandRunner {
+	if n.commandCapabilities == nil {
+		n.commandCapabilities = map[int][]string{}
+	}
+	n.commandCapabilities[index] = caps
+	return n
+}
+
+// WithCompressedLogDir configures a directory where the output of every command
+// is additionally written to a gzip compressed cmd-<index>.log.gz file.
+func (n *shellCommandRunner) WithCompressedLogDir(input string) ShellCommandRunner {
+	n.compressedLogDir = input
+	return n
+}
+
+// WithEnvAllowlist configures the names of the runner environment variables
+// inherited by the commands when the clean environment is enabled, for example HOME or PATH.
+func (n *shellCommandRunner) WithEnvAllowlist(input []string) ShellCommandRunner {
+	n.envAllowlist = input
+	return n
+}
+
+// WithFactCapture configures the parser of the stdout of the command at the index. The facts parsed
+// from the stdout of the successful command are put in the environment of every subsequent command,
+// the arguments and the environment of a command take precedence over the facts. A parser error fails the command.
+func (n *shellCommandRunner) WithFactCapture(index int, parser FactParser) ShellCommandRunner {
+	if n.factParsers == nil {
+		n.factParsers = map[int]FactParser{}
+	}
+	n.factParsers[index] = parser
+	return n
+}
+
+// WithFailureOutputDir configures a directory where the complete output of a failed command
+// is preserved, together with the resolved command, in a cmd-<index>.failure.log file.
+// The output is preserved regardless of the other output settings.
+func (n *shellCommandRunner) WithFailureOutputDir(input string) ShellCommandRunner {
+	n.failureOutputDir = input
+	return n
+}
+
+// WithFilesystemDiff configures the paths recorded before and after every command.
+// The created, modified and deleted files are logged after the command finishes.
+// Recording the paths is expensive, the number of recorded entries is bounded,
+// see WithFilesystemDiffMaxEntries.
+func (n *shellCommandRunner) WithFilesystemDiff(input []string) ShellCommandRunner {
+	n.fsDiffPaths = input
+	return n
+}
+
+// WithFilesystemDiffMaxEntries configures the maximum number of entries recorded for the filesystem diff.
+// The default is DefaultFilesystemDiffMaxEntries.
+func (n *shellCommandRunner) WithFilesystemDiffMaxEntries(input int) ShellCommandRunner {
+	n.fsDiffMaxEntries = input
+	return n
+}
+
+// WithIOPriority configures the IO scheduling class and the level within the class, from 0 (highest)
+// to 7 (lowest), of every command. The level is clamped to the valid range, an invalid class
+// is replaced with the best effort class. The level is ignored by the idle class.
+func (n *shellCommandRunner) WithIOPriority(class IOPriorityClass, level int) ShellCommandRunner {
+	priority := clampIOPriority(class, level)
+	n.ioPriority = &priority
+	return n
+}
+
+// WithLoginShell configures the commands to be executed in a login shell. By default, the shell
+// is not a login shell and does not read any profile, the commands inherit the environment of the bootstrapper.
+// A login shell, the shell invoked with -l, sources /etc/profile and the profile of the user of the command
+// before the command is executed, the HOME is set to the home directory of the user. The profiles may change
+// the inherited environment, for example the PATH, the arguments and the environment of the command
+// take precedence. Shells not known to support -l are executed with the default invocation.
+func (n *shellCommandRunner) WithLoginShell(input bool) ShellCommandRunner {
+	n.loginShell = input
+	return n
+}
+
+// WithMount configures a host directory bind mounted at the target before every command and unmounted
+// after it, for example a package download cache shared by the commands, like a BuildKit cache mount.
+// A missing target directory is created and removed after the command. Mounting requires CAP_SYS_ADMIN,
+// the command fails when the directory cannot be mounted. Supported on Linux only.
+func (n *shellCommandRunner) WithMount(source, target string, readonly bool) ShellCommandRunner {
+	n.mounts = append(n.mounts, newCommandMount(source, target, readonly))
+	return n
+}
+
+// WithNiceness configures the niceness of every command, from -20 (highest priority)
+// to 19 (lowest priority), so the bootstrap does not starve other guest processes.
+// The niceness is clamped to the valid range. Lowering the niceness below the niceness
+// of the runner requires privileges, a warning is logged when it is not permitted.
+func (n *shellCommandRunner) WithNiceness(input int) ShellCommandRunner {
+	niceness := clampNiceness(input)
+	n.niceness = &niceness
+	return n
+}
+
+// WithOutputFlushInterval configures the runner to buffer the output and deliver it to the server
+// in batches every interval, and when the command finishes, instead of delivering every write separately.
+// Combined with the lines output mode, the server receives batches of complete lines.
+// By default, the output is delivered as it is written.
+func (n *shellCommandRunner) WithOutputFlushInterval(input time.Duration) ShellCommandRunner {
+	n.outputFlushInterval = input
+	return n
+}
+
+// WithOutputIdleTimeout configures the runner to kill a command which has not written
+// to stdout or stderr for the duration. Every output chunk restarts the timeout so long running
+// commands reporting progress are not affected. Such command fails with ErrOutputIdleTimeout.
+// By default, commands are not killed.
+func (n *shellCommandRunner) WithOutputIdleTimeout(input time.Duration) ShellCommandRunner {
+	n.outputIdleTimeout = input
+	return n
+}
+
+// WithOutputMode configures how the captured output is delivered to the server.
+// In lines mode, the output not terminated with a new line is delivered when the process exits.
+func (n *shellCommandRunner) WithOutputMode(input OutputMode) ShellCommandRunner {
+	n.outputMode = input
+	return n
+}
+
+// WithPath configures the PATH of every command, replacing the PATH inherited from the process.
+// A PATH set in the environment of the command takes precedence.
+func (n *shellCommandRunner) WithPath(input string) ShellCommandRunner {
+	n.path = input
+	return n
+}
+
+// WithSecret configures a secret available to the commands as the secrets directory file
+// named after the secret id. The secret exists only for the duration of a command
+// and is never written to the root file system.
+func (n *shellCommandRunner) WithSecret(id string, data []byte) ShellCommandRunner {
+	n.secrets[id] = data
+	return n
+}
+
+// WithSecretsDir configures the directory where the secrets are mounted.
+// The default is DefaultSecretsDir.
+func (n *shellCommandRunner) WithSecretsDir(input string) ShellCommandRunner {
+	n.secretsDir = input
+	return n
+}
+
+// WithSensitiveEnv configures the names of the environment variables and build arguments
+// with values redacted from the command failure errors. The secret values are always redacted.
+func (n *shellCommandRunner) WithSensitiveEnv(input []string) ShellCommandRunner {
+	n.sensitiveEnv = input
+	return n
+}
+
+// WithStdoutRedirect configures the runner to write the stdout of the command at the index to the target file,
+// like RUN command > target, instead of delivering it to the server. The target is truncated before every attempt
+// of the command, created with the mode and owned by the user of the command. The stderr is delivered as usual.
+func (n *shellCommandRunner) WithStdoutRedirect(index int, target string, mode fs.FileMode) ShellCommandRunner {
+	if n.stdoutRedirects == nil {
+		n.stdoutRedirects = map[int]stdoutRedirect{}
+	}
+	n.stdoutRedirects[index] = stdoutRedirect{mode: mode, target: target}
+	return n
+}
+
+// WithSyslog configures the runner to also write the start and the finish of every command, and its output,
+// to the local syslog with the tag. The output is written with the info priority, the failures with the err priority.
+// The sensitive values are redacted from the failures only, like in the command failure errors.
+// When the local syslog is unavailable, a warning is logged and the commands are executed without it.
+func (n *shellCommandRunner) WithSyslog(tag string) ShellCommandRunner {
+	n.syslogTag = tag
+	return n
+}
+
+// WithTimestampedOutput configures the runner to prefix every output line with the RFC3339
+// timestamp and the command index, for example 2021-04-01T10:20:30Z [2] output, to make
+// interleaved logs readable. The prefix is also written to the command logs and the captured
+// failure output. Only the lines output mode is prefixed, the raw output may be binary
+// and is always delivered as it is.
+func (n *shellCommandRunner) WithTimestampedOutput(input bool) ShellCommandRunner {
+	n.timestampedOutput = input
+	return n
+}
+
+// WithTrailingNewline configures the runner to terminate the command passed to the shell with a new line,
+// unless the command already ends with one. By default the command is passed to the shell verbatim,
+// as received from the server. A terminating new line completes a here-doc or a line continuation
+// on the last line of the command.
+func (n *shellCommandRunner) WithTrailingNewline(input bool) ShellCommandRunner {
+	n.trailingNewline = input
+	return n
+}
+
+// executeAttempt executes the command once.
+func (n *shellCommandRunner) executeAttempt(ctx context.Context, index int, cmd commands.Run, grpcClient rootfs.ClientProvider) (executeErr error) {
 
 	logValues := []interface{}{
+		"index", index,
 		"workdir", cmd.Workdir.Value,
 		"user", cmd.User.Value,
 		"shell", cmd.Shell.Commands,
 	}
 	if n.logger.IsTrace() {
-		logValues = append(logValues, []interface{}{"raw-command", cmd}...)
+		rawCommand := cmd
+		rawCommand.Args = redactValues(cmd.Args, n.sensitiveEnv, sensitiveEnvRedaction)
+		rawCommand.Env = redactValues(cmd.Env, n.sensitiveEnv, sensitiveEnvRedaction)
+		logValues = append(logValues, []interface{}{"raw-command", rawCommand}...)
 	}
 
 	n.logger.Debug("executing command", logValues...)
 
+	n.lastUsage = nil
+
 	cmdEnv := env.NewBuildEnv()
+	// the facts captured from the previous commands, the arguments and the environment of the command take precedence:
+	for k, v := range n.facts {
+		cmdEnv.Put(k, v)
+	}
 	for k, v := range cmd.Args {
 		cmdEnv.Put(k, v)
 	}
@@ -84,47 +437,180 @@ func (n *shellCommandRunner) Execute(cmd commands.Run, grpcClient rootfs.ClientP
 		cmdEnv.Put(k, v)
 	}
 
-	environment, commandToExecute, cleanupFunc := constructExecutableCommand(n.logger, cmdEnv, cmd.Command)
+	sysLog := n.commandSyslog()
+	syslogInfo(sysLog, "[%d] command started, %s", index, n.describeCommand(cmd, cmdEnv))
+
+	capturedOutput := n.captureFailureOutput()
+	defer func() {
+		if executeErr != nil {
+			syslogErr(sysLog, "[%d] command failed: %s", index, n.redact(cmdEnv, executeErr.Error()))
+			n.dumpFailureOutput(index, cmd, cmdEnv, capturedOutput, executeErr)
+			return
+		}
+		syslogInfo(sysLog, "[%d] command finished successfully", index)
+	}()
+
+	if err := n.checkBinaryAllowlist(index, cmdEnv.Expand(cmd.Command), cmd.Workdir.Value, cmdEnv); err != nil {
+		n.logger.Error("command rejected by the binary allowlist", "index", index, "reason", err)
+		return err
+	}
+
+	cmdargs, login := n.shellArgs(index, cmd.Shell.Commands)
+	baseEnv := n.baseEnvironment()
+	if login {
+		// the base environment is inherited by the process only, the profiles sourced by the login shell may change it:
+		baseEnv = nil
+	}
+
+	environment, commandToExecute, cleanupFunc := constructExecutableCommand(n.logger, baseEnv, cmdEnv, n.commandText(cmd.Command))
 	defer cleanupFunc()
 
 	// TODO: https://github.com/combust-labs/firebuild/issues/2
 
-	cmdargs := cmd.Shell.Commands
 	//cmdargs = append(cmdargs, fmt.Sprintf("'%s'", strings.ReplaceAll(envString+cmdEnv.Expand(cmd.Command), "'", "'\\''")))
 	cmdargs = append(cmdargs, commandToExecute)
 
 	shellCmd := exec.Command(cmdargs[0], cmdargs[1:]...)
 	shellCmd.Dir = cmd.Workdir.Value
 	shellCmd.Env = environment
-	shellCmd.Stderr = &shellCommandWriter{
+	if login {
+		shellCmd.Env = append(n.loginEnvironment(index, cmd.User), environment...)
+	}
+
+	// the secrets environment is passed to the process only, never to the command file:
+	secretsEnv, secretsCleanup := n.mountSecrets(index)
+	defer secretsCleanup()
+	shellCmd.Env = append(shellCmd.Env, secretsEnv...)
+	mountsCleanup, err := n.mountAll(index)
+	if err != nil {
+		return err
+	}
+	defer mountsCleanup()
+	cmdLog := n.openCommandLog(index)
+	defer cmdLog.Close()
+
+	// counts the output delivered after the command finished, the output drained when cancelled:
+	drained := &drainCounter{}
+	sendStderr, closeStderr := n.outputSender(drained.wrap(grpcClient.StdErr))
+	sendStdout, closeStdout := n.outputSender(drained.wrap(grpcClient.StdOut))
+
+	linePrefix := n.linePrefix(index)
+	stderrWriter := &shellCommandWriter{
+		linePrefix: linePrefix,
+		mode:       n.outputMode,
 		writerFunc: func(p []byte) error {
 			n.logger.Trace("writing stderr", "data", string(p))
-			return grpcClient.StdErr([]string{string(p)})
+			cmdLog.Write(p)
+			syslogOutput(sysLog, index, "stderr", p)
+			capturedOutput.writeStderr(p)
+			return sendStderr(string(p))
 		},
 	}
-	shellCmd.Stdout = &shellCommandWriter{
+	stdoutWriter := &shellCommandWriter{
+		linePrefix: linePrefix,
+		mode:       n.outputMode,
 		writerFunc: func(p []byte) error {
 			n.logger.Trace("writing stdout", "data", string(p))
-			return grpcClient.StdOut([]string{string(p)})
+			cmdLog.Write(p)
+			syslogOutput(sysLog, index, "stdout", p)
+			capturedOutput.writeStdout(p)
+			return sendStdout(string(p))
 		},
 	}
+	watchdog := newIdleWatchdog(n.clock, n.outputIdleTimeout)
+	shellCmd.Stderr = watchdog.wrap(stderrWriter)
+	factsStdout, capturedFacts := n.captureFacts(index, stdoutWriter)
+	shellCmd.Stdout = watchdog.wrap(factsStdout)
+	stdoutFile, err := n.openStdoutRedirect(index, cmd)
+	if err != nil {
+		n.logger.Error("failed redirecting stdout", "index", index, "reason", err)
+		return err
+	}
+	if stdoutFile != nil {
+		defer stdoutFile.Close()
+		shellCmd.Stdout = watchdog.wrap(stdoutFile)
+	}
+	if watchdog != nil || ctx.Done() != nil {
+		// processes started by the command may keep the output open after the command is killed:
+		shellCmd.WaitDelay = idleKillWaitDelay
+	}
+
+	cgroup := n.openCgroup(index)
+	defer cgroup.Close()
+	cgroup.apply(shellCmd)
+
+	if len(n.fsDiffPaths) > 0 {
+		before := takeFilesystemSnapshot(n.fsDiffPaths, n.fsDiffMaxEntries)
+		defer n.logFilesystemDiff(index, before)
+	}
 
 	// Start the command
-	if err := shellCmd.Start(); err != nil {
+	if err := n.startWithCapabilities(index, shellCmd); err != nil {
 		n.logger.Error("failed starting command", "reason", err)
 		return err
 	}
 
-	if err := shellCmd.Wait(); err != nil {
+	// processes started by the command before the priority is applied keep the default priority:
+	n.applyPriority(index, shellCmd.Process)
+
+	watchdog.start(func() {
+		n.logger.Error("command produced no output within the idle timeout, killing", "index", index, "timeout", n.outputIdleTimeout)
+		if err := shellCmd.Process.Kill(); err != nil {
+			n.logger.Error("failed killing idle command", "index", index, "reason", err)
+		}
+	})
+
+	stopCancel := killOnDone(ctx, shellCmd.Process, func(err error) {
+		n.logger.Error("failed killing cancelled command", "index", index, "reason", err)
+	})
+	waitErr := shellCmd.Wait()
+	stopCancel()
+	idle := watchdog.stop()
+	drained.start()
+
+	if usage, ok := processUsage(shellCmd.ProcessState); ok {
+		n.lastUsage = &usage
+	}
+
+	// deliver any remaining output the process did not terminate with a new line:
+	if err := stdoutWriter.Flush(); err != nil {
+		n.logger.Warn("failed flushing remaining stdout", "reason", err)
+	}
+	if err := stderrWriter.Flush(); err != nil {
+		n.logger.Warn("failed flushing remaining stderr", "reason", err)
+	}
+	if err := closeStdout(); err != nil {
+		n.logger.Warn("failed delivering buffered stdout", "reason", err)
+	}
+	if err := closeStderr(); err != nil {
+		n.logger.Warn("failed delivering buffered stderr", "reason", err)
+	}
+
+	if ctx.Err() != nil {
+		n.logger.Warn("command cancelled, buffered output delivered", "index", index, "flushed-bytes", drained.bytes())
+		return errors.Wrapf(ctx.Err(), "command cancelled, %d bytes of buffered output flushed, %s", drained.bytes(), n.describeCommand(cmd, cmdEnv))
+	}
+
+	if err := waitErr; err != nil {
+		if idle {
+			return errors.Wrapf(ErrOutputIdleTimeout, "command killed after %s without output, %s", n.outputIdleTimeout, n.describeCommand(cmd, cmdEnv))
+		}
 		if exiterr, ok := err.(*exec.ExitError); ok {
 
+			failedCommand := n.describeCommand(cmd, cmdEnv)
+
+			if cgroup.oomKilled() {
+				n.logger.Error("command killed by the OOM killer", "memory-max-bytes", n.cgroupLimits.MemoryMaxBytes)
+				return errors.Wrapf(exiterr, "command killed by the OOM killer, memory limit: %d bytes, %s", n.cgroupLimits.MemoryMaxBytes, failedCommand)
+			}
+
 			// The program has exited with an exit code != 0
 			// This works on both Unix and Windows. Although package
 			// syscall is generally platform dependent, WaitStatus is
 			// defined for both Unix and Windows and in both cases has
 			// an ExitStatus() method with the same signature.
 			n.logger.Error("command finished with error", "reason", exiterr)
-			return errors.Wrapf(exiterr, "command exited with code: %d, message %q", exiterr.ExitCode(), exiterr.String())
+			return errors.Wrapf(exiterr, "command exited with code: %d, message %q, %s", exiterr.ExitCode(), exiterr.String(), failedCommand)
 		} else {
 			n.logger.Error("wait returned a non exec.ExitError error", "reason", err)
 			return err
@@ -133,23 +619,237 @@ func (n *shellCommandRunner) Execute(cmd commands.Run, grpcClient rootfs.ClientP
 
 	n.logger.Debug("command finished successfully")
 
-	return nil
+	return n.recordFacts(index, capturedFacts)
+}
+
+// commandText returns the command passed to the shell.
+func (n *shellCommandRunner) commandText(command string) string {
+	if n.trailingNewline && !strings.HasSuffix(command, "\n") {
+		return command + "\n"
+	}
+	return command
+}
+
+// describeCommand returns the resolved command, the shell and the workdir with the sensitive values redacted.
+func (n *shellCommandRunner) describeCommand(cmd commands.Run, cmdEnv env.BuildEnv) string {
+	return fmt.Sprintf("command %q, shell %q, workdir %q",
+		n.redact(cmdEnv, cmdEnv.Expand(cmd.Command)),
+		n.redact(cmdEnv, strings.Join(cmd.Shell.Commands, " ")),
+		n.redact(cmdEnv, cmd.Workdir.Value))
+}
+
+func (n *shellCommandRunner) captureFailureOutput() *failureOutput {
+	if n.failureOutputDir == "" {
+		return nil
+	}
+	return newFailureOutput(n.outputMode)
+}
+
+func (n *shellCommandRunner) dumpFailureOutput(index int, cmd commands.Run, cmdEnv env.BuildEnv, output *failureOutput, failure error) {
+	if output == nil {
+		return
+	}
+	// the captured output is not redacted, it is what the command has written:
+	filePath, err := output.dump(n.failureOutputDir, index, n.describeCommand(cmd, cmdEnv), errors.New(n.redact(cmdEnv, failure.Error())))
+	if err != nil {
+		n.logger.Error("failed preserving failed command output", "index", index, "reason", err)
+		return
+	}
+	n.logger.Info("failed command output preserved", "index", index, "path", filePath)
+}
+
+// redact replaces the values of the secrets and the sensitive environment in the input.
+func (n *shellCommandRunner) redact(cmdEnv env.BuildEnv, input string) string {
+	values := []string{}
+	for _, data := range n.secrets {
+		values = append(values, string(data))
+	}
+	snapshot := cmdEnv.Snapshot()
+	for _, name := range n.sensitiveEnv {
+		if value, ok := snapshot[name]; ok {
+			values = append(values, value)
+		}
+	}
+	for _, value := range values {
+		if value == "" {
+			continue
+		}
+		input = strings.ReplaceAll(input, value, sensitiveEnvRedaction)
+	}
+	return input
+}
+
+// baseEnvironment returns the environment inherited by every command.
+func (n *shellCommandRunner) baseEnvironment() []string {
+	environment := os.Environ()
+	if n.cleanEnvironment {
+		environment = allowedEnvironment(environment, n.envAllowlist)
+	}
+	if n.path == "" {
+		return environment
+	}
+	output := []string{}
+	for _, item := range environment {
+		if !strings.HasPrefix(item, "PATH=") {
+			output = append(output, item)
+		}
+	}
+	return append(output, "PATH="+n.path)
+}
+
+// allowedEnvironment returns the items of the environment with an allowed name.
+func allowedEnvironment(environment, allowlist []string) []string {
+	allowed := map[string]struct{}{}
+	for _, name := range allowlist {
+		allowed[name] = struct{}{}
+	}
+	output := []string{}
+	for _, item := range environment {
+		name := strings.SplitN(item, "=", 2)[0]
+		if _, ok := allowed[name]; ok {
+			output = append(output, item)
+		}
+	}
+	return output
+}
+
+func (n *shellCommandRunner) logFilesystemDiff(index int, before *fsSnapshot) {
+	after := takeFilesystemSnapshot(n.fsDiffPaths, n.fsDiffMaxEntries)
+	if before.truncated || after.truncated {
+		n.logger.Warn("filesystem snapshot truncated, the diff is incomplete",
+			"index", index,
+			"max-entries", n.fsDiffMaxEntries)
+	}
+	diff := before.diff(after)
+	n.logger.Info("filesystem diff",
+		"index", index,
+		"created", diff.created,
+		"modified", diff.modified,
+		"deleted", diff.deleted)
+}
+
+// outputSender returns a function delivering the output to the server
+// and a function delivering the output buffered when the command finishes.
+func (n *shellCommandRunner) outputSender(sendFunc func([]string) error) (func(string) error, func() error) {
+	if n.outputFlushInterval <= 0 {
+		return func(line string) error {
+			return sendFunc([]string{line})
+		}, func() error { return nil }
+	}
+	batcher := newOutputBatcher(n.clock, n.outputFlushInterval, sendFunc)
+	return batcher.add, batcher.Close
+}
+
+func (n *shellCommandRunner) openCgroup(index int) *commandCgroup {
+	if n.cgroupLimits == nil {
+		return nil
+	}
+	cgroup, err := newCommandCgroup(*n.cgroupLimits, index)
+	if err != nil {
+		n.logger.Warn("failed creating command cgroup, executing without limits", "index", index, "reason", err)
+		return nil
+	}
+	return cgroup
+}
+
+func (n *shellCommandRunner) openCommandLog(index int) *commandLog {
+	if n.compressedLogDir == "" {
+		return nil
+	}
+	cmdLog, err := newCommandLog(n.compressedLogDir, index, n.outputMode)
+	if err != nil {
+		// the compressed log is an archive only, the command is executed regardless:
+		n.logger.Warn("failed creating compressed command log", "index", index, "reason", err)
+		return nil
+	}
+	return cmdLog
+}
+
+// linePrefix returns the function prefixing the output lines, nil when the lines are not prefixed.
+func (n *shellCommandRunner) linePrefix(index int) func() []byte {
+	if !n.timestampedOutput || n.outputMode != OutputModeLines {
+		return nil
+	}
+	return func() []byte {
+		return []byte(fmt.Sprintf("%s [%d] ", n.clock.Now().UTC().Format(time.RFC3339), index))
+	}
+}
+
+// clockReceiver is a command runner or a resource deployer measuring time, the bootstrapper hands its clock
+// to the command runner and the resource deployer implementing it.
+type clockReceiver interface {
+	setClock(clock.Clock)
+}
+
+func (n *shellCommandRunner) setClock(input clock.Clock) {
+	n.clock = input
+}
+
+func (n *executingResourceDeployer) setClock(input clock.Clock) {
+	n.clock = input
+}
+
+func (n *scriptedCommandRunner) setClock(input clock.Clock) {
+	n.clock = input
+}
+
+// setClock measures the wall time on the clock and hands the clock over to the inner runner.
+func (n *resourceTrackingCommandRunner) setClock(input clock.Clock) {
+	n.clock = input
+	if receiver, ok := n.inner.(clockReceiver); ok {
+		receiver.setClock(input)
+	}
 }
 
 type shellCommandWriter struct {
+	buffer     []byte
+	linePrefix func() []byte
+	mode       OutputMode
 	writerFunc func([]byte) error
 }
 
 func (e *shellCommandWriter) Write(p []byte) (n int, err error) {
-	if err := e.writerFunc(p); err != nil {
-		return 0, err
+	if e.mode != OutputModeLines {
+		if err := e.writerFunc(p); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	e.buffer = append(e.buffer, p...)
+	for {
+		idx := bytes.IndexByte(e.buffer, '\n')
+		if idx < 0 {
+			break
+		}
+		line := e.buffer[:idx]
+		e.buffer = e.buffer[idx+1:]
+		if err := e.writerFunc(e.prefixed(line)); err != nil {
+			return 0, err
+		}
 	}
 	return len(p), nil
 }
 
+// Flush delivers the buffered output not terminated with a new line.
+func (e *shellCommandWriter) Flush() error {
+	if len(e.buffer) == 0 {
+		return nil
+	}
+	remaining := e.buffer
+	e.buffer = nil
+	return e.writerFunc(e.prefixed(remaining))
+}
+
+func (e *shellCommandWriter) prefixed(line []byte) []byte {
+	if e.linePrefix == nil {
+		return line
+	}
+	return append(e.linePrefix(), line...)
+}
+
 // returns environment, command to execute and a cleanup function
-func constructExecutableCommand(logger hclog.Logger, cmdEnv env.BuildEnv, inputCommand string) ([]string, string, func()) {
-	environment := os.Environ()
+func constructExecutableCommand(logger hclog.Logger, baseEnv []string, cmdEnv env.BuildEnv, inputCommand string) ([]string, string, func()) {
+	environment := baseEnv
 	for k, v := range cmdEnv.Snapshot() {
 		environment = append(environment, fmt.Sprintf("%s=\"%s\"", k, v))
 	}
@@ -0,0 +1,304 @@
+package bootstrap
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/combust-labs/firebuild-shared/build/commands"
+	"github.com/combust-labs/firebuild-shared/build/rootfs"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShellCommandRunnerWithNiceness(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{
+			commands.Run{
+				OriginalCommand: "RUN niceness",
+				Args:            map[string]string{},
+				Command:         "niceness",
+				Env:             map[string]string{},
+				Shell: commands.Shell{
+					// the priority is applied after the command starts, the 19th field of stat is the niceness:
+					Commands: []string{"/bin/sh", "-c", "sleep 0.2; cut -d' ' -f19 /proc/self/stat"},
+				},
+				User:    commands.DefaultUser(),
+				Workdir: commands.DefaultWorkdir(),
+			},
+		},
+	}
+
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+	// raising the niceness does not require privileges, 42 is clamped to 19:
+	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithCommandRunner(NewShellCommandRunner(logger.Named("shell-runner")).
+			WithIOPriority(IOPriorityClassIdle, 0).
+			WithNiceness(42).
+			WithOutputMode(OutputModeLines))
+
+	assert.Nil(t, bootstrapper.Execute())
+
+	<-testServer.FinishedNotify()
+
+	assert.Equal(t, []string{"19"}, testServer.ReceivedStdout())
+}
+
+func TestResourceTrackingCommandRunner(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{
+			commands.Run{
+				OriginalCommand: "RUN usage",
+				Args:            map[string]string{},
+				Command:         "usage",
+				Env:             map[string]string{},
+				Shell: commands.Shell{
+					Commands: []string{"/bin/sh", "-c", "head -c 1000000 /dev/zero | wc -c"},
+				},
+				User:    commands.DefaultUser(),
+				Workdir: commands.DefaultWorkdir(),
+			},
+		},
+	}
+
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+	commandRunner := NewResourceTrackingCommandRunner(NewShellCommandRunner(logger.Named("shell-runner")), logger.Named("usage"))
+	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithCommandRunner(commandRunner)
+
+	assert.Nil(t, bootstrapper.Execute())
+
+	<-testServer.FinishedNotify()
+
+	usage := commandRunner.Usage()
+	if assert.Equal(t, 1, len(usage)) {
+		assert.Equal(t, 0, usage[0].Index)
+		assert.Equal(t, "RUN usage", usage[0].Command)
+		assert.Greater(t, usage[0].MaxRSSBytes, int64(0))
+		assert.Greater(t, int64(usage[0].WallTime), int64(0))
+	}
+}
+
+func TestNetnsCommandRunner(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{
+			commands.Run{
+				OriginalCommand: "RUN netns",
+				Args:            map[string]string{},
+				Command:         "netns",
+				Env:             map[string]string{},
+				Shell: commands.Shell{
+					// an empty network namespace has only the loopback interface:
+					Commands: []string{"/bin/sh", "-c", "tail -n +3 /proc/net/dev | cut -d: -f1 | tr -d ' '"},
+				},
+				User:    commands.DefaultUser(),
+				Workdir: commands.DefaultWorkdir(),
+			},
+		},
+	}
+
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithCommandRunner(NewNetnsCommandRunner("", logger.Named("netns-runner")).
+			WithOutputMode(OutputModeLines))
+
+	if err := bootstrapper.Execute(); err != nil {
+		if errors.Is(err, syscall.EPERM) {
+			t.Skip("creating a network namespace requires privileges", err)
+		}
+		t.Fatal("expected the command to execute, got error", err)
+	}
+
+	<-testServer.FinishedNotify()
+
+	assert.Equal(t, []string{"lo"}, testServer.ReceivedStdout())
+}
+
+func TestShellCommandRunnerWithCommandCapabilities(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	_, err := parseCapabilities([]string{"CAP_NET_BIND_SERVICE", "unknown"})
+	assert.NotNil(t, err)
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{
+			commands.Run{
+				OriginalCommand: "RUN capabilities",
+				Args:            map[string]string{},
+				Command:         "capabilities",
+				Env:             map[string]string{},
+				Shell: commands.Shell{
+					Commands: []string{"/bin/sh", "-c", "grep -E '^Cap(Eff|Bnd):' /proc/self/status | cut -f2"},
+				},
+				User:    commands.DefaultUser(),
+				Workdir: commands.DefaultWorkdir(),
+			},
+		},
+	}
+
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithCommandRunner(NewShellCommandRunner(logger.Named("shell-runner")).
+			WithCommandCapabilities(0, []string{"net_bind_service"}).
+			WithOutputMode(OutputModeLines))
+
+	if err := bootstrapper.Execute(); err != nil {
+		if errors.Is(err, syscall.EPERM) {
+			t.Skip("dropping capabilities requires CAP_SETPCAP", err)
+		}
+		t.Fatal("expected the command to execute, got error", err)
+	}
+
+	<-testServer.FinishedNotify()
+
+	// CAP_NET_BIND_SERVICE is the capability 10:
+	assert.Equal(t, []string{"0000000000000400", "0000000000000400"}, testServer.ReceivedStdout())
+}
+
+func TestNetnsCommandRunnerWithCommandCapabilities(t *testing.T) {
+
+	// CAP_SETPCAP is the capability 8, CAP_SYS_ADMIN the capability 21:
+	if !hasEffectiveCapabilities(t, 8, 21) {
+		t.Skip("creating a network namespace and dropping capabilities require CAP_SYS_ADMIN and CAP_SETPCAP")
+	}
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{
+			commands.Run{
+				OriginalCommand: "RUN netns capabilities",
+				Args:            map[string]string{},
+				Command:         "netns capabilities",
+				Env:             map[string]string{},
+				Shell: commands.Shell{
+					Commands: []string{"/bin/sh", "-c", "tail -n +3 /proc/net/dev | cut -d: -f1 | tr -d ' '; grep -E '^CapEff:' /proc/self/status | cut -f2"},
+				},
+				User:    commands.DefaultUser(),
+				Workdir: commands.DefaultWorkdir(),
+			},
+		},
+	}
+
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+	// the network namespace is entered before CAP_SYS_ADMIN is dropped:
+	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithCommandRunner(NewNetnsCommandRunner("", logger.Named("netns-runner")).
+			WithCommandCapabilities(0, []string{"net_bind_service"}).
+			WithOutputMode(OutputModeLines))
+
+	assert.Nil(t, bootstrapper.Execute())
+
+	<-testServer.FinishedNotify()
+
+	assert.Equal(t, []string{"lo", "0000000000000400"}, testServer.ReceivedStdout())
+}
+
+// hasEffectiveCapabilities returns true if the test process has all the capabilities in its effective set.
+func hasEffectiveCapabilities(t *testing.T, caps ...uint) bool {
+	status, err := ioutil.ReadFile("/proc/self/status")
+	if err != nil {
+		t.Fatal("expected process status, got error", err)
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if !strings.HasPrefix(line, "CapEff:") {
+			continue
+		}
+		effective, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+		if err != nil {
+			t.Fatal("expected effective capabilities, got error", err)
+		}
+		for _, capability := range caps {
+			if effective&(1<<capability) == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func TestShellCommandRunnerWithMount(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cacheDir := filepath.Join(tempDir, "cache")
+	sourcesDir := filepath.Join(tempDir, "sources")
+	for _, dir := range []string{cacheDir, sourcesDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal("expected dir, got error", err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(sourcesDir, "source"), []byte("source\n"), 0644); err != nil {
+		t.Fatal("expected source file, got error", err)
+	}
+
+	cacheTarget := filepath.Join(tempDir, "target", "cache")
+	sourcesTarget := filepath.Join(tempDir, "target", "sources")
+
+	runner := NewShellCommandRunner(logger.Named("shell-runner")).
+		WithMount(cacheDir, cacheTarget, false).
+		WithMount(sourcesDir, sourcesTarget, true).
+		WithOutputMode(OutputModeLines)
+
+	command := commands.Run{
+		OriginalCommand: "RUN mounts",
+		Args:            map[string]string{},
+		Command:         "mounts",
+		Env:             map[string]string{},
+		Shell: commands.Shell{
+			Commands: []string{"/bin/sh", "-c", "cat " + sourcesTarget + "/source; echo cached > " + cacheTarget + "/cached; touch " + sourcesTarget + "/written || echo read-only"},
+		},
+		User:    commands.DefaultUser(),
+		Workdir: commands.DefaultWorkdir(),
+	}
+
+	grpcClient := &outputRecordingClient{}
+	if err := runner.ExecuteIndexed(0, command, grpcClient); err != nil {
+		if errors.Is(err, syscall.EPERM) {
+			t.Skip("bind mounting requires privileges", err)
+		}
+		t.Fatal("expected the command to execute, got error", err)
+	}
+
+	assert.Equal(t, []string{"source", "read-only"}, grpcClient.stdout)
+	// the cache is written through to the host directory:
+	cached, err := ioutil.ReadFile(filepath.Join(cacheDir, "cached"))
+	assert.Nil(t, err)
+	assert.Equal(t, "cached\n", string(cached))
+	// the targets are unmounted and removed after the command:
+	_, statErr := os.Stat(sourcesTarget)
+	assert.True(t, os.IsNotExist(statErr))
+}
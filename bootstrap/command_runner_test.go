@@ -0,0 +1,1057 @@
+package bootstrap
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/combust-labs/firebuild-mmds/clock"
+	"github.com/combust-labs/firebuild-shared/build/commands"
+	"github.com/combust-labs/firebuild-shared/build/rootfs"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShellCommandWriterLinesMode(t *testing.T) {
+
+	received := []string{}
+	writer := &shellCommandWriter{
+		mode: OutputModeLines,
+		writerFunc: func(p []byte) error {
+			received = append(received, string(p))
+			return nil
+		},
+	}
+
+	writer.Write([]byte("line 1\nline"))
+	writer.Write([]byte(" 2\nno trailing new line"))
+	assert.Equal(t, []string{"line 1", "line 2"}, received)
+
+	assert.Nil(t, writer.Flush())
+	assert.Equal(t, []string{"line 1", "line 2", "no trailing new line"}, received)
+
+}
+
+func TestShellCommandWriterRawMode(t *testing.T) {
+
+	received := []string{}
+	writer := &shellCommandWriter{
+		mode: OutputModeRaw,
+		writerFunc: func(p []byte) error {
+			received = append(received, string(p))
+			return nil
+		},
+	}
+
+	writer.Write([]byte("line 1\nline"))
+	assert.Nil(t, writer.Flush())
+	assert.Equal(t, []string{"line 1\nline"}, received)
+
+}
+
+func TestShellCommandRunnerLinePrefix(t *testing.T) {
+
+	runner := NewShellCommandRunner(hclog.Default()).
+		WithOutputMode(OutputModeLines).
+		WithTimestampedOutput(true).(*shellCommandRunner)
+
+	received := []string{}
+	writer := &shellCommandWriter{
+		linePrefix: runner.linePrefix(3),
+		mode:       OutputModeLines,
+		writerFunc: func(p []byte) error {
+			received = append(received, string(p))
+			return nil
+		},
+	}
+
+	writer.Write([]byte("line 1\nno trailing new line"))
+	assert.Nil(t, writer.Flush())
+	if assert.Equal(t, 2, len(received)) {
+		assert.Regexp(t, `^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}Z \[3\] line 1$`, received[0])
+		assert.Regexp(t, `^\S+ \[3\] no trailing new line$`, received[1])
+	}
+
+	// the raw output is never prefixed:
+	rawRunner := NewShellCommandRunner(hclog.Default()).
+		WithTimestampedOutput(true).(*shellCommandRunner)
+	assert.Nil(t, rawRunner.linePrefix(3))
+
+	// the timestamp is taken from the clock handed by the bootstrapper:
+	runner.setClock(clock.NewFake(time.Date(2021, 4, 1, 12, 30, 0, 0, time.UTC)))
+	assert.Equal(t, "2021-04-01T12:30:00Z [3] ", string(runner.linePrefix(3)()))
+}
+
+func TestShellCommandRunnerCompressedLogs(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	logDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(logDir)
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{
+			commands.Run{
+				OriginalCommand: "RUN echo logged output",
+				Args:            map[string]string{},
+				Command:         "echo logged output",
+				Env:             map[string]string{},
+				Shell: commands.Shell{
+					Commands: []string{"/bin/echo", "-e"},
+				},
+				User:    commands.DefaultUser(),
+				Workdir: commands.DefaultWorkdir(),
+			},
+		},
+	}
+
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithCommandRunner(NewShellCommandRunner(logger.Named("shell-runner")).
+			WithOutputMode(OutputModeLines).
+			WithCompressedLogDir(logDir))
+
+	assert.Nil(t, bootstrapper.Execute())
+
+	<-testServer.FinishedNotify()
+
+	serverOutput := testServer.ReceivedStdout()
+	assert.Equal(t, 1, len(serverOutput))
+
+	logFile, err := os.Open(filepath.Join(logDir, "cmd-0.log.gz"))
+	if err != nil {
+		t.Fatal("expected compressed log file, got error", err)
+	}
+	defer logFile.Close()
+	gzReader, err := gzip.NewReader(logFile)
+	if err != nil {
+		t.Fatal("expected gzip reader, got error", err)
+	}
+	logContents, err := ioutil.ReadAll(gzReader)
+	assert.Nil(t, err)
+	assert.Equal(t, serverOutput[0]+"\n", string(logContents))
+
+}
+
+func TestShellCommandRunnerSecrets(t *testing.T) {
+
+	if os.Geteuid() != 0 {
+		t.Skip("mounting the secrets directory requires root")
+	}
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	secretsDir := filepath.Join(tempDir, "secrets")
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{
+			commands.Run{
+				OriginalCommand: "RUN --mount=type=secret,id=token cat /run/secrets/token",
+				Args:            map[string]string{},
+				Command:         "cat /run/secrets/token",
+				Env:             map[string]string{},
+				Shell: commands.Shell{
+					Commands: []string{"/bin/sh", "-c", "cat " + filepath.Join(secretsDir, "token")},
+				},
+				User:    commands.DefaultUser(),
+				Workdir: commands.DefaultWorkdir(),
+			},
+		},
+	}
+
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithCommandRunner(NewShellCommandRunner(logger.Named("shell-runner")).
+			WithSecretsDir(secretsDir).
+			WithSecret("token", []byte("secret-value")))
+
+	assert.Nil(t, bootstrapper.Execute())
+
+	<-testServer.FinishedNotify()
+
+	serverOutput := testServer.ReceivedStdout()
+	assert.Equal(t, []string{"secret-value"}, serverOutput)
+
+	_, statErr := os.Stat(filepath.Join(secretsDir, "token"))
+	assert.True(t, os.IsNotExist(statErr))
+}
+
+func TestShellCommandRunnerWithPath(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	toolDir := filepath.Join(tempDir, "opt/bin")
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{
+			commands.Run{
+				OriginalCommand: "RUN install firebuild-tool",
+				Args:            map[string]string{},
+				Command:         "install firebuild-tool",
+				Env:             map[string]string{},
+				Shell: commands.Shell{
+					Commands: []string{"/bin/sh", "-c", "mkdir -p " + toolDir +
+						" && printf '#!/bin/sh\\necho tool-output\\n' > " + filepath.Join(toolDir, "firebuild-tool") +
+						" && chmod +x " + filepath.Join(toolDir, "firebuild-tool")},
+				},
+				User:    commands.DefaultUser(),
+				Workdir: commands.DefaultWorkdir(),
+			},
+			commands.Run{
+				OriginalCommand: "RUN firebuild-tool",
+				Args:            map[string]string{},
+				Command:         "firebuild-tool",
+				Env:             map[string]string{},
+				Shell: commands.Shell{
+					Commands: []string{"/bin/sh", "-c", "firebuild-tool"},
+				},
+				User:    commands.DefaultUser(),
+				Workdir: commands.DefaultWorkdir(),
+			},
+		},
+	}
+
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithCommandRunner(NewShellCommandRunner(logger.Named("shell-runner")).
+			WithOutputMode(OutputModeLines).
+			WithPath(toolDir + ":" + os.Getenv("PATH")))
+
+	assert.Nil(t, bootstrapper.Execute())
+
+	<-testServer.FinishedNotify()
+
+	assert.Equal(t, []string{"tool-output"}, testServer.ReceivedStdout())
+}
+
+func TestShellCommandRunnerOutputFlushInterval(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+	marker := filepath.Join(tempDir, "marker")
+
+	fake := clock.NewFake(time.Now())
+	runner := NewShellCommandRunner(logger.Named("shell-runner")).
+		WithOutputFlushInterval(time.Minute).
+		WithOutputMode(OutputModeLines)
+	runner.(*shellCommandRunner).setClock(fake)
+
+	grpcClient := &batchRecordingClient{}
+	result := make(chan error, 1)
+	go func() {
+		result <- runner.ExecuteIndexed(0, commands.Run{
+			OriginalCommand: "RUN batched output",
+			Args:            map[string]string{},
+			Command:         "batched output",
+			Env:             map[string]string{},
+			Shell: commands.Shell{
+				Commands: []string{"/bin/sh", "-c", "echo line 1 && echo line 2 && while [ ! -f " + marker + " ]; do sleep 0.01; done && echo line 3"},
+			},
+			User:    commands.DefaultUser(),
+			Workdir: commands.DefaultWorkdir(),
+		}, grpcClient)
+	}()
+
+	// the buffered output is delivered when the clock of the runner passes the flush interval:
+	fake.BlockUntil(1)
+	deadline := time.Now().Add(time.Second * 5)
+	for len(grpcClient.lines()) < 2 && time.Now().Before(deadline) {
+		fake.Advance(time.Minute)
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Equal(t, []string{"line 1", "line 2"}, grpcClient.lines())
+
+	if err := ioutil.WriteFile(marker, []byte{}, 0644); err != nil {
+		t.Fatal("expected marker file, got error", err)
+	}
+	assert.Nil(t, <-result)
+	assert.Equal(t, []string{"line 1", "line 2", "line 3"}, grpcClient.lines())
+}
+
+// batchRecordingClient records the output delivered to the server, safe for concurrent use.
+type batchRecordingClient struct {
+	rootfs.ClientProvider
+	sync.Mutex
+	stdout []string
+}
+
+func (c *batchRecordingClient) StdErr(lines []string) error {
+	return nil
+}
+
+func (c *batchRecordingClient) StdOut(lines []string) error {
+	c.Lock()
+	defer c.Unlock()
+	c.stdout = append(c.stdout, lines...)
+	return nil
+}
+
+func (c *batchRecordingClient) lines() []string {
+	c.Lock()
+	defer c.Unlock()
+	return append([]string{}, c.stdout...)
+}
+
+func TestShellCommandRunnerOutputIdleTimeout(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	fake := clock.NewFake(time.Now())
+	runner := NewShellCommandRunner(logger.Named("shell-runner")).
+		WithOutputIdleTimeout(time.Minute).
+		WithOutputMode(OutputModeLines)
+	runner.(*shellCommandRunner).setClock(fake)
+
+	result := make(chan error, 1)
+	go func() {
+		result <- runner.ExecuteIndexed(0, commands.Run{
+			OriginalCommand: "RUN hung",
+			Args:            map[string]string{},
+			Command:         "hung",
+			Env:             map[string]string{},
+			Shell: commands.Shell{
+				Commands: []string{"/bin/sh", "-c", "exec sleep 10"},
+			},
+			User:    commands.DefaultUser(),
+			Workdir: commands.DefaultWorkdir(),
+		}, &outputRecordingClient{})
+	}()
+
+	// the idle timeout is measured by the clock of the runner:
+	fake.BlockUntil(1)
+	started := time.Now()
+	fake.Advance(time.Minute)
+	executeErr := <-result
+	assert.True(t, errors.Is(executeErr, ErrOutputIdleTimeout), executeErr)
+	assert.True(t, time.Since(started) < time.Second*5)
+}
+
+func TestIdleWatchdog(t *testing.T) {
+
+	var nilWatchdog *idleWatchdog
+	nilWatchdog.start(func() {})
+	nilWatchdog.reset()
+	assert.False(t, nilWatchdog.stop())
+	assert.Nil(t, newIdleWatchdog(clock.Real(), 0))
+
+	fake := clock.NewFake(time.Now())
+	chanIdle := make(chan struct{})
+	watchdog := newIdleWatchdog(fake, time.Minute)
+	watchdog.start(func() { close(chanIdle) })
+
+	// the output restarts the timeout:
+	fake.Advance(30 * time.Second)
+	watchdog.reset()
+	fake.Advance(30 * time.Second)
+	select {
+	case <-chanIdle:
+		t.Fatal("expected the watchdog not to fire after the output")
+	default:
+	}
+
+	fake.Advance(30 * time.Second)
+	<-chanIdle
+	assert.True(t, watchdog.stop())
+}
+
+func TestClampPriority(t *testing.T) {
+	assert.Equal(t, -20, clampNiceness(-100))
+	assert.Equal(t, 5, clampNiceness(5))
+	assert.Equal(t, 19, clampNiceness(100))
+	assert.Equal(t, ioPriority{class: IOPriorityClassIdle, level: 0}, clampIOPriority(IOPriorityClassIdle, -1))
+	assert.Equal(t, ioPriority{class: IOPriorityClassBestEffort, level: 7}, clampIOPriority(IOPriorityClass(42), 100))
+}
+
+func TestOutputBatcher(t *testing.T) {
+
+	batches := [][]string{}
+	flushed := make(chan struct{}, 1)
+	fake := clock.NewFake(time.Now())
+	batcher := newOutputBatcher(fake, time.Hour, func(lines []string) error {
+		batches = append(batches, lines)
+		flushed <- struct{}{}
+		return nil
+	})
+
+	assert.Nil(t, batcher.add("line 1"))
+	assert.Nil(t, batcher.add("line 2"))
+	// the output is delivered every time the clock of the batcher passes the flush interval:
+	fake.Advance(time.Minute)
+	select {
+	case <-flushed:
+		t.Fatal("expected no delivery before the flush interval")
+	case <-time.After(time.Millisecond * 50):
+	}
+	fake.Advance(time.Hour)
+	<-flushed
+	assert.Nil(t, batcher.flush())
+	assert.Nil(t, batcher.add("line 3"))
+	assert.Nil(t, batcher.Close())
+
+	assert.Equal(t, [][]string{{"line 1", "line 2"}, {"line 3"}}, batches)
+}
+
+func TestResourceTrackingCommandRunnerWallTime(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	commandRunner := NewResourceTrackingCommandRunner(NewScriptedCommandRunner(map[int]ScriptedResult{
+		0: {Delay: time.Minute, Stdout: []string{"delayed"}},
+	}), logger.Named("usage"))
+	// the clock is handed over to the inner runner:
+	fake := clock.NewFake(time.Now())
+	commandRunner.(clockReceiver).setClock(fake)
+
+	grpcClient := &outputRecordingClient{}
+	assert.Nil(t, commandRunner.ExecuteIndexed(0, testRunCommand("echo delayed"), grpcClient))
+	assert.Equal(t, []string{"delayed"}, grpcClient.stdout)
+
+	usage := commandRunner.Usage()
+	if assert.Equal(t, 1, len(usage)) {
+		assert.Equal(t, time.Minute, usage[0].WallTime)
+	}
+}
+
+func TestShellCommandRunnerCleanEnvironment(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	t.Setenv("FIREBUILD_TEST_ALLOWED", "allowed")
+	t.Setenv("FIREBUILD_TEST_LEAKED", "leaked")
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{
+			commands.Run{
+				OriginalCommand: "RUN print environment",
+				Args:            map[string]string{},
+				Command:         "print environment",
+				Env:             map[string]string{},
+				Shell: commands.Shell{
+					Commands: []string{"/bin/sh", "-c", "echo ${FIREBUILD_TEST_ALLOWED:-unset} ${FIREBUILD_TEST_LEAKED:-unset} ${HOME:-unset}"},
+				},
+				User:    commands.DefaultUser(),
+				Workdir: commands.DefaultWorkdir(),
+			},
+		},
+	}
+
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithCommandRunner(NewShellCommandRunner(logger.Named("shell-runner")).
+			WithCleanEnvironment(true).
+			WithEnvAllowlist([]string{"FIREBUILD_TEST_ALLOWED"}).
+			WithOutputMode(OutputModeLines))
+
+	assert.Nil(t, bootstrapper.Execute())
+
+	<-testServer.FinishedNotify()
+
+	assert.Equal(t, []string{"allowed unset unset"}, testServer.ReceivedStdout())
+}
+
+func TestShellCommandRunnerLoginShell(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(tempDir, ".profile"), []byte("export PATH=\"/opt/login/bin:$PATH\"\n"), 0644))
+
+	execute := func(loginShell bool) []string {
+		buildCtx := &rootfs.WorkContext{
+			ExecutableCommands: []commands.VMInitSerializableCommand{
+				commands.Run{
+					OriginalCommand: "RUN print path",
+					Args:            map[string]string{},
+					Command:         "print path",
+					Env:             map[string]string{},
+					Shell: commands.Shell{
+						Commands: []string{"/bin/sh", "-c", "case \"$PATH\" in /opt/login/bin:*) echo login ;; *) echo default ;; esac; echo $HOME"},
+					},
+					User:    commands.DefaultUser(),
+					Workdir: commands.DefaultWorkdir(),
+				},
+			},
+		}
+
+		testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+		runner := NewShellCommandRunner(logger.Named("shell-runner")).
+			WithLoginShell(loginShell).
+			WithOutputMode(OutputModeLines)
+		runner.(*shellCommandRunner).lookupHome = func(cmdUser commands.User) (string, error) {
+			assert.Equal(t, commands.DefaultUser(), cmdUser)
+			return tempDir, nil
+		}
+
+		assert.Nil(t, NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+			WithCommandRunner(runner).
+			Execute())
+
+		<-testServer.FinishedNotify()
+		return testServer.ReceivedStdout()
+	}
+
+	assert.Equal(t, []string{"default", os.Getenv("HOME")}, execute(false))
+	assert.Equal(t, []string{"login", tempDir}, execute(true))
+
+	// every runner resolves the home directory of the login shell:
+	for _, runner := range []ShellCommandRunner{
+		NewShellCommandRunner(logger),
+		NewCgroupLimitedCommandRunner(CgroupLimits{}, logger),
+		NewNetnsCommandRunner("/proc/self/ns/net", logger),
+	} {
+		assert.NotNil(t, runner.(*shellCommandRunner).lookupHome)
+	}
+
+	args, login := loginShellArgs([]string{"/bin/bash", "-c"})
+	assert.True(t, login)
+	assert.Equal(t, []string{"/bin/bash", "-l", "-c"}, args)
+	args, login = loginShellArgs([]string{"/bin/sh", "-l", "-c"})
+	assert.True(t, login)
+	assert.Equal(t, []string{"/bin/sh", "-l", "-c"}, args)
+	args, login = loginShellArgs([]string{"/usr/bin/python3", "-c"})
+	assert.False(t, login)
+	assert.Equal(t, []string{"/usr/bin/python3", "-c"}, args)
+}
+
+func TestAllowedEnvironment(t *testing.T) {
+	assert.Equal(t, []string{"HOME=/root", "EMPTY="},
+		allowedEnvironment([]string{"HOME=/root", "HOMEDIR=/home", "EMPTY=", "PATH=/bin"}, []string{"HOME", "EMPTY"}))
+	assert.Equal(t, []string{}, allowedEnvironment([]string{"HOME=/root"}, nil))
+}
+
+func TestShellCommandRunnerFailureDetails(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{
+			commands.Run{
+				OriginalCommand: "RUN login ${TOKEN} --region ${REGION}",
+				Args: map[string]string{
+					"REGION": "eu-central-1",
+				},
+				Command: "login ${TOKEN} --region ${REGION}",
+				Env: map[string]string{
+					"TOKEN": "sensitive-token",
+				},
+				Shell: commands.Shell{
+					Commands: []string{"/bin/sh", "-c", "exit 3"},
+				},
+				User:    commands.DefaultUser(),
+				Workdir: commands.DefaultWorkdir(),
+			},
+		},
+	}
+
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithCommandRunner(NewShellCommandRunner(logger.Named("shell-runner")).
+			WithSensitiveEnv([]string{"TOKEN"}))
+
+	bootstrapErr := bootstrapper.Execute()
+	assert.NotNil(t, bootstrapErr)
+
+	<-testServer.FinishedNotify()
+
+	assert.Contains(t, bootstrapErr.Error(), "command exited with code: 3")
+	assert.Contains(t, bootstrapErr.Error(), `command "login `+sensitiveEnvRedaction+` --region eu-central-1"`)
+	assert.Contains(t, bootstrapErr.Error(), `shell "/bin/sh -c exit 3"`)
+	assert.Contains(t, bootstrapErr.Error(), `workdir "/"`)
+	assert.NotContains(t, bootstrapErr.Error(), "sensitive-token")
+}
+
+func TestShellCommandRunnerRetryHint(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	newCommand := func(marker string, attempts string) commands.Run {
+		return commands.Run{
+			OriginalCommand: "RUN flaky",
+			Args: map[string]string{
+				RetryAttemptsArg: attempts,
+				RetryBackoffArg:  "1h",
+			},
+			Command: "flaky",
+			Env:     map[string]string{},
+			Shell: commands.Shell{
+				// fails on the first attempt only:
+				Commands: []string{"/bin/sh", "-c", "test -f " + marker + " || { touch " + marker + "; exit 1; }"},
+			},
+			User:    commands.DefaultUser(),
+			Workdir: commands.DefaultWorkdir(),
+		}
+	}
+
+	fake := clock.NewFake(time.Now())
+	runner := NewShellCommandRunner(logger.Named("shell-runner"))
+	runner.(*shellCommandRunner).setClock(fake)
+
+	result := make(chan error, 1)
+	go func() {
+		result <- runner.ExecuteIndexed(0, newCommand(filepath.Join(tempDir, "retried"), "2"), &outputRecordingClient{})
+	}()
+
+	// the retry waits for the backoff on the clock of the runner:
+	fake.BlockUntil(1)
+	select {
+	case err := <-result:
+		t.Fatal("expected the retry to wait for the backoff, got", err)
+	default:
+	}
+	fake.Advance(time.Hour)
+	assert.Nil(t, <-result)
+
+	// without the hint, the command is executed once:
+	assert.NotNil(t, runner.ExecuteIndexed(0, newCommand(filepath.Join(tempDir, "once"), ""), &outputRecordingClient{}))
+}
+
+func TestShellCommandRunnerFailureOutput(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	failureDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(failureDir)
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{
+			commands.Run{
+				OriginalCommand: "RUN echo succeeded",
+				Args:            map[string]string{},
+				Command:         "echo succeeded",
+				Env:             map[string]string{},
+				Shell: commands.Shell{
+					Commands: []string{"/bin/echo", "-e"},
+				},
+				User:    commands.DefaultUser(),
+				Workdir: commands.DefaultWorkdir(),
+			},
+			commands.Run{
+				OriginalCommand: "RUN failing-command",
+				Args:            map[string]string{},
+				Command:         "failing-command",
+				Env:             map[string]string{},
+				Shell: commands.Shell{
+					Commands: []string{"/bin/sh", "-c", "echo out-line; echo err-line >&2; exit 2"},
+				},
+				User:    commands.DefaultUser(),
+				Workdir: commands.DefaultWorkdir(),
+			},
+		},
+	}
+
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithCommandRunner(NewShellCommandRunner(logger.Named("shell-runner")).
+			WithFailureOutputDir(failureDir))
+
+	assert.NotNil(t, bootstrapper.Execute())
+
+	<-testServer.FinishedNotify()
+
+	// only the failed command output is preserved:
+	_, statErr := os.Stat(filepath.Join(failureDir, "cmd-0.failure.log"))
+	assert.True(t, os.IsNotExist(statErr))
+
+	failureLog, err := ioutil.ReadFile(filepath.Join(failureDir, "cmd-1.failure.log"))
+	if err != nil {
+		t.Fatal("expected failure output, got error", err)
+	}
+	assert.Contains(t, string(failureLog), `command "failing-command"`)
+	assert.Contains(t, string(failureLog), "command exited with code: 2")
+	assert.Contains(t, string(failureLog), "--- stdout ---\nout-line\n")
+	assert.Contains(t, string(failureLog), "--- stderr ---\nerr-line\n")
+}
+
+func TestFilesystemSnapshotDiff(t *testing.T) {
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	ioutil.WriteFile(filepath.Join(tempDir, "modified"), []byte("before"), 0644)
+	ioutil.WriteFile(filepath.Join(tempDir, "deleted"), []byte("before"), 0644)
+	ioutil.WriteFile(filepath.Join(tempDir, "unchanged"), []byte("before"), 0644)
+
+	before := takeFilesystemSnapshot([]string{tempDir}, DefaultFilesystemDiffMaxEntries)
+	assert.False(t, before.truncated)
+
+	ioutil.WriteFile(filepath.Join(tempDir, "modified"), []byte("after, longer"), 0644)
+	os.Remove(filepath.Join(tempDir, "deleted"))
+	ioutil.WriteFile(filepath.Join(tempDir, "created"), []byte("after"), 0644)
+
+	diff := before.diff(takeFilesystemSnapshot([]string{tempDir}, DefaultFilesystemDiffMaxEntries))
+	assert.Equal(t, []string{filepath.Join(tempDir, "created")}, diff.created)
+	assert.Equal(t, []string{filepath.Join(tempDir, "deleted")}, diff.deleted)
+	assert.Contains(t, diff.modified, filepath.Join(tempDir, "modified"))
+	assert.NotContains(t, diff.modified, filepath.Join(tempDir, "unchanged"))
+
+	truncated := takeFilesystemSnapshot([]string{tempDir}, 2)
+	assert.True(t, truncated.truncated)
+	assert.Equal(t, 2, len(truncated.entries))
+}
+
+func TestShellCommandRunnerSyslog(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	newCommand := func(script string) commands.Run {
+		return commands.Run{
+			OriginalCommand: "RUN syslog",
+			Args:            map[string]string{},
+			Command:         "syslog",
+			Env:             map[string]string{},
+			Shell: commands.Shell{
+				Commands: []string{"/bin/sh", "-c", script},
+			},
+			User:    commands.DefaultUser(),
+			Workdir: commands.DefaultWorkdir(),
+		}
+	}
+
+	runner := NewShellCommandRunner(logger.Named("shell-runner")).
+		WithOutputMode(OutputModeLines).
+		WithSyslog("firebuild").(*shellCommandRunner)
+	sysLog := &recordingSyslog{}
+	runner.syslog = sysLog
+	runner.syslogOnce.Do(func() {})
+
+	assert.Nil(t, runner.ExecuteIndexed(0, newCommand("echo out"), &outputRecordingClient{}))
+	assert.NotNil(t, runner.ExecuteIndexed(1, newCommand("echo err >&2; exit 3"), &outputRecordingClient{}))
+
+	assert.Equal(t, 5, len(sysLog.info))
+	if assert.Equal(t, 1, len(sysLog.err)) {
+		assert.Contains(t, sysLog.err[0], "[1] command failed: command exited with code: 3")
+	}
+	assert.Contains(t, sysLog.info[0], "[0] command started")
+	assert.Equal(t, "[0] stdout: out", sysLog.info[1])
+	assert.Equal(t, "[0] command finished successfully", sysLog.info[2])
+	assert.Equal(t, "[1] stderr: err", sysLog.info[len(sysLog.info)-1])
+
+	// an unavailable syslog does not fail the command:
+	assert.Nil(t, NewShellCommandRunner(logger.Named("shell-runner")).
+		WithSyslog("firebuild").
+		Execute(newCommand("true"), &outputRecordingClient{}))
+}
+
+// recordingSyslog records the messages written to the syslog.
+type recordingSyslog struct {
+	err  []string
+	info []string
+}
+
+func (s *recordingSyslog) Err(message string) error {
+	s.err = append(s.err, message)
+	return nil
+}
+
+func (s *recordingSyslog) Info(message string) error {
+	s.info = append(s.info, message)
+	return nil
+}
+
+func TestShellCommandRunnerCancelDrainsOutput(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	cmd := commands.Run{
+		OriginalCommand: "RUN cancelled",
+		Args:            map[string]string{},
+		Command:         "cancelled",
+		Env:             map[string]string{},
+		Shell: commands.Shell{
+			// the partial line stays buffered until the command finishes:
+			Commands: []string{"/bin/sh", "-c", "echo complete && printf partial && exec sleep 10"},
+		},
+		User:    commands.DefaultUser(),
+		Workdir: commands.DefaultWorkdir(),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	time.AfterFunc(time.Millisecond*300, cancel)
+
+	grpcClient := &outputRecordingClient{}
+	runner := NewShellCommandRunner(logger.Named("shell-runner")).
+		WithOutputMode(OutputModeLines)
+
+	started := time.Now()
+	executeErr := runner.ExecuteContext(ctx, 0, cmd, grpcClient)
+	assert.NotNil(t, executeErr)
+	assert.True(t, errors.Is(executeErr, context.Canceled))
+	assert.Contains(t, executeErr.Error(), "7 bytes of buffered output flushed")
+	assert.True(t, time.Since(started) < time.Second*5)
+	assert.Equal(t, []string{"complete", "partial"}, grpcClient.stdout)
+}
+
+func TestShellCommandRunnerFactCapture(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	newCommand := func(script string) commands.Run {
+		return commands.Run{
+			OriginalCommand: "RUN " + script,
+			Args:            map[string]string{},
+			Command:         script,
+			Env:             map[string]string{},
+			Shell: commands.Shell{
+				Commands: []string{"/bin/sh", "-c"},
+			},
+			User:    commands.DefaultUser(),
+			Workdir: commands.DefaultWorkdir(),
+		}
+	}
+
+	grpcClient := &outputRecordingClient{}
+	// the host environment would be exported in the command file:
+	runner := NewShellCommandRunner(logger.Named("shell-runner")).
+		WithCleanEnvironment(true).
+		WithFactCapture(0, func(stdout string) (map[string]string, error) {
+			return map[string]string{"DETECTED_ARCH": strings.TrimSpace(stdout)}, nil
+		}).
+		WithFactCapture(2, func(stdout string) (map[string]string, error) {
+			return nil, errors.New("unexpected output")
+		}).
+		WithOutputMode(OutputModeLines)
+
+	assert.Nil(t, runner.ExecuteIndexed(0, newCommand("echo x86_64"), grpcClient))
+	assert.Nil(t, runner.ExecuteIndexed(1, newCommand("echo arch $DETECTED_ARCH"), grpcClient))
+	assert.Equal(t, []string{"x86_64", "arch x86_64"}, grpcClient.stdout)
+
+	parseErr := runner.ExecuteIndexed(2, newCommand("echo garbage"), grpcClient)
+	assert.NotNil(t, parseErr)
+	assert.Contains(t, parseErr.Error(), "unexpected output")
+}
+
+func TestShellCommandRunnerTrailingNewline(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	// a line continuation on the last line is completed only by the trailing new line:
+	cmd := commands.Run{
+		OriginalCommand: "RUN echo continued \\",
+		Args:            map[string]string{},
+		Command:         "echo continued \\",
+		Env:             map[string]string{},
+		Shell: commands.Shell{
+			Commands: []string{"/bin/sh", "-c"},
+		},
+		User:    commands.DefaultUser(),
+		Workdir: commands.DefaultWorkdir(),
+	}
+
+	verbatimClient := &outputRecordingClient{}
+	// the host environment would be exported in the command file:
+	assert.Nil(t, NewShellCommandRunner(logger.Named("shell-runner")).
+		WithCleanEnvironment(true).
+		WithOutputMode(OutputModeLines).
+		ExecuteIndexed(0, cmd, verbatimClient))
+	assert.Equal(t, []string{"continued \\"}, verbatimClient.stdout)
+
+	terminatedClient := &outputRecordingClient{}
+	assert.Nil(t, NewShellCommandRunner(logger.Named("shell-runner")).
+		WithCleanEnvironment(true).
+		WithOutputMode(OutputModeLines).
+		WithTrailingNewline(true).
+		ExecuteIndexed(0, cmd, terminatedClient))
+	assert.Equal(t, []string{"continued"}, terminatedClient.stdout)
+
+	runner := NewShellCommandRunner(logger).WithTrailingNewline(true).(*shellCommandRunner)
+	assert.Equal(t, "echo\n", runner.commandText("echo"))
+	assert.Equal(t, "echo\n", runner.commandText("echo\n"))
+}
+
+func TestShellCommandRunnerStdoutRedirect(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	target := filepath.Join(tempDir, "output.log")
+	rootfs.MustPutTestResource(t, target, []byte("previous contents which are longer"))
+
+	cmd := commands.Run{
+		OriginalCommand: "RUN redirected",
+		Args:            map[string]string{},
+		Command:         "redirected",
+		Env:             map[string]string{},
+		Shell: commands.Shell{
+			Commands: []string{"/bin/sh", "-c", "echo to file && echo to stderr >&2"},
+		},
+		User:    commands.DefaultUser(),
+		Workdir: commands.DefaultWorkdir(),
+	}
+
+	grpcClient := &outputRecordingClient{}
+	assert.Nil(t, NewShellCommandRunner(logger.Named("shell-runner")).
+		WithOutputMode(OutputModeLines).
+		WithStdoutRedirect(0, target, fs.FileMode(0600)).
+		ExecuteIndexed(0, cmd, grpcClient))
+
+	assert.Equal(t, 0, len(grpcClient.stdout))
+	assert.Equal(t, []string{"to stderr"}, grpcClient.stderr)
+	contents, err := ioutil.ReadFile(target)
+	assert.Nil(t, err)
+	assert.Equal(t, "to file\n", string(contents))
+	stat, err := os.Stat(target)
+	assert.Nil(t, err)
+	assert.Equal(t, fs.FileMode(0600), stat.Mode().Perm())
+}
+
+func TestShellCommandRunnerBinaryAllowlist(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	binDir := filepath.Join(tempDir, "bin")
+	marker := filepath.Join(tempDir, "executed")
+	for _, name := range []string{"allowed", "denied"} {
+		rootfs.MustPutTestResource(t, filepath.Join(binDir, name), []byte("#!/bin/sh\necho "+name+" >> "+marker+"\n"))
+		assert.Nil(t, os.Chmod(filepath.Join(binDir, name), 0755))
+	}
+
+	newRun := func(command string) commands.Run {
+		return commands.Run{
+			OriginalCommand: "RUN " + command,
+			Args:            map[string]string{},
+			Command:         command,
+			Env:             map[string]string{},
+			Shell: commands.Shell{
+				Commands: []string{"/bin/sh", "-c"},
+			},
+			User:    commands.DefaultUser(),
+			Workdir: commands.Workdir{Value: tempDir},
+		}
+	}
+
+	runner := NewShellCommandRunner(logger.Named("shell-runner")).
+		WithBinaryAllowlist([]string{filepath.Join(binDir, "allowed")}).
+		WithCleanEnvironment(true).
+		WithPath(binDir)
+
+	assert.Nil(t, runner.ExecuteIndexed(0, newRun("allowed"), &outputRecordingClient{}))
+	assert.Nil(t, runner.ExecuteIndexed(1, newRun("KEY=value allowed --flag"), &outputRecordingClient{}))
+	assert.Nil(t, runner.ExecuteIndexed(2, newRun("./bin/allowed"), &outputRecordingClient{}))
+
+	for index, command := range []string{"denied", "bin/denied", "echo builtin", "missing"} {
+		runErr := runner.ExecuteIndexed(3+index, newRun(command), &outputRecordingClient{})
+		assert.True(t, errors.Is(runErr, ErrBinaryNotAllowed), command)
+	}
+
+	// the rejected commands are not executed:
+	executed, err := ioutil.ReadFile(marker)
+	assert.Nil(t, err)
+	assert.Equal(t, "allowed\nallowed\nallowed\n", string(executed))
+}
+
+func TestShellCommandRunnerRetryErrorClassifier(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	counter := filepath.Join(tempDir, "attempts")
+	cmd := commands.Run{
+		OriginalCommand: "RUN failing",
+		Args:            map[string]string{RetryAttemptsArg: "3"},
+		Command:         "failing",
+		Env:             map[string]string{},
+		Shell: commands.Shell{
+			Commands: []string{"/bin/sh", "-c", "echo attempt >> " + counter + " && exit 1"},
+		},
+		User:    commands.DefaultUser(),
+		Workdir: commands.DefaultWorkdir(),
+	}
+
+	runner := NewShellCommandRunner(logger.Named("shell-runner"))
+	runner.(errorClassifierReceiver).setErrorClassifier(func(err error) ErrorClass {
+		return ErrorClassPermanent
+	})
+
+	assert.NotNil(t, runner.ExecuteIndexed(0, cmd, &outputRecordingClient{}))
+	contents, err := ioutil.ReadFile(counter)
+	assert.Nil(t, err)
+	// the exit error classified as permanent is not retried:
+	assert.Equal(t, "attempt\n", string(contents))
+}
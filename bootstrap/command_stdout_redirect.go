@@ -0,0 +1,46 @@
+package bootstrap
+
+import (
+	"io/fs"
+	"os"
+
+	"github.com/combust-labs/firebuild-shared/build/commands"
+	"github.com/pkg/errors"
+)
+
+// stdoutRedirect is a file the stdout of a command is written to instead of being delivered to the server.
+type stdoutRedirect struct {
+	mode   fs.FileMode
+	target string
+}
+
+// openStdoutRedirect opens the stdout redirect target of the command at the index, truncated,
+// with the mode and owned by the user of the command. Returns nil if the stdout is not redirected.
+func (n *shellCommandRunner) openStdoutRedirect(index int, cmd commands.Run) (*os.File, error) {
+	redirect, ok := n.stdoutRedirects[index]
+	if !ok {
+		return nil, nil
+	}
+	file, err := os.OpenFile(redirect.target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, redirect.mode)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed opening stdout redirect target '%s'", redirect.target)
+	}
+	// the mode of a created file is masked with the umask:
+	if err := file.Chmod(redirect.mode); err != nil {
+		file.Close()
+		return nil, errors.Wrapf(err, "failed chmoding stdout redirect target '%s'", redirect.target)
+	}
+	if cmd.User.Value != n.defaultUser.Value {
+		uid, gid, err := (&userResolver{}).resolve(cmd.User.Value)
+		if err != nil {
+			file.Close()
+			return nil, errors.Wrapf(err, "failed resolving the owner of stdout redirect target '%s'", redirect.target)
+		}
+		if err := file.Chown(uid, gid); err != nil {
+			file.Close()
+			return nil, errors.Wrapf(err, "failed chowning stdout redirect target '%s'", redirect.target)
+		}
+	}
+	n.logger.Debug("command stdout redirected", "index", index, "target", redirect.target)
+	return file, nil
+}
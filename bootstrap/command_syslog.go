@@ -0,0 +1,55 @@
+package bootstrap
+
+import (
+	"fmt"
+	"strings"
+)
+
+// syslogWriter writes messages to the local syslog with a priority.
+type syslogWriter interface {
+	Err(string) error
+	Info(string) error
+}
+
+// commandSyslog returns the syslog writer of the runner, connecting to the local syslog on first use.
+// When the syslog is unavailable, a warning is logged once and nil is returned.
+func (n *shellCommandRunner) commandSyslog() syslogWriter {
+	if n.syslogTag == "" {
+		return nil
+	}
+	n.syslogOnce.Do(func() {
+		writer, err := dialSyslog(n.syslogTag)
+		if err != nil {
+			n.logger.Warn("syslog unavailable, commands are not logged to syslog", "tag", n.syslogTag, "reason", err)
+			return
+		}
+		n.syslog = writer
+	})
+	return n.syslog
+}
+
+// syslogInfo writes the message to the syslog with the info priority, the errors are ignored.
+func syslogInfo(writer syslogWriter, format string, args ...interface{}) {
+	if writer == nil {
+		return
+	}
+	writer.Info(fmt.Sprintf(format, args...))
+}
+
+// syslogErr writes the message to the syslog with the err priority, the errors are ignored.
+func syslogErr(writer syslogWriter, format string, args ...interface{}) {
+	if writer == nil {
+		return
+	}
+	writer.Err(fmt.Sprintf(format, args...))
+}
+
+// syslogOutput writes every line of the command output to the syslog with the info priority.
+func syslogOutput(writer syslogWriter, index int, stream string, p []byte) {
+	if writer == nil {
+		return
+	}
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		writer.Info(fmt.Sprintf("[%d] %s: %s", index, stream, line))
+	}
+}
@@ -0,0 +1,10 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package bootstrap
+
+import "fmt"
+
+func dialSyslog(tag string) (syslogWriter, error) {
+	return nil, fmt.Errorf("syslog is not supported on this platform")
+}
@@ -0,0 +1,10 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package bootstrap
+
+import "log/syslog"
+
+func dialSyslog(tag string) (syslogWriter, error) {
+	return syslog.New(syslog.LOG_INFO|syslog.LOG_USER, tag)
+}
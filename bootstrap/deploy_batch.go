@@ -0,0 +1,166 @@
+package bootstrap
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// smallFileBatchBytes is the minimum size of the preallocated small files batch buffer.
+	smallFileBatchBytes = 4 * 1024 * 1024
+	// smallFileBatchFiles is the maximum number of files written in a single batch.
+	smallFileBatchFiles = 256
+)
+
+// smallFileBatch collects the contents of the small files in a preallocated buffer,
+// the files are written together and made durable with a single sync per file system.
+type smallFileBatch struct {
+	buffer       []byte
+	files        []*batchedFile
+	destinations map[string]bool
+	threshold    int
+	used         int
+}
+
+type batchedFile struct {
+	contents    []byte
+	destination string
+	finish      func() error
+	mode        os.FileMode
+}
+
+func newSmallFileBatch(threshold int) *smallFileBatch {
+	size := smallFileBatchBytes
+	if size < threshold+1 {
+		size = threshold + 1
+	}
+	return &smallFileBatch{
+		buffer:       make([]byte, size),
+		destinations: map[string]bool{},
+		threshold:    threshold,
+	}
+}
+
+// read reads the contents up to the threshold into the free space of the buffer. Returns the read
+// contents and true if the complete contents were read, otherwise the contents read so far
+// followed by the remaining contents are not a small file. The read contents are valid until
+// the next read or add.
+func (b *smallFileBatch) read(contents io.Reader) ([]byte, bool, error) {
+	region := b.buffer[b.used : b.used+b.threshold+1]
+	read, err := io.ReadFull(contents, region)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return region[:read], true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return region[:read], false, nil
+}
+
+// add adds the contents returned by the last read to the batch.
+func (b *smallFileBatch) add(destination string, mode os.FileMode, contents []byte) {
+	b.files = append(b.files, &batchedFile{contents: contents, destination: destination, mode: mode})
+	b.destinations[destination] = true
+	b.used = b.used + len(contents)
+}
+
+// onWritten configures the function finishing the last added file after the batch is written.
+func (b *smallFileBatch) onWritten(finish func() error) {
+	b.files[len(b.files)-1].finish = finish
+}
+
+// full returns true if the batch must be flushed before the next read.
+func (b *smallFileBatch) full() bool {
+	return len(b.files) >= smallFileBatchFiles || len(b.buffer)-b.used < b.threshold+1
+}
+
+// pending returns true if a file with the destination waits in the batch.
+func (b *smallFileBatch) pending(destination string) bool {
+	return b.destinations[destination]
+}
+
+// reset drops the pending files, used also to drop the files of a failed deployment.
+func (b *smallFileBatch) reset() {
+	if b == nil {
+		return
+	}
+	b.files = nil
+	b.destinations = map[string]bool{}
+	b.used = 0
+}
+
+// flushSmallFiles writes the batched files, syncs them and finishes them in the order they were added.
+func (n *executingResourceDeployer) flushSmallFiles() error {
+	batch := n.smallFiles
+	if batch == nil || len(batch.files) == 0 {
+		return nil
+	}
+	defer batch.reset()
+	paths := []string{}
+	for _, file := range batch.files {
+		if err := writeSmallFile(file.destination, n.tempDir, file.mode, file.contents); err != nil {
+			n.logger.Error("error while writing batched file", "on-disk-path", file.destination, "reason", err)
+			return errors.Wrapf(err, "failed writing batched file '%s'", file.destination)
+		}
+		paths = append(paths, file.destination)
+	}
+	if err := syncBatch(paths); err != nil {
+		n.logger.Error("error while syncing batched files", "reason", err)
+		return errors.Wrap(err, "failed syncing batched files")
+	}
+	for _, file := range batch.files {
+		if err := file.finish(); err != nil {
+			return err
+		}
+	}
+	n.logger.Debug("small files batch written", "number-of-files", len(batch.files), "written-bytes", batch.used)
+	return nil
+}
+
+// writeSmallFile writes the contents to a temporary file renamed to the destination,
+// without syncing the file, the batch is synced when all files are written.
+func writeSmallFile(destination, tempDir string, mode os.FileMode, contents []byte) error {
+	if tempDir == "" {
+		// rename is guaranteed to work only within the same device:
+		tempDir = filepath.Dir(destination)
+	}
+	tempFile, err := ioutil.TempFile(tempDir, "."+filepath.Base(destination)+".tmp-")
+	if err != nil {
+		return errors.Wrap(err, "failed creating temporary file")
+	}
+	tempFileName := tempFile.Name()
+	if err := func() error {
+		defer tempFile.Close()
+		if err := tempFile.Chmod(mode); err != nil {
+			return errors.Wrap(err, "failed chmoding temporary file")
+		}
+		if _, err := tempFile.Write(contents); err != nil {
+			return errors.Wrap(err, "failed writing temporary file")
+		}
+		return nil
+	}(); err != nil {
+		os.Remove(tempFileName)
+		return err
+	}
+	if err := os.Rename(tempFileName, destination); err != nil {
+		os.Remove(tempFileName)
+		return errors.Wrap(err, "failed renaming temporary file")
+	}
+	return nil
+}
+
+// syncEachFile syncs every file and its parent directory.
+func syncEachFile(paths []string) error {
+	for _, path := range paths {
+		for _, syncedPath := range []string{path, filepath.Dir(path)} {
+			if err := syncPath(syncedPath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
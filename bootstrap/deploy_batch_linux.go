@@ -0,0 +1,39 @@
+package bootstrap
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// syncBatch makes the written files and their renames durable with a single syncfs(2)
+// of every file system the files are written to.
+func syncBatch(paths []string) error {
+	synced := map[uint64]bool{}
+	for _, path := range paths {
+		dir := filepath.Dir(path)
+		stat := &syscall.Stat_t{}
+		if err := syscall.Stat(dir, stat); err != nil {
+			return err
+		}
+		if synced[uint64(stat.Dev)] {
+			continue
+		}
+		if err := syncFilesystem(dir); err != nil {
+			return err
+		}
+		synced[uint64(stat.Dev)] = true
+	}
+	return nil
+}
+
+func syncFilesystem(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return unix.Syncfs(int(file.Fd()))
+}
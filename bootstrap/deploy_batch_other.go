@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package bootstrap
+
+// syncBatch makes the written files and their renames durable, syncfs(2) is not supported
+// outside of Linux, every file and its parent directory are synced.
+func syncBatch(paths []string) error {
+	return syncEachFile(paths)
+}
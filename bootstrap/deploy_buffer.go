@@ -0,0 +1,13 @@
+package bootstrap
+
+const (
+	// DefaultCopyBufferSize is the default size of the resource contents copy buffer, the io.Copy default.
+	DefaultCopyBufferSize = 32 * 1024
+	// MinCopyBufferSize is the minimum size of the resource contents copy buffer.
+	MinCopyBufferSize = 4 * 1024
+)
+
+// newCopyBuffer returns a buffer for copying the contents of a single file.
+func (n *executingResourceDeployer) newCopyBuffer() []byte {
+	return make([]byte, n.copyBufferSize)
+}
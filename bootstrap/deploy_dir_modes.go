@@ -0,0 +1,57 @@
+package bootstrap
+
+import (
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// deferredDirMode is the mode of a deployed directory applied after the contents are deployed.
+type deferredDirMode struct {
+	mode os.FileMode
+	path string
+}
+
+// mkdirMode returns the mode the directory is created with. With the deferred directory modes,
+// the directory is created writable by the owner and the mode is applied after the contents are deployed.
+func (n *executingResourceDeployer) mkdirMode(path string, mode os.FileMode) os.FileMode {
+	if !n.deferredDirModes {
+		return mode
+	}
+	n.pendingDirModes = append(n.pendingDirModes, deferredDirMode{mode: mode, path: path})
+	return mode | 0700
+}
+
+// withDeferredDirModes applies the deferred directory modes after the deployment,
+// including the directories deployed before a deployment failure.
+func (n *executingResourceDeployer) withDeferredDirModes(f func() error) (deployErr error) {
+	if !n.deferredDirModes {
+		return f()
+	}
+	defer func() {
+		if err := n.applyDeferredDirModes(); err != nil && deployErr == nil {
+			deployErr = err
+		}
+	}()
+	return f()
+}
+
+// applyDeferredDirModes chmods the deployed directories, the nested directories first,
+// so the traversal of a directory is not restricted before its subdirectories are chmoded.
+func (n *executingResourceDeployer) applyDeferredDirModes() error {
+	pending := n.pendingDirModes
+	n.pendingDirModes = nil
+	sort.SliceStable(pending, func(i, j int) bool {
+		return strings.Count(pending[i].path, string(os.PathSeparator)) > strings.Count(pending[j].path, string(os.PathSeparator))
+	})
+	for _, dir := range pending {
+		if err := os.Chmod(dir.path, dir.mode); err != nil {
+			n.logger.Error("error while applying deferred directory mode", "on-disk-path", dir.path, "reason", err)
+			return errors.Wrapf(err, "failed applying mode %04o to directory '%s'", dir.mode, dir.path)
+		}
+		n.logger.Debug("deferred directory mode applied", "on-disk-path", dir.path, "mode", manifestMode(dir.mode))
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package bootstrap
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/combust-labs/firebuild-shared/build/resources"
+)
+
+// contentsSize returns the size of the contents if the reader reports it, for example
+// a file or an in-memory reader, otherwise false.
+func contentsSize(contents io.Reader) (int64, bool) {
+	switch sized := contents.(type) {
+	case interface{ Size() int64 }:
+		return sized.Size(), true
+	case interface{ Stat() (os.FileInfo, error) }:
+		stat, err := sized.Stat()
+		if err != nil || !stat.Mode().IsRegular() {
+			return 0, false
+		}
+		return stat.Size(), true
+	}
+	return 0, false
+}
+
+// checkDiskSpace fails with an *InsufficientDiskSpaceError when the file system
+// of the destination does not have the space for the required bytes.
+// Nothing is checked when the disk space check is disabled or the free space is not known.
+func (n *executingResourceDeployer) checkDiskSpace(destination string, required int64) error {
+	if !n.diskSpaceCheck {
+		return nil
+	}
+	available, ok := availableDiskSpace(filepath.Dir(destination))
+	if !ok || required <= available {
+		return nil
+	}
+	n.logger.Error("insufficient disk space",
+		"on-disk-path", destination,
+		"required-bytes", required,
+		"available-bytes", available)
+	return &InsufficientDiskSpaceError{Available: available, Required: required, Target: destination}
+}
+
+// requiredDiskSpace reads all resources of the channel and returns a channel delivering them in the received order,
+// with the sum of the sizes of the files not excluded from the deployment. The contents of every file are opened
+// to find the size and closed without reading, the contents of unknown size are not counted.
+// An error received from the channel is delivered without the resources.
+func (n *executingResourceDeployer) requiredDiskSpace(source string, resourceChannel chan interface{}) (chan interface{}, int64) {
+	received := []resources.ResolvedResource{}
+	required := int64(0)
+	for item := range resourceChannel {
+		switch titem := item.(type) {
+		case nil:
+			return resourcesChannel(received), required
+		case resources.ResolvedResource:
+			received = append(received, titem)
+			if titem.IsDir() || n.isExcluded(resourceRelativePath(source, titem.SourcePath()), false) {
+				continue
+			}
+			contents, err := titem.Contents()
+			if err != nil {
+				continue // the failure is reported when the file is deployed
+			}
+			if size, ok := contentsSize(contents); ok {
+				required = required + size
+			}
+			contents.Close()
+		case error:
+			errorChannel := make(chan interface{}, 1)
+			errorChannel <- titem
+			return errorChannel, 0
+		}
+	}
+	// the channel was closed without the end of resources:
+	return resourcesChannel(received), required
+}
+
+// resourcesChannel returns a channel delivering the resources followed by the end of resources.
+func resourcesChannel(input []resources.ResolvedResource) chan interface{} {
+	// buffered so nothing blocks when the deployment fails early:
+	output := make(chan interface{}, len(input)+1)
+	for _, resource := range input {
+		output <- resource
+	}
+	output <- nil
+	return output
+}
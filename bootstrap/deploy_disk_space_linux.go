@@ -0,0 +1,12 @@
+package bootstrap
+
+import "syscall"
+
+// availableDiskSpace returns the bytes available to unprivileged users on the file system of the directory.
+func availableDiskSpace(dir string) (int64, bool) {
+	stat := &syscall.Statfs_t{}
+	if err := syscall.Statfs(dir, stat); err != nil {
+		return 0, false
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), true
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package bootstrap
+
+// availableDiskSpace is not supported outside of Linux, the free space is not known.
+func availableDiskSpace(dir string) (int64, bool) {
+	return 0, false
+}
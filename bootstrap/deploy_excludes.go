@@ -0,0 +1,122 @@
+package bootstrap
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// deployExclude is a single gitignore-style exclude pattern.
+type deployExclude struct {
+	anchored bool
+	dirOnly  bool
+	negate   bool
+	segments []string
+}
+
+// parseDeployExcludes parses gitignore-style patterns, empty patterns and comments are ignored.
+func parseDeployExcludes(patterns []string) []deployExclude {
+	excludes := []deployExclude{}
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+		exclude := deployExclude{}
+		if strings.HasPrefix(pattern, "!") {
+			exclude.negate = true
+			pattern = pattern[1:]
+		}
+		if strings.HasSuffix(pattern, "/") {
+			exclude.dirOnly = true
+			pattern = strings.TrimRight(pattern, "/")
+		}
+		// a pattern with a separator other than a trailing one is relative to the resource root:
+		if strings.Contains(pattern, "/") {
+			exclude.anchored = true
+			pattern = strings.TrimLeft(pattern, "/")
+		}
+		if pattern == "" {
+			continue
+		}
+		exclude.segments = strings.Split(pattern, "/")
+		excludes = append(excludes, exclude)
+	}
+	return excludes
+}
+
+// matches returns true if the pattern matches the slash separated relative path.
+func (e deployExclude) matches(relPath string, isDir bool) bool {
+	if e.dirOnly && !isDir {
+		return false
+	}
+	pathSegments := strings.Split(relPath, "/")
+	if e.anchored {
+		return matchSegments(e.segments, pathSegments)
+	}
+	// a pattern without a separator matches the name at any depth:
+	matched, _ := path.Match(e.segments[0], pathSegments[len(pathSegments)-1])
+	return matched
+}
+
+// matchSegments matches the path segments against the pattern segments,
+// ** matches zero or more segments.
+func matchSegments(pattern, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	if matched, _ := path.Match(pattern[0], segments[0]); !matched {
+		return false
+	}
+	return matchSegments(pattern[1:], segments[1:])
+}
+
+// isExcluded returns true if the path relative to the resource root is excluded.
+// As with gitignore, the last matching pattern wins and an entry of an excluded
+// directory cannot be included again.
+func (n *executingResourceDeployer) isExcluded(relPath string, isDir bool) bool {
+	if len(n.deployExcludes) == 0 {
+		return false
+	}
+	relPath = filepath.ToSlash(filepath.Clean(relPath))
+	if relPath == "." || relPath == "" {
+		return false
+	}
+	segments := strings.Split(relPath, "/")
+	for i := 1; i < len(segments); i++ {
+		if excludedByLastMatch(n.deployExcludes, strings.Join(segments[:i], "/"), true) {
+			return true
+		}
+	}
+	return excludedByLastMatch(n.deployExcludes, relPath, isDir)
+}
+
+func excludedByLastMatch(excludes []deployExclude, relPath string, isDir bool) bool {
+	excluded := false
+	for _, exclude := range excludes {
+		if exclude.matches(relPath, isDir) {
+			excluded = !exclude.negate
+		}
+	}
+	return excluded
+}
+
+// resourceRelativePath returns the source path of a resource relative to the command source.
+func resourceRelativePath(source, sourcePath string) string {
+	relPath, err := filepath.Rel(filepath.Clean(source), filepath.Clean(sourcePath))
+	if err != nil || strings.HasPrefix(relPath, "..") {
+		return sourcePath
+	}
+	return relPath
+}
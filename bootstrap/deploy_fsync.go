@@ -0,0 +1,33 @@
+package bootstrap
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// syncEntry makes the deployed entry durable when fsync is configured: the entry itself
+// to persist the owner changed after it was written, and the parent directory to persist
+// the rename of the atomic write or the created directory.
+func (n *executingResourceDeployer) syncEntry(entry ManifestEntry) error {
+	if !n.fsync {
+		return nil
+	}
+	for _, path := range []string{entry.Path, filepath.Dir(entry.Path)} {
+		if err := syncPath(path); err != nil {
+			n.logger.Error("error while syncing deployed entry", "on-disk-path", path, "reason", err)
+			return errors.Wrapf(err, "failed syncing '%s'", path)
+		}
+	}
+	return nil
+}
+
+func syncPath(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
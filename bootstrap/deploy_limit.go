@@ -0,0 +1,31 @@
+package bootstrap
+
+import "io"
+
+// limitDeployBytes returns a reader counting the bytes deployed from the contents
+// and failing with MaxTotalDeployBytesError when the total exceeds the maximum.
+func (n *executingResourceDeployer) limitDeployBytes(target string, contents io.Reader) io.Reader {
+	if n.maxTotalDeployBytes <= 0 {
+		return contents
+	}
+	return &deployLimitReader{deployer: n, reader: contents, target: target}
+}
+
+type deployLimitReader struct {
+	deployer *executingResourceDeployer
+	reader   io.Reader
+	target   string
+}
+
+func (r *deployLimitReader) Read(p []byte) (int, error) {
+	read, err := r.reader.Read(p)
+	r.deployer.deployedBytes = r.deployer.deployedBytes + int64(read)
+	if r.deployer.deployedBytes > r.deployer.maxTotalDeployBytes {
+		return read, &MaxTotalDeployBytesError{
+			Limit:  r.deployer.maxTotalDeployBytes,
+			Target: r.target,
+			Total:  r.deployer.deployedBytes,
+		}
+	}
+	return read, err
+}
@@ -0,0 +1,42 @@
+package bootstrap
+
+import (
+	"bytes"
+)
+
+// LineEnding is the line ending style the text resources are normalized to.
+type LineEnding int
+
+const (
+	// LineEndingLF normalizes the line endings to \n.
+	LineEndingLF LineEnding = iota
+	// LineEndingCRLF normalizes the line endings to \r\n.
+	LineEndingCRLF
+)
+
+// textDetectionLength is the length of the prefix inspected to detect binary contents,
+// the same heuristic as git: contents with a NUL byte in the prefix are binary.
+const textDetectionLength = 8000
+
+// isText returns true if the contents look like text.
+func isText(data []byte) bool {
+	if len(data) > textDetectionLength {
+		data = data[:textDetectionLength]
+	}
+	return bytes.IndexByte(data, 0) == -1
+}
+
+// lineEndingTransform returns a deploy transform converting the line endings of text contents
+// to the style. Binary contents are returned unchanged.
+func lineEndingTransform(style LineEnding) func([]byte) ([]byte, error) {
+	return func(data []byte) ([]byte, error) {
+		if !isText(data) {
+			return data, nil
+		}
+		normalized := bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+		if style == LineEndingCRLF {
+			normalized = bytes.ReplaceAll(normalized, []byte("\n"), []byte("\r\n"))
+		}
+		return normalized, nil
+	}
+}
@@ -0,0 +1,31 @@
+package bootstrap
+
+import (
+	"io"
+
+	"github.com/combust-labs/firebuild-shared/build/resources"
+)
+
+// openResource opens the contents of the resource, retrying a failed open according
+// to the resource open retry, except of the errors classified as permanent.
+// A failure to open is returned as a *ResourceOpenError.
+func (n *executingResourceDeployer) openResource(resource resources.ResolvedResource) (io.ReadCloser, error) {
+	backoff := n.resourceOpenBackoff
+	for attempt := 1; ; attempt++ {
+		resourceReader, err := resource.Contents()
+		if err == nil {
+			return resourceReader, nil
+		}
+		if attempt >= n.resourceOpenAttempts || !shouldRetry(n.errorClassifier, err, true) {
+			return nil, &ResourceOpenError{Attempts: attempt, Err: err, Target: resource.TargetPath()}
+		}
+		n.logger.Warn("failed opening resource, retrying",
+			"resource-path", resource.TargetPath(),
+			"attempt", attempt,
+			"max-attempts", n.resourceOpenAttempts,
+			"backoff", backoff,
+			"reason", err)
+		n.clock.Sleep(backoff)
+		backoff = backoff * 2
+	}
+}
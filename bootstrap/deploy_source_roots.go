@@ -0,0 +1,120 @@
+package bootstrap
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/combust-labs/firebuild-shared/build/resources"
+	"github.com/combust-labs/firebuild-shared/build/rootfs"
+	"github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
+)
+
+// ErrSourceNotAllowed is returned when the absolute source of an ADD or COPY command
+// is not in any of the allowed source roots.
+var ErrSourceNotAllowed = errors.New("resource source not in the allowed source roots")
+
+// localSourceClient serves the resources of an absolute source from the local file system,
+// the other calls go to the client.
+type localSourceClient struct {
+	rootfs.ClientProvider
+	logger  hclog.Logger
+	request ResourceRequest
+	source  string
+}
+
+// sourceClient returns a client serving the absolute source of the request from the local file system
+// when the source is in one of the allowed source roots. Without the allowed source roots,
+// or for a relative source, the client is returned.
+func (n *executingResourceDeployer) sourceClient(client rootfs.ClientProvider, request ResourceRequest) (rootfs.ClientProvider, error) {
+	if n.allowedSourceRoots == nil || !filepath.IsAbs(request.Source) {
+		return client, nil
+	}
+	source, err := n.allowedSourcePath(request.Source)
+	if err != nil {
+		n.logger.Error("resource source rejected", "index", request.CommandIndex, "source", request.Source, "reason", err)
+		return nil, errors.Wrapf(err, "command %d", request.CommandIndex)
+	}
+	n.logger.Debug("resource source served from the local file system", "index", request.CommandIndex, "source", request.Source, "on-disk-path", source)
+	return &localSourceClient{
+		ClientProvider: client,
+		logger:         n.logger.Named("local-source"),
+		request:        request,
+		source:         source,
+	}, nil
+}
+
+// allowedSourcePath returns the path with the symlinks evaluated if it is in one of the allowed source roots,
+// the roots are compared with the symlinks evaluated so a symlink cannot escape the roots.
+func (n *executingResourceDeployer) allowedSourcePath(path string) (string, error) {
+	evaluated, err := filepath.EvalSymlinks(filepath.Clean(path))
+	if err != nil {
+		return "", errors.Wrapf(err, "failed resolving source '%s'", path)
+	}
+	for _, root := range n.allowedSourceRoots {
+		evaluatedRoot, err := filepath.EvalSymlinks(filepath.Clean(root))
+		if err != nil {
+			continue // a missing root does not contain anything
+		}
+		relPath, err := filepath.Rel(evaluatedRoot, evaluated)
+		if err == nil && relPath != ".." && !strings.HasPrefix(relPath, ".."+string(os.PathSeparator)) {
+			return evaluated, nil
+		}
+	}
+	return "", errors.Wrapf(ErrSourceNotAllowed, "source '%s' resolved to '%s'", path, evaluated)
+}
+
+func (c *localSourceClient) Resource(source string) (chan interface{}, error) {
+	resolved, err := c.resolve()
+	output := make(chan interface{}, len(resolved)+1)
+	defer close(output)
+	if err != nil {
+		output <- err
+		return output, nil
+	}
+	for _, resource := range resolved {
+		output <- resource
+	}
+	output <- nil
+	return output, nil
+}
+
+// resolve walks the source, the directories and the regular files are resolved with the target
+// relative to the target of the command. Other entries are skipped.
+func (c *localSourceClient) resolve() ([]resources.ResolvedResource, error) {
+	resolved := []resources.ResolvedResource{}
+	walkErr := filepath.Walk(c.source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(c.source, path)
+		if err != nil {
+			return err
+		}
+		targetPath := c.request.Target
+		if relPath != "." {
+			targetPath = filepath.Join(c.request.Target, relPath)
+		}
+		sourcePath := filepath.Join(c.request.Source, relPath)
+		if info.IsDir() {
+			resolved = append(resolved, resources.NewResolvedDirectoryResourceWithPath(info.Mode().Perm(),
+				path, sourcePath, targetPath, c.request.Workdir, c.request.User))
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			c.logger.Warn("skipping source entry which is not a regular file", "source-path", sourcePath, "mode", info.Mode().String())
+			return nil
+		}
+		onDiskPath := path
+		resolved = append(resolved, resources.NewResolvedFileResourceWithPath(func() (io.ReadCloser, error) {
+			return os.Open(onDiskPath)
+		}, info.Mode().Perm(), sourcePath, targetPath, c.request.Workdir, c.request.User, path))
+		return nil
+	})
+	if walkErr != nil {
+		return nil, errors.Wrapf(walkErr, "failed resolving source '%s'", c.request.Source)
+	}
+	return resolved, nil
+}
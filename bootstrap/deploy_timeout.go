@@ -0,0 +1,49 @@
+package bootstrap
+
+import (
+	"io"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// ErrResourceDeployTimeout is returned when writing a resource exceeds the resource deploy timeout.
+var ErrResourceDeployTimeout = errors.New("resource deploy timed out")
+
+// withDeployTimeout returns a reader failing with ErrResourceDeployTimeout after the resource
+// deploy timeout and a function stopping the timeout, returning true if the timeout has expired.
+// The contents are closed when the timeout expires to interrupt a blocked read.
+func (n *executingResourceDeployer) withDeployTimeout(contents io.ReadCloser) (io.Reader, func() bool) {
+	if n.resourceDeployTimeout <= 0 {
+		return contents, func() bool { return false }
+	}
+	reader := &deadlineReader{reader: contents}
+	timer := n.clock.AfterFunc(n.resourceDeployTimeout, func() {
+		atomic.StoreInt32(&reader.expired, 1)
+		contents.Close()
+	})
+	return reader, func() bool {
+		timer.Stop()
+		return reader.hasExpired()
+	}
+}
+
+type deadlineReader struct {
+	expired int32
+	reader  io.Reader
+}
+
+func (r *deadlineReader) hasExpired() bool {
+	return atomic.LoadInt32(&r.expired) == 1
+}
+
+func (r *deadlineReader) Read(p []byte) (int, error) {
+	if r.hasExpired() {
+		return 0, ErrResourceDeployTimeout
+	}
+	read, err := r.reader.Read(p)
+	if r.hasExpired() {
+		return read, ErrResourceDeployTimeout
+	}
+	return read, err
+}
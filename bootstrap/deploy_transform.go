@@ -0,0 +1,55 @@
+package bootstrap
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// deployTransform transforms the contents of the files with the target matching the glob.
+type deployTransform struct {
+	glob          string
+	transformFunc func([]byte) ([]byte, error)
+}
+
+// matches returns true if the glob matches the target path or the target file name.
+func (t deployTransform) matches(target string) (bool, error) {
+	matched, err := filepath.Match(t.glob, target)
+	if err != nil || matched {
+		return matched, err
+	}
+	return filepath.Match(t.glob, filepath.Base(target))
+}
+
+// transformContents applies the transforms matching the target to the contents
+// in the order they were registered. The contents are returned as they are
+// when no transform matches.
+func (n *executingResourceDeployer) transformContents(target string, contents io.Reader) (io.Reader, error) {
+	matching := []deployTransform{}
+	for _, transform := range n.transforms {
+		matched, err := transform.matches(target)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid deploy transform glob '%s'", transform.glob)
+		}
+		if matched {
+			matching = append(matching, transform)
+		}
+	}
+	if len(matching) == 0 {
+		return contents, nil
+	}
+	data, err := ioutil.ReadAll(contents)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed reading contents of '%s' for transform", target)
+	}
+	for _, transform := range matching {
+		data, err = transform.transformFunc(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed transforming contents of '%s' with transform '%s'", target, transform.glob)
+		}
+	}
+	return bytes.NewReader(data), nil
+}
@@ -0,0 +1,71 @@
+package bootstrap
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/combust-labs/firebuild-shared/build/resources"
+	"github.com/pkg/errors"
+)
+
+// validateResource reads the contents of the resource without writing them and verifies
+// the contents match the checksum, when given, and the destination can be written.
+func (n *executingResourceDeployer) validateResource(resource resources.ResolvedResource, destination, checksum string) error {
+	if err := n.validateWritable(destination); err != nil {
+		return err
+	}
+	resourceReader, err := n.openResource(resource)
+	if err != nil {
+		return err
+	}
+	defer resourceReader.Close()
+	timedReader, stopTimeout := n.withDeployTimeout(resourceReader)
+	contentsHash := sha256.New()
+	read, err := io.CopyBuffer(contentsHash, timedReader, n.newCopyBuffer())
+	if stopTimeout() {
+		return errors.Wrapf(ErrResourceDeployTimeout, "reading '%s' exceeded the deploy timeout %s", resource.TargetPath(), n.resourceDeployTimeout)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed reading contents of resource '%s'", resource.TargetPath())
+	}
+	contentsSHA256 := hex.EncodeToString(contentsHash.Sum(nil))
+	if checksum != "" && checksum != contentsSHA256 {
+		return fmt.Errorf("checksum mismatch of resource '%s': expected sha256:%s, got sha256:%s", resource.TargetPath(), checksum, contentsSHA256)
+	}
+	n.logger.Info("resource validated",
+		"resource-path", resource.TargetPath(),
+		"on-disk-path", destination,
+		"read-bytes", read,
+		"sha256", contentsSHA256)
+	return nil
+}
+
+// validateWritable verifies that the closest existing parent of the path is a directory
+// the deployer can write to, the missing intermediate directories would be created in it.
+func (n *executingResourceDeployer) validateWritable(path string) error {
+	current := filepath.Dir(path)
+	for {
+		stat, err := os.Stat(current)
+		if err == nil {
+			if !stat.IsDir() {
+				return fmt.Errorf("cannot deploy '%s': '%s' is not a directory", path, current)
+			}
+			if err := checkWritable(current); err != nil {
+				return errors.Wrapf(err, "cannot deploy '%s': directory '%s' is not writable", path, current)
+			}
+			return nil
+		}
+		if !os.IsNotExist(err) {
+			return errors.Wrapf(err, "cannot deploy '%s'", path)
+		}
+		parent := filepath.Dir(current)
+		if parent == current {
+			return errors.Wrapf(err, "cannot deploy '%s'", path)
+		}
+		current = parent
+	}
+}
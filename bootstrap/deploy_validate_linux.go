@@ -0,0 +1,9 @@
+package bootstrap
+
+import "syscall"
+
+// checkWritable checks the directory is writable with the permissions of the deployer, see access(2).
+func checkWritable(dir string) error {
+	const wOK = 0x2
+	return syscall.Access(dir, wOK)
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package bootstrap
+
+// checkWritable is not supported outside of Linux, the directories are assumed writable.
+func checkWritable(dir string) error {
+	return nil
+}
@@ -0,0 +1,35 @@
+package bootstrap
+
+import (
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// WriterFactory creates the writer of the contents of a deployed file,
+// the contents are complete when the writer is closed without an error.
+type WriterFactory func(target string, mode fs.FileMode) (io.WriteCloser, error)
+
+// writeContents writes the contents of a file to the destination with the writer factory,
+// without a writer factory the contents are written atomically to the file system.
+func (n *executingResourceDeployer) writeContents(destination string, mode os.FileMode, contents io.Reader) (int64, error) {
+	if n.writerFactory == nil {
+		return writeFileAtomically(destination, n.tempDir, mode, contents, n.newCopyBuffer())
+	}
+	writer, err := n.writerFactory(destination, mode)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed creating writer of '%s'", destination)
+	}
+	// hide ReadFrom of the writer, it would copy with its own buffer:
+	written, err := io.CopyBuffer(struct{ io.Writer }{writer}, contents, n.newCopyBuffer())
+	if err != nil {
+		writer.Close()
+		return written, errors.Wrapf(err, "failed writing '%s'", destination)
+	}
+	if err := writer.Close(); err != nil {
+		return written, errors.Wrapf(err, "failed closing writer of '%s'", destination)
+	}
+	return written, nil
+}
@@ -0,0 +1,132 @@
+package bootstrap
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/combust-labs/firebuild-shared/build/commands"
+	"github.com/pkg/errors"
+)
+
+// diagnosticsCommand is a command of the work context received from the server.
+type diagnosticsCommand struct {
+	Command commands.VMInitSerializableCommand `json:"Command"`
+	Index   int                                `json:"Index"`
+	Kind    string                             `json:"Kind"`
+}
+
+// diagnosticsBundle is everything needed to reproduce a failed bootstrap.
+// The bootstrap data is not included, it contains the client key.
+type diagnosticsBundle struct {
+	BuildMetadata map[string]string    `json:"BuildMetadata"`
+	Commands      []diagnosticsCommand `json:"Commands"`
+	DeployedPaths []string             `json:"DeployedPaths"`
+	Environment   []string             `json:"Environment"`
+	Error         string               `json:"Error"`
+	Events        []Event              `json:"Events"`
+	Phase         BootstrapPhase       `json:"Phase,omitempty"`
+	Time          time.Time            `json:"Time"`
+}
+
+// diagnostics records the work context and the events of a bootstrap attempt.
+// A nil diagnostics records nothing.
+type diagnostics struct {
+	sync.Mutex
+	commands []diagnosticsCommand
+	events   []Event
+}
+
+func newDiagnostics(dir string) *diagnostics {
+	if dir == "" {
+		return nil
+	}
+	return &diagnostics{commands: []diagnosticsCommand{}, events: []Event{}}
+}
+
+func (d *diagnostics) recordCommand(index int, cmd commands.VMInitSerializableCommand) {
+	if d == nil {
+		return
+	}
+	kind := "UNKNOWN"
+	switch cmd.(type) {
+	case commands.Run:
+		kind = "RUN"
+	case commands.Add:
+		kind = "ADD"
+	case commands.Copy:
+		kind = "COPY"
+	}
+	d.Lock()
+	defer d.Unlock()
+	d.commands = append(d.commands, diagnosticsCommand{Command: cmd, Index: index, Kind: kind})
+}
+
+func (d *diagnostics) recordEvent(event Event) {
+	if d == nil {
+		return
+	}
+	d.Lock()
+	defer d.Unlock()
+	d.events = append(d.events, event)
+}
+
+// dumpDiagnostics writes the diagnostics bundle of the failed bootstrap
+// to the bootstrap-<unix-nanos>.diagnostics.json file in the diagnostics directory.
+func (b *defaultBootstrapper) dumpDiagnostics(failure error) {
+	if b.diagnostics == nil {
+		return
+	}
+	b.diagnostics.Lock()
+	bundle := diagnosticsBundle{
+		BuildMetadata: b.BuildMetadata(),
+		Commands:      append([]diagnosticsCommand{}, b.diagnostics.commands...),
+		DeployedPaths: []string{},
+		Environment:   []string{},
+		Error:         failure.Error(),
+		Events:        append([]Event{}, b.diagnostics.events...),
+		Time:          b.clock.Now().UTC(),
+	}
+	b.diagnostics.Unlock()
+	var bootstrapErr *BootstrapError
+	if errors.As(failure, &bootstrapErr) {
+		bundle.Phase = bootstrapErr.Phase
+	}
+	if provider, ok := b.resourceDeployer.(manifestProvider); ok {
+		for _, entry := range provider.Manifest() {
+			bundle.DeployedPaths = append(bundle.DeployedPaths, entry.Path)
+		}
+	}
+	for k, v := range redactValues(b.commandEnv, b.sensitiveEnvKeys, sensitiveEnvRedaction) {
+		bundle.Environment = append(bundle.Environment, fmt.Sprintf("%s=%s", k, b.redact(v)))
+	}
+	sort.Strings(bundle.Environment)
+
+	filePath, err := writeDiagnostics(b.diagnosticsDir, bundle)
+	if err != nil {
+		b.logger.Error("failed writing diagnostics", "diagnostics-dir", b.diagnosticsDir, "reason", err)
+		return
+	}
+	b.logger.Info("diagnostics written", "path", filePath)
+}
+
+func writeDiagnostics(dir string, bundle diagnosticsBundle) (string, error) {
+	data, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return "", errors.Wrap(err, "failed serializing diagnostics")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", errors.Wrap(err, "failed creating diagnostics directory")
+	}
+	filePath := filepath.Join(dir, fmt.Sprintf("bootstrap-%d.diagnostics.json", bundle.Time.UnixNano()))
+	// the work context and the environment may contain sensitive values:
+	if _, err := writeFileAtomically(filePath, "", 0600, bytes.NewReader(data), nil); err != nil {
+		return "", errors.Wrap(err, "failed writing diagnostics")
+	}
+	return filePath, nil
+}
@@ -0,0 +1,233 @@
+package bootstrap
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+
+	"github.com/combust-labs/firebuild-shared/build/commands"
+	"github.com/combust-labs/firebuild-shared/build/rootfs"
+	"github.com/combust-labs/firebuild-shared/env"
+	"github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
+)
+
+// DefaultDockerSocket is the default Docker daemon socket.
+const DefaultDockerSocket = "/var/run/docker.sock"
+
+// dockerAPIBaseURI is the base URI of the Docker Engine API requests,
+// the host is ignored by the socket client.
+const dockerAPIBaseURI = "http://docker"
+
+// NewDockerSocketClient returns an HTTP client sending the requests to the Docker daemon socket.
+func NewDockerSocketClient(socketPath string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+}
+
+type dockerExecCommandRunner struct {
+	cli         *http.Client
+	containerID string
+	logger      hclog.Logger
+}
+
+// NewDockerExecCommandRunner returns a command runner executing every command in the running container
+// with the Docker Engine exec API, for hybrid workflows where the guest is a container.
+// The User, Workdir, Args and Env of the command are passed as the user, working directory and environment
+// of the exec, the output is streamed to the server. The client must send the requests to the Docker daemon,
+// for example the one returned by NewDockerSocketClient. The Engine API is called directly
+// so the Docker SDK is not required.
+func NewDockerExecCommandRunner(containerID string, cli *http.Client, logger hclog.Logger) IndexedCommandRunner {
+	return &dockerExecCommandRunner{
+		cli:         cli,
+		containerID: containerID,
+		logger:      logger,
+	}
+}
+
+type dockerExecConfig struct {
+	AttachStderr bool     `json:"AttachStderr"`
+	AttachStdout bool     `json:"AttachStdout"`
+	Cmd          []string `json:"Cmd"`
+	Env          []string `json:"Env"`
+	User         string   `json:"User,omitempty"`
+	WorkingDir   string   `json:"WorkingDir,omitempty"`
+}
+
+type dockerExecStartConfig struct {
+	Detach bool `json:"Detach"`
+	Tty    bool `json:"Tty"`
+}
+
+type dockerExecCreated struct {
+	ID string `json:"Id"`
+}
+
+type dockerExecInspect struct {
+	ExitCode int  `json:"ExitCode"`
+	Running  bool `json:"Running"`
+}
+
+func (n *dockerExecCommandRunner) Execute(cmd commands.Run, grpcClient rootfs.ClientProvider) error {
+	return n.ExecuteIndexed(0, cmd, grpcClient)
+}
+
+func (n *dockerExecCommandRunner) ExecuteIndexed(index int, cmd commands.Run, grpcClient rootfs.ClientProvider) error {
+
+	cmdEnv := env.NewBuildEnv()
+	for k, v := range cmd.Args {
+		cmdEnv.Put(k, v)
+	}
+	for k, v := range cmd.Env {
+		cmdEnv.Put(k, v)
+	}
+
+	execConfig := dockerExecConfig{
+		AttachStderr: true,
+		AttachStdout: true,
+		Cmd:          append(append([]string{}, cmd.Shell.Commands...), cmdEnv.Expand(cmd.Command)),
+		Env:          dockerExecEnv(cmdEnv),
+		User:         cmd.User.Value,
+		WorkingDir:   cmd.Workdir.Value,
+	}
+
+	n.logger.Debug("executing command in container",
+		"index", index,
+		"container-id", n.containerID,
+		"workdir", execConfig.WorkingDir,
+		"user", execConfig.User,
+		"shell", cmd.Shell.Commands)
+
+	created := &dockerExecCreated{}
+	if err := n.call(http.MethodPost, fmt.Sprintf("/containers/%s/exec", url.PathEscape(n.containerID)), execConfig, created); err != nil {
+		n.logger.Error("failed creating exec", "index", index, "reason", err)
+		return errors.Wrap(err, "failed creating exec")
+	}
+
+	response, err := n.request(http.MethodPost, fmt.Sprintf("/exec/%s/start", url.PathEscape(created.ID)), dockerExecStartConfig{})
+	if err != nil {
+		n.logger.Error("failed starting exec", "index", index, "reason", err)
+		return errors.Wrap(err, "failed starting exec")
+	}
+	streamErr := demultiplexDockerStream(response.Body, grpcClient)
+	response.Body.Close()
+	if streamErr != nil {
+		n.logger.Error("failed streaming exec output", "index", index, "reason", streamErr)
+		return errors.Wrap(streamErr, "failed streaming exec output")
+	}
+
+	inspect := &dockerExecInspect{}
+	if err := n.call(http.MethodGet, fmt.Sprintf("/exec/%s/json", url.PathEscape(created.ID)), nil, inspect); err != nil {
+		n.logger.Error("failed inspecting exec", "index", index, "reason", err)
+		return errors.Wrap(err, "failed inspecting exec")
+	}
+	if inspect.Running {
+		return fmt.Errorf("exec output closed while the command is running, command %q", cmd.OriginalCommand)
+	}
+	if inspect.ExitCode != 0 {
+		n.logger.Error("command finished with error", "index", index, "exit-code", inspect.ExitCode)
+		return fmt.Errorf("command exited with code: %d, command %q", inspect.ExitCode, cmd.OriginalCommand)
+	}
+
+	n.logger.Debug("command finished successfully", "index", index)
+
+	return nil
+}
+
+// call sends the request and deserializes the response into the output.
+func (n *dockerExecCommandRunner) call(method, path string, input, output interface{}) error {
+	response, err := n.request(method, path, input)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if err := json.NewDecoder(response.Body).Decode(output); err != nil {
+		return errors.Wrapf(err, "failed deserializing response of '%s'", path)
+	}
+	return nil
+}
+
+// request sends the request, a response with an error status is returned as an error.
+func (n *dockerExecCommandRunner) request(method, path string, input interface{}) (*http.Response, error) {
+	var body io.Reader
+	if input != nil {
+		data, err := json.Marshal(input)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed serializing request")
+		}
+		body = bytes.NewReader(data)
+	}
+	request, err := http.NewRequest(method, dockerAPIBaseURI+path, body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed creating request")
+	}
+	if input != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	response, err := n.cli.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode >= http.StatusBadRequest {
+		defer response.Body.Close()
+		message, _ := ioutil.ReadAll(response.Body)
+		return nil, fmt.Errorf("docker API '%s' returned status %d: %s", path, response.StatusCode, bytes.TrimSpace(message))
+	}
+	return response, nil
+}
+
+// demultiplexDockerStream sends the stdout and stderr frames of a non-TTY exec stream to the server.
+// Every frame starts with a header of the stream type byte, three zero bytes and the big endian
+// uint32 frame size.
+func demultiplexDockerStream(stream io.Reader, grpcClient rootfs.ClientProvider) error {
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(stream, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return errors.Wrap(err, "failed reading frame header")
+		}
+		frame := make([]byte, binary.BigEndian.Uint32(header[4:]))
+		if _, err := io.ReadFull(stream, frame); err != nil {
+			return errors.Wrap(err, "failed reading frame")
+		}
+		switch header[0] {
+		case 1:
+			if err := grpcClient.StdOut([]string{string(frame)}); err != nil {
+				return err
+			}
+		case 2:
+			if err := grpcClient.StdErr([]string{string(frame)}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func dockerExecEnv(cmdEnv env.BuildEnv) []string {
+	snapshot := cmdEnv.Snapshot()
+	names := []string{}
+	for name := range snapshot {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	execEnv := []string{}
+	for _, name := range names {
+		execEnv = append(execEnv, fmt.Sprintf("%s=%s", name, snapshot[name]))
+	}
+	return execEnv
+}
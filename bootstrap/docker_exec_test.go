@@ -0,0 +1,103 @@
+package bootstrap
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/combust-labs/firebuild-shared/build/commands"
+	"github.com/combust-labs/firebuild-shared/build/rootfs"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDockerExecCommandRunner(t *testing.T) {
+
+	frame := func(stream byte, data string) []byte {
+		header := make([]byte, 8)
+		header[0] = stream
+		binary.BigEndian.PutUint32(header[4:], uint32(len(data)))
+		return append(header, []byte(data)...)
+	}
+
+	execConfigs := []dockerExecConfig{}
+	exitCode := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/containers/test-container/exec", func(w http.ResponseWriter, r *http.Request) {
+		execConfig := dockerExecConfig{}
+		if err := json.NewDecoder(r.Body).Decode(&execConfig); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		execConfigs = append(execConfigs, execConfig)
+		json.NewEncoder(w).Encode(dockerExecCreated{ID: "test-exec"})
+	})
+	mux.HandleFunc("/exec/test-exec/start", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(frame(1, "out"))
+		w.Write(frame(2, "err"))
+	})
+	mux.HandleFunc("/exec/test-exec/json", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(dockerExecInspect{ExitCode: exitCode})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	cli := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "tcp", server.Listener.Addr().String())
+			},
+		},
+	}
+
+	cmd := commands.Run{
+		OriginalCommand: "RUN echo ${GREETING}",
+		Args:            map[string]string{"ARG1": "arg"},
+		Command:         "echo ${GREETING}",
+		Env:             map[string]string{"GREETING": "hello"},
+		Shell: commands.Shell{
+			Commands: []string{"/bin/sh", "-c"},
+		},
+		User:    commands.User{Value: "nobody"},
+		Workdir: commands.Workdir{Value: "/app"},
+	}
+
+	grpcClient := &outputRecordingClient{}
+	runner := NewDockerExecCommandRunner("test-container", cli, hclog.Default())
+	assert.Nil(t, runner.ExecuteIndexed(0, cmd, grpcClient))
+
+	if assert.Equal(t, 1, len(execConfigs)) {
+		assert.Equal(t, []string{"/bin/sh", "-c", "echo hello"}, execConfigs[0].Cmd)
+		assert.Equal(t, []string{"ARG1=arg", "GREETING=hello"}, execConfigs[0].Env)
+		assert.Equal(t, "nobody", execConfigs[0].User)
+		assert.Equal(t, "/app", execConfigs[0].WorkingDir)
+	}
+	assert.Equal(t, []string{"out"}, grpcClient.stdout)
+	assert.Equal(t, []string{"err"}, grpcClient.stderr)
+
+	exitCode = 2
+	execErr := runner.ExecuteIndexed(0, cmd, grpcClient)
+	assert.NotNil(t, execErr)
+	assert.Contains(t, execErr.Error(), "exited with code: 2")
+}
+
+// outputRecordingClient records the output sent to the server.
+type outputRecordingClient struct {
+	rootfs.ClientProvider
+	stderr []string
+	stdout []string
+}
+
+func (c *outputRecordingClient) StdErr(lines []string) error {
+	c.stderr = append(c.stderr, lines...)
+	return nil
+}
+
+func (c *outputRecordingClient) StdOut(lines []string) error {
+	c.stdout = append(c.stdout, lines...)
+	return nil
+}
@@ -0,0 +1,33 @@
+package bootstrap
+
+import "strings"
+
+// envPrefix selects the bootstrapper environment variables injected into every command.
+type envPrefix struct {
+	prefix string
+	strip  bool
+}
+
+// environment returns the variables of the environ, in the os.Environ format, with the prefix.
+// A variable left without a name by stripping the prefix is skipped.
+func (p *envPrefix) environment(environ []string) map[string]string {
+	env := map[string]string{}
+	if p == nil || p.prefix == "" {
+		return env
+	}
+	for _, item := range environ {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], p.prefix) {
+			continue
+		}
+		name, value := parts[0], parts[1]
+		if p.strip {
+			name = strings.TrimPrefix(name, p.prefix)
+		}
+		if name == "" {
+			continue
+		}
+		env[name] = value
+	}
+	return env
+}
@@ -0,0 +1,97 @@
+package bootstrap
+
+import (
+	"context"
+	"crypto/x509"
+	"io"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// ErrorClass is the retry class of an error.
+type ErrorClass int
+
+const (
+	// ErrorClassUnknown leaves the decision to the retry loop, every loop keeps its own default.
+	ErrorClassUnknown ErrorClass = iota
+	// ErrorClassTransient is an error which may not happen again, the operation is retried.
+	ErrorClassTransient
+	// ErrorClassPermanent is an error which happens again, the operation is not retried.
+	ErrorClassPermanent
+)
+
+// ErrorClassifier returns the retry class of an error.
+type ErrorClassifier func(err error) ErrorClass
+
+// DefaultErrorClassifier classifies the network errors and incomplete work contexts as transient,
+// the validation errors, missing files, cancelled operations and errors repeating on every attempt,
+// like exceeded deploy limits, as permanent. Other errors are unknown.
+func DefaultErrorClassifier(err error) ErrorClass {
+	var bootstrapErr *BootstrapError
+	if errors.As(err, &bootstrapErr) && bootstrapErr.Phase == BootstrapPhaseValidation {
+		return ErrorClassPermanent
+	}
+	var limitErr *MaxTotalDeployBytesError
+	var spaceErr *InsufficientDiskSpaceError
+	var treeErr *TreeMismatchError
+	var authorityErr x509.UnknownAuthorityError
+	var certificateErr x509.CertificateInvalidError
+	var hostnameErr x509.HostnameError
+	switch {
+	case errors.Is(err, context.Canceled),
+		errors.Is(err, os.ErrNotExist),
+		errors.Is(err, ErrBinaryNotAllowed),
+		errors.Is(err, ErrSourceNotAllowed),
+		errors.Is(err, ErrTargetExists),
+		errors.As(err, &limitErr),
+		errors.As(err, &spaceErr),
+		errors.As(err, &treeErr),
+		errors.As(err, &authorityErr),
+		errors.As(err, &certificateErr),
+		errors.As(err, &hostnameErr):
+		return ErrorClassPermanent
+	}
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrIncompleteWorkContext),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.ETIMEDOUT),
+		errors.As(err, &netErr):
+		return ErrorClassTransient
+	}
+	return ErrorClassUnknown
+}
+
+// errorClassifierReceiver is a command runner or a resource deployer using an error classifier
+// in its retry loops, the bootstrapper hands its error classifier to the runner and the deployer implementing it.
+type errorClassifierReceiver interface {
+	setErrorClassifier(ErrorClassifier)
+}
+
+// shouldRetry returns true if the failed operation is retried: the transient errors are retried,
+// the permanent errors are not, the decision of an unknown error is the default of the retry loop.
+func shouldRetry(classifier ErrorClassifier, err error, unknownDefault bool) bool {
+	if classifier == nil {
+		classifier = DefaultErrorClassifier
+	}
+	switch classifier(err) {
+	case ErrorClassTransient:
+		return true
+	case ErrorClassPermanent:
+		return false
+	}
+	return unknownDefault
+}
+
+func (n *shellCommandRunner) setErrorClassifier(classifier ErrorClassifier) {
+	n.errorClassifier = classifier
+}
+
+func (n *executingResourceDeployer) setErrorClassifier(classifier ErrorClassifier) {
+	n.errorClassifier = classifier
+}
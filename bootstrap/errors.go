@@ -0,0 +1,255 @@
+package bootstrap
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// CommandFailures aggregates the failures of individual commands
+// when the bootstrap continues past failing commands.
+type CommandFailures []error
+
+func (e CommandFailures) Error() string {
+	messages := []string{}
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return fmt.Sprintf("%d command(s) failed: %s", len(e), strings.Join(messages, "; "))
+}
+
+// Unwrap returns the individual failures.
+func (e CommandFailures) Unwrap() []error {
+	return e
+}
+
+// ResourceFailures aggregates the failures of individual resources
+// when the deployment continues past resources with failing contents.
+type ResourceFailures []error
+
+func (e ResourceFailures) Error() string {
+	messages := []string{}
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return fmt.Sprintf("%d resource(s) failed: %s", len(e), strings.Join(messages, "; "))
+}
+
+// Unwrap returns the individual failures.
+func (e ResourceFailures) Unwrap() []error {
+	return e
+}
+
+// EndpointFailures aggregates the failures of individual server endpoints
+// when none of the endpoints serves the work context.
+type EndpointFailures []error
+
+func (e EndpointFailures) Error() string {
+	messages := []string{}
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return fmt.Sprintf("%d endpoint(s) failed: %s", len(e), strings.Join(messages, "; "))
+}
+
+// Unwrap returns the individual failures.
+func (e EndpointFailures) Unwrap() []error {
+	return e
+}
+
+// ErrEmptyWorkContext is returned when the server returns a work context without commands
+// and an empty work context is not allowed.
+var ErrEmptyWorkContext = errors.New("empty work context received from the server")
+
+// ErrIncompleteWorkContext is returned when the server stream is reset or closed
+// before the complete work context is received.
+var ErrIncompleteWorkContext = errors.New("incomplete work context received from the server")
+
+// incompleteWorkContextError is an ErrIncompleteWorkContext caused by a failed fetch.
+type incompleteWorkContextError struct {
+	cause error
+}
+
+func (e *incompleteWorkContextError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrIncompleteWorkContext.Error(), e.cause.Error())
+}
+
+// Is returns true for ErrIncompleteWorkContext.
+func (e *incompleteWorkContextError) Is(target error) bool {
+	return target == ErrIncompleteWorkContext
+}
+
+// Unwrap returns the failure of the fetch.
+func (e *incompleteWorkContextError) Unwrap() error {
+	return e.cause
+}
+
+// incompleteStreamMessages identify the failures of a stream terminated before
+// all messages are received, or a message decoded only partially.
+var incompleteStreamMessages = []string{
+	"RST_STREAM",
+	"transport is closing",
+	"unexpected EOF",
+	"unexpected end of JSON input",
+}
+
+// asIncompleteWorkContext returns an error matching ErrIncompleteWorkContext
+// if the work context fetch failed because the stream was incomplete, otherwise the error.
+func asIncompleteWorkContext(err error) error {
+	if err == nil || errors.Is(err, ErrIncompleteWorkContext) {
+		return err
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return &incompleteWorkContextError{cause: err}
+	}
+	for _, message := range incompleteStreamMessages {
+		if strings.Contains(err.Error(), message) {
+			return &incompleteWorkContextError{cause: err}
+		}
+	}
+	return err
+}
+
+// MaxTotalDeployBytesError is returned when the cumulative bytes written
+// by the resource deployer exceed the configured maximum.
+type MaxTotalDeployBytesError struct {
+	Limit  int64
+	Target string
+	Total  int64
+}
+
+func (e *MaxTotalDeployBytesError) Error() string {
+	return fmt.Sprintf("deploying '%s' exceeded the maximum total deploy bytes %d, deployed %d bytes", e.Target, e.Limit, e.Total)
+}
+
+// InsufficientDiskSpaceError is returned when the file system of a file to deploy
+// does not have the space for the known size of the file.
+type InsufficientDiskSpaceError struct {
+	Available int64
+	Required  int64
+	Target    string
+}
+
+func (e *InsufficientDiskSpaceError) Error() string {
+	return fmt.Sprintf("insufficient disk space to deploy '%s': need %d bytes, have %d bytes", e.Target, e.Required, e.Available)
+}
+
+// ResourceOpenError is returned when the contents of a resource cannot be opened,
+// after all attempts of the resource open retry. Failures writing the opened
+// contents are not ResourceOpenErrors.
+type ResourceOpenError struct {
+	Attempts int
+	Err      error
+	Target   string
+}
+
+func (e *ResourceOpenError) Error() string {
+	return fmt.Sprintf("failed resolving contents of resource '%s' after %d attempt(s): %s", e.Target, e.Attempts, e.Err.Error())
+}
+
+// Unwrap returns the failure of the last attempt.
+func (e *ResourceOpenError) Unwrap() error {
+	return e.Err
+}
+
+// TreeMismatchError is returned when the deployed tree does not match the expected tree.
+type TreeMismatchError struct {
+	Missing        []string
+	ModeMismatches []string
+	Unexpected     []string
+}
+
+func (e *TreeMismatchError) Error() string {
+	lines := []string{}
+	for _, path := range e.Missing {
+		lines = append(lines, "- "+path)
+	}
+	for _, mismatch := range e.ModeMismatches {
+		lines = append(lines, "~ "+mismatch)
+	}
+	for _, path := range e.Unexpected {
+		lines = append(lines, "+ "+path)
+	}
+	return fmt.Sprintf("deployed tree does not match the expected tree:\n%s", strings.Join(lines, "\n"))
+}
+
+// BootstrapPhase is the phase of the bootstrap an error occurred in.
+type BootstrapPhase string
+
+const (
+	// BootstrapPhaseValidation validates the bootstrap data and creates the TLS configuration.
+	BootstrapPhaseValidation BootstrapPhase = "validation"
+	// BootstrapPhaseMMDS fetches the MMDS environment.
+	BootstrapPhaseMMDS BootstrapPhase = "mmds"
+	// BootstrapPhaseConnect connects to the server and fetches the work context.
+	BootstrapPhaseConnect BootstrapPhase = "connect"
+	// BootstrapPhaseCommands executes the commands of the work context.
+	BootstrapPhaseCommands BootstrapPhase = "commands"
+	// BootstrapPhaseVerification verifies the deployed tree.
+	BootstrapPhaseVerification BootstrapPhase = "verification"
+	// BootstrapPhaseReadiness waits for the readiness probe.
+	BootstrapPhaseReadiness BootstrapPhase = "readiness"
+	// BootstrapPhaseFinalize executes the finalize command.
+	BootstrapPhaseFinalize BootstrapPhase = "finalize"
+	// BootstrapPhaseComplete reports the result to the server.
+	BootstrapPhaseComplete BootstrapPhase = "complete"
+)
+
+// BootstrapError is returned by the bootstrapper when the bootstrap fails,
+// the message is the message of the underlying error.
+type BootstrapError struct {
+	Err   error
+	Phase BootstrapPhase
+}
+
+func (e *BootstrapError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *BootstrapError) Unwrap() error {
+	return e.Err
+}
+
+// runCommandError is a failed RUN command, a RUN command may have partially
+// modified the machine before failing and is not safe to execute again.
+type runCommandError struct {
+	err error
+}
+
+func (e *runCommandError) Error() string {
+	return e.err.Error()
+}
+
+func (e *runCommandError) Unwrap() error {
+	return e.err
+}
+
+// IsResumable returns true if the bootstrap which failed with the error can be safely resumed
+// with the progress file, which executes the failed and the remaining commands again.
+// Network, MMDS and readiness failures are resumable. Validation and tree verification failures
+// fail again, a failed RUN or finalize command may have partially modified the machine
+// and is not safe to execute again. A failed resource deployment is resumable, the files are
+// written atomically, except of deployments exceeding the total size limit or resources
+// not found on the server. Errors not returned by the bootstrapper are not resumable.
+func IsResumable(err error) bool {
+	var bootstrapErr *BootstrapError
+	if !errors.As(err, &bootstrapErr) {
+		return false
+	}
+	switch bootstrapErr.Phase {
+	case BootstrapPhaseMMDS, BootstrapPhaseConnect, BootstrapPhaseReadiness, BootstrapPhaseComplete:
+		return true
+	case BootstrapPhaseCommands:
+		var runErr *runCommandError
+		var limitErr *MaxTotalDeployBytesError
+		if errors.As(bootstrapErr.Err, &runErr) || errors.As(bootstrapErr.Err, &limitErr) {
+			return false
+		}
+		return !errors.Is(bootstrapErr.Err, os.ErrNotExist)
+	}
+	return false
+}
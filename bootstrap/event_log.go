@@ -0,0 +1,109 @@
+package bootstrap
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// EventBootstrapStarted is emitted when the bootstrap starts.
+	EventBootstrapStarted = "bootstrap.started"
+	// EventBootstrapFinished is emitted when the bootstrap finishes, with the error of a failed bootstrap.
+	EventBootstrapFinished = "bootstrap.finished"
+	// EventCommandStarted is emitted before a command is executed.
+	EventCommandStarted = "command.started"
+	// EventCommandFinished is emitted after a command is executed, with the error of a failed command.
+	EventCommandFinished = "command.finished"
+	// EventCommandSkipped is emitted for a command which is not executed, with the reason.
+	EventCommandSkipped = "command.skipped"
+	// EventResourceDeployed is emitted after the resources of an ADD or COPY command are deployed.
+	EventResourceDeployed = "resource.deployed"
+)
+
+// Event is a single entry of the bootstrap event log.
+type Event struct {
+	Command    string    `json:"Command,omitempty"`
+	DurationMs int64     `json:"DurationMs,omitempty"`
+	Error      string    `json:"Error,omitempty"`
+	Index      *int      `json:"Index,omitempty"`
+	Kind       string    `json:"Kind,omitempty"`
+	Reason     string    `json:"Reason,omitempty"`
+	Source     string    `json:"Source,omitempty"`
+	Target     string    `json:"Target,omitempty"`
+	Time       time.Time `json:"Time"`
+	Type       string    `json:"Type"`
+}
+
+// eventLog writes the events as newline delimited JSON. A nil event log discards the events.
+type eventLog struct {
+	sync.Mutex
+	writer io.Writer
+}
+
+func (l *eventLog) write(event Event) error {
+	if l == nil {
+		return nil
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	l.Lock()
+	defer l.Unlock()
+	_, err = l.writer.Write(append(data, '\n'))
+	return err
+}
+
+// emitEvent writes the event to the event log, the event log is not required
+// to execute the bootstrap, failures are logged as warnings.
+func (b *defaultBootstrapper) emitEvent(event Event) {
+	event.Command = b.redact(event.Command)
+	event.Error = b.redact(event.Error)
+	event.Reason = b.redact(event.Reason)
+	event.Time = b.clock.Now().UTC()
+	b.diagnostics.recordEvent(event)
+	if err := b.eventLog.write(event); err != nil {
+		b.logger.Warn("failed writing event log", "event", event.Type, "reason", err)
+	}
+}
+
+// startCommand starts the command span, emits the command started event and returns a function
+// ending the span and emitting the command finished event with the outcome of the command.
+func (b *defaultBootstrapper) startCommand(ctx context.Context, spanName string, event Event) func(error) {
+	attrs := []attribute.KeyValue{}
+	if event.Index != nil {
+		attrs = append(attrs, attribute.Int("index", *event.Index))
+	}
+	if event.Command != "" {
+		attrs = append(attrs, attribute.String("command", event.Command))
+	}
+	if event.Source != "" {
+		attrs = append(attrs, attribute.String("source", event.Source))
+	}
+	if event.Target != "" {
+		attrs = append(attrs, attribute.String("target", event.Target))
+	}
+	_, endSpan := b.startSpan(ctx, spanName, attrs...)
+	started := b.clock.Now()
+	event.Type = EventCommandStarted
+	b.emitEvent(event)
+	return func(err error) {
+		endSpan(err)
+		event.DurationMs = b.clock.Now().Sub(started).Milliseconds()
+		event.Type = EventCommandFinished
+		if err != nil {
+			event.Error = err.Error()
+		}
+		b.emitEvent(event)
+		if err == nil && event.Kind != "RUN" {
+			event.DurationMs = 0
+			event.Type = EventResourceDeployed
+			b.emitEvent(event)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package bootstrap
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// expectedTreeVerifier is a resource deployer verifying the deployed tree
+// after all commands are executed.
+type expectedTreeVerifier interface {
+	VerifyExpectedTree() error
+}
+
+// VerifyExpectedTree verifies that every path of the expected tree exists with the expected mode
+// and that no path outside of the expected tree was deployed. The differences are returned
+// as TreeMismatchError. Returns nil when no expected tree is configured.
+func (n *executingResourceDeployer) VerifyExpectedTree() error {
+	if n.expectedTree == nil {
+		return nil
+	}
+
+	mismatch := &TreeMismatchError{}
+
+	expectedPaths := []string{}
+	for path := range n.expectedTree {
+		expectedPaths = append(expectedPaths, path)
+	}
+	sort.Strings(expectedPaths)
+
+	for _, path := range expectedPaths {
+		expectedMode := n.expectedTree[path]
+		fileInfo, err := os.Lstat(path)
+		if err != nil {
+			mismatch.Missing = append(mismatch.Missing, path)
+			continue
+		}
+		if fileInfo.IsDir() != expectedMode.IsDir() || fileInfo.Mode().Perm() != expectedMode.Perm() {
+			mismatch.ModeMismatches = append(mismatch.ModeMismatches,
+				fmt.Sprintf("%s: expected %s, got %s", path, expectedMode, fileInfo.Mode()))
+		}
+	}
+
+	seen := map[string]struct{}{}
+	for _, entry := range n.manifest {
+		if _, ok := seen[entry.Path]; ok {
+			continue
+		}
+		seen[entry.Path] = struct{}{}
+		if _, ok := n.expectedTree[entry.Path]; !ok {
+			mismatch.Unexpected = append(mismatch.Unexpected, entry.Path)
+		}
+	}
+	sort.Strings(mismatch.Unexpected)
+
+	if len(mismatch.Missing) == 0 && len(mismatch.ModeMismatches) == 0 && len(mismatch.Unexpected) == 0 {
+		n.logger.Info("deployed tree matches the expected tree", "expected-paths", len(expectedPaths))
+		return nil
+	}
+	n.logger.Error("deployed tree does not match the expected tree",
+		"missing", mismatch.Missing,
+		"mode-mismatches", mismatch.ModeMismatches,
+		"unexpected", mismatch.Unexpected)
+	return mismatch
+}
@@ -0,0 +1,70 @@
+package bootstrap
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// failureOutput captures the complete output of a single command
+// so it can be preserved when the command fails.
+// A nil failure output discards the output.
+type failureOutput struct {
+	sync.Mutex
+	newLines bool
+	stderr   bytes.Buffer
+	stdout   bytes.Buffer
+}
+
+func newFailureOutput(mode OutputMode) *failureOutput {
+	return &failureOutput{
+		// in lines mode the new lines are stripped from the output:
+		newLines: mode == OutputModeLines,
+	}
+}
+
+func (o *failureOutput) writeStderr(p []byte) {
+	if o == nil {
+		return
+	}
+	o.write(&o.stderr, p)
+}
+
+func (o *failureOutput) writeStdout(p []byte) {
+	if o == nil {
+		return
+	}
+	o.write(&o.stdout, p)
+}
+
+func (o *failureOutput) write(buffer *bytes.Buffer, p []byte) {
+	o.Lock()
+	defer o.Unlock()
+	buffer.Write(p)
+	if o.newLines {
+		buffer.WriteString("\n")
+	}
+}
+
+// dump writes the failure, the command description and the captured output to
+// the cmd-<index>.failure.log file in the directory.
+func (o *failureOutput) dump(dir string, index int, description string, failure error) (string, error) {
+	if o == nil {
+		return "", nil
+	}
+	o.Lock()
+	defer o.Unlock()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	contents := bytes.NewBufferString(fmt.Sprintf("%s\nerror: %s\n", description, failure.Error()))
+	contents.WriteString("--- stdout ---\n")
+	contents.Write(o.stdout.Bytes())
+	contents.WriteString("--- stderr ---\n")
+	contents.Write(o.stderr.Bytes())
+	filePath := filepath.Join(dir, commandFileName(index, ".failure.log"))
+	return filePath, ioutil.WriteFile(filePath, contents.Bytes(), 0600)
+}
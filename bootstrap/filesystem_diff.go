@@ -0,0 +1,75 @@
+package bootstrap
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// DefaultFilesystemDiffMaxEntries is the default maximum number of entries
+// recorded in a single filesystem snapshot.
+const DefaultFilesystemDiffMaxEntries = 10000
+
+type fsEntry struct {
+	mode    os.FileMode
+	modTime time.Time
+	size    int64
+}
+
+// fsSnapshot is the state of the files under the watched paths.
+// A truncated snapshot has reached the maximum number of entries.
+type fsSnapshot struct {
+	entries   map[string]fsEntry
+	truncated bool
+}
+
+func takeFilesystemSnapshot(paths []string, maxEntries int) *fsSnapshot {
+	snapshot := &fsSnapshot{entries: map[string]fsEntry{}}
+	for _, root := range paths {
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil // not existing and unreadable paths are not recorded
+			}
+			if len(snapshot.entries) >= maxEntries {
+				snapshot.truncated = true
+				return filepath.SkipAll
+			}
+			snapshot.entries[path] = fsEntry{mode: info.Mode(), modTime: info.ModTime(), size: info.Size()}
+			return nil
+		})
+		if snapshot.truncated {
+			break
+		}
+	}
+	return snapshot
+}
+
+type fsDiff struct {
+	created  []string
+	deleted  []string
+	modified []string
+}
+
+func (s *fsSnapshot) diff(after *fsSnapshot) *fsDiff {
+	result := &fsDiff{created: []string{}, deleted: []string{}, modified: []string{}}
+	for path, afterEntry := range after.entries {
+		beforeEntry, ok := s.entries[path]
+		if !ok {
+			result.created = append(result.created, path)
+			continue
+		}
+		if beforeEntry != afterEntry {
+			result.modified = append(result.modified, path)
+		}
+	}
+	for path := range s.entries {
+		if _, ok := after.entries[path]; !ok {
+			result.deleted = append(result.deleted, path)
+		}
+	}
+	sort.Strings(result.created)
+	sort.Strings(result.deleted)
+	sort.Strings(result.modified)
+	return result
+}
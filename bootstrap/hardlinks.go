@@ -0,0 +1,79 @@
+package bootstrap
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// deduplicate replaces the deployed file with a hardlink to a previously deployed file
+// with the same contents, mode and owner. The file is kept when there is no such file
+// or the hardlink cannot be created, for example across file system boundaries.
+func (n *executingResourceDeployer) deduplicate(entry ManifestEntry) {
+	if !n.deduplicateHardlinks || entry.IsDir || entry.SHA256 == "" {
+		return
+	}
+	// files with a different mode or owner must be real copies:
+	key := entry.SHA256 + " " + entry.Mode + " " + entry.Owner
+	source, ok := n.hardlinkSources[key]
+	if !ok || source == entry.Path {
+		n.hardlinkSources[key] = entry.Path
+		return
+	}
+	// the source could have been modified by the commands executed since it was deployed:
+	if !fileHasContents(source, entry.SHA256) {
+		n.hardlinkSources[key] = entry.Path
+		return
+	}
+	if err := linkAtomically(source, entry.Path); err != nil {
+		n.logger.Debug("file not deduplicated, keeping the copy",
+			"on-disk-path", entry.Path,
+			"hardlink-source", source,
+			"reason", err)
+		return
+	}
+	n.logger.Info("file deduplicated",
+		"on-disk-path", entry.Path,
+		"hardlink-source", source)
+}
+
+// fileHasContents returns true if the sha256 of the file contents is the expected hex encoded hash.
+func fileHasContents(path, expectedSHA256 string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	contentsHash := sha256.New()
+	if _, err := io.Copy(contentsHash, file); err != nil {
+		return false
+	}
+	return hex.EncodeToString(contentsHash.Sum(nil)) == expectedSHA256
+}
+
+// linkAtomically creates a hardlink to the source next to the destination and renames it
+// to the destination so the destination is never missing.
+func linkAtomically(source, destination string) error {
+	tempFile, err := ioutil.TempFile(filepath.Dir(destination), "."+filepath.Base(destination)+".link-")
+	if err != nil {
+		return errors.Wrap(err, "failed reserving temporary hardlink name")
+	}
+	tempFileName := tempFile.Name()
+	tempFile.Close()
+	if err := os.Remove(tempFileName); err != nil {
+		return errors.Wrap(err, "failed reserving temporary hardlink name")
+	}
+	if err := os.Link(source, tempFileName); err != nil {
+		return errors.Wrap(err, "failed creating hardlink")
+	}
+	if err := os.Rename(tempFileName, destination); err != nil {
+		os.Remove(tempFileName)
+		return errors.Wrap(err, "failed renaming hardlink")
+	}
+	return nil
+}
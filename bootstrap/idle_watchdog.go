@@ -0,0 +1,102 @@
+package bootstrap
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/combust-labs/firebuild-mmds/clock"
+	"github.com/pkg/errors"
+)
+
+// ErrOutputIdleTimeout is returned when a command is killed because it has not
+// written to stdout or stderr within the output idle timeout.
+var ErrOutputIdleTimeout = errors.New("command produced no output within the idle timeout")
+
+// idleKillWaitDelay bounds the time to wait for the output of a killed command to be closed.
+const idleKillWaitDelay = time.Second * 5
+
+// idleWatchdog calls the idle function when the output has not been written to
+// within the timeout measured by the clock. A nil watchdog never fires.
+type idleWatchdog struct {
+	sync.Mutex
+	clock   clock.Clock
+	fired   bool
+	onIdle  func()
+	stopped bool
+	timeout time.Duration
+	timer   clock.Timer
+}
+
+func newIdleWatchdog(clock clock.Clock, timeout time.Duration) *idleWatchdog {
+	if timeout <= 0 {
+		return nil
+	}
+	return &idleWatchdog{clock: clock, timeout: timeout}
+}
+
+// start arms the watchdog, the idle function is called at most once.
+func (w *idleWatchdog) start(onIdle func()) {
+	if w == nil {
+		return
+	}
+	w.Lock()
+	defer w.Unlock()
+	w.onIdle = onIdle
+	w.timer = w.clock.AfterFunc(w.timeout, w.fire)
+}
+
+// reset restarts the timeout, called on every output chunk.
+func (w *idleWatchdog) reset() {
+	if w == nil {
+		return
+	}
+	w.Lock()
+	defer w.Unlock()
+	if w.timer == nil || w.fired || w.stopped {
+		return
+	}
+	w.timer.Reset(w.timeout)
+}
+
+// stop disarms the watchdog and returns true if the idle function has been called.
+func (w *idleWatchdog) stop() bool {
+	if w == nil {
+		return false
+	}
+	w.Lock()
+	defer w.Unlock()
+	w.stopped = true
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	return w.fired
+}
+
+func (w *idleWatchdog) fire() {
+	w.Lock()
+	defer w.Unlock()
+	if w.fired || w.stopped {
+		return
+	}
+	w.fired = true
+	w.onIdle()
+}
+
+// wrap returns a writer resetting the watchdog on every write.
+func (w *idleWatchdog) wrap(writer io.Writer) io.Writer {
+	if w == nil {
+		return writer
+	}
+	return &idleResettingWriter{watchdog: w, writer: writer}
+}
+
+type idleResettingWriter struct {
+	watchdog *idleWatchdog
+	writer   io.Writer
+}
+
+func (w *idleResettingWriter) Write(p []byte) (int, error) {
+	w.watchdog.reset()
+	return w.writer.Write(p)
+}
@@ -0,0 +1,64 @@
+package bootstrap
+
+import (
+	"context"
+	"os"
+	"os/exec"
+
+	"github.com/combust-labs/firebuild-shared/build/commands"
+	"github.com/combust-labs/firebuild-shared/build/rootfs"
+	"github.com/pkg/errors"
+)
+
+// ldconfigFallbackPaths are the locations of ldconfig checked when it is not on the path,
+// ldconfig is usually installed in a directory on the path of the root user only.
+var ldconfigFallbackPaths = []string{"/sbin/ldconfig", "/usr/sbin/ldconfig"}
+
+// lookupLdconfig returns the path of the ldconfig executable.
+func lookupLdconfig() (string, error) {
+	if path, err := exec.LookPath("ldconfig"); err == nil {
+		return path, nil
+	}
+	for _, path := range ldconfigFallbackPaths {
+		if info, err := os.Stat(path); err == nil && !info.IsDir() && info.Mode().Perm()&0111 != 0 {
+			return path, nil
+		}
+	}
+	return "", errors.New("ldconfig not found")
+}
+
+// refreshLinkerCache executes ldconfig with the command runner when resources have been deployed
+// since the last refresh. The refresh is skipped with a warning when ldconfig is not installed.
+func (b *defaultBootstrapper) refreshLinkerCache(ctx context.Context, client rootfs.ClientProvider) error {
+	if !b.linkerCacheStale {
+		return nil
+	}
+	b.linkerCacheStale = false
+	path, err := b.lookupLdconfig()
+	if err != nil {
+		b.logger.Warn("linker cache not refreshed, ldconfig not found", "reason", err)
+		return nil
+	}
+	index := LdconfigCommandIndex
+	endCommand := b.startCommand(ctx, "bootstrap.Ldconfig", Event{
+		Command: path,
+		Index:   &index,
+		Kind:    "RUN",
+	})
+	err = b.executeRun(ctx, LdconfigCommandIndex, commands.Run{
+		OriginalCommand: "RUN " + path,
+		Args:            map[string]string{},
+		Command:         path,
+		Env:             map[string]string{},
+		Shell:           commands.DefaultShell(),
+		User:            commands.DefaultUser(),
+		Workdir:         commands.DefaultWorkdir(),
+	}, client)
+	endCommand(err)
+	if err != nil {
+		b.logger.Error("refreshing the linker cache failed", "reason", err)
+		return errors.Wrap(err, "refreshing the linker cache failed")
+	}
+	b.logger.Info("linker cache refreshed", "ldconfig", path)
+	return nil
+}
@@ -0,0 +1,86 @@
+package bootstrap
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// ManifestEntry describes a file or a directory deployed by an ADD or COPY command.
+// The stage is the build stage the resource was copied from with COPY --from,
+// empty for the resources of the build context.
+type ManifestEntry struct {
+	CommandIndex int    `json:"CommandIndex"`
+	IsDir        bool   `json:"IsDir"`
+	Mode         string `json:"Mode"`
+	Owner        string `json:"Owner"`
+	Path         string `json:"Path"`
+	SHA256       string `json:"SHA256,omitempty"`
+	Size         int64  `json:"Size"`
+	Stage        string `json:"Stage,omitempty"`
+}
+
+// Manifest returns the files and directories deployed so far, in the order they were deployed.
+func (n *executingResourceDeployer) Manifest() []ManifestEntry {
+	return append([]ManifestEntry{}, n.manifest...)
+}
+
+func (n *executingResourceDeployer) recordManifestEntry(entry ManifestEntry) {
+	n.manifest = append(n.manifest, entry)
+}
+
+// withManifest writes the manifest after the deployment, including the entries
+// deployed before a deployment failure.
+func (n *executingResourceDeployer) withManifest(f func() error) (deployErr error) {
+	if n.manifestOutput == "" {
+		return f()
+	}
+	defer func() {
+		if err := n.writeManifest(); err != nil {
+			n.logger.Error("failed writing deploy manifest", "manifest", n.manifestOutput, "reason", err)
+			if deployErr == nil {
+				deployErr = err
+			}
+		}
+	}()
+	return f()
+}
+
+func (n *executingResourceDeployer) writeManifest() error {
+	entries := n.manifest
+	if entries == nil {
+		entries = []ManifestEntry{}
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed serializing deploy manifest")
+	}
+	if err := os.MkdirAll(filepath.Dir(n.manifestOutput), 0755); err != nil {
+		return errors.Wrap(err, "failed creating deploy manifest directory")
+	}
+	if _, err := writeFileAtomically(n.manifestOutput, "", 0644, bytes.NewReader(data), nil); err != nil {
+		return errors.Wrap(err, "failed writing deploy manifest")
+	}
+	return nil
+}
+
+func manifestMode(mode os.FileMode) string {
+	return fmt.Sprintf("%04o", mode.Perm())
+}
+
+// manifestOwner returns the uid:gid of a deployed resource, the resources not chowned
+// are owned by the process. A gid of -1 does not change the group.
+func manifestOwner(chown bool, uid, gid int) string {
+	if !chown {
+		uid = os.Geteuid()
+		gid = os.Getegid()
+	}
+	if gid < 0 {
+		gid = os.Getegid()
+	}
+	return fmt.Sprintf("%d:%d", uid, gid)
+}
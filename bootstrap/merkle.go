@@ -0,0 +1,52 @@
+package bootstrap
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+)
+
+// manifestProvider is a resource deployer listing the deployed files and directories.
+type manifestProvider interface {
+	Manifest() []ManifestEntry
+}
+
+// merkleRoot returns the hex encoded root of a SHA-256 Merkle tree over the deployed entries.
+// Every leaf is the hash of the path, the mode and the contents hash of an entry, the leaves
+// are ordered by path and a path deployed multiple times is represented by its last entry.
+// A node without a sibling is promoted to the next level. Returns an empty string
+// when nothing is deployed.
+func merkleRoot(entries []ManifestEntry) string {
+	latest := map[string]ManifestEntry{}
+	for _, entry := range entries {
+		latest[entry.Path] = entry
+	}
+	paths := []string{}
+	for path := range latest {
+		paths = append(paths, path)
+	}
+	if len(paths) == 0 {
+		return ""
+	}
+	sort.Strings(paths)
+
+	level := [][]byte{}
+	for _, path := range paths {
+		entry := latest[path]
+		leaf := sha256.Sum256([]byte(entry.Path + "\x00" + entry.Mode + "\x00" + entry.SHA256))
+		level = append(level, leaf[:])
+	}
+	for len(level) > 1 {
+		next := [][]byte{}
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			node := sha256.Sum256(append(append([]byte{}, level[i]...), level[i+1]...))
+			next = append(next, node[:])
+		}
+		level = next
+	}
+	return hex.EncodeToString(level[0])
+}
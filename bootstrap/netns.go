@@ -0,0 +1,23 @@
+package bootstrap
+
+import (
+	"github.com/hashicorp/go-hclog"
+)
+
+// commandNetns is the network namespace the commands are started in.
+// An empty path starts every command in a new, empty network namespace.
+type commandNetns struct {
+	path string
+}
+
+// NewNetnsCommandRunner returns a shell command runner starting every command in the network namespace
+// at the path, for example /var/run/netns/build. With an empty path, every command is started
+// in a new network namespace with only the loopback interface, which is down, denying the command
+// any network access for hermetic builds. Entering or creating a network namespace requires
+// CAP_SYS_ADMIN, the command fails when the namespace cannot be entered.
+// Network namespaces are supported on Linux only.
+func NewNetnsCommandRunner(nsPath string, logger hclog.Logger) ShellCommandRunner {
+	runner := NewShellCommandRunner(logger).(*shellCommandRunner)
+	runner.netns = &commandNetns{path: nsPath}
+	return runner
+}
@@ -0,0 +1,82 @@
+package bootstrap
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// start starts the command in the network namespace.
+func (ns *commandNetns) start(cmd *exec.Cmd) error {
+	if ns == nil {
+		return cmd.Start()
+	}
+	if ns.path == "" {
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNET
+		if err := cmd.Start(); err != nil {
+			return errors.Wrap(err, "failed starting command in a new network namespace")
+		}
+		return nil
+	}
+
+	target, err := os.Open(ns.path)
+	if err != nil {
+		return errors.Wrapf(err, "failed opening network namespace '%s'", ns.path)
+	}
+	defer target.Close()
+
+	// the command is forked from the current thread and inherits its network namespace:
+	runtime.LockOSThread()
+	original, err := os.Open("/proc/thread-self/ns/net")
+	if err != nil {
+		runtime.UnlockOSThread()
+		return errors.Wrap(err, "failed opening current network namespace")
+	}
+	defer original.Close()
+
+	if err := setns(target); err != nil {
+		runtime.UnlockOSThread()
+		return errors.Wrapf(err, "failed entering network namespace '%s'", ns.path)
+	}
+	startErr := cmd.Start()
+	if err := setns(original); err != nil {
+		// the thread stays locked to the goroutine and is not reused in the wrong namespace:
+		return errors.Wrap(err, "failed restoring network namespace")
+	}
+	runtime.UnlockOSThread()
+	return startErr
+}
+
+// enter moves the current thread to the network namespace, to a new network namespace without the path.
+// The thread must be locked and never be used by another goroutine, it is not moved back.
+func (ns *commandNetns) enter() error {
+	if ns == nil {
+		return nil
+	}
+	if ns.path == "" {
+		if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			return errors.Wrap(err, "failed creating a new network namespace")
+		}
+		return nil
+	}
+	target, err := os.Open(ns.path)
+	if err != nil {
+		return errors.Wrapf(err, "failed opening network namespace '%s'", ns.path)
+	}
+	defer target.Close()
+	if err := setns(target); err != nil {
+		return errors.Wrapf(err, "failed entering network namespace '%s'", ns.path)
+	}
+	return nil
+}
+
+func setns(ns *os.File) error {
+	return unix.Setns(int(ns.Fd()), unix.CLONE_NEWNET)
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package bootstrap
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+func (ns *commandNetns) start(cmd *exec.Cmd) error {
+	if ns == nil {
+		return cmd.Start()
+	}
+	return fmt.Errorf("network namespaces are supported on Linux only")
+}
+
+func (ns *commandNetns) enter() error {
+	if ns == nil {
+		return nil
+	}
+	return fmt.Errorf("network namespaces are supported on Linux only")
+}
@@ -0,0 +1,71 @@
+package bootstrap
+
+import (
+	"sync"
+	"time"
+
+	"github.com/combust-labs/firebuild-mmds/clock"
+)
+
+// outputBatcher buffers the output of a command and delivers it to the server
+// in batches, every flush interval and when closed, instead of a call per write.
+type outputBatcher struct {
+	sync.Mutex
+	chanDone chan struct{}
+	lastErr  error
+	lines    []string
+	sendFunc func([]string) error
+	wg       sync.WaitGroup
+}
+
+func newOutputBatcher(clock clock.Clock, interval time.Duration, sendFunc func([]string) error) *outputBatcher {
+	batcher := &outputBatcher{
+		chanDone: make(chan struct{}),
+		lines:    []string{},
+		sendFunc: sendFunc,
+	}
+	ticker := clock.NewTicker(interval)
+	batcher.wg.Add(1)
+	go func() {
+		defer batcher.wg.Done()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C():
+				batcher.flush()
+			case <-batcher.chanDone:
+				return
+			}
+		}
+	}()
+	return batcher
+}
+
+// add buffers the output, returns the error of the last failed delivery.
+func (b *outputBatcher) add(line string) error {
+	b.Lock()
+	defer b.Unlock()
+	b.lines = append(b.lines, line)
+	return b.lastErr
+}
+
+func (b *outputBatcher) flush() error {
+	b.Lock()
+	defer b.Unlock()
+	if len(b.lines) == 0 {
+		return b.lastErr
+	}
+	lines := b.lines
+	b.lines = []string{}
+	if err := b.sendFunc(lines); err != nil {
+		b.lastErr = err
+	}
+	return b.lastErr
+}
+
+// Close stops the periodic delivery and delivers the remaining output.
+func (b *outputBatcher) Close() error {
+	close(b.chanDone)
+	b.wg.Wait()
+	return b.flush()
+}
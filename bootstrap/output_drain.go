@@ -0,0 +1,60 @@
+package bootstrap
+
+import (
+	"context"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// drainCounter counts the bytes of the output delivered after the command finished.
+type drainCounter struct {
+	draining int32
+	drained  int64
+}
+
+// start starts counting, called when the command finished.
+func (c *drainCounter) start() {
+	atomic.StoreInt32(&c.draining, 1)
+}
+
+func (c *drainCounter) bytes() int64 {
+	return atomic.LoadInt64(&c.drained)
+}
+
+// wrap returns the send function counting the delivered bytes once draining.
+func (c *drainCounter) wrap(sendFunc func([]string) error) func([]string) error {
+	return func(lines []string) error {
+		if atomic.LoadInt32(&c.draining) == 1 {
+			for _, line := range lines {
+				atomic.AddInt64(&c.drained, int64(len(line)))
+			}
+		}
+		return sendFunc(lines)
+	}
+}
+
+// killOnDone kills the process when the context is done and returns a function
+// stopping the watch. The process is not killed once the returned function is called.
+func killOnDone(ctx context.Context, process *os.Process, onKillErr func(error)) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		select {
+		case <-ctx.Done():
+			if err := process.Kill(); err != nil {
+				onKillErr(err)
+			}
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+		wg.Wait()
+	}
+}
@@ -0,0 +1,60 @@
+package bootstrap
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// ErrTargetExists is returned when a resource is deployed to an existing file
+// and the overwrite policy is PolicyFail.
+var ErrTargetExists = errors.New("resource target exists")
+
+// OverwritePolicy defines what the deployer does when the target file of a resource exists.
+type OverwritePolicy int
+
+const (
+	// PolicyOverwrite replaces the existing file.
+	PolicyOverwrite OverwritePolicy = iota
+	// PolicySkip keeps the existing file and does not deploy the resource.
+	PolicySkip
+	// PolicyFail fails the deployment with ErrTargetExists.
+	PolicyFail
+	// PolicyBackup keeps the existing file as <target>.bak and replaces it.
+	PolicyBackup
+)
+
+// backupSuffix is appended to the target path of the backup of the existing file.
+const backupSuffix = ".bak"
+
+// applyOverwritePolicy applies the overwrite policy to the destination of a file, returns
+// false if the resource must not be deployed. Existing directories are always merged into.
+func (n *executingResourceDeployer) applyOverwritePolicy(destination string) (bool, error) {
+	if n.overwritePolicy == PolicyOverwrite {
+		return true, nil
+	}
+	stat, err := os.Lstat(destination)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "failed checking target '%s'", destination)
+	}
+	if stat.IsDir() {
+		return true, nil
+	}
+	switch n.overwritePolicy {
+	case PolicySkip:
+		n.logger.Info("target exists, resource skipped", "on-disk-path", destination)
+		return false, nil
+	case PolicyFail:
+		return false, errors.Wrapf(ErrTargetExists, "target '%s' exists", destination)
+	case PolicyBackup:
+		// the new contents are renamed over the target, the backup keeps the existing file:
+		if err := linkAtomically(destination, destination+backupSuffix); err != nil {
+			return false, errors.Wrapf(err, "failed backing up target '%s'", destination)
+		}
+		n.logger.Info("existing target backed up", "on-disk-path", destination, "backup-path", destination+backupSuffix)
+	}
+	return true, nil
+}
@@ -0,0 +1,55 @@
+package bootstrap
+
+import (
+	"context"
+	"path/filepath"
+
+	"github.com/combust-labs/firebuild-shared/build/commands"
+	"github.com/combust-labs/firebuild-shared/build/rootfs"
+	"github.com/pkg/errors"
+)
+
+// postResourceCommand verifies the resources of the ADD and COPY commands with the source matching the glob.
+type postResourceCommand struct {
+	command    commands.Run
+	sourceGlob string
+}
+
+// matches returns true if the glob matches the source path or the source file name.
+func (c postResourceCommand) matches(source string) (bool, error) {
+	source = filepath.Clean(source)
+	matched, err := filepath.Match(c.sourceGlob, source)
+	if err != nil || matched {
+		return matched, err
+	}
+	return filepath.Match(c.sourceGlob, filepath.Base(source))
+}
+
+// verifyResource executes the post resource commands matching the source of the deployed resource
+// in the order they were registered, the first failing command fails the resource command.
+func (b *defaultBootstrapper) verifyResource(ctx context.Context, index int, source string, client rootfs.ClientProvider) error {
+	for _, verification := range b.postResourceCommands {
+		matched, err := verification.matches(source)
+		if err != nil {
+			return errors.Wrapf(err, "invalid post resource command glob '%s'", verification.sourceGlob)
+		}
+		if !matched {
+			continue
+		}
+		commandIndex := PostResourceCommandIndex
+		endCommand := b.startCommand(ctx, "bootstrap.PostResource", Event{
+			Command: verification.command.OriginalCommand,
+			Index:   &commandIndex,
+			Kind:    "RUN",
+			Source:  source,
+		})
+		err = b.executeRun(ctx, PostResourceCommandIndex, b.withCommandEnv(verification.command), client)
+		endCommand(err)
+		if err != nil {
+			b.logger.Error("resource verification failed", "index", index, "source", source, "reason", err)
+			return errors.Wrapf(err, "verification of resource '%s' of command %d failed", source, index)
+		}
+		b.logger.Info("resource verified", "index", index, "source", source)
+	}
+	return nil
+}
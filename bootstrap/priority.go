@@ -0,0 +1,80 @@
+package bootstrap
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// IOPriorityClass is the IO scheduling class of a command, see ioprio_set(2).
+type IOPriorityClass int
+
+const (
+	// IOPriorityClassRealTime gives the command the first access to the disk.
+	IOPriorityClassRealTime IOPriorityClass = 1
+	// IOPriorityClassBestEffort is the default class, the level orders the commands within the class.
+	IOPriorityClassBestEffort IOPriorityClass = 2
+	// IOPriorityClassIdle gives the command the disk only when no other program needs it.
+	IOPriorityClassIdle IOPriorityClass = 3
+)
+
+const (
+	maxNiceness        = 19
+	minNiceness        = -20
+	maxIOPriorityLevel = 7
+)
+
+type ioPriority struct {
+	class IOPriorityClass
+	level int
+}
+
+func clampNiceness(niceness int) int {
+	if niceness < minNiceness {
+		return minNiceness
+	}
+	if niceness > maxNiceness {
+		return maxNiceness
+	}
+	return niceness
+}
+
+func clampIOPriority(class IOPriorityClass, level int) ioPriority {
+	if class < IOPriorityClassRealTime || class > IOPriorityClassIdle {
+		class = IOPriorityClassBestEffort
+	}
+	if level < 0 {
+		level = 0
+	}
+	if level > maxIOPriorityLevel {
+		level = maxIOPriorityLevel
+	}
+	return ioPriority{class: class, level: level}
+}
+
+// applyPriority adjusts the scheduling priority of a started command.
+// The priority is not required to execute the command, failures are logged as warnings.
+func (n *shellCommandRunner) applyPriority(index int, process *os.Process) {
+	if n.niceness != nil {
+		if err := setNiceness(process.Pid, *n.niceness); err != nil {
+			if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) {
+				n.logger.Warn("not permitted to set the niceness, lowering the niceness requires privileges",
+					"index", index,
+					"niceness", *n.niceness,
+					"reason", err)
+			} else {
+				n.logger.Warn("failed setting the niceness", "index", index, "niceness", *n.niceness, "reason", err)
+			}
+		}
+	}
+	if n.ioPriority != nil {
+		if err := setIOPriority(process.Pid, n.ioPriority.class, n.ioPriority.level); err != nil {
+			n.logger.Warn("failed setting the IO priority",
+				"index", index,
+				"class", n.ioPriority.class,
+				"level", n.ioPriority.level,
+				"reason", err)
+		}
+	}
+}
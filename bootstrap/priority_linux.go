@@ -0,0 +1,22 @@
+package bootstrap
+
+import (
+	"syscall"
+)
+
+const (
+	ioprioClassShift = 13
+	ioprioWhoProcess = 1
+)
+
+func setNiceness(pid, niceness int) error {
+	return syscall.Setpriority(syscall.PRIO_PROCESS, pid, niceness)
+}
+
+func setIOPriority(pid int, class IOPriorityClass, level int) error {
+	ioprio := int(class)<<ioprioClassShift | level
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(pid), uintptr(ioprio)); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package bootstrap
+
+import "fmt"
+
+func setNiceness(pid, niceness int) error {
+	return fmt.Errorf("setting the niceness is supported on Linux only")
+}
+
+func setIOPriority(pid int, class IOPriorityClass, level int) error {
+	return fmt.Errorf("setting the IO priority is supported on Linux only")
+}
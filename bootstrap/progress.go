@@ -0,0 +1,87 @@
+package bootstrap
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/combust-labs/firebuild-shared/build/commands"
+	"github.com/pkg/errors"
+)
+
+// progressEntry is a successfully executed command.
+type progressEntry struct {
+	Command string `json:"Command"`
+	Index   int    `json:"Index"`
+}
+
+// bootstrapProgress tracks the successfully executed commands so a retried or resumed
+// bootstrap does not execute them again. The progress is persisted when the path is set.
+type bootstrapProgress struct {
+	Completed []progressEntry `json:"Completed"`
+	path      string
+}
+
+// loadProgress loads the progress file, a missing file is an empty progress.
+func loadProgress(path string) (*bootstrapProgress, error) {
+	progress := &bootstrapProgress{Completed: []progressEntry{}, path: path}
+	if path == "" {
+		return progress, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return progress, nil
+		}
+		return nil, errors.Wrap(err, "failed reading progress file")
+	}
+	if err := json.Unmarshal(data, progress); err != nil {
+		return nil, errors.Wrap(err, "failed deserializing progress file")
+	}
+	return progress, nil
+}
+
+// isCompleted returns true if the command at the index has been executed successfully.
+// The command must be the same, the server could have updated the work context.
+func (p *bootstrapProgress) isCompleted(index int, command string) bool {
+	for _, entry := range p.Completed {
+		if entry.Index == index && entry.Command == command {
+			return true
+		}
+	}
+	return false
+}
+
+// complete records the successfully executed command and persists the progress.
+func (p *bootstrapProgress) complete(index int, command string) error {
+	p.Completed = append(p.Completed, progressEntry{Command: command, Index: index})
+	if p.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(p)
+	if err != nil {
+		return errors.Wrap(err, "failed serializing progress file")
+	}
+	if err := os.MkdirAll(filepath.Dir(p.path), 0755); err != nil {
+		return errors.Wrap(err, "failed creating progress file directory")
+	}
+	if _, err := writeFileAtomically(p.path, "", 0644, bytes.NewReader(data), nil); err != nil {
+		return errors.Wrap(err, "failed writing progress file")
+	}
+	return nil
+}
+
+// originalCommand returns the original command text of the command.
+func originalCommand(cmd commands.VMInitSerializableCommand) string {
+	switch vCommand := cmd.(type) {
+	case commands.Run:
+		return vCommand.OriginalCommand
+	case commands.Add:
+		return vCommand.OriginalCommand
+	case commands.Copy:
+		return vCommand.OriginalCommand
+	}
+	return ""
+}
@@ -0,0 +1,45 @@
+package bootstrap
+
+import (
+	"fmt"
+	"syscall"
+)
+
+func remountReadWrite(mountpoint string) error {
+	return syscall.Mount("", mountpoint, "", syscall.MS_REMOUNT, "")
+}
+
+func remountReadOnly(mountpoint string) error {
+	return syscall.Mount("", mountpoint, "", syscall.MS_REMOUNT|syscall.MS_RDONLY, "")
+}
+
+func mountTmpfs(mountpoint string) error {
+	return syscall.Mount("tmpfs", mountpoint, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "mode=0700")
+}
+
+func mountTmpfsWithSize(mountpoint string, sizeBytes int64) error {
+	options := "mode=0755"
+	if sizeBytes > 0 {
+		options = fmt.Sprintf("size=%d,%s", sizeBytes, options)
+	}
+	return syscall.Mount("tmpfs", mountpoint, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, options)
+}
+
+func bindMount(source, target string, readonly bool) error {
+	if err := syscall.Mount(source, target, "", syscall.MS_BIND, ""); err != nil {
+		return err
+	}
+	if !readonly {
+		return nil
+	}
+	// the read-only flag of a bind mount is applied by a remount:
+	if err := syscall.Mount("", target, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+		syscall.Unmount(target, 0)
+		return err
+	}
+	return nil
+}
+
+func unmount(mountpoint string) error {
+	return syscall.Unmount(mountpoint, 0)
+}
@@ -0,0 +1,30 @@
+//go:build !linux
+// +build !linux
+
+package bootstrap
+
+import "fmt"
+
+func remountReadWrite(mountpoint string) error {
+	return fmt.Errorf("remounting is supported on Linux only")
+}
+
+func remountReadOnly(mountpoint string) error {
+	return fmt.Errorf("remounting is supported on Linux only")
+}
+
+func mountTmpfs(mountpoint string) error {
+	return fmt.Errorf("mounting is supported on Linux only")
+}
+
+func mountTmpfsWithSize(mountpoint string, sizeBytes int64) error {
+	return fmt.Errorf("mounting is supported on Linux only")
+}
+
+func bindMount(source, target string, readonly bool) error {
+	return fmt.Errorf("mounting is supported on Linux only")
+}
+
+func unmount(mountpoint string) error {
+	return fmt.Errorf("unmounting is supported on Linux only")
+}
@@ -1,59 +1,508 @@
 package bootstrap
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"io/fs"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/combust-labs/firebuild-mmds/clock"
 	"github.com/combust-labs/firebuild-shared/build/commands"
 	"github.com/combust-labs/firebuild-shared/build/resources"
 	"github.com/combust-labs/firebuild-shared/build/rootfs"
 	"github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
 )
 
+// ResourceDeployer executes ADD and COPY commands.
 type ResourceDeployer interface {
 	Add(commands.Add, rootfs.ClientProvider) error
 	Copy(commands.Copy, rootfs.ClientProvider) error
 }
 
+// IndexedResourceDeployer is a resource deployer receiving the index of the command, the position
+// of the command in the work context. The bootstrapper executes the ADD and COPY commands
+// with AddIndexed and CopyIndexed when the deployer implements it.
+type IndexedResourceDeployer interface {
+	ResourceDeployer
+	AddIndexed(int, commands.Add, rootfs.ClientProvider) error
+	CopyIndexed(int, commands.Copy, rootfs.ClientProvider) error
+}
+
+// addIndexed executes the ADD command with the index when the resource deployer supports it.
+func addIndexed(deployer ResourceDeployer, index int, cmd commands.Add, grpcClient rootfs.ClientProvider) error {
+	if indexed, ok := deployer.(IndexedResourceDeployer); ok {
+		return indexed.AddIndexed(index, cmd, grpcClient)
+	}
+	return deployer.Add(cmd, grpcClient)
+}
+
+// copyIndexed executes the COPY command with the index when the resource deployer supports it.
+func copyIndexed(deployer ResourceDeployer, index int, cmd commands.Copy, grpcClient rootfs.ClientProvider) error {
+	if indexed, ok := deployer.(IndexedResourceDeployer); ok {
+		return indexed.CopyIndexed(index, cmd, grpcClient)
+	}
+	return deployer.Copy(cmd, grpcClient)
+}
+
 type noopResourceDeployer struct {
 	logger hclog.Logger
 }
 
 func (n *noopResourceDeployer) Add(cmd commands.Add, grpcClient rootfs.ClientProvider) error {
-	n.logger.Debug("executing ADD command", "command", cmd)
+	return n.AddIndexed(0, cmd, grpcClient)
+}
+func (n *noopResourceDeployer) AddIndexed(index int, cmd commands.Add, grpcClient rootfs.ClientProvider) error {
+	n.logger.Debug("executing ADD command", "index", index, "command", cmd)
 	return nil
 }
 func (n *noopResourceDeployer) Copy(cmd commands.Copy, grpcClient rootfs.ClientProvider) error {
-	n.logger.Debug("executing COPY command", "command", cmd)
+	return n.CopyIndexed(0, cmd, grpcClient)
+}
+func (n *noopResourceDeployer) CopyIndexed(index int, cmd commands.Copy, grpcClient rootfs.ClientProvider) error {
+	n.logger.Debug("executing COPY command", "index", index, "command", cmd)
 	return nil
 }
 
+// ExecutingResourceDeployer is a resource deployer writing the resources to the file system.
+type ExecutingResourceDeployer interface {
+	IndexedResourceDeployer
+	DeployTarStream(io.Reader, []TarTarget) error
+	Manifest() []ManifestEntry
+	Cleanup() error
+	StagedPaths() []string
+	VerifyExpectedTree() error
+	WithAllowedSourceRoots([]string) ExecutingResourceDeployer
+	WithBatchSmallFiles(int) ExecutingResourceDeployer
+	WithContinueOnContentsError(bool) ExecutingResourceDeployer
+	WithCopyBufferSize(int) ExecutingResourceDeployer
+	WithDeduplicateHardlinks(bool) ExecutingResourceDeployer
+	WithDeferredDirModes(bool) ExecutingResourceDeployer
+	WithDeployExcludes([]string) ExecutingResourceDeployer
+	WithDeployTransform(string, func([]byte) ([]byte, error)) ExecutingResourceDeployer
+	WithDeterministicOrder(bool) ExecutingResourceDeployer
+	WithDiskSpaceCheck(bool) ExecutingResourceDeployer
+	WithExpectedTree(map[string]fs.FileMode) ExecutingResourceDeployer
+	WithFsync(bool) ExecutingResourceDeployer
+	WithGroupSource(string) ExecutingResourceDeployer
+	WithLineEndingNormalization(string, LineEnding) ExecutingResourceDeployer
+	WithManifestOutput(string) ExecutingResourceDeployer
+	WithMaxTotalDeployBytes(int64) ExecutingResourceDeployer
+	WithNumericOwner(int, int) ExecutingResourceDeployer
+	WithOverwritePolicy(OverwritePolicy) ExecutingResourceDeployer
+	WithPasswdSource(string) ExecutingResourceDeployer
+	WithRemountRW(string) ExecutingResourceDeployer
+	WithResourceDeployTimeout(time.Duration) ExecutingResourceDeployer
+	WithResourceOpenRetry(int, time.Duration) ExecutingResourceDeployer
+	WithResourcePriority(map[string]int) ExecutingResourceDeployer
+	WithStagingRoot(string) ExecutingResourceDeployer
+	WithTempDir(string) ExecutingResourceDeployer
+	WithTmpfsTarget(string, int64) ExecutingResourceDeployer
+	WithValidateResourcesOnly(bool) ExecutingResourceDeployer
+	WithWriterFactory(WriterFactory) ExecutingResourceDeployer
+}
+
 type executingResourceDeployer struct {
-	defaultUser commands.User
-	logger      hclog.Logger
+	allowedSourceRoots      []string
+	clock                   clock.Clock
+	continueOnContentsError bool
+	copyBufferSize          int
+	deduplicateHardlinks    bool
+	defaultUser             commands.User
+	deferredDirModes        bool
+	deployExcludes          []deployExclude
+	deployedBytes           int64
+	deterministicOrder      bool
+	diskSpaceCheck          bool
+	errorClassifier         ErrorClassifier
+	expectedTree            map[string]fs.FileMode
+	fsync                   bool
+	hardlinkSources         map[string]string
+	logger                  hclog.Logger
+	manifest                []ManifestEntry
+	manifestOutput          string
+	maxTotalDeployBytes     int64
+	numericOwner            *numericOwner
+	overwritePolicy         OverwritePolicy
+	pendingDirModes         []deferredDirMode
+	remountRW               string
+	resourceDeployTimeout   time.Duration
+	resourceOpenAttempts    int
+	resourceOpenBackoff     time.Duration
+	resourcePriority        map[string]int
+	smallFiles              *smallFileBatch
+	stagingRoot             string
+	tempDir                 string
+	tmpfsTargets            []*tmpfsTarget
+	validateResourcesOnly   bool
+	transforms              []deployTransform
+	userResolver            *userResolver
+	writerFactory           WriterFactory
 }
 
-func NewExecutingResourceDeployer(logger hclog.Logger) ResourceDeployer {
+func NewExecutingResourceDeployer(logger hclog.Logger) ExecutingResourceDeployer {
 	return &executingResourceDeployer{
-		defaultUser: commands.DefaultUser(),
-		logger:      logger,
+		clock:           clock.Real(),
+		copyBufferSize:  DefaultCopyBufferSize,
+		defaultUser:     commands.DefaultUser(),
+		hardlinkSources: map[string]string{},
+		logger:          logger,
+		userResolver:    &userResolver{},
 	}
 }
 
+// WithAllowedSourceRoots configures the directories the absolute sources of the ADD and COPY commands
+// are read from. An absolute source in one of the roots is read from the local file system
+// instead of the server, an absolute source outside of the roots is rejected with ErrSourceNotAllowed.
+// The sources are compared with the symlinks evaluated, the symlinks in a source directory are skipped.
+// A nil list, the default, serves all sources from the server.
+func (n *executingResourceDeployer) WithAllowedSourceRoots(input []string) ExecutingResourceDeployer {
+	n.allowedSourceRoots = input
+	return n
+}
+
+// WithBatchSmallFiles configures the deployer to batch the files of an ADD or COPY command with the contents
+// of at most thresholdBytes. The contents of the batched files are collected in a preallocated buffer, the files
+// are written without syncing every file and made durable with a single sync of the file system when the batch
+// is flushed, when the batch is full and after all resources of the command are received. A zero threshold
+// disables the batching. The files of a tar stream are not batched.
+func (n *executingResourceDeployer) WithBatchSmallFiles(thresholdBytes int) ExecutingResourceDeployer {
+	n.smallFiles = nil
+	if thresholdBytes > 0 {
+		n.smallFiles = newSmallFileBatch(thresholdBytes)
+	}
+	return n
+}
+
+// WithContinueOnContentsError configures the deployer to continue deploying the remaining
+// resources of a command when the contents of a resource cannot be resolved.
+// The command fails with ResourceFailures after all other resources are deployed.
+// By default, the command is aborted on the first contents failure.
+func (n *executingResourceDeployer) WithContinueOnContentsError(input bool) ExecutingResourceDeployer {
+	n.continueOnContentsError = input
+	return n
+}
+
+// WithCopyBufferSize configures the size of the buffer the contents of the resources are copied
+// to the files with, tuning the IO for the storage backend. Larger buffers may improve the throughput
+// on high latency file systems. The default is DefaultCopyBufferSize, a size below MinCopyBufferSize
+// is raised to MinCopyBufferSize.
+func (n *executingResourceDeployer) WithCopyBufferSize(input int) ExecutingResourceDeployer {
+	if input < MinCopyBufferSize {
+		n.logger.Warn("copy buffer size below the minimum, using the minimum", "copy-buffer-size", input, "minimum", MinCopyBufferSize)
+		input = MinCopyBufferSize
+	}
+	n.copyBufferSize = input
+	return n
+}
+
+// WithDeduplicateHardlinks configures the deployer to hardlink deployed files to previously
+// deployed files with identical contents, mode and owner to save space on the root file system.
+// Files are copied when the hardlink cannot be created, for example across file system boundaries.
+// Hardlinked files share the contents, a later modification of one of them modifies all.
+func (n *executingResourceDeployer) WithDeduplicateHardlinks(input bool) ExecutingResourceDeployer {
+	n.deduplicateHardlinks = input
+	return n
+}
+
+// WithDeferredDirModes configures the deployer to create the directories of an ADD or COPY command
+// and of a tar stream writable by the owner and to apply their modes after all contents of the command
+// are deployed, also when the deployment fails. A restrictive directory mode, for example 0500,
+// does not prevent writing the contents of the directory. The deferred mode is applied with chmod,
+// it is not masked with the umask and it is also applied to an existing directory.
+func (n *executingResourceDeployer) WithDeferredDirModes(input bool) ExecutingResourceDeployer {
+	n.deferredDirModes = input
+	return n
+}
+
+// WithDeployExcludes configures gitignore-style patterns of the directory resource entries
+// which are not deployed, for example .git/ or **/*.tmp. The patterns are matched against the path
+// relative to the command source. A pattern with a leading or inner slash is anchored to the source,
+// a trailing slash matches only directories, ! includes a previously excluded entry again.
+// Entries of an excluded directory are excluded as well.
+func (n *executingResourceDeployer) WithDeployExcludes(input []string) ExecutingResourceDeployer {
+	n.deployExcludes = parseDeployExcludes(input)
+	return n
+}
+
+// WithDeployTransform registers a transform of the contents of the files with the target path
+// or the target file name matching the glob, for example *.conf. The transformed contents are written
+// instead of the resource contents, which allows substituting runtime values into configuration files.
+// Multiple matching transforms are applied in the order they were registered.
+func (n *executingResourceDeployer) WithDeployTransform(glob string, transformFunc func([]byte) ([]byte, error)) ExecutingResourceDeployer {
+	n.transforms = append(n.transforms, deployTransform{glob: glob, transformFunc: transformFunc})
+	return n
+}
+
+// WithDeterministicOrder configures the deployer to deploy the resources of a command in the lexicographic
+// order of their target paths instead of the order received from the server, which is not stable across runs,
+// so the manifest and the event log are byte-reproducible. The directories are still created before any file,
+// a resource priority takes precedence over the order. The order applies to the independent resources
+// of a single ADD or COPY command only, the commands are always executed in order.
+func (n *executingResourceDeployer) WithDeterministicOrder(input bool) ExecutingResourceDeployer {
+	n.deterministicOrder = input
+	return n
+}
+
+// WithDiskSpaceCheck configures the deployer to check the free space of the file system before writing,
+// failing with an *InsufficientDiskSpaceError instead of partially written files. The files of an ADD or COPY
+// command are checked once, before the first file is written, for the sum of the sizes of all files of the command.
+// The size is known for the tar stream entries, checked one by one, and for the resource contents reporting
+// their size, the resources streamed from the server are not checked.
+func (n *executingResourceDeployer) WithDiskSpaceCheck(input bool) ExecutingResourceDeployer {
+	n.diskSpaceCheck = input
+	return n
+}
+
+// WithExpectedTree configures the exact set of on-disk paths the deployment must produce, with their modes.
+// After all commands are executed, every expected path must exist with the expected permissions and type,
+// and every deployed path must be expected. The bootstrap fails with TreeMismatchError otherwise.
+// Directories are expected with fs.ModeDir, for example fs.ModeDir|0755.
+func (n *executingResourceDeployer) WithExpectedTree(input map[string]fs.FileMode) ExecutingResourceDeployer {
+	n.expectedTree = input
+	return n
+}
+
+// WithFsync configures the deployer to fsync every deployed file and directory and its parent directory,
+// so the deployment survives a crash of the host once the command succeeds, trading throughput for durability.
+// The contents of a file are always synced before the file is atomically renamed to the target,
+// syncing the parent directory makes the rename itself durable.
+func (n *executingResourceDeployer) WithFsync(input bool) ExecutingResourceDeployer {
+	n.fsync = input
+	return n
+}
+
+// WithGroupSource configures the group database used to resolve group names,
+// for example the /etc/group file of the target root file system.
+// When not set, group names are resolved against the host.
+func (n *executingResourceDeployer) WithGroupSource(input string) ExecutingResourceDeployer {
+	n.userResolver.groupSource = input
+	return n
+}
+
+// WithLineEndingNormalization configures the deployer to convert the line endings of the files
+// with the target path or the target file name matching the glob to the style, for example
+// to deploy the configuration files of a build context checked out on Windows with LF line endings.
+// Only text files are converted, files with a NUL byte in the first 8000 bytes are written unchanged.
+// The conversion is a deploy transform, applied in registration order with the other transforms.
+func (n *executingResourceDeployer) WithLineEndingNormalization(glob string, style LineEnding) ExecutingResourceDeployer {
+	n.transforms = append(n.transforms, deployTransform{glob: glob, transformFunc: lineEndingTransform(style)})
+	return n
+}
+
+// WithManifestOutput configures a path of the JSON manifest listing every deployed file
+// and directory. The manifest is rewritten after every ADD and COPY command.
+func (n *executingResourceDeployer) WithManifestOutput(input string) ExecutingResourceDeployer {
+	n.manifestOutput = input
+	return n
+}
+
+// WithMaxTotalDeployBytes configures the maximum number of bytes written across all deployed files.
+// The deployment is aborted with MaxTotalDeployBytesError when the limit is exceeded,
+// the file exceeding the limit is not written. By default, there is no limit.
+func (n *executingResourceDeployer) WithMaxTotalDeployBytes(input int64) ExecutingResourceDeployer {
+	n.maxTotalDeployBytes = input
+	return n
+}
+
+// WithNumericOwner configures the numeric uid and gid of every deployed file and directory,
+// overriding the user of the command. The ids do not have to exist in the passwd
+// and group databases. A gid of -1 leaves the group unchanged.
+func (n *executingResourceDeployer) WithNumericOwner(uid, gid int) ExecutingResourceDeployer {
+	n.numericOwner = &numericOwner{uid: uid, gid: gid}
+	return n
+}
+
+// WithOverwritePolicy configures what the deployer does when the target file of a resource exists,
+// PolicyOverwrite by default. Existing directories are always merged into.
+func (n *executingResourceDeployer) WithOverwritePolicy(input OverwritePolicy) ExecutingResourceDeployer {
+	n.overwritePolicy = input
+	return n
+}
+
+// WithPasswdSource configures the passwd database used to resolve user names,
+// for example the /etc/passwd file of the target root file system.
+// When not set, user names are resolved against the host.
+func (n *executingResourceDeployer) WithPasswdSource(input string) ExecutingResourceDeployer {
+	n.userResolver.passwdSource = input
+	return n
+}
+
+// WithRemountRW configures a read-only mount point remounted read-write
+// for the duration of every deployment and remounted read-only afterwards.
+func (n *executingResourceDeployer) WithRemountRW(input string) ExecutingResourceDeployer {
+	n.remountRW = input
+	return n
+}
+
+// WithResourceDeployTimeout configures the maximum duration of writing a single resource.
+// A resource exceeding the timeout is aborted, its contents are closed and the partially written file
+// is removed. The command fails with ErrResourceDeployTimeout, combined with WithContinueOnContentsError
+// the remaining resources are deployed and the timed out resources are reported as ResourceFailures.
+// By default, there is no timeout.
+func (n *executingResourceDeployer) WithResourceDeployTimeout(input time.Duration) ExecutingResourceDeployer {
+	n.resourceDeployTimeout = input
+	return n
+}
+
+// WithResourceOpenRetry configures the number of attempts to open the contents of a resource
+// and the backoff before the first retry, doubled for every following retry. The contents
+// are opened once by default. Only opening the contents is retried, a failed write fails the resource.
+func (n *executingResourceDeployer) WithResourceOpenRetry(attempts int, backoff time.Duration) ExecutingResourceDeployer {
+	n.resourceOpenAttempts = attempts
+	n.resourceOpenBackoff = backoff
+	return n
+}
+
+// WithResourcePriority configures the deployment order of the resources of a command by the source path.
+// The files with a higher priority are deployed first, the files without a priority inherit
+// the priority of the closest parent directory with one, 0 otherwise. The directories are created
+// before any file, in the order received from the server.
+// The commands are always executed strictly in order, the priority orders the resources within
+// a single ADD or COPY command only: a resource required by an earlier RUN command, for example
+// a CA bundle, must be deployed by an ADD or COPY command preceding it. The priority does not apply
+// to DeployTarStream, which deploys the entries in the stream order.
+func (n *executingResourceDeployer) WithResourcePriority(input map[string]int) ExecutingResourceDeployer {
+	n.resourcePriority = normalizeResourcePriority(input)
+	return n
+}
+
+// WithStagingRoot configures a staging directory all resources are written under instead of the root
+// file system, for example to pack a read-only squashfs or overlay image from the staging directory
+// after the bootstrap, with the finalize command. A target /etc/app.conf is written to <staging-root>/etc/app.conf.
+// The manifest and the expected tree paths are the staged on-disk paths, StagedPaths lists them
+// for the packer.
+func (n *executingResourceDeployer) WithStagingRoot(input string) ExecutingResourceDeployer {
+	n.stagingRoot = input
+	return n
+}
+
+// WithTempDir configures the directory where the files are written before being
+// renamed to their target path. The directory must be on the same device as the targets.
+// When not set, the files are written in the directory of the target.
+func (n *executingResourceDeployer) WithTempDir(input string) ExecutingResourceDeployer {
+	n.tempDir = input
+	return n
+}
+
+// WithTmpfsTarget configures a tmpfs of the size mounted at the on-disk mountpoint before the first resource
+// is written under it, for ephemeral secrets or caches which must not persist in the root file system image.
+// A resource exceeding the size fails to deploy. A size of 0 or less uses the kernel default of half of the memory.
+// The tmpfs is unmounted, and its contents discarded, by Cleanup when the bootstrap finishes.
+// Mounting requires CAP_SYS_ADMIN and is supported on Linux only.
+func (n *executingResourceDeployer) WithTmpfsTarget(mountpoint string, sizeBytes int64) ExecutingResourceDeployer {
+	n.tmpfsTargets = append(n.tmpfsTargets, newTmpfsTarget(mountpoint, sizeBytes))
+	return n
+}
+
+// WithValidateResourcesOnly configures the deployer to validate the ADD and COPY resources without deploying them,
+// as a pre-flight before any mutation: the contents of every file are read and, when the command has
+// a --checksum=sha256:<hex> flag, verified, and the parent directories of the targets are verified writable.
+// Nothing is written, the tmpfs targets are not mounted and the manifest stays empty.
+// The resource failures are reported like the deployment failures. Does not apply to DeployTarStream.
+func (n *executingResourceDeployer) WithValidateResourcesOnly(input bool) ExecutingResourceDeployer {
+	n.validateResourcesOnly = input
+	return n
+}
+
+// WithWriterFactory configures the factory of the writers of the deployed file contents, for example
+// to write the files to a block device or an encrypted overlay. The deployer creates the directories,
+// applies the overwrite policy and chowns the target path as without a factory, the factory
+// is responsible for the durability and the atomicity of the write. The contents are written to the writer
+// of the target as they are received, without a temporary file renamed over the target: writing over a running
+// executable in place fails with ETXTBSY, and a failed write leaves the partially written target to the factory.
+// The small files are not batched with a writer factory. A nil factory writes the files atomically
+// to the file system, the default.
+func (n *executingResourceDeployer) WithWriterFactory(input WriterFactory) ExecutingResourceDeployer {
+	n.writerFactory = input
+	return n
+}
+
 func (n *executingResourceDeployer) Add(cmd commands.Add, grpcClient rootfs.ClientProvider) error {
-	n.logger.Debug("executing ADD command", "command", cmd)
-	return n.deployResources(cmd.Source, grpcClient)
+	return n.AddIndexed(0, cmd, grpcClient)
+}
+func (n *executingResourceDeployer) AddIndexed(index int, cmd commands.Add, grpcClient rootfs.ClientProvider) error {
+	n.logger.Debug("executing ADD command", "index", index, "command", cmd)
+	checksum, err := parseChecksumFlag(cmd.OriginalCommand)
+	if err != nil {
+		n.logger.Error("invalid ADD command flags", "index", index, "reason", err)
+		return err
+	}
+	client, err := n.sourceClient(grpcClient, ResourceRequest{
+		CommandIndex: index,
+		Source:       cmd.Source,
+		Target:       cmd.Target,
+		User:         cmd.User,
+		Workdir:      cmd.Workdir,
+	})
+	if err != nil {
+		return err
+	}
+	return n.withManifest(func() error {
+		return n.withWritableTarget(func() error {
+			return n.withDeferredDirModes(func() error {
+				return n.deployResources(index, cmd.Source, resourceOverrides{checksum: checksum}, client)
+			})
+		})
+	})
 }
 func (n *executingResourceDeployer) Copy(cmd commands.Copy, grpcClient rootfs.ClientProvider) error {
-	n.logger.Debug("executing COPY command", "command", cmd)
-	return n.deployResources(cmd.Source, grpcClient)
+	return n.CopyIndexed(0, cmd, grpcClient)
+}
+func (n *executingResourceDeployer) CopyIndexed(index int, cmd commands.Copy, grpcClient rootfs.ClientProvider) error {
+	n.logger.Debug("executing COPY command", "index", index, "command", cmd)
+	overrides, err := parseResourceOverrides(cmd.OriginalCommand)
+	if err != nil {
+		n.logger.Error("invalid COPY command flags", "index", index, "reason", err)
+		return err
+	}
+	client, err := n.sourceClient(grpcClient, ResourceRequest{
+		CommandIndex: index,
+		Source:       cmd.Source,
+		Target:       cmd.Target,
+		User:         cmd.User,
+		Workdir:      cmd.Workdir,
+	})
+	if err != nil {
+		return err
+	}
+	return n.withManifest(func() error {
+		return n.withWritableTarget(func() error {
+			return n.withDeferredDirModes(func() error {
+				return n.deployResources(index, cmd.Source, overrides, client)
+			})
+		})
+	})
 }
 
-func (n *executingResourceDeployer) deployResources(source string, grpcClient rootfs.ClientProvider) error {
+func (n *executingResourceDeployer) withWritableTarget(f func() error) (deployErr error) {
+	if n.remountRW == "" {
+		return f()
+	}
+	if err := remountReadWrite(n.remountRW); err != nil {
+		n.logger.Error("failed remounting target read-write", "mountpoint", n.remountRW, "reason", err)
+		return errors.Wrapf(err, "failed remounting '%s' read-write", n.remountRW)
+	}
+	defer func() {
+		if err := remountReadOnly(n.remountRW); err != nil {
+			n.logger.Error("failed remounting target read-only", "mountpoint", n.remountRW, "reason", err)
+			if deployErr == nil {
+				deployErr = errors.Wrapf(err, "failed remounting '%s' read-only", n.remountRW)
+			}
+		}
+	}()
+	return f()
+}
+
+func (n *executingResourceDeployer) deployResources(index int, source string, overrides resourceOverrides, grpcClient rootfs.ClientProvider) error {
 
 	resourceChannel, err := grpcClient.Resource(source)
 
@@ -61,33 +510,82 @@ func (n *executingResourceDeployer) deployResources(source string, grpcClient ro
 		return err
 	}
 
+	resourceChannel = n.prioritizeResources(resourceChannel)
+
+	requiredBytes := int64(0)
+	if n.diskSpaceCheck && !n.validateResourcesOnly {
+		resourceChannel, requiredBytes = n.requiredDiskSpace(source, resourceChannel)
+	}
+	diskSpaceChecked := false
+
+	// the files batched by a failed deployment are never written:
+	n.smallFiles.reset()
+
 	nResourcesTransferred := 0
+	nResourcesExcluded := 0
+	contentsFailures := ResourceFailures{}
 
 	for {
 		select {
 		case item := <-resourceChannel:
 			switch titem := item.(type) {
 			case nil:
-				if nResourcesTransferred == 0 {
+				if err := n.flushSmallFiles(); err != nil {
+					return err
+				}
+				if nResourcesExcluded > 0 {
+					n.logger.Info("resource entries excluded",
+						"resource-path", source,
+						"excluded-entries", nResourcesExcluded)
+				}
+				if nResourcesTransferred == 0 && nResourcesExcluded == 0 {
 					// there was nothing transferred, this is an error implying the resource was not found:
 					n.logger.Error("no resources transferred for",
 						"resource-path", source)
 					return os.ErrNotExist
 				}
+				if len(contentsFailures) > 0 {
+					n.logger.Error("resource deployed with failures",
+						"resource-path", source,
+						"number-of-resources", nResourcesTransferred,
+						"failed-resources", len(contentsFailures))
+					return contentsFailures
+				}
 				n.logger.Debug("resource deployed",
 					"resource-path", source,
 					"number-of-resources", nResourcesTransferred)
 				return nil // finished successfully
 			case resources.ResolvedResource:
 
+				if n.isExcluded(resourceRelativePath(source, titem.SourcePath()), titem.IsDir()) {
+					n.logger.Debug("resource entry excluded",
+						"resource-path", titem.TargetPath(),
+						"source-path", titem.SourcePath())
+					nResourcesExcluded = nResourcesExcluded + 1
+					continue
+				}
+
 				nResourcesTransferred = nResourcesTransferred + 1
 
+				targetMode := overrides.targetMode(titem.TargetMode())
+				targetUser := overrides.targetUser(titem.TargetUser())
+
 				if titem.IsDir() {
 
-					fullTargetResourcePath := filepath.Join(titem.TargetWorkdir().Value, titem.TargetPath())
+					fullTargetResourcePath := n.stagedPath(filepath.Join(titem.TargetWorkdir().Value, titem.TargetPath()))
+					if n.validateResourcesOnly {
+						if err := n.validateWritable(fullTargetResourcePath); err != nil {
+							n.logger.Error("resource directory validation failed", "resource-path", titem.TargetPath(), "reason", err)
+							return err
+						}
+						continue
+					}
+					if err := n.ensureTmpfs(fullTargetResourcePath); err != nil {
+						return err
+					}
 
 					// create a directory:
-					if err := os.MkdirAll(fullTargetResourcePath, titem.TargetMode()); err != nil {
+					if err := os.MkdirAll(fullTargetResourcePath, n.mkdirMode(fullTargetResourcePath, targetMode)); err != nil {
 						n.logger.Error("error while creating directory",
 							"resource-path", titem.TargetPath(),
 							"on-disk-path", fullTargetResourcePath)
@@ -98,15 +596,15 @@ func (n *executingResourceDeployer) deployResources(source string, grpcClient ro
 						"resource-path", titem.TargetPath(),
 						"on-disk-path", fullTargetResourcePath)
 
-					if titem.TargetUser().Value != n.defaultUser.Value {
-						uid, gid, err := stringToUidAndGid(titem.TargetUser().Value)
-						if err != nil {
-							n.logger.Error("error while chowning directory",
-								"resource-path", titem.TargetPath(),
-								"on-disk-path", fullTargetResourcePath,
-								"reason", err)
-							return err
-						}
+					uid, gid, chown, err := n.targetOwner(targetUser)
+					if err != nil {
+						n.logger.Error("error while chowning directory",
+							"resource-path", titem.TargetPath(),
+							"on-disk-path", fullTargetResourcePath,
+							"reason", err)
+						return err
+					}
+					if chown {
 						if err := os.Chown(fullTargetResourcePath, uid, gid); err != nil {
 							n.logger.Error("error while chowning directory",
 								"resource-path", titem.TargetPath(),
@@ -115,15 +613,42 @@ func (n *executingResourceDeployer) deployResources(source string, grpcClient ro
 							return err
 						}
 					}
+
+					dirEntry := ManifestEntry{
+						CommandIndex: index,
+						IsDir:        true,
+						Mode:         manifestMode(targetMode),
+						Owner:        manifestOwner(chown, uid, gid),
+						Path:         fullTargetResourcePath,
+						Stage:        overrides.stage,
+					}
+					if err := n.syncEntry(dirEntry); err != nil {
+						return err
+					}
+					n.recordManifestEntry(dirEntry)
 					continue
 				}
 
-				destination := filepath.Join(titem.TargetWorkdir().Value, titem.TargetPath())
+				destination := n.stagedPath(filepath.Join(titem.TargetWorkdir().Value, titem.TargetPath()))
 				targetFileName := filepath.Base(titem.SourcePath())
 				if filepath.Base(destination) != targetFileName {
 					// ensure that we always have a full target path:
 					destination = filepath.Join(destination, targetFileName)
 				}
+				if n.validateResourcesOnly {
+					if err := n.validateResource(titem, destination, overrides.checksum); err != nil {
+						n.logger.Error("resource validation failed", "resource-path", titem.TargetPath(), "reason", err)
+						if n.continueOnContentsError {
+							contentsFailures = append(contentsFailures, err)
+							continue
+						}
+						return err
+					}
+					continue
+				}
+				if err := n.ensureTmpfs(destination); err != nil {
+					return err
+				}
 
 				// make sure we have the parent directory
 				// this is the default Docker behavior, it creates intermediate directories for ADD / COPY commands
@@ -134,61 +659,70 @@ func (n *executingResourceDeployer) deployResources(source string, grpcClient ro
 					return err
 				}
 
-				resourceReader, err := titem.Contents()
+				deploy, err := n.applyOverwritePolicy(destination)
 				if err != nil {
-					n.logger.Error("error while fetching resource reader",
+					n.logger.Error("overwrite policy rejected the resource",
 						"resource-path", titem.TargetPath(),
 						"on-disk-path", destination,
 						"reason", err)
 					return err
 				}
-				defer resourceReader.Close()
-
-				targetFile, err := os.OpenFile(destination, os.O_CREATE|os.O_RDWR, titem.TargetMode())
+				if !deploy {
+					continue
+				}
 
+				// the contents are resolved only when the resource is deployed:
+				resourceReader, err := n.openResource(titem)
 				if err != nil {
-					n.logger.Error("error while creating target file",
+					n.logger.Error("error while fetching resource reader",
 						"resource-path", titem.TargetPath(),
 						"on-disk-path", destination,
 						"reason", err)
+					if n.continueOnContentsError {
+						contentsFailures = append(contentsFailures, err)
+						continue
+					}
 					return err
 				}
 
-				written, err := io.Copy(targetFile, resourceReader)
+				if !diskSpaceChecked {
+					// the space for all files of the command is checked before the first file is written:
+					diskSpaceChecked = true
+					if err := n.checkDiskSpace(destination, requiredBytes); err != nil {
+						resourceReader.Close()
+						return err
+					}
+				}
+
+				written, contentsSHA256, batched, err := n.writeResource(destination, targetMode, resourceReader)
 				if err != nil {
-					targetFile.Close()
 					n.logger.Error("error while writing target file",
 						"resource-path", titem.TargetPath(),
 						"on-disk-path", destination,
 						"reason", err)
+					if errors.Is(err, ErrResourceDeployTimeout) && n.continueOnContentsError {
+						contentsFailures = append(contentsFailures, errors.Wrapf(err, "resource '%s'", titem.TargetPath()))
+						continue
+					}
 					return err
 				}
 
-				targetFile.Close()
-
-				n.logger.Info("file written",
-					"resource-path", titem.TargetPath(),
-					"on-disk-path", destination,
-					"written-bytes", written)
-
-				// chown the file:
-
-				if titem.TargetUser().Value != n.defaultUser.Value {
-					uid, gid, err := stringToUidAndGid(titem.TargetUser().Value)
-					if err != nil {
-						n.logger.Error("error while chowning file",
-							"resource-path", titem.TargetPath(),
-							"on-disk-path", destination,
-							"reason", err)
-						return err
-					}
-					if err := os.Chown(destination, uid, gid); err != nil {
-						n.logger.Error("error while chowning file",
-							"resource-path", titem.TargetPath(),
-							"on-disk-path", destination,
-							"reason", err)
-						return err
+				resourcePath := titem.TargetPath()
+				finish := func() error {
+					return n.finishFile(index, overrides.stage, resourcePath, destination, targetMode, targetUser, written, contentsSHA256)
+				}
+				if batched {
+					// the file is written with the batch:
+					n.smallFiles.onWritten(finish)
+					if n.smallFiles.full() {
+						if err := n.flushSmallFiles(); err != nil {
+							return err
+						}
 					}
+					continue
+				}
+				if err := finish(); err != nil {
+					return err
 				}
 
 			case error:
@@ -199,6 +733,243 @@ func (n *executingResourceDeployer) deployResources(source string, grpcClient ro
 
 }
 
+// finishFile chowns the written file and records it in the manifest.
+func (n *executingResourceDeployer) finishFile(index int, stage, resourcePath, destination string, targetMode os.FileMode, targetUser commands.User, written int64, contentsSHA256 string) error {
+
+	n.logger.Info("file written",
+		"resource-path", resourcePath,
+		"on-disk-path", destination,
+		"written-bytes", written)
+
+	// chown the file:
+
+	uid, gid, chown, err := n.targetOwner(targetUser)
+	if err != nil {
+		n.logger.Error("error while chowning file",
+			"resource-path", resourcePath,
+			"on-disk-path", destination,
+			"reason", err)
+		return err
+	}
+	if chown {
+		if err := os.Chown(destination, uid, gid); err != nil {
+			n.logger.Error("error while chowning file",
+				"resource-path", resourcePath,
+				"on-disk-path", destination,
+				"reason", err)
+			return err
+		}
+	}
+
+	entry := ManifestEntry{
+		CommandIndex: index,
+		Mode:         manifestMode(targetMode),
+		Owner:        manifestOwner(chown, uid, gid),
+		Path:         destination,
+		SHA256:       contentsSHA256,
+		Size:         written,
+		Stage:        stage,
+	}
+	n.deduplicate(entry)
+	if err := n.syncEntry(entry); err != nil {
+		return err
+	}
+	n.recordManifestEntry(entry)
+	return nil
+}
+
+// writeResource writes the transformed contents of a resource to the destination
+// and closes the contents. Returns the number of written bytes, the hex encoded
+// sha256 of the written contents and true if the contents are added to the small files
+// batch, the batched file is written when the batch is flushed.
+func (n *executingResourceDeployer) writeResource(destination string, mode os.FileMode, resourceReader io.ReadCloser) (int64, string, bool, error) {
+	defer resourceReader.Close()
+	timedReader, stopTimeout := n.withDeployTimeout(resourceReader)
+	written, contentsSHA256, small, err := func() (int64, string, []byte, error) {
+		contents, err := n.transformContents(destination, timedReader)
+		if err != nil {
+			return 0, "", nil, err
+		}
+		contents = n.limitDeployBytes(destination, contents)
+		if n.smallFiles != nil && n.writerFactory == nil {
+			// a pending file must be written before the file replacing it:
+			if n.smallFiles.pending(destination) {
+				if err := n.flushSmallFiles(); err != nil {
+					return 0, "", nil, err
+				}
+			}
+			head, isSmall, err := n.smallFiles.read(contents)
+			if err != nil {
+				return 0, "", nil, err
+			}
+			if isSmall {
+				contentsSHA256 := sha256.Sum256(head)
+				return int64(len(head)), hex.EncodeToString(contentsSHA256[:]), head, nil
+			}
+			contents = io.MultiReader(bytes.NewReader(head), contents)
+		}
+		contentsHash := sha256.New()
+		written, err := n.writeContents(destination, mode, io.TeeReader(contents, contentsHash))
+		return written, hex.EncodeToString(contentsHash.Sum(nil)), nil, err
+	}()
+	if stopTimeout() {
+		return written, "", false, errors.Wrapf(ErrResourceDeployTimeout, "writing '%s' exceeded the deploy timeout %s", destination, n.resourceDeployTimeout)
+	}
+	if err != nil {
+		return written, contentsSHA256, false, err
+	}
+	if small != nil {
+		n.smallFiles.add(destination, mode, small)
+		return written, contentsSHA256, true, nil
+	}
+	return written, contentsSHA256, false, nil
+}
+
+// resourceOverrides are the --chmod and --chown flags of a COPY command.
+// They take precedence over the mode and the user of the resource,
+// the numeric owner of the deployer takes precedence over --chown.
+// The stage is the --from flag of a COPY command, recorded in the manifest.
+type resourceOverrides struct {
+	checksum string
+	mode     *os.FileMode
+	stage    string
+	user     string
+}
+
+func (o resourceOverrides) targetMode(mode os.FileMode) os.FileMode {
+	if o.mode != nil {
+		return *o.mode
+	}
+	return mode
+}
+
+func (o resourceOverrides) targetUser(user commands.User) commands.User {
+	if o.user != "" {
+		return commands.User{Value: o.user}
+	}
+	return user
+}
+
+// parseResourceOverrides extracts the --checksum, --chmod, --chown and --from flags from the original command.
+func parseResourceOverrides(originalCommand string) (resourceOverrides, error) {
+	overrides := resourceOverrides{}
+	fields := strings.Fields(originalCommand)
+	if len(fields) == 0 {
+		return overrides, nil
+	}
+	for _, field := range fields[1:] {
+		if !strings.HasPrefix(field, "--") {
+			break // flags precede the sources
+		}
+		switch {
+		case strings.HasPrefix(field, "--chmod="):
+			mode, err := strconv.ParseUint(strings.TrimPrefix(field, "--chmod="), 8, 32)
+			if err != nil {
+				return overrides, errors.Wrapf(err, "invalid --chmod value '%s'", field)
+			}
+			fileMode := os.FileMode(mode)
+			overrides.mode = &fileMode
+		case strings.HasPrefix(field, "--checksum="):
+			checksum, err := parseChecksum(field)
+			if err != nil {
+				return overrides, err
+			}
+			overrides.checksum = checksum
+		case strings.HasPrefix(field, "--chown="):
+			overrides.user = strings.TrimPrefix(field, "--chown=")
+		case strings.HasPrefix(field, "--from="):
+			overrides.stage = strings.TrimPrefix(field, "--from=")
+		}
+	}
+	return overrides, nil
+}
+
+// parseChecksumFlag extracts the --checksum flag from the original command, the other flags are ignored.
+func parseChecksumFlag(originalCommand string) (string, error) {
+	fields := strings.Fields(originalCommand)
+	if len(fields) == 0 {
+		return "", nil
+	}
+	for _, field := range fields[1:] {
+		if !strings.HasPrefix(field, "--") {
+			break // flags precede the sources
+		}
+		if strings.HasPrefix(field, "--checksum=") {
+			return parseChecksum(field)
+		}
+	}
+	return "", nil
+}
+
+// parseChecksum returns the hex encoded sha256 of a --checksum=sha256:<hex> flag.
+func parseChecksum(field string) (string, error) {
+	checksum := strings.ToLower(strings.TrimPrefix(field, "--checksum="))
+	decoded, err := hex.DecodeString(strings.TrimPrefix(checksum, "sha256:"))
+	if !strings.HasPrefix(checksum, "sha256:") || err != nil || len(decoded) != sha256.Size {
+		return "", fmt.Errorf("invalid --checksum value '%s', expected sha256:<hex>", field)
+	}
+	return strings.TrimPrefix(checksum, "sha256:"), nil
+}
+
+type numericOwner struct {
+	uid int
+	gid int
+}
+
+// targetOwner returns the uid and gid of a deployed resource and if the resource has to be chowned.
+func (n *executingResourceDeployer) targetOwner(user commands.User) (int, int, bool, error) {
+	if n.numericOwner != nil {
+		return n.numericOwner.uid, n.numericOwner.gid, true, nil
+	}
+	if user.Value == n.defaultUser.Value {
+		return -1, -1, false, nil
+	}
+	uid, gid, err := n.userResolver.resolve(user.Value)
+	return uid, gid, true, err
+}
+
+// writeFileAtomically writes the contents to a temporary file and renames it to the destination
+// so the destination never contains a partially written file. Renaming replaces the directory entry,
+// so a running executable, which cannot be opened for writing, is replaced without ETXTBSY,
+// the running process keeps executing the previous file.
+// When the temp dir is empty, the temporary file is created in the directory of the destination.
+// The contents are copied with the copy buffer, a nil buffer uses the io.Copy default.
+func writeFileAtomically(destination, tempDir string, mode os.FileMode, contents io.Reader, copyBuffer []byte) (int64, error) {
+	if tempDir == "" {
+		// rename is guaranteed to work only within the same device:
+		tempDir = filepath.Dir(destination)
+	}
+	tempFile, err := ioutil.TempFile(tempDir, "."+filepath.Base(destination)+".tmp-")
+	if err != nil {
+		return 0, errors.Wrap(err, "failed creating temporary file")
+	}
+	tempFileName := tempFile.Name()
+	written, err := func() (int64, error) {
+		defer tempFile.Close()
+		if err := tempFile.Chmod(mode); err != nil {
+			return 0, errors.Wrap(err, "failed chmoding temporary file")
+		}
+		// hide ReadFrom of the file, it would copy with its own buffer:
+		written, err := io.CopyBuffer(struct{ io.Writer }{tempFile}, contents, copyBuffer)
+		if err != nil {
+			return written, errors.Wrap(err, "failed writing temporary file")
+		}
+		if err := tempFile.Sync(); err != nil {
+			return written, errors.Wrap(err, "failed syncing temporary file")
+		}
+		return written, nil
+	}()
+	if err != nil {
+		os.Remove(tempFileName)
+		return written, err
+	}
+	if err := os.Rename(tempFileName, destination); err != nil {
+		os.Remove(tempFileName)
+		return written, errors.Wrap(err, "failed renaming temporary file")
+	}
+	return written, nil
+}
+
 func stringToUidAndGid(input string) (int, int, error) {
 	parts := strings.Split(input, ":")
 	if len(parts) == 0 {
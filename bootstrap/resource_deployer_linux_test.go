@@ -0,0 +1,370 @@
+package bootstrap
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/combust-labs/firebuild-shared/build/commands"
+	"github.com/combust-labs/firebuild-shared/build/resources"
+	"github.com/combust-labs/firebuild-shared/build/rootfs"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAtomicDeployWithTMPDIROnDifferentDevice(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	// the target workdir lives next to the sources, $TMPDIR on a tmpfs:
+	targetDir, err := ioutil.TempDir(".", ".deploy-target-")
+	if err != nil {
+		t.Fatal("expected target dir, got error", err)
+	}
+	defer os.RemoveAll(targetDir)
+	targetDir, _ = filepath.Abs(targetDir)
+
+	tmpDir, err := ioutil.TempDir("/dev/shm", "")
+	if err != nil {
+		t.Skip("tmpfs not available", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if mustDevice(t, targetDir) == mustDevice(t, tmpDir) {
+		t.Skip("the target dir and the temp dir are on the same device")
+	}
+	t.Setenv("TMPDIR", tmpDir)
+
+	fileContents := []byte("test-file contents")
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{
+			commands.Copy{
+				OriginalCommand: "COPY etc/test-file /etc/test-file",
+				OriginalSource:  "etc/test-file",
+				Source:          "etc/test-file",
+				Target:          "/etc/test-file",
+				User:            commands.DefaultUser(),
+				Workdir:         commands.Workdir{Value: targetDir},
+			},
+		},
+		ResourcesResolved: rootfs.Resources{
+			"etc/test-file": []resources.ResolvedResource{
+				resources.NewResolvedFileResourceWithPath(func() (io.ReadCloser, error) {
+					return io.NopCloser(bytes.NewReader(fileContents)), nil
+				},
+					fs.FileMode(0640),
+					"etc/test-file",
+					"/etc/test-file",
+					commands.Workdir{Value: targetDir},
+					commands.DefaultUser(),
+					"etc/test-file"),
+			},
+		},
+	}
+
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithResourceDeployer(NewExecutingResourceDeployer(logger.Named("executing-deployer")))
+
+	bootstrapErr := bootstrapper.Execute()
+	assert.Nil(t, bootstrapErr)
+
+	<-testServer.FinishedNotify()
+
+	deployed, err := ioutil.ReadFile(filepath.Join(targetDir, "etc/test-file"))
+	assert.Nil(t, err)
+	assert.Equal(t, fileContents, deployed)
+
+	stat, err := os.Stat(filepath.Join(targetDir, "etc/test-file"))
+	assert.Nil(t, err)
+	assert.Equal(t, fs.FileMode(0640), stat.Mode().Perm())
+
+	// no temporary files are left behind:
+	entries, err := ioutil.ReadDir(filepath.Join(targetDir, "etc"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+}
+
+func TestCopyWithChmod(t *testing.T) {
+	targetPath := mustDeployWithCopyCommand(t, "COPY --chmod=600 etc/test-file /etc/test-file")
+	stat, err := os.Stat(targetPath)
+	assert.Nil(t, err)
+	assert.Equal(t, fs.FileMode(0600), stat.Mode().Perm())
+	assert.Equal(t, uint32(os.Geteuid()), stat.Sys().(*syscall.Stat_t).Uid)
+}
+
+func TestCopyWithChown(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("chown requires root")
+	}
+	targetPath := mustDeployWithCopyCommand(t, "COPY --chown=1000:1001 etc/test-file /etc/test-file")
+	stat, err := os.Stat(targetPath)
+	assert.Nil(t, err)
+	assert.Equal(t, fs.FileMode(0640), stat.Mode().Perm())
+	assert.Equal(t, uint32(1000), stat.Sys().(*syscall.Stat_t).Uid)
+	assert.Equal(t, uint32(1001), stat.Sys().(*syscall.Stat_t).Gid)
+}
+
+// mustDeployWithCopyCommand deploys a 0640 file with a COPY command and returns the path of the deployed file.
+func mustDeployWithCopyCommand(t *testing.T, originalCommand string) string {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tempDir) })
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{
+			commands.Copy{
+				OriginalCommand: originalCommand,
+				OriginalSource:  "etc/test-file",
+				Source:          "etc/test-file",
+				Target:          "/etc/test-file",
+				User:            commands.DefaultUser(),
+				Workdir:         commands.Workdir{Value: tempDir},
+			},
+		},
+		ResourcesResolved: rootfs.Resources{
+			"etc/test-file": []resources.ResolvedResource{
+				resources.NewResolvedFileResourceWithPath(func() (io.ReadCloser, error) {
+					return io.NopCloser(bytes.NewReader([]byte("test-file contents"))), nil
+				},
+					fs.FileMode(0640),
+					"etc/test-file",
+					"/etc/test-file",
+					commands.Workdir{Value: tempDir},
+					commands.DefaultUser(),
+					"etc/test-file"),
+			},
+		},
+	}
+
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithResourceDeployer(NewExecutingResourceDeployer(logger.Named("executing-deployer")))
+
+	assert.Nil(t, bootstrapper.Execute())
+
+	<-testServer.FinishedNotify()
+
+	return filepath.Join(tempDir, "etc/test-file")
+}
+
+func mustDevice(t *testing.T, path string) uint64 {
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal("expected stat, got error", err)
+	}
+	return uint64(stat.Sys().(*syscall.Stat_t).Dev)
+}
+
+func TestTmpfsTarget(t *testing.T) {
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	newFile := func(path string, size int) resources.ResolvedResource {
+		return resources.NewResolvedFileResourceWithPath(func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(bytes.Repeat([]byte("x"), size))), nil
+		},
+			fs.FileMode(0600),
+			path,
+			"/"+path,
+			commands.Workdir{Value: tempDir},
+			commands.DefaultUser(),
+			path)
+	}
+	newCopy := func(path string) commands.Copy {
+		return commands.Copy{
+			OriginalCommand: "COPY " + path + " /" + path,
+			Source:          path,
+			Target:          "/" + path,
+			User:            commands.DefaultUser(),
+			Workdir:         commands.Workdir{Value: tempDir},
+		}
+	}
+
+	mountpoint := filepath.Join(tempDir, "secrets")
+	deployer := NewExecutingResourceDeployer(hclog.Default()).
+		WithTmpfsTarget(mountpoint, 64*1024)
+
+	if err := deployer.CopyIndexed(0, newCopy("secrets/token"), &resourcesClientProvider{items: []interface{}{newFile("secrets/token", 16)}}); err != nil {
+		if errors.Is(err, syscall.EPERM) {
+			t.Skip("mounting a tmpfs requires privileges", err)
+		}
+		t.Fatal("expected the resource to deploy, got error", err)
+	}
+	defer deployer.Cleanup()
+
+	statfs := syscall.Statfs_t{}
+	assert.Nil(t, syscall.Statfs(mountpoint, &statfs))
+	assert.Equal(t, int64(0x01021994), int64(statfs.Type)) // TMPFS_MAGIC
+
+	// the size of the tmpfs is enforced:
+	assert.NotNil(t, deployer.CopyIndexed(1, newCopy("secrets/large"), &resourcesClientProvider{items: []interface{}{newFile("secrets/large", 128*1024)}}))
+
+	// resources outside of the mountpoint are written to the file system:
+	assert.Nil(t, deployer.CopyIndexed(2, newCopy("etc/app.conf"), &resourcesClientProvider{items: []interface{}{newFile("etc/app.conf", 16)}}))
+
+	assert.Nil(t, deployer.Cleanup())
+	_, statErr := os.Stat(filepath.Join(mountpoint, "token"))
+	assert.True(t, os.IsNotExist(statErr))
+	_, statErr = os.Stat(filepath.Join(tempDir, "etc/app.conf"))
+	assert.Nil(t, statErr)
+}
+
+func TestDiskSpaceCheck(t *testing.T) {
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	newFile := func(path string, size int) resources.ResolvedResource {
+		return resources.NewResolvedFileResourceWithPath(func() (io.ReadCloser, error) {
+			return &sizedContents{Reader: bytes.NewReader(bytes.Repeat([]byte("x"), size))}, nil
+		},
+			fs.FileMode(0600),
+			path,
+			"/"+path,
+			commands.Workdir{Value: tempDir},
+			commands.DefaultUser(),
+			path)
+	}
+	newCopy := func(path string) commands.Copy {
+		return commands.Copy{
+			OriginalCommand: "COPY " + path + " /" + path,
+			Source:          path,
+			Target:          "/" + path,
+			User:            commands.DefaultUser(),
+			Workdir:         commands.Workdir{Value: tempDir},
+		}
+	}
+
+	mountpoint := filepath.Join(tempDir, "data")
+	deployer := NewExecutingResourceDeployer(hclog.Default()).
+		WithDiskSpaceCheck(true).
+		WithTmpfsTarget(mountpoint, 64*1024)
+
+	if err := deployer.CopyIndexed(0, newCopy("data/small"), &resourcesClientProvider{items: []interface{}{newFile("data/small", 16)}}); err != nil {
+		if errors.Is(err, syscall.EPERM) {
+			t.Skip("mounting a tmpfs requires privileges", err)
+		}
+		t.Fatal("expected the resource to deploy, got error", err)
+	}
+	defer deployer.Cleanup()
+
+	deployErr := deployer.CopyIndexed(1, newCopy("data/large"), &resourcesClientProvider{items: []interface{}{newFile("data/large", 128*1024)}})
+	var spaceErr *InsufficientDiskSpaceError
+	if !errors.As(deployErr, &spaceErr) {
+		t.Fatal("expected InsufficientDiskSpaceError, got", deployErr)
+	}
+	assert.Equal(t, int64(128*1024), spaceErr.Required)
+	assert.True(t, spaceErr.Available < spaceErr.Required)
+	assert.Contains(t, deployErr.Error(), "insufficient disk space")
+
+	// nothing is written for the rejected file:
+	entries, err := ioutil.ReadDir(mountpoint)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+
+	// every file fits on its own, the files of the command together do not:
+	deployErr = deployer.CopyIndexed(2, newCopy("data/pair"), &resourcesClientProvider{items: []interface{}{
+		newFile("data/first", 40*1024),
+		newFile("data/second", 40*1024),
+	}})
+	if !errors.As(deployErr, &spaceErr) {
+		t.Fatal("expected InsufficientDiskSpaceError, got", deployErr)
+	}
+	assert.Equal(t, int64(80*1024), spaceErr.Required)
+	assert.True(t, spaceErr.Available >= 40*1024)
+
+	// the command is rejected before the first file is written:
+	entries, err = ioutil.ReadDir(mountpoint)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+}
+
+func TestDeployOverRunningExecutable(t *testing.T) {
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	executable, err := ioutil.ReadFile("/bin/sleep")
+	if err != nil {
+		t.Skip("sleep executable not available", err)
+	}
+	target := filepath.Join(tempDir, "bin/app")
+	rootfs.MustPutTestResource(t, target, executable)
+	assert.Nil(t, os.Chmod(target, 0755))
+
+	running := exec.Command(target, "30")
+	if err := running.Start(); err != nil {
+		t.Fatal("expected the executable to start, got error", err)
+	}
+	defer running.Wait()
+	defer running.Process.Kill()
+
+	// the running executable cannot be written in place:
+	if _, err := os.OpenFile(target, os.O_WRONLY, 0); !errors.Is(err, syscall.ETXTBSY) {
+		t.Skip("expected the running executable to be busy, got", err)
+	}
+
+	updated := []byte("#!/bin/sh\necho updated\n")
+	client := &resourcesClientProvider{items: []interface{}{
+		resources.NewResolvedFileResourceWithPath(func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(updated)), nil
+		},
+			fs.FileMode(0755),
+			"bin/app",
+			"/bin/app",
+			commands.Workdir{Value: tempDir},
+			commands.DefaultUser(),
+			"bin/app"),
+	}}
+
+	assert.Nil(t, NewExecutingResourceDeployer(hclog.Default()).CopyIndexed(0, commands.Copy{
+		OriginalCommand: "COPY bin/app /bin/app",
+		Source:          "bin/app",
+		Target:          "/bin/app",
+		User:            commands.DefaultUser(),
+		Workdir:         commands.Workdir{Value: tempDir},
+	}, client))
+
+	deployed, err := ioutil.ReadFile(target)
+	assert.Nil(t, err)
+	assert.Equal(t, updated, deployed)
+	// the running process is not affected:
+	assert.Nil(t, running.Process.Signal(syscall.Signal(0)))
+}
+
+// sizedContents are resource contents reporting their size.
+type sizedContents struct {
+	*bytes.Reader
+}
+
+func (c *sizedContents) Close() error {
+	return nil
+}
@@ -1,8 +1,30 @@
 package bootstrap
 
 import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 
+	"github.com/combust-labs/firebuild-mmds/clock"
+	"github.com/combust-labs/firebuild-shared/build/commands"
+	"github.com/combust-labs/firebuild-shared/build/resources"
+	"github.com/combust-labs/firebuild-shared/build/rootfs"
+	"github.com/hashicorp/go-hclog"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -31,3 +53,1649 @@ func TestUidGidParser(t *testing.T) {
 	assert.Equal(t, 10, gid)
 
 }
+
+func TestUserResolverWithSources(t *testing.T) {
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	passwdFile := filepath.Join(tempDir, "passwd")
+	groupFile := filepath.Join(tempDir, "group")
+	if err := ioutil.WriteFile(passwdFile, []byte("root:x:0:0:root:/root:/bin/sh\nbuilder:x:1001:1001::/home/builder:/bin/sh\n"), 0644); err != nil {
+		t.Fatal("expected passwd file, got error", err)
+	}
+	if err := ioutil.WriteFile(groupFile, []byte("root:x:0:\nbuilders:x:2001:builder\n"), 0644); err != nil {
+		t.Fatal("expected group file, got error", err)
+	}
+
+	resolver := &userResolver{passwdSource: passwdFile, groupSource: groupFile}
+
+	uid, gid, err1 := resolver.resolve("builder")
+	assert.Nil(t, err1)
+	assert.Equal(t, 1001, uid)
+	assert.Equal(t, -1, gid)
+
+	uid, gid, err2 := resolver.resolve("builder:builders")
+	assert.Nil(t, err2)
+	assert.Equal(t, 1001, uid)
+	assert.Equal(t, 2001, gid)
+
+	uid, gid, err3 := resolver.resolve("10:10")
+	assert.Nil(t, err3)
+	assert.Equal(t, 10, uid)
+	assert.Equal(t, 10, gid)
+
+	_, _, err4 := resolver.resolve("missing")
+	assert.NotNil(t, err4)
+
+}
+
+func TestParseResourceOverrides(t *testing.T) {
+
+	overrides1, err1 := parseResourceOverrides("COPY --chmod=640 --chown=1000:1000 src /dst")
+	assert.Nil(t, err1)
+	assert.Equal(t, fs.FileMode(0640), overrides1.targetMode(0755))
+	assert.Equal(t, "1000:1000", overrides1.targetUser(commands.DefaultUser()).Value)
+
+	overrides2, err2 := parseResourceOverrides("COPY --from=builder src /dst")
+	assert.Nil(t, err2)
+	assert.Equal(t, "builder", overrides2.stage)
+	assert.Equal(t, fs.FileMode(0755), overrides2.targetMode(0755))
+	assert.Equal(t, commands.DefaultUser().Value, overrides2.targetUser(commands.DefaultUser()).Value)
+
+	// flags are not parsed past the sources:
+	overrides3, err3 := parseResourceOverrides("COPY src --chmod=640 /dst")
+	assert.Nil(t, err3)
+	assert.Equal(t, fs.FileMode(0755), overrides3.targetMode(0755))
+
+	_, err4 := parseResourceOverrides("COPY --chmod=u+x src /dst")
+	assert.NotNil(t, err4)
+
+	checksum := strings.Repeat("ab", 32)
+	overrides5, err5 := parseResourceOverrides("COPY --checksum=sha256:" + strings.ToUpper(checksum) + " src /dst")
+	assert.Nil(t, err5)
+	assert.Equal(t, checksum, overrides5.checksum)
+
+	_, err6 := parseResourceOverrides("COPY --checksum=md5:" + checksum + " src /dst")
+	assert.NotNil(t, err6)
+
+	// ADD ignores the other flags:
+	addChecksum, err7 := parseChecksumFlag("ADD --chmod=u+x --checksum=sha256:" + checksum + " src /dst")
+	assert.Nil(t, err7)
+	assert.Equal(t, checksum, addChecksum)
+}
+
+func TestNumericOwnerOverride(t *testing.T) {
+
+	deployer := NewExecutingResourceDeployer(hclog.Default()).(*executingResourceDeployer)
+
+	_, _, chown, err1 := deployer.targetOwner(commands.DefaultUser())
+	assert.Nil(t, err1)
+	assert.False(t, chown)
+
+	deployer.WithNumericOwner(1001, 1002)
+
+	uid, gid, chown, err2 := deployer.targetOwner(commands.DefaultUser())
+	assert.Nil(t, err2)
+	assert.True(t, chown)
+	assert.Equal(t, 1001, uid)
+	assert.Equal(t, 1002, gid)
+
+	// the user does not have to exist:
+	uid, gid, chown, err3 := deployer.targetOwner(commands.User{Value: "does-not-exist"})
+	assert.Nil(t, err3)
+	assert.True(t, chown)
+	assert.Equal(t, 1001, uid)
+	assert.Equal(t, 1002, gid)
+
+}
+
+func TestDeployManifest(t *testing.T) {
+
+	logger := hclog.Default()
+	logger.SetLevel(hclog.Debug)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	fileContents := []byte("test-file contents")
+	manifestPath := filepath.Join(tempDir, "manifest/deploy.json")
+
+	buildCtx := &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{
+			commands.Run{
+				OriginalCommand: "RUN echo before",
+				Args:            map[string]string{},
+				Command:         "echo before",
+				Env:             map[string]string{},
+				Shell: commands.Shell{
+					Commands: []string{"/bin/echo", "-e"},
+				},
+				User:    commands.DefaultUser(),
+				Workdir: commands.DefaultWorkdir(),
+			},
+			commands.Add{
+				OriginalCommand: "ADD etc/test-file /etc/test-file",
+				OriginalSource:  "etc/test-file",
+				Source:          "etc/test-file",
+				Target:          "/etc/test-file",
+				User:            commands.DefaultUser(),
+				Workdir:         commands.Workdir{Value: tempDir},
+			},
+		},
+		ResourcesResolved: rootfs.Resources{
+			"etc/test-file": []resources.ResolvedResource{
+				resources.NewResolvedFileResourceWithPath(func() (io.ReadCloser, error) {
+					return io.NopCloser(bytes.NewReader(fileContents)), nil
+				},
+					fs.FileMode(0640),
+					"etc/test-file",
+					"/etc/test-file",
+					commands.Workdir{Value: tempDir},
+					commands.DefaultUser(),
+					"etc/test-file"),
+			},
+		},
+	}
+
+	testServer, bootstrapConfig := mustStartTestServer(t, logger, buildCtx)
+
+	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithResourceDeployer(NewExecutingResourceDeployer(logger.Named("executing-deployer")).
+			WithManifestOutput(manifestPath))
+
+	assert.Nil(t, bootstrapper.Execute())
+
+	<-testServer.FinishedNotify()
+
+	manifestData, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		t.Fatal("expected manifest, got error", err)
+	}
+	manifest := []ManifestEntry{}
+	if err := json.Unmarshal(manifestData, &manifest); err != nil {
+		t.Fatal("expected valid manifest, got error", err)
+	}
+
+	contentsHash := sha256.Sum256(fileContents)
+	assert.Equal(t, []ManifestEntry{
+		{
+			CommandIndex: 1,
+			Mode:         "0640",
+			Owner:        fmt.Sprintf("%d:%d", os.Geteuid(), os.Getegid()),
+			Path:         filepath.Join(tempDir, "etc/test-file"),
+			SHA256:       hex.EncodeToString(contentsHash[:]),
+			Size:         int64(len(fileContents)),
+		},
+	}, manifest)
+
+}
+
+func TestDeployResourcesContentsError(t *testing.T) {
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	newClient := func() rootfs.ClientProvider {
+		return &resourcesClientProvider{items: []interface{}{
+			resources.NewResolvedFileResourceWithPath(func() (io.ReadCloser, error) {
+				return nil, fmt.Errorf("contents unavailable")
+			},
+				fs.FileMode(0644),
+				"etc/broken-file",
+				"/etc/broken-file",
+				commands.Workdir{Value: tempDir},
+				commands.DefaultUser(),
+				"etc/broken-file"),
+			resources.NewResolvedFileResourceWithPath(func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader([]byte("contents"))), nil
+			},
+				fs.FileMode(0644),
+				"etc/good-file",
+				"/etc/good-file",
+				commands.Workdir{Value: tempDir},
+				commands.DefaultUser(),
+				"etc/good-file"),
+		}}
+	}
+
+	cmd := commands.Copy{
+		OriginalCommand: "COPY etc /etc",
+		Source:          "etc",
+		Target:          "/etc",
+		User:            commands.DefaultUser(),
+		Workdir:         commands.Workdir{Value: tempDir},
+	}
+
+	// aborts on the first failure by default:
+	abortErr := NewExecutingResourceDeployer(hclog.Default()).CopyIndexed(0, cmd, newClient())
+	assert.NotNil(t, abortErr)
+	assert.Contains(t, abortErr.Error(), "etc/broken-file")
+	_, statErr := os.Stat(filepath.Join(tempDir, "etc/good-file"))
+	assert.True(t, os.IsNotExist(statErr))
+
+	continueErr := NewExecutingResourceDeployer(hclog.Default()).
+		WithContinueOnContentsError(true).
+		CopyIndexed(0, cmd, newClient())
+	assert.NotNil(t, continueErr)
+	failures, ok := continueErr.(ResourceFailures)
+	assert.True(t, ok)
+	assert.Equal(t, 1, len(failures))
+	assert.Contains(t, continueErr.Error(), "etc/broken-file")
+	_, statErr = os.Stat(filepath.Join(tempDir, "etc/good-file"))
+	assert.Nil(t, statErr)
+
+}
+
+func TestDeployWithDeduplicateHardlinks(t *testing.T) {
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	newResource := func(path string, mode fs.FileMode, contents string) resources.ResolvedResource {
+		return resources.NewResolvedFileResourceWithPath(func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader([]byte(contents))), nil
+		},
+			mode,
+			path,
+			"/"+path,
+			commands.Workdir{Value: tempDir},
+			commands.DefaultUser(),
+			path)
+	}
+
+	client := &resourcesClientProvider{items: []interface{}{
+		newResource("etc/first", fs.FileMode(0644), "contents"),
+		newResource("etc/duplicate", fs.FileMode(0644), "contents"),
+		newResource("etc/different-mode", fs.FileMode(0600), "contents"),
+		newResource("etc/different-contents", fs.FileMode(0644), "other contents"),
+	}}
+
+	cmd := commands.Copy{
+		OriginalCommand: "COPY etc /etc",
+		Source:          "etc",
+		Target:          "/etc",
+		User:            commands.DefaultUser(),
+		Workdir:         commands.Workdir{Value: tempDir},
+	}
+
+	assert.Nil(t, NewExecutingResourceDeployer(hclog.Default()).
+		WithDeduplicateHardlinks(true).
+		CopyIndexed(0, cmd, client))
+
+	stat := func(path string) os.FileInfo {
+		fileInfo, err := os.Stat(filepath.Join(tempDir, path))
+		if err != nil {
+			t.Fatal("expected deployed file, got error", err)
+		}
+		return fileInfo
+	}
+
+	assert.True(t, os.SameFile(stat("etc/first"), stat("etc/duplicate")))
+	assert.False(t, os.SameFile(stat("etc/first"), stat("etc/different-mode")))
+	assert.False(t, os.SameFile(stat("etc/first"), stat("etc/different-contents")))
+	assert.Equal(t, fs.FileMode(0600), stat("etc/different-mode").Mode().Perm())
+
+	duplicateContents, err := ioutil.ReadFile(filepath.Join(tempDir, "etc/duplicate"))
+	assert.Nil(t, err)
+	assert.Equal(t, "contents", string(duplicateContents))
+
+	// no temporary hardlinks are left behind:
+	entries, err := ioutil.ReadDir(filepath.Join(tempDir, "etc"))
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(entries))
+}
+
+func TestDeployTransform(t *testing.T) {
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	newClient := func() rootfs.ClientProvider {
+		newResource := func(path, contents string) resources.ResolvedResource {
+			return resources.NewResolvedFileResourceWithPath(func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader([]byte(contents))), nil
+			},
+				fs.FileMode(0644),
+				path,
+				"/"+path,
+				commands.Workdir{Value: tempDir},
+				commands.DefaultUser(),
+				path)
+		}
+		return &resourcesClientProvider{items: []interface{}{
+			newResource("etc/app.conf", "listen={{PORT}}"),
+			newResource("etc/app.txt", "listen={{PORT}}"),
+		}}
+	}
+
+	cmd := commands.Copy{
+		OriginalCommand: "COPY etc /etc",
+		Source:          "etc",
+		Target:          "/etc",
+		User:            commands.DefaultUser(),
+		Workdir:         commands.Workdir{Value: tempDir},
+	}
+
+	assert.Nil(t, NewExecutingResourceDeployer(hclog.Default()).
+		WithDeployTransform("*.conf", func(input []byte) ([]byte, error) {
+			return bytes.ReplaceAll(input, []byte("{{PORT}}"), []byte("8080")), nil
+		}).
+		WithDeployTransform(filepath.Join(tempDir, "etc/*.conf"), func(input []byte) ([]byte, error) {
+			return append(input, []byte("\n")...), nil
+		}).
+		CopyIndexed(0, cmd, newClient()))
+
+	transformed, err := ioutil.ReadFile(filepath.Join(tempDir, "etc/app.conf"))
+	assert.Nil(t, err)
+	assert.Equal(t, "listen=8080\n", string(transformed))
+	untouched, err := ioutil.ReadFile(filepath.Join(tempDir, "etc/app.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "listen={{PORT}}", string(untouched))
+
+	transformErr := NewExecutingResourceDeployer(hclog.Default()).
+		WithDeployTransform("*.conf", func(input []byte) ([]byte, error) {
+			return nil, fmt.Errorf("missing value")
+		}).
+		CopyIndexed(0, cmd, newClient())
+	assert.NotNil(t, transformErr)
+	assert.Contains(t, transformErr.Error(), "app.conf")
+}
+
+func TestLineEndingNormalization(t *testing.T) {
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	newClient := func() rootfs.ClientProvider {
+		newResource := func(path, contents string) resources.ResolvedResource {
+			return resources.NewResolvedFileResourceWithPath(func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader([]byte(contents))), nil
+			},
+				fs.FileMode(0644),
+				path,
+				"/"+path,
+				commands.Workdir{Value: tempDir},
+				commands.DefaultUser(),
+				path)
+		}
+		return &resourcesClientProvider{items: []interface{}{
+			newResource("etc/app.conf", "first\r\nsecond\nthird\r\n"),
+			newResource("etc/app.bin", "first\r\n\x00second\r\n"),
+			newResource("etc/app.txt", "first\r\nsecond\r\n"),
+		}}
+	}
+
+	cmd := commands.Copy{
+		OriginalCommand: "COPY etc /etc",
+		Source:          "etc",
+		Target:          "/etc",
+		User:            commands.DefaultUser(),
+		Workdir:         commands.Workdir{Value: tempDir},
+	}
+
+	readFile := func(path string) string {
+		contents, err := ioutil.ReadFile(filepath.Join(tempDir, path))
+		assert.Nil(t, err)
+		return string(contents)
+	}
+
+	assert.Nil(t, NewExecutingResourceDeployer(hclog.Default()).
+		WithLineEndingNormalization("*.conf", LineEndingLF).
+		WithLineEndingNormalization("*.bin", LineEndingLF).
+		CopyIndexed(0, cmd, newClient()))
+
+	assert.Equal(t, "first\nsecond\nthird\n", readFile("etc/app.conf"))
+	// binary contents are not converted:
+	assert.Equal(t, "first\r\n\x00second\r\n", readFile("etc/app.bin"))
+	assert.Equal(t, "first\r\nsecond\r\n", readFile("etc/app.txt"))
+
+	assert.Nil(t, NewExecutingResourceDeployer(hclog.Default()).
+		WithLineEndingNormalization("*.conf", LineEndingCRLF).
+		CopyIndexed(0, cmd, newClient()))
+
+	assert.Equal(t, "first\r\nsecond\r\nthird\r\n", readFile("etc/app.conf"))
+}
+
+func TestWriterFactory(t *testing.T) {
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	newClient := func() rootfs.ClientProvider {
+		newResource := func(path, contents string) resources.ResolvedResource {
+			return resources.NewResolvedFileResourceWithPath(func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader([]byte(contents))), nil
+			},
+				fs.FileMode(0640),
+				path,
+				"/"+path,
+				commands.Workdir{Value: tempDir},
+				commands.DefaultUser(),
+				path)
+		}
+		return &resourcesClientProvider{items: []interface{}{
+			newResource("etc/app.conf", "app contents"),
+			newResource("etc/db.conf", "db contents"),
+		}}
+	}
+
+	cmd := commands.Copy{
+		OriginalCommand: "COPY etc /etc",
+		Source:          "etc",
+		Target:          "/etc",
+		User:            commands.DefaultUser(),
+		Workdir:         commands.Workdir{Value: tempDir},
+	}
+
+	sink := &recordingWriterFactory{contents: map[string]*bytes.Buffer{}, modes: map[string]fs.FileMode{}}
+	deployer := NewExecutingResourceDeployer(hclog.Default()).
+		WithBatchSmallFiles(1024).
+		WithWriterFactory(sink.create)
+	assert.Nil(t, deployer.CopyIndexed(0, cmd, newClient()))
+
+	assert.Equal(t, "app contents", sink.contents[filepath.Join(tempDir, "etc/app.conf")].String())
+	assert.Equal(t, "db contents", sink.contents[filepath.Join(tempDir, "etc/db.conf")].String())
+	assert.Equal(t, fs.FileMode(0640), sink.modes[filepath.Join(tempDir, "etc/app.conf")])
+	assert.Equal(t, 2, sink.closed)
+	// the files are not written to the file system:
+	_, statErr := os.Stat(filepath.Join(tempDir, "etc/app.conf"))
+	assert.True(t, os.IsNotExist(statErr))
+	assert.Equal(t, 2, len(deployer.Manifest()))
+
+	factoryErr := NewExecutingResourceDeployer(hclog.Default()).
+		WithWriterFactory(func(target string, mode fs.FileMode) (io.WriteCloser, error) {
+			return nil, fmt.Errorf("device busy")
+		}).
+		CopyIndexed(0, cmd, newClient())
+	assert.NotNil(t, factoryErr)
+	assert.Contains(t, factoryErr.Error(), "device busy")
+}
+
+// recordingWriterFactory records the contents written by the deployer in memory.
+type recordingWriterFactory struct {
+	closed   int
+	contents map[string]*bytes.Buffer
+	modes    map[string]fs.FileMode
+}
+
+func (f *recordingWriterFactory) create(target string, mode fs.FileMode) (io.WriteCloser, error) {
+	f.contents[target] = &bytes.Buffer{}
+	f.modes[target] = mode
+	return &recordingWriter{Buffer: f.contents[target], factory: f}, nil
+}
+
+type recordingWriter struct {
+	*bytes.Buffer
+	factory *recordingWriterFactory
+}
+
+func (w *recordingWriter) Close() error {
+	w.factory.closed = w.factory.closed + 1
+	return nil
+}
+
+func TestWriterFactoryWritesInPlace(t *testing.T) {
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	target := filepath.Join(tempDir, "etc/app.conf")
+	rootfs.MustPutTestResource(t, target, []byte("previous contents"))
+
+	client := &resourcesClientProvider{items: []interface{}{
+		resources.NewResolvedFileResourceWithPath(func() (io.ReadCloser, error) {
+			// the connection fails after the first bytes of the contents:
+			return io.NopCloser(io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(fmt.Errorf("connection reset")))), nil
+		},
+			fs.FileMode(0640),
+			"etc/app.conf",
+			"/etc/app.conf",
+			commands.Workdir{Value: tempDir},
+			commands.DefaultUser(),
+			"etc/app.conf"),
+	}}
+	cmd := commands.Copy{
+		OriginalCommand: "COPY etc/app.conf /etc/app.conf",
+		Source:          "etc/app.conf",
+		Target:          "/etc/app.conf",
+		User:            commands.DefaultUser(),
+		Workdir:         commands.Workdir{Value: tempDir},
+	}
+
+	created := []string{}
+	deployErr := NewExecutingResourceDeployer(hclog.Default()).
+		WithWriterFactory(func(target string, mode fs.FileMode) (io.WriteCloser, error) {
+			created = append(created, target)
+			return os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+		}).
+		CopyIndexed(0, cmd, client)
+	assert.NotNil(t, deployErr)
+	assert.Contains(t, deployErr.Error(), "connection reset")
+
+	// the factory writes the target itself, not a temporary file renamed over it:
+	assert.Equal(t, []string{target}, created)
+	// the failed write leaves the partially written target:
+	contents, err := ioutil.ReadFile(target)
+	assert.Nil(t, err)
+	assert.Equal(t, "partial", string(contents))
+	entries, err := ioutil.ReadDir(filepath.Dir(target))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+}
+
+func TestDeferredDirModes(t *testing.T) {
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	newDir := func(path string, mode fs.FileMode) resources.ResolvedResource {
+		return resources.NewResolvedDirectoryResourceWithPath(mode,
+			path,
+			path,
+			"/"+path,
+			commands.Workdir{Value: tempDir},
+			commands.DefaultUser())
+	}
+	newFile := func(path string) resources.ResolvedResource {
+		return resources.NewResolvedFileResourceWithPath(func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader([]byte(path))), nil
+		},
+			fs.FileMode(0400),
+			path,
+			"/"+path,
+			commands.Workdir{Value: tempDir},
+			commands.DefaultUser(),
+			path)
+	}
+
+	client := &resourcesClientProvider{items: []interface{}{
+		newDir("secrets", 0500),
+		newDir("secrets/keys", 0700),
+		newFile("secrets/keys/id_rsa"),
+		newFile("secrets/token"),
+	}}
+
+	cmd := commands.Copy{
+		OriginalCommand: "COPY secrets /secrets",
+		Source:          "secrets",
+		Target:          "/secrets",
+		User:            commands.DefaultUser(),
+		Workdir:         commands.Workdir{Value: tempDir},
+	}
+
+	assert.Nil(t, NewExecutingResourceDeployer(hclog.Default()).
+		WithDeferredDirModes(true).
+		CopyIndexed(0, cmd, client))
+	defer os.Chmod(filepath.Join(tempDir, "secrets"), 0700)
+
+	stat, err := os.Stat(filepath.Join(tempDir, "secrets"))
+	assert.Nil(t, err)
+	assert.Equal(t, fs.FileMode(0500), stat.Mode().Perm())
+	stat, err = os.Stat(filepath.Join(tempDir, "secrets/keys"))
+	assert.Nil(t, err)
+	assert.Equal(t, fs.FileMode(0700), stat.Mode().Perm())
+	for _, path := range []string{"secrets/keys/id_rsa", "secrets/token"} {
+		contents, err := ioutil.ReadFile(filepath.Join(tempDir, path))
+		assert.Nil(t, err)
+		assert.Equal(t, path, string(contents))
+	}
+
+	// the directories are created writable by the owner while the contents are deployed:
+	deployer := NewExecutingResourceDeployer(hclog.Default()).WithDeferredDirModes(true).(*executingResourceDeployer)
+	assert.Equal(t, fs.FileMode(0700), deployer.mkdirMode(filepath.Join(tempDir, "other"), 0500))
+	assert.Equal(t, 1, len(deployer.pendingDirModes))
+	assert.Equal(t, fs.FileMode(0500), NewExecutingResourceDeployer(hclog.Default()).(*executingResourceDeployer).mkdirMode(filepath.Join(tempDir, "other"), 0500))
+}
+
+func TestAllowedSourceRoots(t *testing.T) {
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	sharedRoot := filepath.Join(tempDir, "shared")
+	otherRoot := filepath.Join(tempDir, "other")
+	targetRoot := filepath.Join(tempDir, "target")
+	for _, dir := range []string{filepath.Join(sharedRoot, "assets/sub"), otherRoot, targetRoot} {
+		assert.Nil(t, os.MkdirAll(dir, 0755))
+	}
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(sharedRoot, "assets/a.txt"), []byte("a"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(sharedRoot, "assets/sub/b.txt"), []byte("b"), 0600))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(otherRoot, "secret"), []byte("secret"), 0600))
+	assert.Nil(t, os.Symlink(filepath.Join(otherRoot, "secret"), filepath.Join(sharedRoot, "assets/link")))
+	assert.Nil(t, os.Symlink(otherRoot, filepath.Join(sharedRoot, "escape")))
+
+	newCopy := func(source string) commands.Copy {
+		return commands.Copy{
+			OriginalCommand: "COPY " + source + " /opt/assets",
+			Source:          source,
+			Target:          "/opt/assets",
+			User:            commands.DefaultUser(),
+			Workdir:         commands.Workdir{Value: targetRoot},
+		}
+	}
+
+	deployer := NewExecutingResourceDeployer(hclog.Default()).WithAllowedSourceRoots([]string{sharedRoot})
+	assert.Nil(t, deployer.CopyIndexed(0, newCopy(filepath.Join(sharedRoot, "assets")), &resourcesClientProvider{}))
+
+	for path, expected := range map[string]string{"opt/assets/a.txt": "a", "opt/assets/sub/b.txt": "b"} {
+		contents, err := ioutil.ReadFile(filepath.Join(targetRoot, path))
+		assert.Nil(t, err)
+		assert.Equal(t, expected, string(contents))
+	}
+	stat, err := os.Stat(filepath.Join(targetRoot, "opt/assets/sub/b.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, fs.FileMode(0600), stat.Mode().Perm())
+	// the symlinks in the source directory are not deployed:
+	_, err = os.Lstat(filepath.Join(targetRoot, "opt/assets/link"))
+	assert.True(t, os.IsNotExist(err))
+
+	for _, source := range []string{filepath.Join(otherRoot, "secret"), filepath.Join(sharedRoot, "escape/secret"), filepath.Join(sharedRoot, "../other/secret")} {
+		assert.True(t, errors.Is(deployer.CopyIndexed(1, newCopy(source), &resourcesClientProvider{}), ErrSourceNotAllowed), source)
+	}
+
+	// the relative sources and, without the allowed source roots, the absolute sources are served by the server:
+	assert.True(t, errors.Is(deployer.CopyIndexed(2, newCopy("assets"), &resourcesClientProvider{}), os.ErrNotExist))
+	assert.True(t, errors.Is(NewExecutingResourceDeployer(hclog.Default()).CopyIndexed(3, newCopy(filepath.Join(sharedRoot, "assets")), &resourcesClientProvider{}), os.ErrNotExist))
+}
+
+func TestDeployExcludes(t *testing.T) {
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	newFile := func(path string) resources.ResolvedResource {
+		return resources.NewResolvedFileResourceWithPath(func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader([]byte(path))), nil
+		},
+			fs.FileMode(0644),
+			"app/"+path,
+			"/app/"+path,
+			commands.Workdir{Value: tempDir},
+			commands.DefaultUser(),
+			path)
+	}
+	newDir := func(path string) resources.ResolvedResource {
+		return resources.NewResolvedDirectoryResourceWithPath(fs.FileMode(0755),
+			path,
+			"app/"+path,
+			"/app/"+path,
+			commands.Workdir{Value: tempDir},
+			commands.DefaultUser())
+	}
+
+	client := &resourcesClientProvider{items: []interface{}{
+		newDir(".git"),
+		newFile(".git/config"),
+		newFile("main.go"),
+		newFile("main.tmp"),
+		newFile("keep.tmp"),
+		newDir("src"),
+		newFile("src/lib.go"),
+		newDir("src/build"),
+		newFile("src/build/out.bin"),
+		newFile("build"),
+	}}
+
+	cmd := commands.Copy{
+		OriginalCommand: "COPY app /app",
+		Source:          "app",
+		Target:          "/app",
+		User:            commands.DefaultUser(),
+		Workdir:         commands.Workdir{Value: tempDir},
+	}
+
+	assert.Nil(t, NewExecutingResourceDeployer(hclog.Default()).
+		WithDeployExcludes([]string{".git", "*.tmp", "!keep.tmp", "build/"}).
+		CopyIndexed(0, cmd, client))
+
+	for _, deployed := range []string{"main.go", "keep.tmp", "src/lib.go", "build"} {
+		_, err := os.Stat(filepath.Join(tempDir, "app", deployed))
+		assert.Nil(t, err, "expected deployed", deployed)
+	}
+	for _, excluded := range []string{".git", "main.tmp", "src/build"} {
+		_, err := os.Stat(filepath.Join(tempDir, "app", excluded))
+		assert.True(t, os.IsNotExist(err), "expected excluded", excluded)
+	}
+}
+
+func TestDeployExcludesMatching(t *testing.T) {
+	deployer := NewExecutingResourceDeployer(hclog.Default()).
+		WithDeployExcludes([]string{"/docs", "**/testdata/*.json", "logs/", "# comment"}).(*executingResourceDeployer)
+	assert.True(t, deployer.isExcluded("docs", true))
+	assert.True(t, deployer.isExcluded("docs/index.md", false))
+	assert.False(t, deployer.isExcluded("src/docs", true))
+	assert.True(t, deployer.isExcluded("testdata/a.json", false))
+	assert.True(t, deployer.isExcluded("pkg/x/testdata/a.json", false))
+	assert.False(t, deployer.isExcluded("pkg/x/testdata/a.txt", false))
+	assert.True(t, deployer.isExcluded("a/logs/today.log", false))
+	assert.False(t, deployer.isExcluded("logs", false))
+	assert.False(t, deployer.isExcluded("comment", false))
+}
+
+func TestStagingRoot(t *testing.T) {
+
+	stagingRoot, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(stagingRoot)
+
+	client := &resourcesClientProvider{items: []interface{}{
+		resources.NewResolvedDirectoryResourceWithPath(fs.FileMode(0755),
+			"etc/app",
+			"etc/app",
+			"/etc/app",
+			commands.Workdir{Value: "/"},
+			commands.DefaultUser()),
+		resources.NewResolvedFileResourceWithPath(func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader([]byte("staged"))), nil
+		},
+			fs.FileMode(0644),
+			"etc/app/app.conf",
+			"/etc/app/app.conf",
+			commands.Workdir{Value: "/"},
+			commands.DefaultUser(),
+			"etc/app/app.conf"),
+	}}
+
+	cmd := commands.Copy{
+		OriginalCommand: "COPY etc/app /etc/app",
+		Source:          "etc/app",
+		Target:          "/etc/app",
+		User:            commands.DefaultUser(),
+		Workdir:         commands.Workdir{Value: "/"},
+	}
+
+	deployer := NewExecutingResourceDeployer(hclog.Default()).WithStagingRoot(stagingRoot)
+	assert.Nil(t, deployer.CopyIndexed(0, cmd, client))
+
+	staged, err := ioutil.ReadFile(filepath.Join(stagingRoot, "etc/app/app.conf"))
+	assert.Nil(t, err)
+	assert.Equal(t, "staged", string(staged))
+	assert.Equal(t, []string{
+		filepath.Join(stagingRoot, "etc/app"),
+		filepath.Join(stagingRoot, "etc/app/app.conf"),
+	}, deployer.StagedPaths())
+
+	assert.Equal(t, []string{}, NewExecutingResourceDeployer(hclog.Default()).StagedPaths())
+}
+
+func TestManifestStage(t *testing.T) {
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	newClient := func(path string) rootfs.ClientProvider {
+		return &resourcesClientProvider{items: []interface{}{
+			resources.NewResolvedDirectoryResourceWithPath(fs.FileMode(0755),
+				"etc",
+				"etc",
+				"/etc",
+				commands.Workdir{Value: tempDir},
+				commands.DefaultUser()),
+			resources.NewResolvedFileResourceWithPath(func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader([]byte(path))), nil
+			},
+				fs.FileMode(0644),
+				"etc/"+path,
+				"/etc/"+path,
+				commands.Workdir{Value: tempDir},
+				commands.DefaultUser(),
+				path),
+		}}
+	}
+	newCopy := func(originalCommand string) commands.Copy {
+		return commands.Copy{
+			OriginalCommand: originalCommand,
+			Source:          "etc",
+			Target:          "/etc",
+			User:            commands.DefaultUser(),
+			Workdir:         commands.Workdir{Value: tempDir},
+		}
+	}
+
+	deployer := NewExecutingResourceDeployer(hclog.Default())
+	assert.Nil(t, deployer.CopyIndexed(0, newCopy("COPY --from=builder etc /etc"), newClient("built")))
+	assert.Nil(t, deployer.CopyIndexed(1, newCopy("COPY etc /etc"), newClient("context")))
+
+	stages := map[string]string{}
+	for _, entry := range deployer.Manifest() {
+		stages[fmt.Sprintf("%d %s", entry.CommandIndex, strings.TrimPrefix(entry.Path, tempDir+"/"))] = entry.Stage
+	}
+	assert.Equal(t, map[string]string{
+		"0 etc":         "builder",
+		"0 etc/built":   "builder",
+		"1 etc":         "",
+		"1 etc/context": "",
+	}, stages)
+}
+
+func TestResourcePriority(t *testing.T) {
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	newFile := func(path string) resources.ResolvedResource {
+		return resources.NewResolvedFileResourceWithPath(func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader([]byte(path))), nil
+		},
+			fs.FileMode(0644),
+			"files/"+path,
+			"/files/"+path,
+			commands.Workdir{Value: tempDir},
+			commands.DefaultUser(),
+			path)
+	}
+
+	client := &resourcesClientProvider{items: []interface{}{
+		newFile("packages/a.deb"),
+		newFile("packages/b.deb"),
+		resources.NewResolvedDirectoryResourceWithPath(fs.FileMode(0700),
+			"ssl",
+			"files/ssl",
+			"/files/ssl",
+			commands.Workdir{Value: tempDir},
+			commands.DefaultUser()),
+		newFile("ssl/ca.pem"),
+		newFile("readme"),
+	}}
+
+	cmd := commands.Copy{
+		OriginalCommand: "COPY files /files",
+		Source:          "files",
+		Target:          "/files",
+		User:            commands.DefaultUser(),
+		Workdir:         commands.Workdir{Value: tempDir},
+	}
+
+	deployer := NewExecutingResourceDeployer(hclog.Default()).
+		WithResourcePriority(map[string]int{
+			"files/ssl":       10,
+			"/files/packages": -1,
+		})
+	assert.Nil(t, deployer.CopyIndexed(0, cmd, client))
+
+	deployed := []string{}
+	for _, entry := range deployer.Manifest() {
+		deployed = append(deployed, strings.TrimPrefix(entry.Path, tempDir+"/"))
+	}
+	assert.Equal(t, []string{
+		"files/ssl",
+		"files/ssl/ca.pem",
+		"files/readme",
+		"files/packages/a.deb",
+		"files/packages/b.deb",
+	}, deployed)
+
+	// the directory is created with its mode before the files:
+	stat, err := os.Stat(filepath.Join(tempDir, "files/ssl"))
+	assert.Nil(t, err)
+	assert.Equal(t, fs.FileMode(0700), stat.Mode().Perm())
+}
+
+func TestDeterministicOrder(t *testing.T) {
+
+	newFile := func(tempDir, path string) resources.ResolvedResource {
+		return resources.NewResolvedFileResourceWithPath(func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader([]byte(path))), nil
+		},
+			fs.FileMode(0644),
+			"files/"+path,
+			"/files/"+path,
+			commands.Workdir{Value: tempDir},
+			commands.DefaultUser(),
+			path)
+	}
+	newDirectory := func(tempDir, path string) resources.ResolvedResource {
+		return resources.NewResolvedDirectoryResourceWithPath(fs.FileMode(0755),
+			path,
+			"files/"+path,
+			"/files/"+path,
+			commands.Workdir{Value: tempDir},
+			commands.DefaultUser())
+	}
+
+	deploy := func(order []string) []string {
+		tempDir, err := ioutil.TempDir("", "")
+		if err != nil {
+			t.Fatal("expected temp dir, got error", err)
+		}
+		defer os.RemoveAll(tempDir)
+
+		client := &resourcesClientProvider{items: []interface{}{}}
+		for _, path := range order {
+			if path == "etc" || path == "etc/app" {
+				client.items = append(client.items, newDirectory(tempDir, path))
+				continue
+			}
+			client.items = append(client.items, newFile(tempDir, path))
+		}
+		cmd := commands.Copy{
+			OriginalCommand: "COPY files /files",
+			Source:          "files",
+			Target:          "/files",
+			User:            commands.DefaultUser(),
+			Workdir:         commands.Workdir{Value: tempDir},
+		}
+		deployer := NewExecutingResourceDeployer(hclog.Default()).
+			WithDeterministicOrder(true)
+		assert.Nil(t, deployer.CopyIndexed(0, cmd, client))
+
+		deployed := []string{}
+		for _, entry := range deployer.Manifest() {
+			deployed = append(deployed, strings.TrimPrefix(entry.Path, tempDir+"/"))
+		}
+		return deployed
+	}
+
+	expected := []string{
+		"files/etc",
+		"files/etc/app",
+		"files/etc/app/b.conf",
+		"files/etc/app/c.conf",
+		"files/readme",
+	}
+	assert.Equal(t, expected, deploy([]string{"etc", "readme", "etc/app", "etc/app/c.conf", "etc/app/b.conf"}))
+	assert.Equal(t, expected, deploy([]string{"etc", "etc/app", "etc/app/b.conf", "readme", "etc/app/c.conf"}))
+}
+
+func TestValidateResourcesOnly(t *testing.T) {
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	contents := []byte("validated contents")
+	contentsHash := sha256.Sum256(contents)
+
+	newClient := func() rootfs.ClientProvider {
+		return &resourcesClientProvider{items: []interface{}{
+			resources.NewResolvedDirectoryResourceWithPath(fs.FileMode(0755),
+				"etc",
+				"etc",
+				"/etc",
+				commands.Workdir{Value: tempDir},
+				commands.DefaultUser()),
+			resources.NewResolvedFileResourceWithPath(func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(contents)), nil
+			},
+				fs.FileMode(0644),
+				"etc/app.conf",
+				"/etc/app.conf",
+				commands.Workdir{Value: tempDir},
+				commands.DefaultUser(),
+				"etc/app.conf"),
+		}}
+	}
+	newAdd := func(checksum string) commands.Add {
+		return commands.Add{
+			OriginalCommand: "ADD --checksum=sha256:" + checksum + " etc /etc",
+			Source:          "etc",
+			Target:          "/etc",
+			User:            commands.DefaultUser(),
+			Workdir:         commands.Workdir{Value: tempDir},
+		}
+	}
+
+	deployer := NewExecutingResourceDeployer(hclog.Default()).
+		WithValidateResourcesOnly(true)
+
+	assert.Nil(t, deployer.AddIndexed(0, newAdd(hex.EncodeToString(contentsHash[:])), newClient()))
+	// nothing is written:
+	_, statErr := os.Stat(filepath.Join(tempDir, "etc"))
+	assert.True(t, os.IsNotExist(statErr))
+	assert.Equal(t, 0, len(deployer.Manifest()))
+
+	checksumErr := deployer.AddIndexed(1, newAdd(strings.Repeat("0", 64)), newClient())
+	if assert.NotNil(t, checksumErr) {
+		assert.Contains(t, checksumErr.Error(), "checksum mismatch")
+	}
+
+	// the target parent must be a directory:
+	if err := ioutil.WriteFile(filepath.Join(tempDir, "etc"), []byte("not a directory"), 0644); err != nil {
+		t.Fatal("expected file, got error", err)
+	}
+	assert.NotNil(t, deployer.AddIndexed(2, newAdd(hex.EncodeToString(contentsHash[:])), newClient()))
+}
+
+func TestCopyBufferSize(t *testing.T) {
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	deployer := NewExecutingResourceDeployer(hclog.Default()).(*executingResourceDeployer)
+	assert.Equal(t, DefaultCopyBufferSize, len(deployer.newCopyBuffer()))
+	deployer.WithCopyBufferSize(1)
+	assert.Equal(t, MinCopyBufferSize, len(deployer.newCopyBuffer()))
+	deployer.WithCopyBufferSize(1024 * 1024)
+	assert.Equal(t, 1024*1024, len(deployer.newCopyBuffer()))
+
+	// the contents are copied in reads of the buffer size:
+	contents := &maxReadRecordingReader{reader: bytes.NewReader(bytes.Repeat([]byte("x"), 3*MinCopyBufferSize))}
+	destination := filepath.Join(tempDir, "file")
+	written, err := writeFileAtomically(destination, "", 0644, contents, make([]byte, MinCopyBufferSize))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3*MinCopyBufferSize), written)
+	assert.Equal(t, MinCopyBufferSize, contents.maxRead)
+}
+
+func TestFsync(t *testing.T) {
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	destination := filepath.Join(tempDir, "file")
+	_, err = writeFileAtomically(destination, "", 0644, bytes.NewReader([]byte("contents")), nil)
+	assert.Nil(t, err)
+
+	deployer := NewExecutingResourceDeployer(hclog.Default()).(*executingResourceDeployer)
+	// disabled by default, nothing is synced:
+	assert.Nil(t, deployer.syncEntry(ManifestEntry{Path: filepath.Join(tempDir, "missing")}))
+
+	deployer.WithFsync(true)
+	assert.Nil(t, deployer.syncEntry(ManifestEntry{Path: destination}))
+	assert.Nil(t, deployer.syncEntry(ManifestEntry{IsDir: true, Path: tempDir}))
+	assert.NotNil(t, deployer.syncEntry(ManifestEntry{Path: filepath.Join(tempDir, "missing")}))
+}
+
+// maxReadRecordingReader records the largest read.
+type maxReadRecordingReader struct {
+	maxRead int
+	reader  io.Reader
+}
+
+func (r *maxReadRecordingReader) Read(p []byte) (int, error) {
+	if len(p) > r.maxRead {
+		r.maxRead = len(p)
+	}
+	return r.reader.Read(p)
+}
+
+func TestMaxTotalDeployBytes(t *testing.T) {
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	newResource := func(path string) resources.ResolvedResource {
+		return resources.NewResolvedFileResourceWithPath(func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader([]byte("123456"))), nil
+		},
+			fs.FileMode(0644),
+			path,
+			"/"+path,
+			commands.Workdir{Value: tempDir},
+			commands.DefaultUser(),
+			path)
+	}
+
+	cmd := commands.Copy{
+		OriginalCommand: "COPY etc /etc",
+		Source:          "etc",
+		Target:          "/etc",
+		User:            commands.DefaultUser(),
+		Workdir:         commands.Workdir{Value: tempDir},
+	}
+
+	deployer := NewExecutingResourceDeployer(hclog.Default()).WithMaxTotalDeployBytes(10)
+
+	// the limit is cumulative across commands:
+	assert.Nil(t, deployer.CopyIndexed(0, cmd, &resourcesClientProvider{items: []interface{}{newResource("etc/first")}}))
+	deployErr := deployer.CopyIndexed(1, cmd, &resourcesClientProvider{items: []interface{}{newResource("etc/second")}})
+	assert.NotNil(t, deployErr)
+
+	var limitErr *MaxTotalDeployBytesError
+	if !errors.As(deployErr, &limitErr) {
+		t.Fatal("expected MaxTotalDeployBytesError, got", deployErr)
+	}
+	assert.Equal(t, int64(10), limitErr.Limit)
+	assert.Equal(t, int64(12), limitErr.Total)
+	assert.Equal(t, filepath.Join(tempDir, "etc/second"), limitErr.Target)
+
+	_, statErr := os.Stat(filepath.Join(tempDir, "etc/first"))
+	assert.Nil(t, statErr)
+	_, statErr = os.Stat(filepath.Join(tempDir, "etc/second"))
+	assert.True(t, os.IsNotExist(statErr))
+}
+
+func TestVerifyExpectedTree(t *testing.T) {
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	client := &resourcesClientProvider{items: []interface{}{
+		resources.NewResolvedDirectoryResourceWithPath(fs.FileMode(0755),
+			filepath.Join(tempDir, "etc/app"),
+			"etc/app",
+			"/etc/app",
+			commands.Workdir{Value: tempDir},
+			commands.DefaultUser()),
+		resources.NewResolvedFileResourceWithPath(func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader([]byte("contents"))), nil
+		},
+			fs.FileMode(0644),
+			"etc/app/app.conf",
+			"/etc/app/app.conf",
+			commands.Workdir{Value: tempDir},
+			commands.DefaultUser(),
+			"etc/app/app.conf"),
+		resources.NewResolvedFileResourceWithPath(func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader([]byte("contents"))), nil
+		},
+			fs.FileMode(0644),
+			"etc/app/surplus.conf",
+			"/etc/app/surplus.conf",
+			commands.Workdir{Value: tempDir},
+			commands.DefaultUser(),
+			"etc/app/surplus.conf"),
+	}}
+
+	cmd := commands.Copy{
+		OriginalCommand: "COPY etc /etc",
+		Source:          "etc",
+		Target:          "/etc",
+		User:            commands.DefaultUser(),
+		Workdir:         commands.Workdir{Value: tempDir},
+	}
+
+	deployer := NewExecutingResourceDeployer(hclog.Default()).
+		WithExpectedTree(map[string]fs.FileMode{
+			filepath.Join(tempDir, "etc/app"):          fs.ModeDir | 0755,
+			filepath.Join(tempDir, "etc/app/app.conf"): 0600,
+			filepath.Join(tempDir, "etc/app/missing"):  0644,
+		})
+	assert.Nil(t, deployer.CopyIndexed(0, cmd, client))
+
+	verifyErr := deployer.VerifyExpectedTree()
+	var mismatchErr *TreeMismatchError
+	if !errors.As(verifyErr, &mismatchErr) {
+		t.Fatal("expected TreeMismatchError, got", verifyErr)
+	}
+	assert.Equal(t, []string{filepath.Join(tempDir, "etc/app/missing")}, mismatchErr.Missing)
+	assert.Equal(t, 1, len(mismatchErr.ModeMismatches))
+	assert.Contains(t, mismatchErr.ModeMismatches[0], "app.conf")
+	assert.Equal(t, []string{filepath.Join(tempDir, "etc/app/surplus.conf")}, mismatchErr.Unexpected)
+
+	// no expected tree, nothing to verify:
+	assert.Nil(t, NewExecutingResourceDeployer(hclog.Default()).VerifyExpectedTree())
+}
+
+func TestResourceDeployTimeout(t *testing.T) {
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	slowReader := newBlockingReader([]byte("partial contents"))
+
+	client := &resourcesClientProvider{items: []interface{}{
+		resources.NewResolvedFileResourceWithPath(func() (io.ReadCloser, error) {
+			return slowReader, nil
+		},
+			fs.FileMode(0644),
+			"etc/slow-file",
+			"/etc/slow-file",
+			commands.Workdir{Value: tempDir},
+			commands.DefaultUser(),
+			"etc/slow-file"),
+		resources.NewResolvedFileResourceWithPath(func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader([]byte("contents"))), nil
+		},
+			fs.FileMode(0644),
+			"etc/fast-file",
+			"/etc/fast-file",
+			commands.Workdir{Value: tempDir},
+			commands.DefaultUser(),
+			"etc/fast-file"),
+	}}
+
+	cmd := commands.Copy{
+		OriginalCommand: "COPY etc /etc",
+		Source:          "etc",
+		Target:          "/etc",
+		User:            commands.DefaultUser(),
+		Workdir:         commands.Workdir{Value: tempDir},
+	}
+
+	fake := clock.NewFake(time.Now())
+	deployer := NewExecutingResourceDeployer(hclog.Default()).
+		WithContinueOnContentsError(true).
+		WithResourceDeployTimeout(time.Hour)
+	deployer.(*executingResourceDeployer).setClock(fake)
+
+	// the timeout expires once the clock of the deployer is advanced:
+	go func() {
+		fake.BlockUntil(1)
+		fake.Advance(time.Hour)
+	}()
+
+	deployErr := deployer.CopyIndexed(0, cmd, client)
+	assert.NotNil(t, deployErr)
+	failures, ok := deployErr.(ResourceFailures)
+	assert.True(t, ok)
+	assert.Equal(t, 1, len(failures))
+	assert.True(t, errors.Is(deployErr, ErrResourceDeployTimeout))
+	assert.Contains(t, deployErr.Error(), "etc/slow-file")
+	assert.True(t, slowReader.isClosed())
+
+	// the partially written file is removed:
+	entries, err := ioutil.ReadDir(filepath.Join(tempDir, "etc"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, "fast-file", entries[0].Name())
+}
+
+// blockingReader returns the contents and blocks until closed.
+type blockingReader struct {
+	chanClosed chan struct{}
+	closeOnce  sync.Once
+	contents   []byte
+}
+
+func newBlockingReader(contents []byte) *blockingReader {
+	return &blockingReader{chanClosed: make(chan struct{}), contents: contents}
+}
+
+func (r *blockingReader) Read(p []byte) (int, error) {
+	if len(r.contents) > 0 {
+		read := copy(p, r.contents)
+		r.contents = r.contents[read:]
+		return read, nil
+	}
+	<-r.chanClosed
+	return 0, io.ErrClosedPipe
+}
+
+func (r *blockingReader) Close() error {
+	r.closeOnce.Do(func() { close(r.chanClosed) })
+	return nil
+}
+
+func (r *blockingReader) isClosed() bool {
+	select {
+	case <-r.chanClosed:
+		return true
+	default:
+		return false
+	}
+}
+
+// resourcesClientProvider serves the items for any resource.
+type resourcesClientProvider struct {
+	rootfs.ClientProvider
+	items []interface{}
+}
+
+func (c *resourcesClientProvider) Resource(source string) (chan interface{}, error) {
+	chanItems := make(chan interface{}, len(c.items)+1)
+	for _, item := range c.items {
+		chanItems <- item
+	}
+	chanItems <- nil
+	return chanItems, nil
+}
+
+func TestDeployTarStream(t *testing.T) {
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	stream := mustTarStream(t, map[string]string{
+		"etc/test-file":             "test-file contents",
+		"etc/directory/":            "",
+		"etc/directory/file1":       "file1 contents",
+		"etc/directory/subdir/file": "subdir file contents",
+	})
+
+	copyTarget, err := NewTarTargetFromCopy(1, commands.Copy{
+		OriginalCommand: "COPY --chmod=700 etc/directory /opt/directory",
+		Source:          "etc/directory",
+		Target:          "/opt/directory",
+		User:            commands.DefaultUser(),
+		Workdir:         commands.Workdir{Value: tempDir},
+	})
+	assert.Nil(t, err)
+
+	deployErr := NewExecutingResourceDeployer(hclog.Default()).DeployTarStream(stream, []TarTarget{
+		NewTarTargetFromAdd(0, commands.Add{
+			Source:  "etc/test-file",
+			Target:  "/etc/",
+			User:    commands.DefaultUser(),
+			Workdir: commands.Workdir{Value: tempDir},
+		}),
+		copyTarget,
+	})
+	assert.Nil(t, deployErr)
+
+	contents, err := ioutil.ReadFile(filepath.Join(tempDir, "etc/test-file"))
+	assert.Nil(t, err)
+	assert.Equal(t, "test-file contents", string(contents))
+
+	contents, err = ioutil.ReadFile(filepath.Join(tempDir, "opt/directory/subdir/file"))
+	assert.Nil(t, err)
+	assert.Equal(t, "subdir file contents", string(contents))
+
+	stat, err := os.Stat(filepath.Join(tempDir, "opt/directory/file1"))
+	assert.Nil(t, err)
+	assert.Equal(t, fs.FileMode(0700), stat.Mode().Perm())
+
+	// entries not matching any target and escaping the root are rejected:
+	unmatchedErr := NewExecutingResourceDeployer(hclog.Default()).
+		DeployTarStream(mustTarStream(t, map[string]string{"unknown": "contents"}), []TarTarget{copyTarget})
+	assert.NotNil(t, unmatchedErr)
+	escapingErr := NewExecutingResourceDeployer(hclog.Default()).
+		DeployTarStream(mustTarStream(t, map[string]string{"../escaping": "contents"}), []TarTarget{copyTarget})
+	assert.NotNil(t, escapingErr)
+
+}
+
+// mustTarStream returns a tar stream of the entries, the names ending with / are directories.
+func mustTarStream(t *testing.T, entries map[string]string) io.Reader {
+	names := []string{}
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buffer := bytes.NewBuffer([]byte{})
+	tarWriter := tar.NewWriter(buffer)
+	for _, name := range names {
+		if strings.HasSuffix(name, "/") {
+			if err := tarWriter.WriteHeader(&tar.Header{Name: name, Mode: 0755, Typeflag: tar.TypeDir}); err != nil {
+				t.Fatal("failed writing tar header", err)
+			}
+			continue
+		}
+		contents := []byte(entries[name])
+		if err := tarWriter.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(contents)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal("failed writing tar header", err)
+		}
+		if _, err := tarWriter.Write(contents); err != nil {
+			t.Fatal("failed writing tar contents", err)
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatal("failed closing tar stream", err)
+	}
+	return buffer
+}
+
+func TestOverwritePolicy(t *testing.T) {
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cmd := commands.Copy{
+		OriginalCommand: "COPY etc/config /etc/config",
+		Source:          "etc/config",
+		Target:          "/etc/config",
+		User:            commands.DefaultUser(),
+		Workdir:         commands.Workdir{Value: tempDir},
+	}
+	target := filepath.Join(tempDir, "etc/config")
+	newClient := func() rootfs.ClientProvider {
+		return &resourcesClientProvider{items: []interface{}{
+			resources.NewResolvedFileResourceWithPath(func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader([]byte("new"))), nil
+			},
+				fs.FileMode(0644),
+				"etc/config",
+				"/etc/config",
+				commands.Workdir{Value: tempDir},
+				commands.DefaultUser(),
+				"etc/config"),
+		}}
+	}
+	resetTarget := func() {
+		rootfs.MustPutTestResource(t, target, []byte("existing"))
+		os.Remove(target + ".bak")
+	}
+	mustReadFile := func(path string) string {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal("expected file, got error", err)
+		}
+		return string(contents)
+	}
+
+	resetTarget()
+	assert.Nil(t, NewExecutingResourceDeployer(hclog.Default()).CopyIndexed(0, cmd, newClient()))
+	assert.Equal(t, "new", mustReadFile(target))
+
+	resetTarget()
+	assert.Nil(t, NewExecutingResourceDeployer(hclog.Default()).WithOverwritePolicy(PolicySkip).CopyIndexed(0, cmd, newClient()))
+	assert.Equal(t, "existing", mustReadFile(target))
+
+	resetTarget()
+	deployErr := NewExecutingResourceDeployer(hclog.Default()).WithOverwritePolicy(PolicyFail).CopyIndexed(0, cmd, newClient())
+	assert.True(t, errors.Is(deployErr, ErrTargetExists))
+	assert.Equal(t, "existing", mustReadFile(target))
+
+	resetTarget()
+	assert.Nil(t, NewExecutingResourceDeployer(hclog.Default()).WithOverwritePolicy(PolicyBackup).CopyIndexed(0, cmd, newClient()))
+	assert.Equal(t, "new", mustReadFile(target))
+	assert.Equal(t, "existing", mustReadFile(target+".bak"))
+
+	// a missing target is deployed with every policy:
+	os.Remove(target)
+	assert.Nil(t, NewExecutingResourceDeployer(hclog.Default()).WithOverwritePolicy(PolicyFail).CopyIndexed(0, cmd, newClient()))
+	assert.Equal(t, "new", mustReadFile(target))
+}
+
+func TestResourceOpenRetry(t *testing.T) {
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cmd := commands.Copy{
+		OriginalCommand: "COPY etc/flaky /etc/flaky",
+		Source:          "etc/flaky",
+		Target:          "/etc/flaky",
+		User:            commands.DefaultUser(),
+		Workdir:         commands.Workdir{Value: tempDir},
+	}
+	// the contents open on the third attempt:
+	newClient := func(opened *int) rootfs.ClientProvider {
+		return &resourcesClientProvider{items: []interface{}{
+			resources.NewResolvedFileResourceWithPath(func() (io.ReadCloser, error) {
+				*opened = *opened + 1
+				if *opened < 3 {
+					return nil, errors.New("connection reset")
+				}
+				return io.NopCloser(bytes.NewReader([]byte("contents"))), nil
+			},
+				fs.FileMode(0644),
+				"etc/flaky",
+				"/etc/flaky",
+				commands.Workdir{Value: tempDir},
+				commands.DefaultUser(),
+				"etc/flaky"),
+		}}
+	}
+
+	// the backoff is waited for on the clock of the deployer, the fake clock does not block:
+	newDeployer := func(attempts int, fake clock.Clock) ExecutingResourceDeployer {
+		deployer := NewExecutingResourceDeployer(hclog.Default()).
+			WithResourceOpenRetry(attempts, time.Hour)
+		deployer.(*executingResourceDeployer).setClock(fake)
+		return deployer
+	}
+	start := time.Date(2021, 4, 1, 12, 30, 0, 0, time.UTC)
+
+	opened := 0
+	fake := clock.NewFake(start)
+	deployErr := newDeployer(2, fake).CopyIndexed(0, cmd, newClient(&opened))
+	var openErr *ResourceOpenError
+	if !errors.As(deployErr, &openErr) {
+		t.Fatal("expected ResourceOpenError, got", deployErr)
+	}
+	assert.Equal(t, 2, openErr.Attempts)
+	assert.Equal(t, "/etc/flaky", openErr.Target)
+	assert.Equal(t, 2, opened)
+	assert.Equal(t, start.Add(time.Hour), fake.Now())
+
+	opened = 0
+	fake = clock.NewFake(start)
+	assert.Nil(t, newDeployer(3, fake).CopyIndexed(0, cmd, newClient(&opened)))
+	assert.Equal(t, 3, opened)
+	// the backoff doubles after every failed attempt:
+	assert.Equal(t, start.Add(3*time.Hour), fake.Now())
+	contents, err := ioutil.ReadFile(filepath.Join(tempDir, "etc/flaky"))
+	assert.Nil(t, err)
+	assert.Equal(t, "contents", string(contents))
+}
+
+func TestBatchSmallFiles(t *testing.T) {
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	newResource := func(path, contents string) resources.ResolvedResource {
+		return resources.NewResolvedFileResourceWithPath(func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader([]byte(contents))), nil
+		},
+			fs.FileMode(0640),
+			path,
+			"/"+path,
+			commands.Workdir{Value: tempDir},
+			commands.DefaultUser(),
+			path)
+	}
+
+	items := []interface{}{}
+	for i := 0; i < smallFileBatchFiles+10; i++ {
+		items = append(items, newResource(fmt.Sprintf("etc/small-%d", i), fmt.Sprintf("contents %d", i)))
+	}
+	items = append(items,
+		newResource("etc/large", strings.Repeat("x", 64)),
+		// replaces the pending file:
+		newResource("etc/small-0", "replaced"))
+
+	cmd := commands.Copy{
+		OriginalCommand: "COPY etc /etc",
+		Source:          "etc",
+		Target:          "/etc",
+		User:            commands.DefaultUser(),
+		Workdir:         commands.Workdir{Value: tempDir},
+	}
+
+	deployer := NewExecutingResourceDeployer(hclog.Default()).WithBatchSmallFiles(32)
+	assert.Nil(t, deployer.CopyIndexed(0, cmd, &resourcesClientProvider{items: items}))
+
+	for i := 1; i < smallFileBatchFiles+10; i++ {
+		contents, err := ioutil.ReadFile(filepath.Join(tempDir, fmt.Sprintf("etc/small-%d", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("contents %d", i), string(contents))
+	}
+	contents, err := ioutil.ReadFile(filepath.Join(tempDir, "etc/small-0"))
+	assert.Nil(t, err)
+	assert.Equal(t, "replaced", string(contents))
+	contents, err = ioutil.ReadFile(filepath.Join(tempDir, "etc/large"))
+	assert.Nil(t, err)
+	assert.Equal(t, strings.Repeat("x", 64), string(contents))
+
+	stat, err := os.Stat(filepath.Join(tempDir, "etc/small-1"))
+	assert.Nil(t, err)
+	assert.Equal(t, fs.FileMode(0640), stat.Mode().Perm())
+	assert.Equal(t, smallFileBatchFiles+12, len(deployer.Manifest()))
+}
+
+func BenchmarkDeploySmallFiles(b *testing.B) {
+	for _, threshold := range []int{0, 4096} {
+		b.Run(fmt.Sprintf("batch-threshold-%d", threshold), func(b *testing.B) {
+			tempDir, err := ioutil.TempDir("", "")
+			if err != nil {
+				b.Fatal("expected temp dir, got error", err)
+			}
+			defer os.RemoveAll(tempDir)
+			items := []interface{}{}
+			for i := 0; i < 1000; i++ {
+				path := fmt.Sprintf("etc/file-%d", i)
+				items = append(items, resources.NewResolvedFileResourceWithPath(func() (io.ReadCloser, error) {
+					return io.NopCloser(bytes.NewReader([]byte("small file contents"))), nil
+				}, fs.FileMode(0644), path, "/"+path, commands.Workdir{Value: tempDir}, commands.DefaultUser(), path))
+			}
+			cmd := commands.Copy{
+				OriginalCommand: "COPY etc /etc",
+				Source:          "etc",
+				Target:          "/etc",
+				User:            commands.DefaultUser(),
+				Workdir:         commands.Workdir{Value: tempDir},
+			}
+			logger := hclog.NewNullLogger()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				deployer := NewExecutingResourceDeployer(logger).WithBatchSmallFiles(threshold)
+				if err := deployer.CopyIndexed(0, cmd, &resourcesClientProvider{items: items}); err != nil {
+					b.Fatal("expected deployment, got error", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package bootstrap
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/combust-labs/firebuild-shared/build/resources"
+)
+
+// normalizeResourcePriority normalizes the source path keys of the resource priorities.
+func normalizeResourcePriority(input map[string]int) map[string]int {
+	priorities := map[string]int{}
+	for source, priority := range input {
+		priorities[normalizeSourcePath(source)] = priority
+	}
+	return priorities
+}
+
+func normalizeSourcePath(source string) string {
+	return strings.Trim(filepath.Clean(source), "/")
+}
+
+// priorityOf returns the priority of the source path, an entry without a priority
+// inherits the priority of the closest parent directory with a priority, 0 otherwise.
+func (n *executingResourceDeployer) priorityOf(sourcePath string) int {
+	current := normalizeSourcePath(sourcePath)
+	for {
+		if priority, ok := n.resourcePriority[current]; ok {
+			return priority
+		}
+		parent := filepath.Dir(current)
+		if parent == current || parent == "." || parent == "/" {
+			return 0
+		}
+		current = parent
+	}
+}
+
+// prioritizeResources reads all resources of the channel and returns a channel delivering them
+// in the deployment order: the directories first, in the received order, followed by the files
+// ordered by the priority, highest first. The files with the same priority keep the received order.
+// With the deterministic order, the directories and the files are ordered by the target path first.
+// Only the contents of the files are resolved at deployment, the resources are cheap to hold.
+// An error received from the channel is delivered without the resources.
+func (n *executingResourceDeployer) prioritizeResources(resourceChannel chan interface{}) chan interface{} {
+	if len(n.resourcePriority) == 0 && !n.deterministicOrder {
+		return resourceChannel
+	}
+	directories := []resources.ResolvedResource{}
+	files := []resources.ResolvedResource{}
+	for item := range resourceChannel {
+		switch titem := item.(type) {
+		case nil:
+			return n.prioritizedChannel(directories, files)
+		case resources.ResolvedResource:
+			if titem.IsDir() {
+				directories = append(directories, titem)
+				continue
+			}
+			files = append(files, titem)
+		case error:
+			errorChannel := make(chan interface{}, 1)
+			errorChannel <- titem
+			return errorChannel
+		}
+	}
+	// the channel was closed without the end of resources:
+	return n.prioritizedChannel(directories, files)
+}
+
+func (n *executingResourceDeployer) prioritizedChannel(directories []resources.ResolvedResource, files []resources.ResolvedResource) chan interface{} {
+	if n.deterministicOrder {
+		// a parent directory target is a prefix of the target of its children and sorts before them:
+		sort.SliceStable(directories, func(i, j int) bool {
+			return directories[i].TargetPath() < directories[j].TargetPath()
+		})
+		sort.SliceStable(files, func(i, j int) bool {
+			return files[i].TargetPath() < files[j].TargetPath()
+		})
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return n.priorityOf(files[i].SourcePath()) > n.priorityOf(files[j].SourcePath())
+	})
+	// buffered so nothing blocks when the deployment fails early:
+	prioritized := make(chan interface{}, len(directories)+len(files)+1)
+	for _, directory := range directories {
+		prioritized <- directory
+	}
+	for _, file := range files {
+		prioritized <- file
+	}
+	prioritized <- nil
+	return prioritized
+}
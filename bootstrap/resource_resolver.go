@@ -0,0 +1,97 @@
+package bootstrap
+
+import (
+	"github.com/combust-labs/firebuild-shared/build/commands"
+	"github.com/combust-labs/firebuild-shared/build/resources"
+	"github.com/combust-labs/firebuild-shared/build/rootfs"
+	"github.com/hashicorp/go-hclog"
+)
+
+// ResourceRequest describes the resources of an ADD or COPY command
+// which have not been resolved by the server.
+type ResourceRequest struct {
+	CommandIndex int
+	Source       string
+	Target       string
+	User         commands.User
+	Workdir      commands.Workdir
+}
+
+// ResourceResolver resolves the resources of a command the server has not resolved,
+// for example from S3, a local cache or MMDS. An empty result means the resources do not exist.
+type ResourceResolver interface {
+	Resolve(ResourceRequest) ([]resources.ResolvedResource, error)
+}
+
+// resolvingClient serves the resources of the server and falls back to the resolver
+// when the server has not resolved any resource of the request.
+type resolvingClient struct {
+	rootfs.ClientProvider
+	logger   hclog.Logger
+	request  ResourceRequest
+	resolver ResourceResolver
+}
+
+// resourceClient returns a client resolving the resources of the command with the resource resolver
+// or the client when there is no resource resolver.
+func (b *defaultBootstrapper) resourceClient(client rootfs.ClientProvider, request ResourceRequest) rootfs.ClientProvider {
+	if b.resourceResolver == nil {
+		return client
+	}
+	return &resolvingClient{
+		ClientProvider: client,
+		logger:         b.logger.Named("resource-resolver"),
+		request:        request,
+		resolver:       b.resourceResolver,
+	}
+}
+
+func (c *resolvingClient) Resource(source string) (chan interface{}, error) {
+	upstream, err := c.ClientProvider.Resource(source)
+	if err != nil {
+		c.logger.Debug("server failed serving resource, resolving", "source", source, "reason", err)
+		return c.resolve(), nil
+	}
+	output := make(chan interface{})
+	go func() {
+		nItems := 0
+		for {
+			item := <-upstream
+			switch item.(type) {
+			case nil:
+				if nItems == 0 {
+					c.logger.Debug("resource not resolved by the server, resolving", "source", source)
+					for resolved := range c.resolve() {
+						output <- resolved
+					}
+					return
+				}
+				output <- nil
+				return
+			case error:
+				output <- item
+				return
+			default:
+				nItems = nItems + 1
+				output <- item
+			}
+		}
+	}()
+	return output, nil
+}
+
+// resolve returns a channel of the resolved resources terminated with nil, or an error.
+func (c *resolvingClient) resolve() chan interface{} {
+	resolved, err := c.resolver.Resolve(c.request)
+	output := make(chan interface{}, len(resolved)+1)
+	defer close(output)
+	if err != nil {
+		output <- err
+		return output
+	}
+	for _, resource := range resolved {
+		output <- resource
+	}
+	output <- nil
+	return output
+}
@@ -0,0 +1,65 @@
+package bootstrap
+
+import (
+	"context"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/combust-labs/firebuild-mmds/mmds"
+	"github.com/combust-labs/firebuild-shared/build/resources"
+	"github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
+)
+
+// MMDSResourceScheme is the scheme of the ADD and COPY sources resolved from MMDS.
+const MMDSResourceScheme = "mmds://"
+
+type mmdsResourceResolver struct {
+	baseURI string
+	client  *http.Client
+	logger  hclog.Logger
+}
+
+// NewMMDSResourceResolver returns a resource resolver resolving the mmds://<name> sources as a guest
+// from the chunked resource stored under the resource/<name> key of the MMDS metadata root at baseURI.
+// The parts are validated before the resource is deployed so a resource with a missing part fails the command.
+// Other sources and the resources not found in MMDS are not resolved.
+func NewMMDSResourceResolver(client *http.Client, baseURI string, logger hclog.Logger) ResourceResolver {
+	return &mmdsResourceResolver{
+		baseURI: baseURI,
+		client:  client,
+		logger:  logger,
+	}
+}
+
+func (r *mmdsResourceResolver) Resolve(request ResourceRequest) ([]resources.ResolvedResource, error) {
+	if !strings.HasPrefix(request.Source, MMDSResourceScheme) {
+		return []resources.ResolvedResource{}, nil
+	}
+	name := strings.TrimPrefix(request.Source, MMDSResourceScheme)
+	resource, err := mmds.GuestFetchChunkedResource(context.Background(), r.client, r.baseURI, name)
+	if err != nil {
+		if errors.Is(err, mmds.ErrResourceNotFound) {
+			r.logger.Debug("resource not found in MMDS", "source", request.Source)
+			return []resources.ResolvedResource{}, nil
+		}
+		r.logger.Error("failed resolving resource from MMDS", "source", request.Source, "reason", err)
+		return nil, errors.Wrapf(err, "command %d", request.CommandIndex)
+	}
+	// like a file copied by Docker, the resource is written under its name only when the target is a directory:
+	sourcePath := filepath.Base(request.Target)
+	if strings.HasSuffix(request.Target, "/") {
+		sourcePath = filepath.Base(name)
+	}
+	return []resources.ResolvedResource{
+		resources.NewResolvedFileResourceWithPath(resource.Contents,
+			fs.FileMode(0644),
+			sourcePath,
+			request.Target,
+			request.Workdir,
+			request.User,
+			request.Source),
+	}, nil
+}
@@ -0,0 +1,102 @@
+package bootstrap
+
+import (
+	"sync"
+	"time"
+
+	"github.com/combust-labs/firebuild-mmds/clock"
+	"github.com/combust-labs/firebuild-shared/build/commands"
+	"github.com/combust-labs/firebuild-shared/build/rootfs"
+	"github.com/hashicorp/go-hclog"
+)
+
+// CommandUsage is the resource usage of an executed command.
+type CommandUsage struct {
+	Command string
+	Index   int
+	// MaxRSSBytes is the maximum resident set size of the command and the processes it waited for,
+	// 0 when not available.
+	MaxRSSBytes   int64
+	SystemCPUTime time.Duration
+	UserCPUTime   time.Duration
+	WallTime      time.Duration
+}
+
+// ResourceTrackingCommandRunner is a command runner recording the resource usage of every command.
+type ResourceTrackingCommandRunner interface {
+	IndexedCommandRunner
+	Usage() []CommandUsage
+}
+
+// commandUsageReporter is implemented by the command runners reporting
+// the resource usage of the last executed command.
+type commandUsageReporter interface {
+	lastCommandUsage() (CommandUsage, bool)
+}
+
+type resourceTrackingCommandRunner struct {
+	sync.Mutex
+	clock  clock.Clock
+	inner  CommandRunner
+	logger hclog.Logger
+	usage  []CommandUsage
+}
+
+// NewResourceTrackingCommandRunner returns a command runner executing the commands with the inner runner,
+// logging the maximum RSS and CPU time of every command. The usage is taken from the rusage
+// of the waited for command process, which is reported on Linux by the shell command runner only.
+// For other runners, only the wall time is recorded.
+func NewResourceTrackingCommandRunner(inner CommandRunner, logger hclog.Logger) ResourceTrackingCommandRunner {
+	return &resourceTrackingCommandRunner{
+		clock:  clock.Real(),
+		inner:  inner,
+		logger: logger,
+		usage:  []CommandUsage{},
+	}
+}
+
+func (n *resourceTrackingCommandRunner) Execute(cmd commands.Run, grpcClient rootfs.ClientProvider) error {
+	return n.ExecuteIndexed(0, cmd, grpcClient)
+}
+
+func (n *resourceTrackingCommandRunner) ExecuteIndexed(index int, cmd commands.Run, grpcClient rootfs.ClientProvider) error {
+	started := n.clock.Now()
+	executeErr := executeIndexed(n.inner, index, cmd, grpcClient)
+	usage := CommandUsage{}
+	if reporter, ok := n.inner.(commandUsageReporter); ok {
+		if reported, ok := reporter.lastCommandUsage(); ok {
+			usage = reported
+		}
+	}
+	usage.Command = cmd.OriginalCommand
+	usage.Index = index
+	usage.WallTime = n.clock.Now().Sub(started)
+
+	n.logger.Info("command resource usage",
+		"index", usage.Index,
+		"command", usage.Command,
+		"max-rss-bytes", usage.MaxRSSBytes,
+		"user-cpu-time", usage.UserCPUTime,
+		"system-cpu-time", usage.SystemCPUTime,
+		"wall-time", usage.WallTime)
+
+	n.Lock()
+	n.usage = append(n.usage, usage)
+	n.Unlock()
+
+	return executeErr
+}
+
+// Usage returns the resource usage of the executed commands, in execution order.
+func (n *resourceTrackingCommandRunner) Usage() []CommandUsage {
+	n.Lock()
+	defer n.Unlock()
+	return append([]CommandUsage{}, n.usage...)
+}
+
+func (n *shellCommandRunner) lastCommandUsage() (CommandUsage, bool) {
+	if n.lastUsage == nil {
+		return CommandUsage{}, false
+	}
+	return *n.lastUsage, true
+}
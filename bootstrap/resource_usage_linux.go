@@ -0,0 +1,24 @@
+package bootstrap
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// processUsage returns the resource usage of the exited process.
+func processUsage(state *os.ProcessState) (CommandUsage, bool) {
+	if state == nil {
+		return CommandUsage{}, false
+	}
+	rusage, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok || rusage == nil {
+		return CommandUsage{}, false
+	}
+	return CommandUsage{
+		// the maximum resident set size is reported in kilobytes on Linux:
+		MaxRSSBytes:   int64(rusage.Maxrss) * 1024,
+		SystemCPUTime: time.Duration(rusage.Stime.Nano()),
+		UserCPUTime:   time.Duration(rusage.Utime.Nano()),
+	}, true
+}
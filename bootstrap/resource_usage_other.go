@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package bootstrap
+
+import "os"
+
+func processUsage(state *os.ProcessState) (CommandUsage, bool) {
+	return CommandUsage{}, false
+}
@@ -0,0 +1,96 @@
+package bootstrap
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/combust-labs/firebuild-mmds/clock"
+	"github.com/combust-labs/firebuild-shared/build/commands"
+	"github.com/combust-labs/firebuild-shared/build/rootfs"
+)
+
+// ScriptedResult is the predetermined result of a command executed by the scripted command runner.
+type ScriptedResult struct {
+	// Delay is the time the command takes before the output is delivered, measured by the clock of the bootstrapper.
+	Delay time.Duration
+	// ExitCode is the exit code of the command, the command fails with a non-zero code.
+	ExitCode int
+	// Stderr is the output delivered to the server as stderr.
+	Stderr []string
+	// Stdout is the output delivered to the server as stdout.
+	Stdout []string
+	// SucceedAfter is the number of executions failing with the exit code before the command
+	// succeeds, for example to exercise retries. With 0, every execution fails with the exit code.
+	SucceedAfter int
+}
+
+// ScriptedCommandRunner is a command runner returning predetermined results without executing the commands.
+type ScriptedCommandRunner interface {
+	IndexedCommandRunner
+	// Executed returns the indexes of the executed commands, in the order of execution.
+	Executed() []int
+}
+
+type scriptedCommandRunner struct {
+	sync.Mutex
+	clock    clock.Clock
+	executed []int
+	failures map[int]int
+	results  map[int]ScriptedResult
+}
+
+// NewScriptedCommandRunner returns a command runner returning the result mapped to the index of every command,
+// so the orchestration of the bootstrap, for example the fail fast threshold or the retries, can be tested
+// deterministically without executing real commands. The commands with an unmapped index succeed without output.
+func NewScriptedCommandRunner(results map[int]ScriptedResult) ScriptedCommandRunner {
+	return &scriptedCommandRunner{
+		clock:    clock.Real(),
+		executed: []int{},
+		failures: map[int]int{},
+		results:  results,
+	}
+}
+
+func (n *scriptedCommandRunner) Executed() []int {
+	n.Lock()
+	defer n.Unlock()
+	return append([]int{}, n.executed...)
+}
+
+func (n *scriptedCommandRunner) Execute(cmd commands.Run, grpcClient rootfs.ClientProvider) error {
+	return n.ExecuteIndexed(0, cmd, grpcClient)
+}
+
+func (n *scriptedCommandRunner) ExecuteIndexed(index int, cmd commands.Run, grpcClient rootfs.ClientProvider) error {
+	n.Lock()
+	n.executed = append(n.executed, index)
+	result, ok := n.results[index]
+	failures := n.failures[index]
+	fail := ok && result.ExitCode != 0 && (result.SucceedAfter == 0 || failures < result.SucceedAfter)
+	if fail {
+		n.failures[index] = failures + 1
+	}
+	n.Unlock()
+
+	if !ok {
+		return nil
+	}
+	if result.Delay > 0 {
+		n.clock.Sleep(result.Delay)
+	}
+	if len(result.Stdout) > 0 {
+		if err := grpcClient.StdOut(result.Stdout); err != nil {
+			return err
+		}
+	}
+	if len(result.Stderr) > 0 {
+		if err := grpcClient.StdErr(result.Stderr); err != nil {
+			return err
+		}
+	}
+	if fail {
+		return fmt.Errorf("command exited with code: %d, command %q", result.ExitCode, cmd.OriginalCommand)
+	}
+	return nil
+}
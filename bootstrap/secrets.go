@@ -0,0 +1,96 @@
+package bootstrap
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// DefaultSecretsDir is the default directory where the secrets are mounted.
+const DefaultSecretsDir = "/run/secrets"
+
+// SecretEnvPrefix is the prefix of environment variables used to expose the secrets
+// when the secrets directory cannot be mounted.
+const SecretEnvPrefix = "SECRET_"
+
+// mountSecrets exposes the secrets to a single command. The secrets are written
+// to a tmpfs mounted in the secrets directory so they never reach the root file system.
+// If the tmpfs cannot be mounted, the secrets are returned as environment variables instead.
+// The returned function removes the secrets.
+func (n *shellCommandRunner) mountSecrets(index int) ([]string, func()) {
+	if len(n.secrets) == 0 {
+		return []string{}, func() {}
+	}
+
+	createdDir := false
+	if _, err := os.Stat(n.secretsDir); os.IsNotExist(err) {
+		if err := os.MkdirAll(n.secretsDir, 0700); err == nil {
+			createdDir = true
+		}
+	}
+	removeDir := func() {
+		if createdDir {
+			os.Remove(n.secretsDir)
+		}
+	}
+
+	if err := mountTmpfs(n.secretsDir); err != nil {
+		removeDir()
+		n.logger.Warn("failed mounting secrets directory, exposing secrets as environment variables",
+			"index", index,
+			"secrets-dir", n.secretsDir,
+			"reason", err)
+		env := []string{}
+		for id, data := range n.secrets {
+			env = append(env, fmt.Sprintf("%s=%s", secretIDToEnvName(id), string(data)))
+		}
+		n.auditSecrets(index, "environment")
+		return env, func() {}
+	}
+
+	cleanup := func() {
+		for id := range n.secrets {
+			os.Remove(filepath.Join(n.secretsDir, id))
+		}
+		if err := unmount(n.secretsDir); err != nil {
+			n.logger.Error("failed unmounting secrets directory", "secrets-dir", n.secretsDir, "reason", err)
+			return
+		}
+		removeDir()
+	}
+
+	for id, data := range n.secrets {
+		if err := ioutil.WriteFile(filepath.Join(n.secretsDir, id), data, 0400); err != nil {
+			n.logger.Error("failed writing secret", "index", index, "secret-id", id, "reason", err)
+		}
+	}
+	n.auditSecrets(index, "tmpfs")
+
+	return []string{}, cleanup
+}
+
+// auditSecrets records the IDs of the secrets exposed to the command and how they are exposed.
+func (n *shellCommandRunner) auditSecrets(index int, exposure string) {
+	ids := []string{}
+	for id := range n.secrets {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	n.audit(index, AuditRecord{Action: AuditSecretsMounted, Details: map[string]string{
+		"exposure":   exposure,
+		"secret-ids": strings.Join(ids, ","),
+	}})
+}
+
+func secretIDToEnvName(id string) string {
+	return SecretEnvPrefix + strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return unicode.ToUpper(r)
+		}
+		return '_'
+	}, id)
+}
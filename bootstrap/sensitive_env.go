@@ -0,0 +1,121 @@
+package bootstrap
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/combust-labs/firebuild-shared/build/commands"
+)
+
+// sensitiveEnvRedaction replaces the sensitive values in the logs, errors and events of the bootstrapper
+// and of the command runner.
+const sensitiveEnvRedaction = "***"
+
+// sensitiveEnvReceiver is a command runner redacting the sensitive environment itself,
+// the bootstrapper hands its sensitive keys to the command runner implementing it.
+type sensitiveEnvReceiver interface {
+	addSensitiveEnv([]string)
+}
+
+// redactedError is an error with the sensitive values redacted from the message,
+// the wrapped error is unchanged so the error can still be inspected with errors.Is and errors.As.
+type redactedError struct {
+	err     error
+	message string
+}
+
+func (e *redactedError) Error() string {
+	return e.message
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// collectSensitiveValues records the values of the sensitive keys in the environment
+// and the arguments of the command, including the environment added by the bootstrapper.
+func (b *defaultBootstrapper) collectSensitiveValues(cmd commands.Run) {
+	if len(b.sensitiveEnvKeys) == 0 {
+		return
+	}
+	withEnv := b.withCommandEnv(cmd)
+	for _, key := range b.sensitiveEnvKeys {
+		for _, values := range []map[string]string{withEnv.Args, withEnv.Env} {
+			if value := values[key]; value != "" {
+				b.sensitiveValues[value] = struct{}{}
+			}
+		}
+	}
+}
+
+// redact replaces the sensitive values collected so far in the input.
+func (b *defaultBootstrapper) redact(input string) string {
+	if len(b.sensitiveValues) == 0 {
+		return input
+	}
+	values := []string{}
+	for value := range b.sensitiveValues {
+		values = append(values, value)
+	}
+	// a value containing another value is replaced first:
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	for _, value := range values {
+		input = strings.ReplaceAll(input, value, sensitiveEnvRedaction)
+	}
+	return input
+}
+
+// redactError returns the error with the sensitive values redacted from the message.
+func (b *defaultBootstrapper) redactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	message := b.redact(err.Error())
+	if message == err.Error() {
+		return err
+	}
+	return &redactedError{err: err, message: message}
+}
+
+// redactCommand returns the command with the values of the sensitive keys redacted
+// from the arguments and the environment of a RUN command.
+func (b *defaultBootstrapper) redactCommand(cmd commands.VMInitSerializableCommand) commands.VMInitSerializableCommand {
+	run, ok := cmd.(commands.Run)
+	if !ok || len(b.sensitiveEnvKeys) == 0 {
+		return cmd
+	}
+	run.Args = redactValues(run.Args, b.sensitiveEnvKeys, sensitiveEnvRedaction)
+	run.Env = redactValues(run.Env, b.sensitiveEnvKeys, sensitiveEnvRedaction)
+	run.Command = b.redact(run.Command)
+	run.OriginalCommand = b.redact(run.OriginalCommand)
+	return run
+}
+
+// redactValues returns a copy of the values with the values of the keys replaced with the redaction.
+func redactValues(values map[string]string, keys []string, redaction string) map[string]string {
+	if values == nil {
+		return nil
+	}
+	output := map[string]string{}
+	for k, v := range values {
+		output[k] = v
+	}
+	for _, key := range keys {
+		if _, ok := output[key]; ok {
+			output[key] = redaction
+		}
+	}
+	return output
+}
+
+func (n *shellCommandRunner) addSensitiveEnv(keys []string) {
+	existing := map[string]struct{}{}
+	for _, key := range n.sensitiveEnv {
+		existing[key] = struct{}{}
+	}
+	for _, key := range keys {
+		if _, ok := existing[key]; !ok {
+			n.sensitiveEnv = append(n.sensitiveEnv, key)
+		}
+	}
+}
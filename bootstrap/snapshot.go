@@ -0,0 +1,126 @@
+package bootstrap
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// snapshotVersion is the version of the bootstrap snapshot format.
+const snapshotVersion = 1
+
+// bootstrapSnapshot is the state of a suspended bootstrap: the successfully executed commands,
+// the files and directories deployed by the resource deployer and the facts captured by the command runner.
+type bootstrapSnapshot struct {
+	Completed []progressEntry   `json:"Completed"`
+	Deployed  []ManifestEntry   `json:"Deployed"`
+	Facts     map[string]string `json:"Facts"`
+	Version   int               `json:"Version"`
+}
+
+// factsSnapshotter is a command runner capturing facts, the facts are part of the bootstrap snapshot.
+type factsSnapshotter interface {
+	restoreFacts(map[string]string)
+	snapshotFacts() map[string]string
+}
+
+// manifestRestorer is a resource deployer continuing the manifest of a restored bootstrap.
+type manifestRestorer interface {
+	restoreManifest([]ManifestEntry)
+}
+
+// Snapshot returns the state of the last execution as JSON: the successfully executed commands,
+// the files and directories deployed by a resource deployer listing them and the facts captured
+// by a command runner capturing them. The bootstrapper of a restarted process restored
+// from the snapshot with RestoreFromSnapshot resumes after the last successfully executed command.
+func (b *defaultBootstrapper) Snapshot() ([]byte, error) {
+	snapshot := bootstrapSnapshot{
+		Completed: []progressEntry{},
+		Deployed:  []ManifestEntry{},
+		Facts:     map[string]string{},
+		Version:   snapshotVersion,
+	}
+	if b.progress != nil {
+		snapshot.Completed = append(snapshot.Completed, b.progress.Completed...)
+	}
+	if provider, ok := b.resourceDeployer.(manifestProvider); ok {
+		snapshot.Deployed = append(snapshot.Deployed, provider.Manifest()...)
+	}
+	if snapshotter, ok := b.commandRunner.(factsSnapshotter); ok {
+		for k, v := range snapshotter.snapshotFacts() {
+			snapshot.Facts[k] = v
+		}
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed serializing bootstrap snapshot")
+	}
+	return data, nil
+}
+
+// RestoreFromSnapshot restores the state captured with Snapshot. The next execution does not execute
+// the commands completed before the snapshot, the deployed files are listed in the manifest
+// and the captured facts are put in the environment of the commands. The snapshot is combined
+// with the progress file, if configured.
+func (b *defaultBootstrapper) RestoreFromSnapshot(input []byte) error {
+	snapshot := &bootstrapSnapshot{}
+	if err := json.Unmarshal(input, snapshot); err != nil {
+		return errors.Wrap(err, "failed deserializing bootstrap snapshot")
+	}
+	if snapshot.Version != snapshotVersion {
+		return errors.Errorf("unsupported bootstrap snapshot version %d", snapshot.Version)
+	}
+	b.restored = snapshot
+	return nil
+}
+
+// startProgress loads the progress of the execution. The state of a restored snapshot
+// is handed to the command runner and the resource deployer once.
+func (b *defaultBootstrapper) startProgress() (*bootstrapProgress, error) {
+	progress, err := loadProgress(b.progressFile)
+	if err != nil {
+		b.logger.Error("failed loading progress", "progress-file", b.progressFile, "reason", err)
+		return nil, err
+	}
+	b.progress = progress
+	if b.restored == nil {
+		return progress, nil
+	}
+	for _, entry := range b.restored.Completed {
+		if !progress.isCompleted(entry.Index, entry.Command) {
+			progress.Completed = append(progress.Completed, entry)
+		}
+	}
+	if restorer, ok := b.resourceDeployer.(manifestRestorer); ok {
+		restorer.restoreManifest(b.restored.Deployed)
+	}
+	if snapshotter, ok := b.commandRunner.(factsSnapshotter); ok {
+		snapshotter.restoreFacts(b.restored.Facts)
+	}
+	b.logger.Info("bootstrap restored from snapshot",
+		"completed", len(b.restored.Completed),
+		"deployed", len(b.restored.Deployed),
+		"facts", len(b.restored.Facts))
+	b.restored = nil
+	return progress, nil
+}
+
+func (n *executingResourceDeployer) restoreManifest(entries []ManifestEntry) {
+	n.manifest = append(append([]ManifestEntry{}, entries...), n.manifest...)
+}
+
+func (n *shellCommandRunner) restoreFacts(facts map[string]string) {
+	if n.facts == nil {
+		n.facts = map[string]string{}
+	}
+	// the facts captured by this runner take precedence:
+	for k, v := range facts {
+		if _, ok := n.facts[k]; !ok {
+			n.facts[k] = v
+		}
+	}
+}
+
+func (n *shellCommandRunner) snapshotFacts() map[string]string {
+	return n.facts
+}
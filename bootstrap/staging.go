@@ -0,0 +1,24 @@
+package bootstrap
+
+import "path/filepath"
+
+// stagedPath returns the on-disk path of a target, under the staging root when configured.
+func (n *executingResourceDeployer) stagedPath(target string) string {
+	if n.stagingRoot == "" {
+		return target
+	}
+	return filepath.Join(n.stagingRoot, target)
+}
+
+// StagedPaths returns the on-disk paths of the files and directories written under
+// the staging root so far, in the order they were written. Empty without a staging root.
+func (n *executingResourceDeployer) StagedPaths() []string {
+	paths := []string{}
+	if n.stagingRoot == "" {
+		return paths
+	}
+	for _, entry := range n.manifest {
+		paths = append(paths, entry.Path)
+	}
+	return paths
+}
@@ -0,0 +1,202 @@
+package bootstrap
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/combust-labs/firebuild-shared/build/commands"
+	"github.com/pkg/errors"
+)
+
+// TarTarget maps the tar stream entries under a source to the target of an ADD or COPY command.
+type TarTarget struct {
+	CommandIndex int
+	Source       string
+	Target       string
+	User         commands.User
+	Workdir      commands.Workdir
+
+	overrides resourceOverrides
+}
+
+// NewTarTargetFromAdd returns the tar target of an ADD command.
+func NewTarTargetFromAdd(index int, cmd commands.Add) TarTarget {
+	return TarTarget{
+		CommandIndex: index,
+		Source:       cmd.Source,
+		Target:       cmd.Target,
+		User:         cmd.User,
+		Workdir:      cmd.Workdir,
+	}
+}
+
+// NewTarTargetFromCopy returns the tar target of a COPY command,
+// the --chmod and --chown flags of the command are applied to the entries.
+func NewTarTargetFromCopy(index int, cmd commands.Copy) (TarTarget, error) {
+	overrides, err := parseResourceOverrides(cmd.OriginalCommand)
+	if err != nil {
+		return TarTarget{}, err
+	}
+	return TarTarget{
+		CommandIndex: index,
+		Source:       cmd.Source,
+		Target:       cmd.Target,
+		User:         cmd.User,
+		Workdir:      cmd.Workdir,
+		overrides:    overrides,
+	}, nil
+}
+
+// destination returns the on disk path of the tar entry, false if the entry is not under the source.
+// The contents of a directory source are deployed to the target.
+func (t TarTarget) destination(entryName string, isDir bool) (string, bool) {
+	source := strings.Trim(filepath.Clean(t.Source), "/")
+	if entryName == source {
+		destination := filepath.Join(t.Workdir.Value, t.Target)
+		if !isDir && filepath.Base(destination) != filepath.Base(source) {
+			// ensure that we always have a full target path:
+			destination = filepath.Join(destination, filepath.Base(source))
+		}
+		return destination, true
+	}
+	if source == "." {
+		return filepath.Join(t.Workdir.Value, t.Target, entryName), true
+	}
+	if strings.HasPrefix(entryName, source+"/") {
+		return filepath.Join(t.Workdir.Value, t.Target, strings.TrimPrefix(entryName, source+"/")), true
+	}
+	return "", false
+}
+
+// DeployTarStream deploys the resources of multiple ADD and COPY commands from a single tar stream.
+// Every entry is deployed to the target of the first tar target with a matching source,
+// an entry not matching any target fails the deployment. Only regular files and directories are supported.
+func (n *executingResourceDeployer) DeployTarStream(stream io.Reader, targets []TarTarget) error {
+	n.logger.Debug("deploying tar stream", "targets", len(targets))
+	return n.withManifest(func() error {
+		return n.withWritableTarget(func() error {
+			return n.withDeferredDirModes(func() error {
+				return n.deployTarEntries(tar.NewReader(stream), targets)
+			})
+		})
+	})
+}
+
+func (n *executingResourceDeployer) deployTarEntries(tarReader *tar.Reader, targets []TarTarget) error {
+	nEntries := 0
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			n.logger.Debug("tar stream deployed", "number-of-entries", nEntries)
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed reading tar stream")
+		}
+
+		entryName := filepath.Clean(strings.TrimPrefix(header.Name, "/"))
+		if entryName == ".." || strings.HasPrefix(entryName, "../") {
+			return fmt.Errorf("tar entry '%s' escapes the stream root", header.Name)
+		}
+
+		var target TarTarget
+		var destination string
+		matched := false
+		for _, candidate := range targets {
+			if destination, matched = candidate.destination(entryName, header.Typeflag == tar.TypeDir); matched {
+				destination = n.stagedPath(destination)
+				target = candidate
+				break
+			}
+		}
+		if !matched {
+			n.logger.Error("tar entry does not match any target", "entry", header.Name)
+			return fmt.Errorf("tar entry '%s' does not match any target", header.Name)
+		}
+
+		if err := n.ensureTmpfs(destination); err != nil {
+			return err
+		}
+
+		targetMode := target.overrides.targetMode(os.FileMode(header.Mode).Perm())
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(destination, n.mkdirMode(destination, targetMode)); err != nil {
+				n.logger.Error("error while creating directory", "entry", header.Name, "on-disk-path", destination)
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(destination), 0755); err != nil {
+				n.logger.Error("error while ensuring resource parent directory", "entry", header.Name, "reason", err)
+				return err
+			}
+			deploy, err := n.applyOverwritePolicy(destination)
+			if err != nil {
+				n.logger.Error("overwrite policy rejected the tar entry", "entry", header.Name, "on-disk-path", destination, "reason", err)
+				return err
+			}
+			if !deploy {
+				nEntries = nEntries + 1
+				continue
+			}
+			if err := n.checkDiskSpace(destination, header.Size); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("tar entry '%s' has unsupported type '%c'", header.Name, header.Typeflag)
+		}
+
+		uid, gid, chown, err := n.targetOwner(target.overrides.targetUser(target.User))
+		if err != nil {
+			n.logger.Error("error while resolving tar entry owner", "entry", header.Name, "reason", err)
+			return err
+		}
+
+		entry := ManifestEntry{
+			CommandIndex: target.CommandIndex,
+			IsDir:        header.Typeflag == tar.TypeDir,
+			Mode:         manifestMode(targetMode),
+			Owner:        manifestOwner(chown, uid, gid),
+			Path:         destination,
+			Stage:        target.overrides.stage,
+		}
+
+		if header.Typeflag == tar.TypeReg {
+			contents, err := n.transformContents(destination, tarReader)
+			if err != nil {
+				n.logger.Error("error while transforming tar entry contents", "entry", header.Name, "on-disk-path", destination, "reason", err)
+				return err
+			}
+			contentsHash := sha256.New()
+			written, err := n.writeContents(destination, targetMode, io.TeeReader(n.limitDeployBytes(destination, contents), contentsHash))
+			if err != nil {
+				n.logger.Error("error while writing target file", "entry", header.Name, "on-disk-path", destination, "reason", err)
+				return err
+			}
+			entry.SHA256 = hex.EncodeToString(contentsHash.Sum(nil))
+			entry.Size = written
+			n.logger.Info("file written", "entry", header.Name, "on-disk-path", destination, "written-bytes", written)
+		}
+
+		if chown {
+			if err := os.Chown(destination, uid, gid); err != nil {
+				n.logger.Error("error while chowning tar entry", "entry", header.Name, "on-disk-path", destination, "reason", err)
+				return err
+			}
+		}
+
+		n.deduplicate(entry)
+		if err := n.syncEntry(entry); err != nil {
+			return err
+		}
+		n.recordManifestEntry(entry)
+		nEntries = nEntries + 1
+	}
+}
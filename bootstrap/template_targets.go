@@ -0,0 +1,153 @@
+package bootstrap
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/combust-labs/firebuild-shared/build/commands"
+	"github.com/combust-labs/firebuild-shared/build/resources"
+	"github.com/combust-labs/firebuild-shared/build/rootfs"
+	"github.com/pkg/errors"
+)
+
+// targetTemplateData is the context the ADD and COPY target templates are evaluated against.
+type targetTemplateData struct {
+	Args map[string]string
+	Env  map[string]string
+	MMDS map[string]string
+}
+
+// targetTemplateFuncs are the only functions available to the target templates besides
+// the comparison and logical builtins. The builtins able to call or format arbitrary
+// values are replaced with failing functions.
+var targetTemplateFuncs = template.FuncMap{
+	"call":    disallowedTemplateFunc("call"),
+	"lower":   strings.ToLower,
+	"print":   disallowedTemplateFunc("print"),
+	"printf":  disallowedTemplateFunc("printf"),
+	"println": disallowedTemplateFunc("println"),
+	"trim":    strings.TrimSpace,
+	"upper":   strings.ToUpper,
+}
+
+func disallowedTemplateFunc(name string) func(...interface{}) (string, error) {
+	return func(...interface{}) (string, error) {
+		return "", fmt.Errorf("function '%s' is not allowed in target templates", name)
+	}
+}
+
+// renderTargetTemplate evaluates the target template. A missing key fails the evaluation
+// and the rendered target must not escape the directory with a '..' element.
+func renderTargetTemplate(target string, data targetTemplateData) (string, error) {
+	if !strings.Contains(target, "{{") {
+		return target, nil
+	}
+	tmpl, err := template.New("target").Funcs(targetTemplateFuncs).Option("missingkey=error").Parse(target)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid target template '%s'", target)
+	}
+	rendered := bytes.NewBuffer(nil)
+	if err := tmpl.Execute(rendered, data); err != nil {
+		return "", errors.Wrapf(err, "failed evaluating target template '%s'", target)
+	}
+	for _, element := range strings.Split(filepath.ToSlash(rendered.String()), "/") {
+		if element == ".." {
+			return "", fmt.Errorf("target template '%s' rendered to '%s' containing '..'", target, rendered.String())
+		}
+	}
+	if strings.ContainsRune(rendered.String(), 0) {
+		return "", fmt.Errorf("target template '%s' rendered to a target containing a NUL character", target)
+	}
+	return rendered.String(), nil
+}
+
+// targetTemplateData returns the template context of a resource command, the build arguments
+// and the environment are the ones of the last RUN command, the server does not send them
+// with ADD and COPY commands.
+func (b *defaultBootstrapper) targetTemplateData(lastRun *commands.Run) targetTemplateData {
+	data := targetTemplateData{Args: map[string]string{}, Env: map[string]string{}, MMDS: map[string]string{}}
+	for k, v := range b.mmdsValues {
+		data.MMDS[k] = v
+	}
+	for k, v := range b.commandEnv {
+		data.Env[k] = v
+	}
+	if lastRun != nil {
+		for k, v := range lastRun.Args {
+			data.Args[k] = v
+		}
+		for k, v := range lastRun.Env {
+			data.Env[k] = v
+		}
+	}
+	return data
+}
+
+// renderTarget returns the target of the resource command and the client serving the resources
+// with the rendered target. The target is returned as it is without target templates.
+func (b *defaultBootstrapper) renderTarget(client rootfs.ClientProvider, target string, lastRun *commands.Run) (string, rootfs.ClientProvider, error) {
+	if !b.templateTargets {
+		return target, client, nil
+	}
+	rendered, err := renderTargetTemplate(target, b.targetTemplateData(lastRun))
+	if err != nil {
+		return "", nil, err
+	}
+	if rendered == target {
+		return target, client, nil
+	}
+	b.logger.Debug("target template rendered", "target", target, "rendered-target", rendered)
+	return rendered, &retargetingClient{ClientProvider: client, from: target, to: rendered}, nil
+}
+
+// retargetingClient serves the resources resolved by the server for the unrendered target
+// under the rendered target.
+type retargetingClient struct {
+	rootfs.ClientProvider
+	from string
+	to   string
+}
+
+func (c *retargetingClient) Resource(source string) (chan interface{}, error) {
+	upstream, err := c.ClientProvider.Resource(source)
+	if err != nil {
+		return nil, err
+	}
+	output := make(chan interface{})
+	go func() {
+		for {
+			item := <-upstream
+			switch titem := item.(type) {
+			case nil:
+				output <- nil
+				return
+			case error:
+				output <- titem
+				return
+			case resources.ResolvedResource:
+				if strings.HasPrefix(titem.TargetPath(), c.from) {
+					item = &retargetedResource{
+						ResolvedResource: titem,
+						targetPath:       c.to + strings.TrimPrefix(titem.TargetPath(), c.from),
+					}
+				}
+				output <- item
+			default:
+				output <- item
+			}
+		}
+	}()
+	return output, nil
+}
+
+type retargetedResource struct {
+	resources.ResolvedResource
+	targetPath string
+}
+
+func (r *retargetedResource) TargetPath() string {
+	return r.targetPath
+}
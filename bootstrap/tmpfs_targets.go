@@ -0,0 +1,81 @@
+package bootstrap
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// resourceDeployerCleaner is a resource deployer releasing resources held for the duration of the bootstrap.
+type resourceDeployerCleaner interface {
+	Cleanup() error
+}
+
+// tmpfsTarget is a tmpfs mounted at the mountpoint before the first resource is written under it.
+type tmpfsTarget struct {
+	createdDir bool
+	mounted    bool
+	mountpoint string
+	sizeBytes  int64
+}
+
+// contains returns true if the on-disk path is the mountpoint or a path under it.
+func (t *tmpfsTarget) contains(path string) bool {
+	return path == t.mountpoint || strings.HasPrefix(path, t.mountpoint+"/")
+}
+
+// ensureTmpfs mounts the tmpfs target containing the on-disk path, if not mounted yet.
+func (n *executingResourceDeployer) ensureTmpfs(path string) error {
+	for _, target := range n.tmpfsTargets {
+		if !target.contains(path) || target.mounted {
+			continue
+		}
+		if _, err := os.Stat(target.mountpoint); os.IsNotExist(err) {
+			if err := os.MkdirAll(target.mountpoint, 0755); err != nil {
+				return errors.Wrapf(err, "failed creating tmpfs mountpoint '%s'", target.mountpoint)
+			}
+			target.createdDir = true
+		}
+		if err := mountTmpfsWithSize(target.mountpoint, target.sizeBytes); err != nil {
+			n.logger.Error("failed mounting tmpfs target", "mountpoint", target.mountpoint, "reason", err)
+			return errors.Wrapf(err, "failed mounting tmpfs at '%s'", target.mountpoint)
+		}
+		target.mounted = true
+		n.logger.Info("tmpfs target mounted", "mountpoint", target.mountpoint, "size-bytes", target.sizeBytes)
+	}
+	return nil
+}
+
+// Cleanup unmounts the tmpfs targets, discarding the resources deployed to them,
+// and removes the mountpoints created by the deployer. Called when the bootstrap finishes.
+func (n *executingResourceDeployer) Cleanup() error {
+	var cleanupErr error
+	for _, target := range n.tmpfsTargets {
+		if !target.mounted {
+			continue
+		}
+		if err := unmount(target.mountpoint); err != nil {
+			n.logger.Error("failed unmounting tmpfs target", "mountpoint", target.mountpoint, "reason", err)
+			if cleanupErr == nil {
+				cleanupErr = errors.Wrapf(err, "failed unmounting tmpfs at '%s'", target.mountpoint)
+			}
+			continue
+		}
+		target.mounted = false
+		if target.createdDir {
+			os.Remove(target.mountpoint)
+			target.createdDir = false
+		}
+		n.logger.Info("tmpfs target unmounted", "mountpoint", target.mountpoint)
+	}
+	return cleanupErr
+}
+
+func newTmpfsTarget(mountpoint string, sizeBytes int64) *tmpfsTarget {
+	return &tmpfsTarget{
+		mountpoint: filepath.Clean(mountpoint),
+		sizeBytes:  sizeBytes,
+	}
+}
@@ -0,0 +1,26 @@
+package bootstrap
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName is the name of the tracer used to instrument the bootstrap.
+const TracerName = "github.com/combust-labs/firebuild-mmds/bootstrap"
+
+// startSpan starts a span and returns a function ending the span with the outcome of the operation.
+func (b *defaultBootstrapper) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, func(error)) {
+	started := b.clock.Now()
+	spanCtx, span := b.tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+	return spanCtx, func(err error) {
+		span.SetAttributes(attribute.Int64("duration_ms", b.clock.Now().Sub(started).Milliseconds()))
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
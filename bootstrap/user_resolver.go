@@ -0,0 +1,96 @@
+package bootstrap
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// userResolver resolves user and group names to numeric ids.
+// When the passwd or group source is set, names are resolved against that file,
+// otherwise the host user database is used.
+type userResolver struct {
+	passwdSource string
+	groupSource  string
+}
+
+// resolve resolves a user or a user:group string to a uid and gid.
+// A missing group is returned as -1.
+func (r *userResolver) resolve(input string) (int, int, error) {
+	if uid, gid, err := stringToUidAndGid(input); err == nil {
+		return uid, gid, nil
+	}
+	parts := strings.Split(input, ":")
+	if len(parts) > 2 {
+		return -1, -1, fmt.Errorf("invalid user:group")
+	}
+	uid, err := r.lookupUid(parts[0])
+	if err != nil {
+		return -1, -1, err
+	}
+	if len(parts) == 1 {
+		return uid, -1, nil
+	}
+	gid, err := r.lookupGid(parts[1])
+	if err != nil {
+		return -1, -1, err
+	}
+	return uid, gid, nil
+}
+
+func (r *userResolver) lookupUid(name string) (int, error) {
+	if uid, err := strconv.Atoi(name); err == nil {
+		return uid, nil
+	}
+	if r.passwdSource == "" {
+		hostUser, err := user.Lookup(name)
+		if err != nil {
+			return -1, err
+		}
+		return strconv.Atoi(hostUser.Uid)
+	}
+	// passwd line format: name:password:uid:gid:gecos:home:shell
+	return lookupIdInDatabase(r.passwdSource, name, 2)
+}
+
+func (r *userResolver) lookupGid(name string) (int, error) {
+	if gid, err := strconv.Atoi(name); err == nil {
+		return gid, nil
+	}
+	if r.groupSource == "" {
+		hostGroup, err := user.LookupGroup(name)
+		if err != nil {
+			return -1, err
+		}
+		return strconv.Atoi(hostGroup.Gid)
+	}
+	// group line format: name:password:gid:members
+	return lookupIdInDatabase(r.groupSource, name, 2)
+}
+
+func lookupIdInDatabase(path, name string, idField int) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return -1, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) <= idField || fields[0] != name {
+			continue
+		}
+		return strconv.Atoi(fields[idField])
+	}
+	if err := scanner.Err(); err != nil {
+		return -1, err
+	}
+	return -1, fmt.Errorf("name '%s' not found in '%s'", name, path)
+}
@@ -0,0 +1,245 @@
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock provides the time to the components measuring timeouts and backoffs.
+type Clock interface {
+	Now() time.Time
+	After(time.Duration) <-chan time.Time
+	AfterFunc(time.Duration, func()) Timer
+	NewTicker(time.Duration) Ticker
+	Sleep(time.Duration)
+}
+
+// Timer calls its function in its own goroutine once the duration elapses, unless stopped.
+// Stop and Reset return true if the timer was active.
+type Timer interface {
+	Reset(time.Duration) bool
+	Stop() bool
+}
+
+// Ticker delivers the time to its channel every interval until stopped,
+// the ticks are dropped for a slow receiver.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+type realClock struct{}
+
+// Real returns a clock backed by the time package.
+func Real() Clock {
+	return &realClock{}
+}
+
+func (c *realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (c *realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (c *realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+func (c *realClock) NewTicker(d time.Duration) Ticker {
+	return &realTicker{ticker: time.NewTicker(d)}
+}
+
+func (c *realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+type realTicker struct {
+	ticker *time.Ticker
+}
+
+func (t *realTicker) C() <-chan time.Time {
+	return t.ticker.C
+}
+
+func (t *realTicker) Stop() {
+	t.ticker.Stop()
+}
+
+// Fake is a clock advanced only explicitly, for deterministic tests.
+// Sleep does not block, it advances the clock instead.
+type Fake struct {
+	sync.Mutex
+	changed *sync.Cond
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+type fakeWaiter struct {
+	deadline time.Time
+	ch       chan time.Time
+	f        func()
+	period   time.Duration
+}
+
+// NewFake returns a fake clock starting at the given time.
+func NewFake(now time.Time) *Fake {
+	fake := &Fake{now: now}
+	fake.changed = sync.NewCond(&fake.Mutex)
+	return fake
+}
+
+// Now returns the current time of the fake clock.
+func (c *Fake) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+// After returns a channel receiving the time once the clock is advanced by the duration.
+func (c *Fake) After(d time.Duration) <-chan time.Time {
+	c.Lock()
+	defer c.Unlock()
+	waiter := &fakeWaiter{deadline: c.now.Add(d), ch: make(chan time.Time, 1)}
+	if d <= 0 {
+		waiter.ch <- c.now
+		return waiter.ch
+	}
+	c.waiters = append(c.waiters, waiter)
+	c.changed.Broadcast()
+	return waiter.ch
+}
+
+// AfterFunc returns a timer calling the function once the clock is advanced by the duration,
+// the function is called by Advance before it returns.
+func (c *Fake) AfterFunc(d time.Duration, f func()) Timer {
+	timer := &fakeTimer{clock: c, f: f}
+	timer.Reset(d)
+	return timer
+}
+
+// NewTicker returns a ticker delivering the time every time the clock is advanced by the interval.
+func (c *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	c.Lock()
+	defer c.Unlock()
+	ticker := &fakeTicker{clock: c, waiter: &fakeWaiter{deadline: c.now.Add(d), ch: make(chan time.Time, 1), period: d}}
+	c.waiters = append(c.waiters, ticker.waiter)
+	c.changed.Broadcast()
+	return ticker
+}
+
+// Sleep advances the clock by the duration.
+func (c *Fake) Sleep(d time.Duration) {
+	c.Advance(d)
+}
+
+// Advance moves the clock forward, notifying the waiters with a passed deadline.
+// The functions of the expired timers are called in the deadline order.
+func (c *Fake) Advance(d time.Duration) {
+	for _, f := range c.advance(d) {
+		f()
+	}
+}
+
+// advance moves the clock forward and returns the functions of the expired timers.
+func (c *Fake) advance(d time.Duration) []func() {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+	sort.Slice(c.waiters, func(i, j int) bool {
+		return c.waiters[i].deadline.Before(c.waiters[j].deadline)
+	})
+	expired := []func(){}
+	remaining := []*fakeWaiter{}
+	for _, waiter := range c.waiters {
+		if waiter.deadline.After(c.now) {
+			remaining = append(remaining, waiter)
+			continue
+		}
+		if waiter.f != nil {
+			expired = append(expired, waiter.f)
+			continue
+		}
+		if waiter.period > 0 {
+			select {
+			case waiter.ch <- c.now:
+			default: // the previous tick was not received
+			}
+			for !waiter.deadline.After(c.now) {
+				waiter.deadline = waiter.deadline.Add(waiter.period)
+			}
+			remaining = append(remaining, waiter)
+			continue
+		}
+		waiter.ch <- c.now
+	}
+	c.waiters = remaining
+	return expired
+}
+
+// remove removes the waiter and returns true if it was waiting.
+func (c *Fake) remove(waiter *fakeWaiter) bool {
+	for i, candidate := range c.waiters {
+		if candidate == waiter {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+type fakeTimer struct {
+	clock  *Fake
+	f      func()
+	waiter *fakeWaiter
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.Lock()
+	active := t.waiter != nil && t.clock.remove(t.waiter)
+	t.waiter = &fakeWaiter{deadline: t.clock.now.Add(d), f: t.f}
+	t.clock.waiters = append(t.clock.waiters, t.waiter)
+	t.clock.changed.Broadcast()
+	t.clock.Unlock()
+	if d <= 0 {
+		// the timer expires without advancing the clock:
+		t.clock.Advance(0)
+	}
+	return active
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+	return t.waiter != nil && t.clock.remove(t.waiter)
+}
+
+// BlockUntil blocks until at least n waiters wait for the clock to advance,
+// so a test advances the clock only once the tested code waits for it.
+func (c *Fake) BlockUntil(n int) {
+	c.Lock()
+	defer c.Unlock()
+	for len(c.waiters) < n {
+		c.changed.Wait()
+	}
+}
+
+type fakeTicker struct {
+	clock  *Fake
+	waiter *fakeWaiter
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.waiter.ch
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+	t.clock.remove(t.waiter)
+}
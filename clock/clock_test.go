@@ -0,0 +1,98 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	fake := NewFake(start)
+
+	fired := fake.After(time.Minute)
+
+	fake.Advance(30 * time.Second)
+	select {
+	case <-fired:
+		t.Fatal("expected the timer not to fire before the deadline")
+	default:
+	}
+
+	fake.Sleep(30 * time.Second)
+	select {
+	case now := <-fired:
+		assert.Equal(t, start.Add(time.Minute), now)
+	default:
+		t.Fatal("expected the timer to fire after the deadline")
+	}
+
+	assert.Equal(t, start.Add(time.Minute), fake.Now())
+}
+
+func TestFakeClockBlockUntil(t *testing.T) {
+	fake := NewFake(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	fired := make(chan time.Time, 1)
+	go func() {
+		fired <- <-fake.After(time.Minute)
+	}()
+
+	// the clock is advanced once the goroutine waits for it:
+	fake.BlockUntil(1)
+	fake.Advance(time.Minute)
+	assert.Equal(t, fake.Now(), <-fired)
+}
+
+func TestFakeClockAfterFunc(t *testing.T) {
+	fake := NewFake(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	fired := make(chan struct{}, 1)
+	timer := fake.AfterFunc(time.Minute, func() { fired <- struct{}{} })
+
+	// a reset timer fires after the new duration:
+	fake.Advance(30 * time.Second)
+	assert.True(t, timer.Reset(time.Minute))
+	fake.Advance(30 * time.Second)
+	select {
+	case <-fired:
+		t.Fatal("expected the timer not to fire before the deadline")
+	default:
+	}
+	fake.Advance(30 * time.Second)
+	<-fired
+	assert.False(t, timer.Stop())
+
+	// a stopped timer never fires:
+	stopped := fake.AfterFunc(time.Minute, func() { t.Error("expected the stopped timer not to fire") })
+	assert.True(t, stopped.Stop())
+	fake.Advance(time.Hour)
+}
+
+func TestFakeClockTicker(t *testing.T) {
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	fake := NewFake(start)
+
+	ticker := fake.NewTicker(time.Minute)
+	fake.Advance(30 * time.Second)
+	select {
+	case <-ticker.C():
+		t.Fatal("expected no tick before the interval")
+	default:
+	}
+
+	// the ticks not received are dropped:
+	fake.Advance(150 * time.Second)
+	assert.Equal(t, start.Add(3*time.Minute), <-ticker.C())
+	fake.Advance(time.Minute)
+	assert.Equal(t, start.Add(4*time.Minute), <-ticker.C())
+
+	ticker.Stop()
+	fake.Advance(time.Hour)
+	select {
+	case <-ticker.C():
+		t.Fatal("expected no tick after the ticker is stopped")
+	default:
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"net/http"
 	"os"
 
 	"github.com/combust-labs/firebuild-mmds/bootstrap"
@@ -39,6 +40,7 @@ var rootCmd = &cobra.Command{
 
 type commandConfig struct {
 	MMDSIP       string
+	MMDSEnvKeys  []string
 	MetadataPath string
 
 	PathAuthorizedKeysPatternFile string
@@ -58,6 +60,7 @@ var (
 func initFlags() {
 	rootCmd.Flags().StringVar(&config.MMDSIP, "guest-mmds-ip", defaultGuestMMDSIP, "Guest IP address of the MMDS service")
 	rootCmd.Flags().StringVar(&config.MetadataPath, "metadata-path", defaultMetadataPath, "Path to the metadata root")
+	rootCmd.Flags().StringSliceVar(&config.MMDSEnvKeys, "mmds-env-key", []string{}, "MMDS metadata key exposed to bootstrap RUN commands as an environment variable, can be specified multiple times")
 
 	rootCmd.Flags().StringVar(&config.PathAuthorizedKeysPatternFile, "path-authorized-keys-pattern", defaultPathAuthorizedKeysPatternFile, "Path to the metadata root")
 	rootCmd.Flags().StringVar(&config.PathEntrypointRunnerFile, "path-entrypoint-runner-file", defaultPathEntrypointRunnerFile, "Path to the entrypoint runner executable")
@@ -83,6 +86,9 @@ func processCommand() int {
 	if config.PrintFlags {
 		fmt.Println("--guest-mmds-ip " + config.MMDSIP)
 		fmt.Println("--metadata-path " + config.MetadataPath)
+		for _, key := range config.MMDSEnvKeys {
+			fmt.Println("--mmds-env-key " + key)
+		}
 		fmt.Println("--path-authorized-keys-pattern " + config.PathAuthorizedKeysPatternFile)
 		fmt.Println("--path-entrypoint-runner-file " + config.PathEntrypointRunnerFile)
 		fmt.Println("--path-env-file " + config.PathEnvFile)
@@ -93,7 +99,9 @@ func processCommand() int {
 
 	rootLogger := logCfg.NewLogger("vminit")
 
-	mmdsData, err := mmds.GuestFetchMMDSMetadata(rootLogger, fmt.Sprintf("http://%s/%s", config.MMDSIP, config.MetadataPath))
+	mmdsBaseURI := fmt.Sprintf("http://%s/%s", config.MMDSIP, config.MetadataPath)
+
+	mmdsData, err := mmds.GuestFetchMMDSMetadata(rootLogger, mmdsBaseURI)
 	if err != nil {
 		// already logged
 		return 1
@@ -104,7 +112,10 @@ func processCommand() int {
 		bootstrapper := bootstrap.
 			NewDefaultBoostrapper(rootLogger.Named("bootstrap"), mmdsData.Bootstrap).
 			WithCommandRunner(bootstrap.NewShellCommandRunner(rootLogger.Named("shell-runner"))).
-			WithResourceDeployer(bootstrap.NewExecutingResourceDeployer(rootLogger.Named("executing-deployer")))
+			WithResourceDeployer(bootstrap.NewExecutingResourceDeployer(rootLogger.Named("executing-deployer"))).
+			WithMMDSBaseURI(mmdsBaseURI).
+			WithMMDSEnv(config.MMDSEnvKeys).
+			WithResourceResolver(bootstrap.NewMMDSResourceResolver(http.DefaultClient, mmdsBaseURI, rootLogger.Named("mmds-resolver")))
 		// TODO: needs properly executing resource deployer
 		if err := bootstrapper.Execute(); err != nil {
 			rootLogger.Error("bootstrap failed", "reason", err)
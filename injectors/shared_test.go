@@ -302,49 +302,48 @@ func TestInjectEntrypoint(t *testing.T) {
 }
 
 const testJsonData = `{
-	"drives":{
+	"Drives":{
 	   "1":{
-		  "drive-id":"1",
-		  "is-read-only":"false",
-		  "is-root-device":"true",
-		  "partuuid":"",
-		  "path-on-host":"rootfs"
+		  "DriveID":"1",
+		  "IsReadOnly":"false",
+		  "IsRootDevice":"true",
+		  "PartUUID":"",
+		  "PathOnHost":"rootfs"
 	   }
 	},
-	"entrypoint-json": "{\"cmd\": [\"--help\", \"--another\"], \"entrypoint\": [\"/usr/bin/start.sh\"], \"env\": {\"ETCD_VERSION\": \"3.4.0\"}, \"shell\": [\"/bin/sh\", \"-c\"], \"user\": \"0:0\", \"workdir\": \"/\"}",
-	"env":{
+	"EntrypointJSON": "{\"cmd\": [\"--help\", \"--another\"], \"entrypoint\": [\"/usr/bin/start.sh\"], \"env\": {\"ETCD_VERSION\": \"3.4.0\"}, \"shell\": [\"/bin/sh\", \"-c\"], \"user\": \"0:0\", \"workdir\": \"/\"}",
+	"Env":{
 		"ENV_VAR": "a value"
 	},
-	"image-tag":"combust-labs/etcd:3.4.0",
-	"local-hostname":"focused-edison",
-	"machine":{
-	   "cpu":"1",
-	   "cpu-template":"",
-	   "ht-enabled":"false",
-	   "kernel-args":"console=ttyS0 noapic reboot=k panic=1 pci=off nomodules rw",
-	   "mem":"128",
-	   "vmlinux":"vmlinux-v5.8"
+	"ImageTag":"combust-labs/etcd:3.4.0",
+	"LocalHostname":"focused-edison",
+	"Machine":{
+	   "CPU":"1",
+	   "CPUTemplate":"",
+	   "HTEnabled":"false",
+	   "KernelArgs":"console=ttyS0 noapic reboot=k panic=1 pci=off nomodules rw",
+	   "Mem":"128",
+	   "VMLinux":"vmlinux-v5.8"
 	},
-	"network":{
-	   "cni-network-name":"alpine",
-	   "interfaces":{
+	"Network":{
+	   "CniNetworkName":"alpine",
+	   "Interfaces":{
 		  "c6:15:a7:48:76:16":{
-			 "gateway":"192.168.127.1",
-			 "host-dev-name":"tap18",
-			 "ifname":"",
-			 "ip":"192.168.127.54",
-			 "ip-addr":"192.168.127.54/24",
-			 "ip-mask":"ffffff00",
-			 "ip-net":"ip+net",
-			 "nameservers":""
+			 "Gateway":"192.168.127.1",
+			 "HostDeviceName":"tap18",
+			 "IfName":"",
+			 "IP":"192.168.127.54",
+			 "IPAddr":"192.168.127.54/24",
+			 "IPMask":"ffffff00",
+			 "IPNet":"ip+net",
+			 "NameServers":""
 		  }
-	   },
-	   "ssh-port":"22"
+	   }
 	},
-	"users":{
+	"Users":{
 	   "alpine":{
-		  "ssh-keys":"ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAACAQDMY2vE7bgq4p4rCfiFfemkMu4P5pX7QA1qCDXu/3kzD/EO1S7jwBR69OTW5BCiOVgRfl+o2or5rBkDrsd6GKCJd3enqRLVqHazeWRJlRLx4W/uyM7n664SgFQ/Tno3g+NIo06XN8Ijhr0IGVsEF+FFO5rWOGVGANV5vuChd4QLtCGW6uJtNuNl6vCFcRU+wlYU/1QzfnuicTNGVQhsG1AIEhqmGRJYXWypOIE4s09z0T/rtD988678jINdPj3e5Gv5qBEra0IrgDTVncQfWW6m+T04uE88qYFzrgDR8rovljZiPKp3xFsBUK7Zkzkc5PIJJPaswnm4qYL2TuPVm1LnfjacrmZdaaIHepyiWNLZFClzwqz8lQqKLyXIccGELyGDibN8AEe2W7VbAoqNe9PGJSo4ooB5Owy97yyPE0VwTXwXiBZ/tjJu6U+/kDXzdhQFu+sJEoLmCOgh/+nZ1zLuP+qVJ7rWARX/GtsQYXN9ZcI+TnrqNQ33F8/l6J5SX/XSHX7wtHCpCa8JdyF4yRTz05UAGEezWPAXhjgckCkMriyaoEibBcNDMiUSB7ngXgs4EYHf5FyepWZw8UFceMLKrEbcPNRfQxnNmTCUU3F71NAHqEl//RESUnF5I4NgwxQnqBCe0sVhTAfLOfkddET88jpHjn5uOxFAelcPyWBW6Q==\n"
+		  "SSHKeys":"ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAACAQDMY2vE7bgq4p4rCfiFfemkMu4P5pX7QA1qCDXu/3kzD/EO1S7jwBR69OTW5BCiOVgRfl+o2or5rBkDrsd6GKCJd3enqRLVqHazeWRJlRLx4W/uyM7n664SgFQ/Tno3g+NIo06XN8Ijhr0IGVsEF+FFO5rWOGVGANV5vuChd4QLtCGW6uJtNuNl6vCFcRU+wlYU/1QzfnuicTNGVQhsG1AIEhqmGRJYXWypOIE4s09z0T/rtD988678jINdPj3e5Gv5qBEra0IrgDTVncQfWW6m+T04uE88qYFzrgDR8rovljZiPKp3xFsBUK7Zkzkc5PIJJPaswnm4qYL2TuPVm1LnfjacrmZdaaIHepyiWNLZFClzwqz8lQqKLyXIccGELyGDibN8AEe2W7VbAoqNe9PGJSo4ooB5Owy97yyPE0VwTXwXiBZ/tjJu6U+/kDXzdhQFu+sJEoLmCOgh/+nZ1zLuP+qVJ7rWARX/GtsQYXN9ZcI+TnrqNQ33F8/l6J5SX/XSHX7wtHCpCa8JdyF4yRTz05UAGEezWPAXhjgckCkMriyaoEibBcNDMiUSB7ngXgs4EYHf5FyepWZw8UFceMLKrEbcPNRfQxnNmTCUU3F71NAHqEl//RESUnF5I4NgwxQnqBCe0sVhTAfLOfkddET88jpHjn5uOxFAelcPyWBW6Q==\n"
 	   }
 	},
-	"vmm-id":"pkztxllhbaactacdyhea"
+	"VMMID":"pkztxllhbaactacdyhea"
  }`
@@ -0,0 +1,63 @@
+package mmds
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// Validate validates the bootstrap data before connecting to the server.
+// The CA chain must form a complete path from every CA to a self-signed root,
+// a truncated chain would only fail the TLS handshake with a confusing error.
+func (b *MMDSBootstrap) Validate() error {
+	return ValidateCAChainPath(b.CaChain)
+}
+
+// ValidateCAChainPath verifies that the issuer of every certificate of the PEM encoded chain
+// is in the chain and that the chain ends with a self-signed root. The first certificate,
+// in the chain order, with the issuer missing from the chain is reported.
+func ValidateCAChainPath(caChain string) error {
+	certs := []*x509.Certificate{}
+	input := []byte(caChain)
+	for {
+		block, remaining := pem.Decode(input)
+		if block == nil {
+			break
+		}
+		input = remaining
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return errors.Wrap(err, "failed parsing CA chain certificate")
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return fmt.Errorf("CA chain contains no certificates")
+	}
+	for _, cert := range certs {
+		if isSelfSigned(cert) {
+			continue
+		}
+		if !hasIssuer(cert, certs) {
+			return fmt.Errorf("incomplete CA chain: the issuer '%s' of the certificate '%s' is missing from the chain",
+				cert.Issuer.String(), cert.Subject.String())
+		}
+	}
+	return nil
+}
+
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil
+}
+
+func hasIssuer(cert *x509.Certificate, candidates []*x509.Certificate) bool {
+	for _, candidate := range candidates {
+		if candidate != cert && bytes.Equal(cert.RawIssuer, candidate.RawSubject) && cert.CheckSignatureFrom(candidate) == nil {
+			return true
+		}
+	}
+	return false
+}
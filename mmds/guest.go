@@ -1,36 +1,151 @@
 package mmds
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/combust-labs/firebuild-mmds/clock"
 	"github.com/hashicorp/go-hclog"
 )
 
+// ErrBootstrapNotFound is returned when MMDS does not contain the bootstrap data.
+var ErrBootstrapNotFound = errors.New("bootstrap data not found in MMDS")
+
 // GuestFetchMMDSMetadata resolves the metadata from MMDS as a guest.
+// The metadata is strictly deserialized with ParseMetadata.
 func GuestFetchMMDSMetadata(logger hclog.Logger, baseURI string) (*MMDSData, error) {
-	httpRequest, err := http.NewRequest(http.MethodGet, baseURI, nil)
+	data, err := guestFetch(context.Background(), http.DefaultClient, baseURI)
 	if err != nil {
-		logger.Error("error when creating a http request", "reason", err.Error())
+		logger.Error("error fetching MMDS data", "reason", err.Error())
 		return nil, err
 	}
-	httpRequest.Header.Add("accept", "application/json")
-	httpResponse, err := http.DefaultClient.Do(httpRequest)
+	mmdsData, err := ParseMetadata(data)
+	if err != nil {
+		logger.Error("error deserializing MMDS data", "reason", err.Error())
+		return nil, err
+	}
+	return mmdsData, nil
+}
+
+// LoadBootstrapFromMMDS resolves the bootstrap data from MMDS as a guest.
+// The baseURI is the metadata root, the bootstrap is read from its Bootstrap key.
+func LoadBootstrapFromMMDS(ctx context.Context, client *http.Client, baseURI string) (*MMDSBootstrap, error) {
+	data, err := guestFetch(ctx, client, strings.TrimRight(baseURI, "/")+"/Bootstrap")
 	if err != nil {
-		logger.Error("error executing MMDS request", "reason", err.Error())
+		var vStatusErr *statusError
+		if errors.As(err, &vStatusErr) && vStatusErr.statusCode == http.StatusNotFound {
+			return nil, ErrBootstrapNotFound
+		}
 		return nil, err
 	}
+	return ParseBootstrap(data)
+}
+
+// LoadBootstrapFromMMDSWithRetry resolves the bootstrap data from MMDS as a guest,
+// retrying transient failures up to attempts times. MMDS may not be ready
+// at the instant the guest boots so refused and reset connections, timeouts and service unavailable
+// responses are retried, every next attempt waits twice as long as the previous one.
+// Other errors, for example an unresolvable host, are not retried.
+// A missing bootstrap is not retried and returns ErrBootstrapNotFound.
+// The backoff is measured with the clock.
+func LoadBootstrapFromMMDSWithRetry(ctx context.Context, client *http.Client, baseURI string, attempts int, backoff time.Duration, clk clock.Clock) (*MMDSBootstrap, error) {
+	if attempts < 1 {
+		attempts = 1
+	}
+	var lastErr error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		bootstrapData, err := LoadBootstrapFromMMDS(ctx, client, baseURI)
+		if err == nil {
+			return bootstrapData, nil
+		}
+		lastErr = err
+		if !isTransientFetchError(err) || attempt == attempts {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-clk.After(backoff):
+		}
+		backoff = backoff * 2
+	}
+	return nil, lastErr
+}
+
+// GuestFetchMMDSValues resolves the values of the selected metadata keys as a guest.
+// Keys are paths relative to the metadata root, for example Network/CniNetworkName.
+// String values are returned as they are, any other value is returned as JSON.
+func GuestFetchMMDSValues(ctx context.Context, client *http.Client, baseURI string, keys []string) (map[string]string, error) {
+	output := map[string]string{}
+	for _, key := range keys {
+		data, err := guestFetch(ctx, client, strings.TrimRight(baseURI, "/")+"/"+strings.TrimLeft(key, "/"))
+		if err != nil {
+			return nil, fmt.Errorf("error fetching MMDS key '%s': %w", key, err)
+		}
+		var value interface{}
+		if err := json.Unmarshal(data, &value); err != nil {
+			return nil, fmt.Errorf("error deserializing MMDS key '%s': %w", key, err)
+		}
+		if stringValue, ok := value.(string); ok {
+			output[key] = stringValue
+			continue
+		}
+		output[key] = string(data)
+	}
+	return output, nil
+}
+
+type statusError struct {
+	statusCode int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("expected status OK but received %d", e.statusCode)
+}
+
+func isTransientFetchError(err error) bool {
+	var vStatusErr *statusError
+	if errors.As(err, &vStatusErr) {
+		switch vStatusErr.statusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	var vNetErr net.Error
+	return errors.As(err, &vNetErr) && vNetErr.Timeout()
+}
+
+func guestFetch(ctx context.Context, client *http.Client, uri string) ([]byte, error) {
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error when creating a http request: %w", err)
+	}
+	httpRequest.Header.Add("accept", "application/json")
+	httpResponse, err := client.Do(httpRequest)
+	if err != nil {
+		return nil, fmt.Errorf("error executing MMDS request: %w", err)
+	}
 	defer httpResponse.Body.Close()
 
 	if httpResponse.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("expected status OK but received %d", httpResponse.StatusCode)
+		return nil, &statusError{statusCode: httpResponse.StatusCode}
 	}
 
-	mmdsData := &MMDSData{}
-	if err := json.NewDecoder(httpResponse.Body).Decode(mmdsData); err != nil {
-		logger.Error("error deserializing MMDS data", "reason", err.Error())
-		return nil, err
+	data, err := ioutil.ReadAll(httpResponse.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading MMDS response: %w", err)
 	}
-	return mmdsData, nil
+	return data, nil
 }
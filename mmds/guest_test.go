@@ -0,0 +1,96 @@
+package mmds
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/combust-labs/firebuild-mmds/clock"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+)
+
+const testBootstrapJSON = `{"HostPort": "127.0.0.1:5000", "ServerName": "test-server-app"}`
+
+func TestLoadBootstrapFromMMDSWithRetryRecovers(t *testing.T) {
+	requests := int32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(testBootstrapJSON))
+	}))
+	defer server.Close()
+
+	bootstrapData, err := LoadBootstrapFromMMDSWithRetry(context.Background(), server.Client(), server.URL+"/latest/meta-data", 5, time.Millisecond, clock.Real())
+	if err != nil {
+		t.Fatal("expected bootstrap data, got error", err)
+	}
+	assert.Equal(t, "127.0.0.1:5000", bootstrapData.HostPort)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+}
+
+func TestLoadBootstrapFromMMDSWithRetryNotFound(t *testing.T) {
+	requests := int32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Error(w, "not found", http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	_, err := LoadBootstrapFromMMDSWithRetry(context.Background(), server.Client(), server.URL+"/latest/meta-data", 5, time.Millisecond, clock.Real())
+	assert.Equal(t, ErrBootstrapNotFound, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
+
+func TestLoadBootstrapFromMMDSWithRetryConnectionRefused(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	serverURL := server.URL
+	server.Close()
+
+	_, err := LoadBootstrapFromMMDSWithRetry(context.Background(), http.DefaultClient, serverURL+"/latest/meta-data", 3, time.Millisecond, clock.Real())
+	assert.NotNil(t, err)
+	assert.True(t, isTransientFetchError(err))
+}
+
+// failingTransport fails every request with the error.
+type failingTransport struct {
+	err      error
+	requests int32
+}
+
+func (t *failingTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	atomic.AddInt32(&t.requests, 1)
+	return nil, t.err
+}
+
+func TestLoadBootstrapFromMMDSWithRetryNonTransientError(t *testing.T) {
+	transport := &failingTransport{err: &net.DNSError{Err: "no such host", Name: "mmds.invalid", IsNotFound: true}}
+
+	_, err := LoadBootstrapFromMMDSWithRetry(context.Background(), &http.Client{Transport: transport}, "http://mmds.invalid/latest/meta-data", 5, time.Millisecond, clock.Real())
+	assert.NotNil(t, err)
+	assert.False(t, isTransientFetchError(err))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&transport.requests))
+
+	timeoutTransport := &failingTransport{err: &net.DNSError{Err: "i/o timeout", Name: "mmds.invalid", IsTimeout: true}}
+	_, err = LoadBootstrapFromMMDSWithRetry(context.Background(), &http.Client{Transport: timeoutTransport}, "http://mmds.invalid/latest/meta-data", 3, time.Millisecond, clock.Real())
+	assert.NotNil(t, err)
+	assert.True(t, isTransientFetchError(err))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&timeoutTransport.requests))
+}
+
+func TestGuestFetchMMDSMetadataRejectsUnknownFields(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"VMMID": "vmm", "Unknown": "value"}`))
+	}))
+	defer server.Close()
+
+	_, err := GuestFetchMMDSMetadata(hclog.NewNullLogger(), server.URL+"/latest/meta-data")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), `unknown field "Unknown"`)
+}
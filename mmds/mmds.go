@@ -1,12 +1,16 @@
 package mmds
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"strings"
 	"time"
 
+	"github.com/combust-labs/firebuild-embedded-ca/ca"
 	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
 )
 
 var (
@@ -43,12 +47,108 @@ type MMDSData struct {
 }
 
 type MMDSBootstrap struct {
-	HostPort     string `json:"HostPort" mapstructure:"HostPort"`
-	CaChain      string `json:"CAChain" mapstructure:"CAChain"`
-	Certificate  string `json:"Cert" mapstructure:"Cert"`
-	Key          string `json:"Key" mapstructure:"Key"`
-	ServerName   string `json:"ServerName" mapstructure:"ServerName"`
-	PingInterval string `json:"PingInterval" mapstructure:"PingInterval"`
+	HostPort     string   `json:"HostPort" mapstructure:"HostPort"`
+	HostPorts    []string `json:"HostPorts,omitempty" mapstructure:"HostPorts,omitempty"`
+	CaChain      string   `json:"CAChain" mapstructure:"CAChain"`
+	Certificate  string   `json:"Cert" mapstructure:"Cert"`
+	Key          string   `json:"Key" mapstructure:"Key"`
+	ServerName   string   `json:"ServerName" mapstructure:"ServerName"`
+	PingInterval string   `json:"PingInterval" mapstructure:"PingInterval"`
+}
+
+// ParseBootstrap strictly deserializes the bootstrap document.
+// Unknown fields are rejected so that malformed documents are caught early.
+func ParseBootstrap(data []byte) (*MMDSBootstrap, error) {
+	output := &MMDSBootstrap{}
+	if err := decodeStrict(data, output); err != nil {
+		return nil, errors.Wrap(err, "invalid bootstrap document")
+	}
+	return output, nil
+}
+
+// ParseMetadata strictly deserializes the metadata document, the same way as ParseBootstrap.
+func ParseMetadata(data []byte) (*MMDSData, error) {
+	output := &MMDSData{}
+	if err := decodeStrict(data, output); err != nil {
+		return nil, errors.Wrap(err, "invalid metadata document")
+	}
+	return output, nil
+}
+
+func decodeStrict(data []byte, output interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(output); err != nil {
+		return err
+	}
+	if decoder.More() {
+		return errors.New("unexpected data after the document")
+	}
+	return nil
+}
+
+// LoadBootstrapFromFile reads and strictly deserializes the bootstrap document from a file.
+func LoadBootstrapFromFile(path string) (*MMDSBootstrap, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed reading bootstrap file")
+	}
+	return ParseBootstrap(data)
+}
+
+// NewBootstrapFromCA issues a new client certificate from the embedded CA
+// and returns the bootstrap data required to connect to the server at hostPort.
+func NewBootstrapFromCA(embeddedCA ca.EmbeddedCA, hostPort, serverName string) (*MMDSBootstrap, error) {
+	clientCertData, err := embeddedCA.NewClientCert()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed creating client certificate")
+	}
+	return &MMDSBootstrap{
+		HostPort:    hostPort,
+		CaChain:     strings.Join(embeddedCA.CAPEMChain(), "\n"),
+		Certificate: string(clientCertData.CertificatePEM()),
+		Key:         string(clientCertData.KeyPEM()),
+		ServerName:  serverName,
+	}, nil
+}
+
+// MarshalBootstrapForMMDS returns the metadata tree to PUT to the Firecracker MMDS,
+// with the bootstrap under latest/meta-data/Bootstrap. The bootstrap is serialized
+// with its JSON field names so the tree parses with ParseBootstrap on the guest.
+func MarshalBootstrapForMMDS(b *MMDSBootstrap) (map[string]interface{}, error) {
+	if b == nil {
+		return nil, errors.New("no bootstrap data")
+	}
+	data, err := json.Marshal(b)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed serializing bootstrap data")
+	}
+	bootstrap := map[string]interface{}{}
+	if err := json.Unmarshal(data, &bootstrap); err != nil {
+		return nil, errors.Wrap(err, "failed serializing bootstrap data")
+	}
+	return map[string]interface{}{
+		"latest": map[string]interface{}{
+			"meta-data": map[string]interface{}{
+				"Bootstrap": bootstrap,
+			},
+		},
+	}, nil
+}
+
+// Endpoints returns the server endpoints in the order they should be tried:
+// the HostPort followed by the HostPorts, without duplicates.
+func (b *MMDSBootstrap) Endpoints() []string {
+	endpoints := []string{}
+	seen := map[string]bool{}
+	for _, endpoint := range append([]string{b.HostPort}, b.HostPorts...) {
+		if endpoint == "" || seen[endpoint] {
+			continue
+		}
+		seen[endpoint] = true
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints
 }
 
 func (b *MMDSBootstrap) SafePingInterval() time.Duration {
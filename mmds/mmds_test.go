@@ -0,0 +1,134 @@
+package mmds
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBootstrap(t *testing.T) {
+	bootstrapData, err := ParseBootstrap([]byte(testBootstrapJSON))
+	if err != nil {
+		t.Fatal("expected bootstrap data, got error", err)
+	}
+	assert.Equal(t, "127.0.0.1:5000", bootstrapData.HostPort)
+	assert.Equal(t, "test-server-app", bootstrapData.ServerName)
+}
+
+func TestParseBootstrapRejectsUnknownFields(t *testing.T) {
+	_, err := ParseBootstrap([]byte(`{"HostPort": "127.0.0.1:5000", "Unknown": "value"}`))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), `unknown field "Unknown"`)
+}
+
+func TestParseBootstrapRejectsTrailingData(t *testing.T) {
+	_, err := ParseBootstrap([]byte(`{"HostPort": "127.0.0.1:5000"} {}`))
+	assert.NotNil(t, err)
+}
+
+func TestParseMetadataRejectsUnknownFields(t *testing.T) {
+	metadata, err := ParseMetadata([]byte(`{"VMMID": "vmm", "Bootstrap": {"HostPort": "127.0.0.1:5000"}}`))
+	if err != nil {
+		t.Fatal("expected metadata, got error", err)
+	}
+	assert.Equal(t, "vmm", metadata.VMMID)
+	assert.Equal(t, "127.0.0.1:5000", metadata.Bootstrap.HostPort)
+
+	_, err = ParseMetadata([]byte(`{"VMMID": "vmm", "Bootstrap": {"HostPort": "127.0.0.1:5000", "Unknown": "value"}}`))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), `unknown field "Unknown"`)
+}
+
+func TestBootstrapEndpoints(t *testing.T) {
+	bootstrapData, err := ParseBootstrap([]byte(`{"HostPort": "10.0.0.1:5000", "HostPorts": ["10.0.0.2:5000", "10.0.0.1:5000", "10.0.0.3:5000"]}`))
+	if err != nil {
+		t.Fatal("expected bootstrap data, got error", err)
+	}
+	assert.Equal(t, []string{"10.0.0.1:5000", "10.0.0.2:5000", "10.0.0.3:5000"}, bootstrapData.Endpoints())
+	assert.Equal(t, []string{"10.0.0.2:5000"}, (&MMDSBootstrap{HostPorts: []string{"10.0.0.2:5000"}}).Endpoints())
+}
+
+func TestMarshalBootstrapForMMDS(t *testing.T) {
+	bootstrapData, err := ParseBootstrap([]byte(testBootstrapJSON))
+	if err != nil {
+		t.Fatal("expected bootstrap data, got error", err)
+	}
+	tree, err := MarshalBootstrapForMMDS(bootstrapData)
+	if err != nil {
+		t.Fatal("expected metadata tree, got error", err)
+	}
+	metadata := tree["latest"].(map[string]interface{})["meta-data"].(map[string]interface{})
+	assert.Equal(t, "127.0.0.1:5000", metadata["Bootstrap"].(map[string]interface{})["HostPort"])
+
+	// the guest parses the bootstrap served from the tree:
+	data, err := json.Marshal(metadata["Bootstrap"])
+	if err != nil {
+		t.Fatal("expected serialized bootstrap, got error", err)
+	}
+	parsed, err := ParseBootstrap(data)
+	if err != nil {
+		t.Fatal("expected bootstrap data, got error", err)
+	}
+	assert.Equal(t, bootstrapData, parsed)
+
+	_, err = MarshalBootstrapForMMDS(nil)
+	assert.NotNil(t, err)
+}
+
+func TestValidateCAChainPath(t *testing.T) {
+	rootKey, root := mustCreateTestCA(t, "test-root", nil, nil)
+	_, intermediate := mustCreateTestCA(t, "test-intermediate", &root, rootKey)
+
+	assert.Nil(t, ValidateCAChainPath(intermediate+root))
+	assert.Nil(t, ValidateCAChainPath(root+intermediate))
+	assert.Nil(t, (&MMDSBootstrap{CaChain: root}).Validate())
+
+	// the root of the intermediate CA is missing:
+	err := ValidateCAChainPath(intermediate)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "issuer 'CN=test-root' of the certificate 'CN=test-intermediate' is missing")
+	}
+	assert.NotNil(t, (&MMDSBootstrap{CaChain: intermediate}).Validate())
+	assert.NotNil(t, ValidateCAChainPath(""))
+}
+
+// mustCreateTestCA returns the key and the PEM encoded certificate of a CA issued by the parent,
+// self-signed when the parent is nil.
+func mustCreateTestCA(t *testing.T, commonName string, parentPEM *string, parentKey *ecdsa.PrivateKey) (*ecdsa.PrivateKey, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("expected key, got error", err)
+	}
+	template := &x509.Certificate{
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		NotAfter:              time.Now().Add(time.Hour),
+		NotBefore:             time.Now().Add(-time.Hour),
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+	}
+	parent, signer := template, key
+	if parentPEM != nil {
+		block, _ := pem.Decode([]byte(*parentPEM))
+		parent, err = x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal("expected parent certificate, got error", err)
+		}
+		signer = parentKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal("expected certificate, got error", err)
+	}
+	return key, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
@@ -0,0 +1,112 @@
+package mmds
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrResourceNotFound is returned when MMDS does not contain the chunked resource.
+var ErrResourceNotFound = errors.New("resource not found in MMDS")
+
+const (
+	chunkedResourcePartsKey   = "Parts"
+	chunkedResourcePartPrefix = "part-"
+)
+
+// MMDSChunkedResource is a resource split across multiple MMDS keys
+// because of the MMDS per value size limit. The Parts key declares the number of parts,
+// every part is a base64 encoded chunk stored under a part-NNN key, for example:
+//
+//	{"Parts": "2", "part-000": "...", "part-001": "..."}
+type MMDSChunkedResource map[string]string
+
+// GuestFetchChunkedResource resolves a chunked resource stored under the resource/<name> key
+// of the metadata root as a guest. The resource is validated before it is returned.
+// A missing resource returns ErrResourceNotFound.
+func GuestFetchChunkedResource(ctx context.Context, client *http.Client, baseURI, name string) (MMDSChunkedResource, error) {
+	data, err := guestFetch(ctx, client, fmt.Sprintf("%s/resource/%s", strings.TrimRight(baseURI, "/"), name))
+	if err != nil {
+		var vStatusErr *statusError
+		if errors.As(err, &vStatusErr) && vStatusErr.statusCode == http.StatusNotFound {
+			return nil, ErrResourceNotFound
+		}
+		return nil, err
+	}
+	output := MMDSChunkedResource{}
+	if err := json.Unmarshal(data, &output); err != nil {
+		return nil, errors.Wrapf(err, "failed deserializing chunked resource '%s'", name)
+	}
+	if err := output.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid chunked resource '%s'", name)
+	}
+	return output, nil
+}
+
+// Validate verifies that all declared parts are present and that there are no undeclared parts.
+func (r MMDSChunkedResource) Validate() error {
+	declared, err := r.parts()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < declared; i++ {
+		if _, ok := r[chunkedResourcePartKey(i)]; !ok {
+			return fmt.Errorf("part '%s' missing, declared parts: %d", chunkedResourcePartKey(i), declared)
+		}
+	}
+	found := []string{}
+	for k := range r {
+		if strings.HasPrefix(k, chunkedResourcePartPrefix) {
+			found = append(found, k)
+		}
+	}
+	if len(found) != declared {
+		sort.Strings(found)
+		return fmt.Errorf("declared parts: %d, found parts: %s", declared, strings.Join(found, ", "))
+	}
+	return nil
+}
+
+// Contents reassembles the parts in order and returns a reader of the complete resource.
+// The signature allows using it as a resolved resource contents function.
+func (r MMDSChunkedResource) Contents() (io.ReadCloser, error) {
+	if err := r.Validate(); err != nil {
+		return nil, err
+	}
+	declared, _ := r.parts()
+	readers := []io.Reader{}
+	for i := 0; i < declared; i++ {
+		decoded, err := base64.StdEncoding.DecodeString(r[chunkedResourcePartKey(i)])
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed decoding part '%s'", chunkedResourcePartKey(i))
+		}
+		readers = append(readers, bytes.NewReader(decoded))
+	}
+	return ioutil.NopCloser(io.MultiReader(readers...)), nil
+}
+
+func (r MMDSChunkedResource) parts() (int, error) {
+	value, ok := r[chunkedResourcePartsKey]
+	if !ok {
+		return 0, fmt.Errorf("not a chunked resource: no %s key", chunkedResourcePartsKey)
+	}
+	declared, err := strconv.Atoi(value)
+	if err != nil || declared < 1 {
+		return 0, fmt.Errorf("invalid number of parts: '%s'", value)
+	}
+	return declared, nil
+}
+
+func chunkedResourcePartKey(index int) string {
+	return fmt.Sprintf("%s%03d", chunkedResourcePartPrefix, index)
+}
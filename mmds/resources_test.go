@@ -0,0 +1,70 @@
+package mmds
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChunkedResourceReassembly(t *testing.T) {
+	resource := MMDSChunkedResource{
+		"Parts":    "3",
+		"part-001": base64.StdEncoding.EncodeToString([]byte("second ")),
+		"part-000": base64.StdEncoding.EncodeToString([]byte("first ")),
+		"part-002": base64.StdEncoding.EncodeToString([]byte("third")),
+	}
+	reader, err := resource.Contents()
+	if err != nil {
+		t.Fatal("expected contents, got error", err)
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, "first second third", string(data))
+}
+
+func TestChunkedResourceMissingPart(t *testing.T) {
+	resource := MMDSChunkedResource{
+		"Parts":    "3",
+		"part-000": base64.StdEncoding.EncodeToString([]byte("first ")),
+		"part-002": base64.StdEncoding.EncodeToString([]byte("third")),
+	}
+	assert.NotNil(t, resource.Validate())
+	_, err := resource.Contents()
+	assert.NotNil(t, err)
+}
+
+func TestGuestFetchChunkedResource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/latest/meta-data/resource/config" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"Parts": "1", "part-000": "` + base64.StdEncoding.EncodeToString([]byte("contents")) + `"}`))
+	}))
+	defer server.Close()
+
+	resource, err := GuestFetchChunkedResource(context.Background(), server.Client(), server.URL+"/latest/meta-data", "config")
+	if err != nil {
+		t.Fatal("expected chunked resource, got error", err)
+	}
+	reader, err := resource.Contents()
+	assert.Nil(t, err)
+	data, _ := ioutil.ReadAll(reader)
+	assert.Equal(t, "contents", string(data))
+}
+
+func TestGuestFetchChunkedResourceNotFound(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not found", http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	_, err := GuestFetchChunkedResource(context.Background(), server.Client(), server.URL+"/latest/meta-data", "config")
+	assert.Equal(t, ErrResourceNotFound, err)
+}